@@ -18,6 +18,7 @@ func main() {
 		latency      = flag.Duration("latency", 0, "Base latency to add (e.g. 100ms, 2s)")
 		jitter       = flag.Duration("jitter", 0, "Latency jitter (e.g. 50ms)")
 		faultType    = flag.String("fault-type", "none", "Fault type: none, slow, reset, timeout, bad-gateway, internal-error")
+		scenario     = flag.String("scenario", "", "JSON file scripting the fault of each connection in order")
 		help         = flag.Bool("help", false, "Show help")
 	)
 	flag.Parse()
@@ -40,26 +41,17 @@ func main() {
 		fmt.Println("  faulty-proxy -port 8081 -failure-rate 0.3 -fault-type reset")
 		fmt.Println("  faulty-proxy -port 8082 -latency 2s -jitter 500ms -fault-type slow")
 		fmt.Println("  faulty-proxy -port 8083 -failure-rate 0.1 -fault-type timeout")
+		fmt.Println("  faulty-proxy -port 8084 -scenario scenario.json")
+		fmt.Println("")
+		fmt.Println("Scenario file (connections past the script use the flags above):")
+		fmt.Println(`  {"repeat": false, "connections": [{"fault": "reset"}, {"fault": "slow", "delay": "500ms"}, {"fault": "none"}]}`)
 		os.Exit(0)
 	}
 
 	// Parse fault type
-	var ft faultyproxy.FaultType
-	switch *faultType {
-	case "none":
-		ft = faultyproxy.NoFault
-	case "slow":
-		ft = faultyproxy.SlowResponse
-	case "reset":
-		ft = faultyproxy.ConnectionReset
-	case "timeout":
-		ft = faultyproxy.ConnectionTimeout
-	case "bad-gateway":
-		ft = faultyproxy.BadGateway
-	case "internal-error":
-		ft = faultyproxy.InternalError
-	default:
-		log.Fatalf("Unknown fault type: %s", *faultType)
+	ft, err := faultyproxy.ParseFaultType(*faultType)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 
 	// Create and configure faulty proxy
@@ -68,6 +60,13 @@ func main() {
 	faultyProxy.Latency = *latency
 	faultyProxy.LatencyJitter = *jitter
 	faultyProxy.FaultType = ft
+	if *scenario != "" {
+		faultyProxy.Scenario, err = faultyproxy.LoadScenario(*scenario)
+		if err != nil {
+			log.Fatalf("Failed to load scenario: %v", err)
+		}
+		log.Printf("Loaded scenario with %d scripted connections from %s", len(faultyProxy.Scenario.Steps), *scenario)
+	}
 
 	// Start proxy
 	if err := faultyProxy.Start(); err != nil {
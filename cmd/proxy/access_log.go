@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogEntry is one JSON line in the access log, written when a CONNECT
+// finishes (including rejected ones)
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ID         int64     `json:"id"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"`
+	Target     string    `json:"target"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"duration_ms"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	// EgressIP is the upstream's egress IP as last measured by a health
+	// check (access_log.egress_ip), the IP the request most likely used
+	EgressIP string `json:"egress_ip,omitempty"`
+
+	// upstreamURL is the selected upstream as configured, for lookups
+	upstreamURL string
+}
+
+// newAccessLogEntry starts an entry for a CONNECT request
+func newAccessLogEntry(r *http.Request, requestID int64, start time.Time) *accessLogEntry {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	return &accessLogEntry{
+		Time:   start,
+		ID:     requestID,
+		Client: client,
+		User:   proxyAuthUsername(r),
+		Target: r.Host,
+	}
+}
+
+// setUpstream records the selected upstream without its credentials
+func (e *accessLogEntry) setUpstream(ps *ProxyServer, upstream string) {
+	if host, _, err := parseUpstreamAuth(upstream); err == nil {
+		e.Upstream = host
+	}
+	e.upstreamURL = upstream
+	ps.mutex.RLock()
+	for _, weighted := range ps.weightedUpstreams {
+		if weighted.URL == upstream {
+			e.Tag = weighted.Tag
+			break
+		}
+	}
+	ps.mutex.RUnlock()
+}
+
+// openLogFiles opens the access and operational log files, if configured.
+// A file that cannot be opened is reported and left disabled.
+func (ps *ProxyServer) openLogFiles() {
+	if ps.config.AccessLog.File != "" {
+		writer, err := newRotatingWriter(ps.config.AccessLog)
+		if err != nil {
+			log.Printf("WARNING: access log disabled: %v", err)
+		} else {
+			ps.accessLog = writer
+			ps.accessLogQueue = newAccessLogQueue(ps.config.AccessLog)
+			go ps.runAccessLogWriter(ps.accessLogQueue)
+			log.Printf("  - Access log: %s", ps.config.AccessLog.File)
+		}
+	}
+	if ps.config.Log.File != "" {
+		writer, err := newRotatingWriter(ps.config.Log)
+		if err != nil {
+			log.Printf("WARNING: log file disabled: %v", err)
+		} else {
+			ps.operationalLog = writer
+			log.SetOutput(writer)
+		}
+	}
+}
+
+// closeLogFiles flushes and closes any open log files
+func (ps *ProxyServer) closeLogFiles() {
+	if ps.accessLog != nil {
+		ps.accessLogQueue.stop()
+		ps.accessLog.Close()
+	}
+	if ps.operationalLog != nil {
+		log.SetOutput(os.Stderr)
+		ps.operationalLog.Close()
+	}
+}
+
+// writeAccessLog queues an entry for the access log, if one is open. It
+// never blocks: when the queue is full an entry is dropped and counted.
+func (ps *ProxyServer) writeAccessLog(entry *accessLogEntry) {
+	if ps.accessLog == nil {
+		return
+	}
+	entry.DurationMs = time.Since(entry.Time).Milliseconds()
+	ps.mutex.RLock()
+	withEgressIP := ps.config.AccessLog.EgressIP
+	ps.mutex.RUnlock()
+	if withEgressIP && entry.upstreamURL != "" {
+		ps.healthMutex.RLock()
+		if health, exists := ps.upstreamHealth[entry.upstreamURL]; exists {
+			entry.EgressIP = health.LastCheckedIP
+		}
+		ps.healthMutex.RUnlock()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if !ps.accessLogQueue.push(append(line, '\n')) {
+		atomic.AddInt64(&ps.stats.DroppedAccessLogs, 1)
+	}
+}
+
+// Access log drop policies for access_log.drop_policy
+const (
+	dropNewest = "drop_newest"
+	dropOldest = "drop_oldest"
+)
+
+// defaultAccessLogBuffer is how many entries may wait for the writer
+const defaultAccessLogBuffer = 1024
+
+// accessLogQueue decouples requests from the access log file, so a slow or
+// stalled disk costs log entries instead of blocking tunnels
+type accessLogQueue struct {
+	lines      chan []byte
+	dropOldest bool
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+func newAccessLogQueue(config LogFileConfig) *accessLogQueue {
+	size := config.BufferSize
+	if size <= 0 {
+		size = defaultAccessLogBuffer
+	}
+	return &accessLogQueue{
+		lines:      make(chan []byte, size),
+		dropOldest: config.DropPolicy == dropOldest,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// push queues a line, reporting false if a line had to be dropped: the new
+// one under drop_newest, the oldest waiting one under drop_oldest
+func (q *accessLogQueue) push(line []byte) bool {
+	select {
+	case q.lines <- line:
+		return true
+	default:
+	}
+	if !q.dropOldest {
+		return false
+	}
+	select {
+	case <-q.lines:
+	default:
+	}
+	select {
+	case q.lines <- line:
+	default:
+		// Another request took the freed slot; this line is the casualty
+	}
+	return false
+}
+
+// stop asks the writer to flush what is queued and waits for it
+func (q *accessLogQueue) stop() {
+	select {
+	case <-q.done:
+	default:
+		close(q.done)
+	}
+	<-q.stopped
+}
+
+// runAccessLogWriter writes queued lines until the queue is stopped
+func (ps *ProxyServer) runAccessLogWriter(q *accessLogQueue) {
+	defer close(q.stopped)
+	write := func(line []byte) {
+		if _, err := ps.accessLog.Write(line); err != nil {
+			log.Printf("Failed to write access log: %v", err)
+		}
+	}
+	for {
+		select {
+		case line := <-q.lines:
+			write(line)
+		case <-q.done:
+			for {
+				select {
+				case line := <-q.lines:
+					write(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// validateAccessLogQueue checks access_log.buffer_size and drop_policy
+func validateAccessLogQueue(config LogFileConfig) error {
+	if config.BufferSize < 0 {
+		return fmt.Errorf("access_log.buffer_size must not be negative, got %d", config.BufferSize)
+	}
+	switch config.DropPolicy {
+	case "", dropNewest, dropOldest:
+		return nil
+	}
+	return fmt.Errorf("access_log.drop_policy must be %q or %q, got %q", dropNewest, dropOldest, config.DropPolicy)
+}
+
+// statusRecorder remembers the status code written to the client so it can
+// be logged; established tunnels keep the default 200
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -102,24 +104,10 @@ func TestHealthCheckerBasicFunctionality(t *testing.T) {
 		defer ipServer.Close()
 
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-				Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9090", Enabled: true, Weight: 1},
 			},
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled:          true,
 				IntervalSeconds:  1, // 1 second for fast testing
 				TimeoutSeconds:   5,
@@ -150,15 +138,7 @@ func TestHealthCheckerBasicFunctionality(t *testing.T) {
 
 	t.Run("StopHealthChecker", func(t *testing.T) {
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled:         true,
 				IntervalSeconds: 1,
 				Endpoints:       []string{"https://httpbin.org/ip"},
@@ -188,15 +168,7 @@ func TestEndpointRotation(t *testing.T) {
 		defer server3.Close()
 
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled:          true,
 				EndpointRotation: true,
 				Endpoints:        []string{server1.URL, server2.URL, server3.URL},
@@ -232,15 +204,7 @@ func TestEndpointRotation(t *testing.T) {
 		defer server2.Close()
 
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				EndpointRotation: false,
 				Endpoints:        []string{server1.URL, server2.URL},
 			},
@@ -269,15 +233,7 @@ func TestHealthCheckResults(t *testing.T) {
 		defer proxyServer.close()
 
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				TimeoutSeconds: 5,
 				Endpoints:      []string{ipServer.URL},
 			},
@@ -309,15 +265,7 @@ func TestHealthCheckResults(t *testing.T) {
 		defer proxyServer.close()
 
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				TimeoutSeconds: 5,
 				Endpoints:      []string{ipServer.URL},
 			},
@@ -350,15 +298,7 @@ func TestHealthCheckResults(t *testing.T) {
 		defer proxyServer.close()
 
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				TimeoutSeconds: 5,
 				Endpoints:      []string{invalidServer.URL},
 			},
@@ -387,15 +327,7 @@ func TestHealthCheckResults(t *testing.T) {
 		defer proxyServer.close()
 
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				TimeoutSeconds: 5,
 				Endpoints:      []string{noIPServer.URL},
 			},
@@ -422,24 +354,10 @@ func TestHealthCheckIntegration(t *testing.T) {
 		defer proxyServer.close()
 
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-				Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: proxyServer.server.URL, Enabled: true, Weight: 1},
 			},
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled:          true,
 				FailureThreshold: 2,
 				TimeoutSeconds:   5,
@@ -492,15 +410,7 @@ func TestHealthCheckIntegration(t *testing.T) {
 func TestHealthCheckConfiguration(t *testing.T) {
 	t.Run("DefaultValues", func(t *testing.T) {
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled: true,
 				// Leave other fields at zero to test defaults
 			},
@@ -529,15 +439,7 @@ func TestHealthCheckConfiguration(t *testing.T) {
 
 	t.Run("DisabledHealthCheck", func(t *testing.T) {
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled: false,
 			},
 		}
@@ -562,15 +464,7 @@ func TestHealthCheckTimeout(t *testing.T) {
 		defer proxyServer.close()
 
 		config := &Config{
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				TimeoutSeconds: 1, // 1 second timeout
 				Endpoints:      []string{slowServer.URL},
 			},
@@ -593,4 +487,376 @@ func TestHealthCheckTimeout(t *testing.T) {
 			t.Errorf("Health check took too long: %v", elapsed)
 		}
 	})
-}
\ No newline at end of file
+}
+// TestNewUpstreamWarmup tests that upstreams added by a reload only receive
+// traffic once an active health check has verified them
+func TestNewUpstreamWarmup(t *testing.T) {
+	ipServer := createMockIPResolverServer("10.0.0.1", 200, 0)
+	defer ipServer.Close()
+
+	existingProxy := createMockProxyServer(ipServer)
+	defer existingProxy.close()
+	addedProxy := createMockProxyServer(ipServer)
+	defer addedProxy.close()
+
+	writeConfig := func(upstreams []string) string {
+		var entries []string
+		for _, upstream := range upstreams {
+			entries = append(entries, fmt.Sprintf(`{"url": %q, "enabled": true, "weight": 1}`, upstream))
+		}
+		return fmt.Sprintf(`{
+			"server": {"name": "Warmup Test", "listen_address": "127.0.0.1:0", "stats_endpoint": "/stats"},
+			"upstream_proxies": [%s],
+			"health_check": {"enabled": true, "interval_seconds": 3600, "timeout_seconds": 5, "endpoints": [%q]}
+		}`, strings.Join(entries, ","), ipServer.URL)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "warmup.json")
+	touchConfig(t, configPath, writeConfig([]string{existingProxy.server.URL}), -time.Minute)
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	ps := NewProxyServer(config, configPath)
+	defer ps.stopHealthChecker()
+
+	// Upstreams present at startup are in rotation immediately
+	if upstream := ps.getNextUpstream(); upstream != existingProxy.server.URL {
+		t.Fatalf("Expected initial upstream to be selected, got %q", upstream)
+	}
+
+	touchConfig(t, configPath, writeConfig([]string{existingProxy.server.URL, addedProxy.server.URL}), time.Second)
+	if err := ps.reloadConfig(); err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if upstream := ps.getNextUpstream(); upstream == addedProxy.server.URL {
+			t.Fatal("Newly added upstream must not be selected before it is verified")
+		}
+	}
+
+	hc := ps.healthChecker
+	hc.processHealthCheckResult(hc.checkUpstreamHealth(addedProxy.server.URL, config))
+
+	selected := false
+	for i := 0; i < 10; i++ {
+		if ps.getNextUpstream() == addedProxy.server.URL {
+			selected = true
+			break
+		}
+	}
+	if !selected {
+		t.Error("Upstream should be selected after a successful health check")
+	}
+}
+
+// TestWarmupDuration tests that a configured warmup admits unverified upstreams
+func TestWarmupDuration(t *testing.T) {
+	now := time.Now()
+	health := &UpstreamHealth{IsHealthy: true, AddedAt: now.Add(-30 * time.Second)}
+
+	if isWarmedUp(health, now, 0) {
+		t.Error("Unverified upstream should wait for a probe when no warmup is configured")
+	}
+	if isWarmedUp(health, now, time.Minute) {
+		t.Error("Unverified upstream should not be admitted before the warmup elapses")
+	}
+	if !isWarmedUp(health, now, 20*time.Second) {
+		t.Error("Unverified upstream should be admitted once the warmup elapses")
+	}
+
+	health.Verified = true
+	if !isWarmedUp(health, now, time.Minute) {
+		t.Error("Verified upstream should always be admitted")
+	}
+}
+
+// TestPerUpstreamHealthEndpoints tests that health_endpoints overrides the global endpoint list
+func TestPerUpstreamHealthEndpoints(t *testing.T) {
+	globalServer := createMockIPResolverServer("10.0.0.1", 200, 0)
+	euServer := createMockIPResolverServer("10.0.0.2", 200, 0)
+	usServer := createMockIPResolverServer("10.0.0.3", 200, 0)
+	defer globalServer.Close()
+	defer euServer.Close()
+	defer usServer.Close()
+
+	// Forwarding proxy that fetches whatever URL the health checker requests
+	forwardingProxy := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resp, err := http.Get(r.URL.String())
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}))
+	}
+	euProxy := forwardingProxy()
+	usProxy := forwardingProxy()
+	plainProxy := forwardingProxy()
+	defer euProxy.Close()
+	defer usProxy.Close()
+	defer plainProxy.Close()
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: euProxy.URL, Enabled: true, Weight: 1, HealthEndpoints: []string{euServer.URL}},
+			{URL: usProxy.URL, Enabled: true, Weight: 1, HealthEndpoints: []string{usServer.URL}},
+			{URL: plainProxy.URL, Enabled: true, Weight: 1},
+		},
+		HealthCheck: HealthCheckConfig{
+			TimeoutSeconds: 5,
+			Endpoints:      []string{globalServer.URL},
+		},
+	}
+
+	ps := NewProxyServer(config, "")
+	hc := NewHealthChecker(ps)
+
+	expected := map[string]struct{ endpoint, ip string }{
+		euProxy.URL:    {euServer.URL, "10.0.0.2"},
+		usProxy.URL:    {usServer.URL, "10.0.0.3"},
+		plainProxy.URL: {globalServer.URL, "10.0.0.1"},
+	}
+	for upstream, want := range expected {
+		result := hc.checkUpstreamHealth(upstream, config)
+		if !result.Success {
+			t.Errorf("Health check via %s failed: %v", upstream, result.Error)
+			continue
+		}
+		if result.Endpoint != want.endpoint || result.IP != want.ip {
+			t.Errorf("Expected %s to be probed against %s (%s), got %s (%s)",
+				upstream, want.endpoint, want.ip, result.Endpoint, result.IP)
+		}
+	}
+}
+
+// TestCapacityHints tests that a capacity hint from the health check scales the upstream's weight
+func TestCapacityHints(t *testing.T) {
+	hintedResolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ip": "10.0.0.9", "capacity": 0.25}`)
+	}))
+	defer hintedResolver.Close()
+	plainResolver := createMockIPResolverServer("10.0.0.10", 200, 0)
+	defer plainResolver.Close()
+
+	hintedProxy := createMockProxyServer(hintedResolver)
+	defer hintedProxy.close()
+	plainProxy := createMockProxyServer(plainResolver)
+	defer plainProxy.close()
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: hintedProxy.server.URL, Enabled: true, Weight: 2},
+			{URL: plainProxy.server.URL, Enabled: true, Weight: 2},
+		},
+		HealthCheck: HealthCheckConfig{
+			TimeoutSeconds:   5,
+			Endpoints:        []string{"http://resolver.invalid/"},
+			UseCapacityHints: true,
+		},
+	}
+	ps := NewProxyServer(config, "")
+	hc := NewHealthChecker(ps)
+
+	effectiveWeights := func() map[string]int {
+		ps.mutex.RLock()
+		defer ps.mutex.RUnlock()
+		weights := make(map[string]int)
+		for _, upstream := range normalizeWeights(ps.applyCapacityHints(ps.weightedUpstreams)) {
+			weights[upstream.URL] = upstream.Weight
+		}
+		return weights
+	}
+
+	before := effectiveWeights()
+	if before[hintedProxy.server.URL] != before[plainProxy.server.URL] {
+		t.Fatalf("Expected equal weights before any hint, got %v", before)
+	}
+
+	for _, upstream := range []string{hintedProxy.server.URL, plainProxy.server.URL} {
+		result := hc.checkUpstreamHealth(upstream, config)
+		if !result.Success {
+			t.Fatalf("Health check via %s failed: %v", upstream, result.Error)
+		}
+		hc.processHealthCheckResult(result)
+	}
+
+	after := effectiveWeights()
+	if after[hintedProxy.server.URL]*4 != after[plainProxy.server.URL] {
+		t.Errorf("Expected hinted upstream at a quarter of the plain upstream's weight, got %v", after)
+	}
+
+	// Hints are ignored unless enabled
+	ps.mutex.Lock()
+	config.HealthCheck.UseCapacityHints = false
+	ps.mutex.Unlock()
+	if weights := effectiveWeights(); weights[hintedProxy.server.URL] != 2 {
+		t.Errorf("Expected configured weight with hints disabled, got %v", weights)
+	}
+}
+
+// TestZeroWeightUpstreamHealthChecked tests that zero-weight upstreams are probed but never selected
+func TestZeroWeightUpstreamHealthChecked(t *testing.T) {
+	ipServer := createMockIPResolverServer("10.0.0.20", 200, 0)
+	defer ipServer.Close()
+
+	activeProxy := createMockProxyServer(ipServer)
+	defer activeProxy.close()
+	stagedProxy := createMockProxyServer(ipServer)
+	defer stagedProxy.close()
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: activeProxy.server.URL, Enabled: true, Weight: 1},
+			{URL: stagedProxy.server.URL, Enabled: true, Weight: 0},
+		},
+		HealthCheck: HealthCheckConfig{
+			Enabled:        true,
+			TimeoutSeconds: 5,
+			Endpoints:      []string{ipServer.URL},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	defer ps.stopHealthChecker()
+	hc := NewHealthChecker(ps)
+
+	hc.performHealthChecks()
+
+	stagedHealth := ps.getHealthMetrics()["upstreams"].(map[string]interface{})[stagedProxy.server.URL].(map[string]interface{})
+	if stagedHealth["success_count"].(int64) == 0 {
+		t.Error("Expected zero-weight upstream to be health checked")
+	}
+	if ip := ps.upstreamHealth[stagedProxy.server.URL].LastCheckedIP; ip != "10.0.0.20" {
+		t.Errorf("Expected health data for zero-weight upstream, got last checked IP %q", ip)
+	}
+
+	for i := 0; i < 20; i++ {
+		if upstream := ps.getNextUpstream(); upstream == stagedProxy.server.URL {
+			t.Fatal("Zero-weight upstream must never be selected")
+		}
+	}
+
+	// Not even as the least-failed fallback when every weighted upstream is down
+	for i := 0; i < 5; i++ {
+		ps.recordUpstreamFailure(activeProxy.server.URL)
+	}
+	if upstream := ps.getNextUpstream(); upstream == stagedProxy.server.URL {
+		t.Error("Zero-weight upstream must not be used as a fallback")
+	}
+}
+
+// TestHealthCheckEndpointTallies tests that rotating health checks are
+// tallied per endpoint, so a failing resolver stands out
+func TestHealthCheckEndpointTallies(t *testing.T) {
+	goodResolver := createMockIPResolverServer("10.0.0.11", 200, 0)
+	defer goodResolver.Close()
+	badResolver := createMockIPResolverServer("", 503, 0)
+	defer badResolver.Close()
+
+	forwardingProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get(r.URL.String())
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer forwardingProxy.Close()
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: forwardingProxy.URL, Enabled: true, Weight: 1},
+		},
+		HealthCheck: HealthCheckConfig{
+			TimeoutSeconds:   5,
+			Endpoints:        []string{goodResolver.URL, badResolver.URL},
+			EndpointRotation: true,
+		},
+	}
+	ps := NewProxyServer(config, "")
+	hc := NewHealthChecker(ps)
+
+	var last string
+	for i := 0; i < 4; i++ {
+		result := hc.checkUpstreamHealth(forwardingProxy.URL, config)
+		hc.processHealthCheckResult(result)
+		last = result.Endpoint
+	}
+
+	metrics := ps.getHealthMetrics()
+	tallies, ok := metrics["endpoints"].(map[string]endpointTally)
+	if !ok {
+		t.Fatalf("Expected per-endpoint tallies in health metrics, got %v", metrics["endpoints"])
+	}
+	if tally := tallies[goodResolver.URL]; tally.SuccessCount != 2 || tally.FailureCount != 0 {
+		t.Errorf("Expected 2 successes via the good resolver, got %+v", tally)
+	}
+	if tally := tallies[badResolver.URL]; tally.SuccessCount != 0 || tally.FailureCount != 2 {
+		t.Errorf("Expected 2 failures via the failing resolver, got %+v", tally)
+	}
+
+	entry := metrics["upstreams"].(map[string]interface{})[forwardingProxy.URL].(map[string]interface{})
+	if entry["last_check_endpoint"] != last {
+		t.Errorf("Expected last_check_endpoint %s, got %v", last, entry["last_check_endpoint"])
+	}
+}
+
+// TestHealthCheckRedirects tests that a resolver redirect is followed by
+// default and fails the check with fail_on_redirect
+func TestHealthCheckRedirects(t *testing.T) {
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/canonical" {
+			http.Redirect(w, r, "/canonical", http.StatusFound)
+			return
+		}
+		json.NewEncoder(w).Encode(IPResponse{IP: "10.0.0.12"})
+	}))
+	defer resolver.Close()
+
+	// Relays responses as they are, leaving redirects to the client
+	forwardingProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			w.Header().Set("Location", location)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer forwardingProxy.Close()
+
+	for _, failOnRedirect := range []bool{false, true} {
+		config := &Config{
+			UpstreamProxies: []UpstreamProxyConfig{
+				{URL: forwardingProxy.URL, Enabled: true, Weight: 1},
+			},
+			HealthCheck: HealthCheckConfig{
+				TimeoutSeconds: 5,
+				Endpoints:      []string{resolver.URL + "/ip"},
+				FailOnRedirect: failOnRedirect,
+			},
+		}
+		hc := NewHealthChecker(NewProxyServer(config, ""))
+		result := hc.checkUpstreamHealth(forwardingProxy.URL, config)
+
+		if !failOnRedirect && (!result.Success || result.IP != "10.0.0.12") {
+			t.Errorf("Expected the redirect to be followed, got success=%v ip=%q (%v)", result.Success, result.IP, result.Error)
+		}
+		if failOnRedirect && (result.Success || result.Error == nil || !strings.Contains(result.Error.Error(), "fail_on_redirect")) {
+			t.Errorf("Expected the redirect to fail the check, got success=%v (%v)", result.Success, result.Error)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// adminStatsResetPath zeroes the request statistics (POST only)
+const adminStatsResetPath = "/admin/stats/reset"
+
+// handleStatsReset serves POST /admin/stats/reset. Authentication matches the
+// stats endpoint and is checked by ServeHTTP.
+func (ps *ProxyServer) handleStatsReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resetAt := ps.resetStats()
+	log.Printf("Statistics reset via %s from %s", adminStatsResetPath, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "reset",
+		"reset_at": resetAt,
+	})
+}
+
+// resetStats zeroes request counters, per-upstream metrics, latency
+// histograms and the recent request history. Health state and in-flight
+// gauges (current requests and connections) are left alone, as are config
+// reload stats.
+func (ps *ProxyServer) resetStats() time.Time {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	atomic.StoreInt64(&ps.stats.TotalRequests, 0)
+	atomic.StoreInt64(&ps.stats.SuccessRequests, 0)
+	atomic.StoreInt64(&ps.stats.FailedRequests, 0)
+	atomic.StoreInt64(&ps.stats.MaxConcurrency, atomic.LoadInt64(&ps.stats.CurrentRequests))
+	atomic.StoreInt64(&ps.stats.DegradedSelections, 0)
+	atomic.StoreInt64(&ps.stats.ShedRequests, 0)
+	atomic.StoreInt64(&ps.stats.RejectedConnections, 0)
+	atomic.StoreInt64(&ps.stats.SetupTimeouts, 0)
+	atomic.StoreInt64(&ps.stats.DirectTunnels, 0)
+	atomic.StoreInt64(&ps.stats.ExpiredTunnels, 0)
+	atomic.StoreInt64(&ps.stats.DroppedAccessLogs, 0)
+	atomic.StoreInt64(&ps.stats.WarmConnectionHits, 0)
+	atomic.StoreInt64(&ps.stats.ClientAborts, 0)
+	atomic.StoreInt64(&ps.stats.ConnectRetries, 0)
+	atomic.StoreInt64(&ps.stats.HijackFailures, 0)
+
+	for _, metric := range ps.stats.UpstreamMetrics {
+		atomic.StoreInt64(&metric.TotalRequests, 0)
+		atomic.StoreInt64(&metric.SuccessRequests, 0)
+		atomic.StoreInt64(&metric.FailedRequests, 0)
+		atomic.StoreInt64(&metric.TotalLatency, 0)
+		atomic.StoreInt64(&metric.DialFailures, 0)
+		atomic.StoreInt64(&metric.HandshakeFailures, 0)
+		atomic.StoreInt64(&metric.ConnectWriteFailures, 0)
+		atomic.StoreInt64(&metric.ConnectReadFailures, 0)
+		atomic.StoreInt64(&metric.Rejections, 0)
+		atomic.StoreInt64(&metric.EmptyTunnels, 0)
+		metric.AvgLatency = 0
+		metric.LastRequest = time.Time{}
+		metric.recentLatency, metric.recentLatencySet = 0, false
+	}
+	ps.stats.RecentRequests = make([]RecentRequest, 0)
+	ps.latency.reset()
+
+	return time.Now()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStatsReset tests that POST /admin/stats/reset zeroes counters but keeps health state
+func TestStatsReset(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+	upstreamURL := "http://" + upstreamAddr
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: upstreamURL, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	for i := 0; i < 3; i++ {
+		conn, _ := dialConnect(t, proxyAddr, "example.com:443")
+		conn.Close()
+	}
+	ps.recordUpstreamFailure(upstreamURL)
+
+	// Requests are recorded just after the 200 reaches the client
+	recorded := func() int {
+		ps.mutex.RLock()
+		defer ps.mutex.RUnlock()
+		return len(ps.stats.RecentRequests)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for recorded() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var before struct {
+		Total TimeWindowStats `json:"total"`
+	}
+	getStats(t, proxyAddr, &before)
+	if before.Total.TotalRequests != 3 {
+		t.Fatalf("Expected 3 requests before reset, got %d", before.Total.TotalRequests)
+	}
+
+	// Only POST resets
+	resp, err := http.Get("http://" + proxyAddr + adminStatsResetPath)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post("http://"+proxyAddr+adminStatsResetPath, "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from reset, got %d", resp.StatusCode)
+	}
+
+	var after struct {
+		Total  TimeWindowStats `json:"total"`
+		Recent TimeWindowStats `json:"recent_15m"`
+	}
+	getStats(t, proxyAddr, &after)
+	if after.Total.TotalRequests != 0 || after.Total.SuccessRequests != 0 || after.Recent.TotalRequests != 0 {
+		t.Errorf("Expected zeroed totals after reset, got total %+v / recent %+v", after.Total, after.Recent)
+	}
+	for _, metric := range after.Total.UpstreamMetrics {
+		if metric.TotalRequests != 0 || metric.SuccessRequests != 0 || metric.AvgLatency != 0 {
+			t.Errorf("Expected zeroed upstream metrics, got %+v", metric)
+		}
+	}
+	if failures := ps.getUpstreamFailureCount(upstreamURL); failures != 1 {
+		t.Errorf("Expected health state to survive the reset, got %d failures", failures)
+	}
+}
+
+// TestStatsResetCounters tests that a reset zeroes the proxy-wide event
+// counters
+func TestStatsResetCounters(t *testing.T) {
+	ps := NewProxyServer(&Config{}, "")
+	counters := map[string]*int64{
+		"expired_tunnels_total":      &ps.stats.ExpiredTunnels,
+		"dropped_access_logs_total":  &ps.stats.DroppedAccessLogs,
+		"warm_connection_hits_total": &ps.stats.WarmConnectionHits,
+		"client_aborts_total":        &ps.stats.ClientAborts,
+		"connect_retries_total":      &ps.stats.ConnectRetries,
+		"hijack_failures_total":      &ps.stats.HijackFailures,
+	}
+	for _, counter := range counters {
+		atomic.StoreInt64(counter, 5)
+	}
+
+	ps.resetStats()
+	for name, counter := range counters {
+		if value := atomic.LoadInt64(counter); value != 0 {
+			t.Errorf("Expected %s to be reset, got %d", name, value)
+		}
+	}
+}
+
+// TestStatsResetRequiresAuth tests that the reset endpoint uses the stats credentials
+func TestStatsResetRequiresAuth(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		Authentication: AuthenticationConfig{
+			Enabled: true,
+			Users:   []UserConfig{{Username: "admin", Password: "secret"}},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	recorder := httptest.NewRecorder()
+	ps.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, adminStatsResetPath, nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", recorder.Code)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, adminStatsResetPath, nil)
+	request.SetBasicAuth("admin", "secret")
+	recorder = httptest.NewRecorder()
+	ps.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected 200 with credentials, got %d", recorder.Code)
+	}
+}
+
+// TestStatsUserRoles tests that proxy-only users cannot read stats and
+// stats-only users cannot open tunnels
+func TestStatsUserRoles(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		Authentication: AuthenticationConfig{
+			Enabled: true,
+			Users: []UserConfig{
+				{Username: "client", Password: "client-pass", Roles: []string{roleProxy}},
+				{Username: "ops", Password: "ops-pass", Roles: []string{roleStats}},
+				{Username: "admin", Password: "admin-pass"},
+			},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	tests := []struct {
+		username, password string
+		wantStats          bool
+		wantProxy          bool
+	}{
+		{"client", "client-pass", false, true},
+		{"ops", "ops-pass", true, false},
+		{"admin", "admin-pass", true, true},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		request.SetBasicAuth(tt.username, tt.password)
+		recorder := httptest.NewRecorder()
+		ps.ServeHTTP(recorder, request)
+		if got := recorder.Code == http.StatusOK; got != tt.wantStats {
+			t.Errorf("%s: expected stats access %v, got status %d", tt.username, tt.wantStats, recorder.Code)
+		}
+
+		connect := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		connect.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.username+":"+tt.password)))
+		if got := ps.authenticate(connect); got != tt.wantProxy {
+			t.Errorf("%s: expected proxy access %v, got %v", tt.username, tt.wantProxy, got)
+		}
+	}
+
+	if err := validateUserRoles([]UserConfig{{Username: "x", Roles: []string{"admin"}}}); err == nil {
+		t.Error("Expected an unknown role to be rejected")
+	}
+}
+
+func getStats(t *testing.T, proxyAddr string, v interface{}) {
+	t.Helper()
+	resp, err := http.Get("http://" + proxyAddr + "/stats")
+	if err != nil {
+		t.Fatalf("Failed to fetch stats: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+}
+
+// TestAdminUpstreamDetail tests the combined, redacted view of one upstream
+func TestAdminUpstreamDetail(t *testing.T) {
+	rejectingAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		if _, err := readConnectRequest(bufio.NewReader(conn)); err == nil {
+			conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		}
+	})
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		Authentication: AuthenticationConfig{
+			Enabled: true,
+			Users:   []UserConfig{{Username: "admin", Password: "secret"}},
+		},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{
+				URL: "http://user:hunter2@" + rejectingAddr, Enabled: true, Weight: 1, Tag: "eu",
+				ConnectHeaders: map[string]string{"X-Api-Key": "key-123"},
+			},
+			// Staged at weight 0, so every CONNECT goes to the first upstream
+			{URL: "http://127.0.0.1:9811", Enabled: true, Weight: 0},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %s\r\n\r\n",
+			base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil || resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("Expected 502 from the rejecting upstream, got %v %v", resp, err)
+		}
+	}
+
+	get := func(path string, auth bool) *http.Response {
+		t.Helper()
+		request, _ := http.NewRequest(http.MethodGet, "http://"+proxyAddr+path, nil)
+		if auth {
+			request.SetBasicAuth("admin", "secret")
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		return resp
+	}
+
+	resp := get(adminUpstreamsPath+"/0", false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", resp.StatusCode)
+	}
+	resp = get(adminUpstreamsPath+"/2", true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown index, got %d", resp.StatusCode)
+	}
+
+	resp = get(adminUpstreamsPath, true)
+	var list []upstreamSummary
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 2 || list[1].Weight != 0 {
+		t.Errorf("Expected 2 upstreams with the second staged, got %+v", list)
+	}
+
+	resp = get(adminUpstreamsPath+"/0", true)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "hunter2") || strings.Contains(string(body), "key-123") {
+		t.Errorf("Detail leaks credentials:\n%s", body)
+	}
+	var detail upstreamDetail
+	if err := json.Unmarshal(body, &detail); err != nil {
+		t.Fatalf("Failed to decode detail: %v", err)
+	}
+
+	if detail.URL != "http://user:xxxxx@"+rejectingAddr || detail.Tag != "eu" || detail.Weight != 1 || detail.CircuitState != circuitClosed {
+		t.Errorf("Unexpected summary fields: %+v", detail.upstreamSummary)
+	}
+	if detail.Config.ConnectHeaders["X-Api-Key"] != "xxxxx" {
+		t.Errorf("Expected the connect header value redacted, got %v", detail.Config.ConnectHeaders)
+	}
+	// Rejections point at config, not health, so the upstream stays healthy
+	if detail.Health == nil || !detail.Health.IsHealthy || detail.Health.Tag != "eu" {
+		t.Errorf("Expected a healthy record tagged eu, got %+v", detail.Health)
+	}
+	if len(detail.RecentErrors) != 2 || detail.RecentErrors[1].Error != "rejected: HTTP/1.1 403 Forbidden" {
+		t.Errorf("Expected 2 recent rejections, got %+v", detail.RecentErrors)
+	}
+	if detail.Stats.Total.Rejections != 2 || detail.Stats.Total.URL != detail.URL {
+		t.Errorf("Expected windowed stats with 2 rejections, got %+v", detail.Stats.Total)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// targetPort extracts the destination port of a CONNECT target
+// ("host:port" or "[v6]:port")
+func targetPort(target string) (int, bool) {
+	_, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, false
+	}
+	return port, true
+}
+
+// portAllowed reports whether server.allowed_ports permits tunneling to
+// target. With a list set, a target without a valid port is refused.
+func (ps *ProxyServer) portAllowed(target string) bool {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	allowed := ps.config.Server.AllowedPorts
+	if len(allowed) == 0 {
+		return true
+	}
+	port, ok := targetPort(target)
+	if !ok {
+		return false
+	}
+	for _, p := range allowed {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAllowedPorts checks that server.allowed_ports holds valid ports
+func validateAllowedPorts(ports []int) error {
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("server.allowed_ports: invalid port %d", port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestAllowedPorts tests that CONNECTs to ports outside allowed_ports get a
+// 403 and never reach an upstream
+func TestAllowedPorts(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+	config := &Config{
+		Server: ServerConfig{AllowedPorts: []int{443}},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	tests := []struct {
+		target string
+		status string
+	}{
+		{"example.com:443", "200"},
+		{"mail.example.com:25", "403"},
+		{"[2001:db8::1]:443", "200"},
+		{"[2001:db8::1]:8443", "403"},
+	}
+	for _, tt := range tests {
+		conn, head := dialConnect(t, proxyAddr, tt.target)
+		conn.Close()
+		if !strings.Contains(head, " "+tt.status+" ") {
+			t.Errorf("CONNECT %s: expected %s, got %q", tt.target, tt.status, head)
+		}
+	}
+
+	if err := validateConfig(&Config{Server: ServerConfig{AllowedPorts: []int{443, 70000}}}); err == nil {
+		t.Error("Expected an out-of-range port to be rejected")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+)
+
+// connectionLimits maps each upstream with max_connections set to its limit.
+// Like upstreamConfig, the first enabled entry for a URL wins. Caller must
+// hold ps.mutex (read).
+func (ps *ProxyServer) connectionLimits() map[string]int64 {
+	limits := make(map[string]int64)
+	for _, proxy := range ps.config.UpstreamProxies {
+		if !proxy.Enabled {
+			continue
+		}
+		if _, seen := limits[proxy.URL]; !seen {
+			limits[proxy.URL] = int64(proxy.MaxConnections)
+		}
+	}
+	for upstream, limit := range limits {
+		if limit <= 0 {
+			delete(limits, upstream)
+		}
+	}
+	return limits
+}
+
+// excludeSaturated drops upstreams whose open connections have reached
+// max_connections. The check happens at selection time, so concurrent
+// CONNECTs can briefly overshoot the limit. Caller must hold ps.mutex (read).
+func (ps *ProxyServer) excludeSaturated(upstreams []WeightedUpstream) []WeightedUpstream {
+	limits := ps.connectionLimits()
+	if len(limits) == 0 {
+		return upstreams
+	}
+
+	available := make([]WeightedUpstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if limit, limited := limits[upstream.URL]; limited {
+			if metric, exists := ps.stats.UpstreamMetrics[upstream.URL]; exists && atomic.LoadInt64(&metric.CurrentConnections) >= limit {
+				continue
+			}
+		}
+		available = append(available, upstream)
+	}
+	return available
+}
+
+// utilization returns current/limit rounded to three decimals, or 0 when
+// there is no limit
+func utilization(current, limit int64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	return math.Round(float64(current)/float64(limit)*1000) / 1000
+}
+
+// trackConnection counts an open connection against the upstream and
+// returns its release. Deferring the call right away covers every exit path
+// of a CONNECT, so each increment has exactly one decrement.
+func trackConnection(us *UpstreamStats) func() {
+	atomic.AddInt64(&us.CurrentConnections, 1)
+	return func() {
+		releaseGauge(&us.CurrentConnections, "current connections of "+redactUpstreamURL(us.URL))
+	}
+}
+
+// releaseGauge decrements an in-flight gauge. Going below zero means a
+// release without a matching increment; the gauge is clamped back to zero
+// and the drift logged, rather than left to skew capacity checks and stats.
+func releaseGauge(gauge *int64, name string) {
+	if atomic.AddInt64(gauge, -1) >= 0 {
+		return
+	}
+	for {
+		current := atomic.LoadInt64(gauge)
+		if current >= 0 || atomic.CompareAndSwapInt64(gauge, current, 0) {
+			break
+		}
+	}
+	log.Printf("Warning: %s gauge went negative, reset to 0", name)
+}
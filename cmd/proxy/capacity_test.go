@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestUpstreamCapacityStats tests that max_connections caps selection and
+// that utilization is reported per upstream, per tag and for the pool
+func TestUpstreamCapacityStats(t *testing.T) {
+	small := "http://" + startMockUpstream(t, echoUpstream)
+	large := "http://" + startMockUpstream(t, echoUpstream)
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: small, Enabled: true, Weight: 1, Tag: "eu", MaxConnections: 2},
+			{URL: large, Enabled: true, Weight: 1, Tag: "eu", MaxConnections: 4},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	open := func(count int) {
+		t.Helper()
+		for i := 0; i < count; i++ {
+			conn, head := dialConnect(t, proxyAddr, "example.com:443")
+			conns = append(conns, conn)
+			if !strings.Contains(head, "200") {
+				t.Fatalf("Expected tunnel %d to be established, got %q", len(conns), head)
+			}
+		}
+	}
+
+	type stats struct {
+		Total TimeWindowStats `json:"total"`
+	}
+	check := func(wantSmall, wantLarge int64, wantSaturation float64) {
+		t.Helper()
+		var s stats
+		getStats(t, proxyAddr, &s)
+		for _, metric := range s.Total.UpstreamMetrics {
+			want, limit := wantSmall, int64(2)
+			if metric.URL == large {
+				want, limit = wantLarge, 4
+			}
+			if metric.CurrentConnections != want || metric.MaxConnections != limit ||
+				metric.Utilization != utilization(want, limit) {
+				t.Errorf("Expected %s at %d/%d, got %+v", metric.URL, want, limit, metric)
+			}
+		}
+		eu := s.Total.TagGroups["eu"]
+		if eu.CurrentConnections != wantSmall+wantLarge || eu.MaxConnections != 6 ||
+			eu.Utilization != utilization(wantSmall+wantLarge, 6) {
+			t.Errorf("Expected tag eu at %d/6, got %+v", wantSmall+wantLarge, eu)
+		}
+		if s.Total.SaturationPct != wantSaturation {
+			t.Errorf("Expected saturation %v%%, got %v%%", wantSaturation, s.Total.SaturationPct)
+		}
+	}
+
+	check(0, 0, 0)
+
+	// Round robin splits the first tunnels evenly
+	open(4)
+	check(2, 2, 66.7)
+
+	// The small upstream is full, so the rest go to the large one
+	open(2)
+	check(2, 4, 100)
+
+	// With every upstream full, further CONNECTs are refused
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	if !strings.Contains(head, "502") {
+		t.Errorf("Expected 502 with the pool saturated, got %q", head)
+	}
+}
+
+// TestConnectionGaugesAfterEarlyReturns tests that the in-flight gauges go
+// back to zero whichever way a CONNECT ends
+func TestConnectionGaugesAfterEarlyReturns(t *testing.T) {
+	closingUpstream := func(conn net.Conn) {
+		readConnectRequest(bufio.NewReader(conn))
+		conn.Close()
+	}
+	cases := []struct {
+		name     string
+		upstream string
+		server   ServerConfig
+	}{
+		{"dial failure", "http://127.0.0.1:1", ServerConfig{}},
+		{"rejected", "http://" + startMockUpstream(t, rejectingUpstream("403 Forbidden")), ServerConfig{}},
+		{"closed before reply", "http://" + startMockUpstream(t, closingUpstream), ServerConfig{}},
+		{"port not allowed", "http://" + startMockUpstream(t, echoUpstream), ServerConfig{AllowedPorts: []int{80}}},
+		{"tunnel closed by client", "http://" + startMockUpstream(t, echoUpstream), ServerConfig{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ps := NewProxyServer(&Config{
+				Server:          tc.server,
+				UpstreamProxies: []UpstreamProxyConfig{{URL: tc.upstream, Enabled: true, Weight: 1}},
+			}, "")
+			proxyAddr := startTestProxy(t, ps)
+
+			conn, _ := dialConnect(t, proxyAddr, "example.com:443")
+			conn.Close()
+
+			metric := ps.upstreamMetrics(tc.upstream)
+			deadline := time.Now().Add(2 * time.Second)
+			for atomic.LoadInt64(&ps.stats.CurrentRequests) != 0 || atomic.LoadInt64(&metric.CurrentConnections) != 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected gauges back at zero, got %d requests and %d connections",
+						atomic.LoadInt64(&ps.stats.CurrentRequests), atomic.LoadInt64(&metric.CurrentConnections))
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+
+	// A release without a matching increment is clamped rather than negative
+	var gauge int64
+	releaseGauge(&gauge, "test")
+	if gauge != 0 {
+		t.Errorf("Expected the gauge to be clamped at zero, got %d", gauge)
+	}
+}
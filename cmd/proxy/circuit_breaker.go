@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Circuit breaker states reported by getCircuitBreakerState
+const (
+	circuitClosed   = "CLOSED"
+	circuitOpen     = "OPEN"
+	circuitHalfOpen = "HALF_OPEN"
+)
+
+// CircuitBreakerConfig enables HALF_OPEN trials for unhealthy upstreams.
+// An upstream whose last failure is older than OpenTimeoutSeconds becomes
+// HALF_OPEN and may receive up to HalfOpenMaxProbes concurrent trial
+// requests; a successful trial closes the circuit, a failed one reopens it.
+type CircuitBreakerConfig struct {
+	OpenTimeoutSeconds int `json:"open_timeout_seconds"`
+	HalfOpenMaxProbes  int `json:"half_open_max_probes"`
+}
+
+func (cbc CircuitBreakerConfig) enabled() bool {
+	return cbc.OpenTimeoutSeconds > 0
+}
+
+func (cbc CircuitBreakerConfig) maxProbes() int {
+	if cbc.HalfOpenMaxProbes > 0 {
+		return cbc.HalfOpenMaxProbes
+	}
+	return 1
+}
+
+// circuitState derives the circuit state of an upstream from its health record
+func circuitState(health *UpstreamHealth, now time.Time, openTimeout time.Duration) string {
+	if health.IsHealthy {
+		return circuitClosed
+	}
+	if openTimeout > 0 && now.Sub(health.LastFailure) >= openTimeout {
+		return circuitHalfOpen
+	}
+	return circuitOpen
+}
+
+// acceptsProbe reports whether a HALF_OPEN upstream has a free trial slot.
+// Caller must hold healthMutex.
+func (cbc CircuitBreakerConfig) acceptsProbe(health *UpstreamHealth, now time.Time) bool {
+	if !cbc.enabled() || health.heldDown(now) {
+		return false
+	}
+	openTimeout := time.Duration(cbc.OpenTimeoutSeconds) * time.Second
+	return circuitState(health, now, openTimeout) == circuitHalfOpen && health.ProbesInFlight < cbc.maxProbes()
+}
+
+// acquireProbe reserves a trial slot when upstream is HALF_OPEN. It returns
+// whether the selection is a probe and whether it may proceed at all.
+// Caller must hold ps.mutex (read).
+func (ps *ProxyServer) acquireProbe(upstream string) (probe, ok bool) {
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	health, exists := ps.upstreamHealth[upstream]
+	if !exists || health.IsHealthy {
+		return false, true
+	}
+	if !ps.config.CircuitBreaker.acceptsProbe(health, time.Now()) {
+		return false, false
+	}
+	health.ProbesInFlight++
+	return true, true
+}
+
+// finishProbe releases a trial slot and closes or reopens the circuit
+func (ps *ProxyServer) finishProbe(upstream string, success bool) {
+	ps.releaseProbe(upstream)
+
+	if success {
+		ps.recordUpstreamSuccess(upstream)
+		return
+	}
+
+	log.Printf("Trial request through HALF_OPEN upstream %s failed, reopening circuit", upstream)
+	ps.recordUpstreamFailure(upstream)
+}
+
+// releaseProbe ends a trial request without a verdict, freeing its slot for
+// the next one
+func (ps *ProxyServer) releaseProbe(upstream string) {
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	if health, exists := ps.upstreamHealth[upstream]; exists && health.ProbesInFlight > 0 {
+		health.ProbesInFlight--
+	}
+}
+
+// withoutUpstream returns upstreams minus the entry for url
+func withoutUpstream(upstreams []WeightedUpstream, url string) []WeightedUpstream {
+	filtered := make([]WeightedUpstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if upstream.URL != url {
+			filtered = append(filtered, upstream)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// forceHalfOpen marks upstream unhealthy with a last failure old enough for
+// its circuit to be HALF_OPEN
+func forceHalfOpen(ps *ProxyServer, upstream string) {
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure(upstream)
+	}
+	ps.healthMutex.Lock()
+	ps.upstreamHealth[upstream].LastFailure = time.Now().Add(-time.Minute)
+	ps.healthMutex.Unlock()
+}
+
+// TestCircuitBreakerHalfOpen tests the OPEN -> HALF_OPEN -> CLOSED/OPEN transitions
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	upstream := "http://127.0.0.1:9701"
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: upstream, Enabled: true, Weight: 1},
+		},
+		CircuitBreaker: CircuitBreakerConfig{OpenTimeoutSeconds: 30},
+	}
+	ps := NewProxyServer(config, "")
+
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure(upstream)
+	}
+	if state := ps.getCircuitBreakerState(upstream); state != circuitOpen {
+		t.Fatalf("Expected OPEN after failures, got %s", state)
+	}
+	if selected := ps.getNextUpstream(); selected != "" {
+		t.Errorf("OPEN circuit should fail fast, got %q", selected)
+	}
+
+	forceHalfOpen(ps, upstream)
+	if state := ps.getCircuitBreakerState(upstream); state != circuitHalfOpen {
+		t.Fatalf("Expected HALF_OPEN after the open timeout, got %s", state)
+	}
+
+	// A failed trial reopens the circuit
+	upstreamSelected, probe := ps.selectUpstream("")
+	if upstreamSelected != upstream || !probe {
+		t.Fatalf("Expected a trial through the HALF_OPEN upstream, got %q (probe: %v)", upstreamSelected, probe)
+	}
+	ps.finishProbe(upstream, false)
+	if state := ps.getCircuitBreakerState(upstream); state != circuitOpen {
+		t.Errorf("Expected OPEN after a failed trial, got %s", state)
+	}
+
+	// A successful trial closes it
+	forceHalfOpen(ps, upstream)
+	if _, probe := ps.selectUpstream(""); !probe {
+		t.Fatal("Expected a trial through the HALF_OPEN upstream")
+	}
+	ps.finishProbe(upstream, true)
+	if state := ps.getCircuitBreakerState(upstream); state != circuitClosed {
+		t.Errorf("Expected CLOSED after a successful trial, got %s", state)
+	}
+}
+
+// TestHalfOpenProbeLimit tests that no more than the configured number of trial
+// requests reach a HALF_OPEN upstream at once
+func TestHalfOpenProbeLimit(t *testing.T) {
+	const maxProbes = 2
+	const clients = 12
+
+	var active, maxActive, arrivals int64
+	release := make(chan struct{})
+	recoveringAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err := readConnectRequest(reader); err != nil {
+			return
+		}
+		atomic.AddInt64(&arrivals, 1)
+		current := atomic.AddInt64(&active, 1)
+		for {
+			seen := atomic.LoadInt64(&maxActive)
+			if current <= seen || atomic.CompareAndSwapInt64(&maxActive, seen, current) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt64(&active, -1)
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	})
+	healthyAddr := startMockUpstream(t, echoUpstream)
+
+	recovering := "http://" + recoveringAddr
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: recovering, Enabled: true, Weight: 1},
+			{URL: "http://" + healthyAddr, Enabled: true, Weight: 1},
+		},
+		CircuitBreaker: CircuitBreakerConfig{OpenTimeoutSeconds: 30, HalfOpenMaxProbes: maxProbes},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+	forceHalfOpen(ps, recovering)
+
+	var wg sync.WaitGroup
+	var established int64
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if head, _ := readConnectRequest(bufio.NewReader(conn)); strings.Contains(head, "200") {
+				atomic.AddInt64(&established, 1)
+			}
+		}()
+	}
+
+	// Everything beyond the trial slots is routed to the healthy upstream
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&established) < clients-maxProbes && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&arrivals); got != maxProbes {
+		t.Errorf("Expected %d trial requests at the HALF_OPEN upstream, got %d", maxProbes, got)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt64(&maxActive); got > maxProbes {
+		t.Errorf("Expected at most %d concurrent trials, saw %d", maxProbes, got)
+	}
+	if got := atomic.LoadInt64(&established); got != clients {
+		t.Errorf("Expected all %d tunnels to be established, got %d", clients, got)
+	}
+	if state := ps.getCircuitBreakerState(recovering); state != circuitClosed {
+		t.Errorf("Expected circuit to close after successful trials, got %s", state)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -14,37 +19,18 @@ import (
 func TestBasicConcurrency(t *testing.T) {
 	// Create simple test configuration
 	config := &Config{
-		Server: struct {
-			Name          string `json:"name"`
-			ListenAddress string `json:"listen_address"`
-			StatsEndpoint string `json:"stats_endpoint"`
-		}{
+		Server: ServerConfig{
 			Name:          "Test Proxy",
 			ListenAddress: "127.0.0.1:3135",
 			StatsEndpoint: "/stats",
 		},
-		Authentication: struct {
-			Enabled bool `json:"enabled"`
-			Users   []struct {
-				Username string `json:"username"`
-				Password string `json:"password"`
-			} `json:"users"`
-		}{
+		Authentication: AuthenticationConfig{
 			Enabled: true,
-			Users: []struct {
-				Username string `json:"username"`
-				Password string `json:"password"`
-			}{
+			Users: []UserConfig{
 				{Username: "proxyuser", Password: "Proxy234"},
 			},
 		},
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9996", Enabled: true, Weight: 1}, // Non-existent upstream
 		},
 	}
@@ -127,31 +113,15 @@ func TestBasicConcurrency(t *testing.T) {
 // TestProxyRoundRobin tests the round-robin upstream selection
 func TestProxyRoundRobin(t *testing.T) {
 	config := &Config{
-		Server: struct {
-			Name          string `json:"name"`
-			ListenAddress string `json:"listen_address"`
-			StatsEndpoint string `json:"stats_endpoint"`
-		}{
+		Server: ServerConfig{
 			Name:          "Test Proxy",
 			ListenAddress: "127.0.0.1:3136",
 			StatsEndpoint: "/stats",
 		},
-		Authentication: struct {
-			Enabled bool `json:"enabled"`
-			Users   []struct {
-				Username string `json:"username"`
-				Password string `json:"password"`
-			} `json:"users"`
-		}{
+		Authentication: AuthenticationConfig{
 			Enabled: false, // Disable auth for simpler testing
 		},
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9995", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9994", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9993", Enabled: true, Weight: 1},
@@ -186,38 +156,19 @@ func TestProxyRoundRobin(t *testing.T) {
 // TestAuthenticationFlow tests the authentication mechanism in detail
 func TestAuthenticationFlow(t *testing.T) {
 	config := &Config{
-		Server: struct {
-			Name          string `json:"name"`
-			ListenAddress string `json:"listen_address"`
-			StatsEndpoint string `json:"stats_endpoint"`
-		}{
+		Server: ServerConfig{
 			Name:          "Test Proxy",
 			ListenAddress: "127.0.0.1:3137",
 			StatsEndpoint: "/stats",
 		},
-		Authentication: struct {
-			Enabled bool `json:"enabled"`
-			Users   []struct {
-				Username string `json:"username"`
-				Password string `json:"password"`
-			} `json:"users"`
-		}{
+		Authentication: AuthenticationConfig{
 			Enabled: true,
-			Users: []struct {
-				Username string `json:"username"`
-				Password string `json:"password"`
-			}{
+			Users: []UserConfig{
 				{Username: "user1", Password: "pass1"},
 				{Username: "user2", Password: "pass2"},
 			},
 		},
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9992", Enabled: true, Weight: 1},
 		},
 	}
@@ -281,4 +232,274 @@ func TestAuthenticationFlow(t *testing.T) {
 			t.Error("Request with malformed auth should not authenticate")
 		}
 	})
-}
\ No newline at end of file
+}
+// TestRequestIDsUniqueUnderConcurrency tests that concurrent requests get
+// unique, monotonically assigned IDs in RecentRequests and the detailed stats view
+func TestRequestIDsUniqueUnderConcurrency(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	const clients = 30
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			readConnectRequest(bufio.NewReader(conn))
+		}()
+	}
+	wg.Wait()
+
+	recent := ps.getRecentRequests(clients)
+	if len(recent) != clients {
+		t.Fatalf("Expected %d recorded requests, got %d", clients, len(recent))
+	}
+	seen := make(map[int64]bool)
+	for _, request := range recent {
+		if request.ID < 1 || request.ID > clients {
+			t.Errorf("Request ID %d outside the expected range 1..%d", request.ID, clients)
+		}
+		if seen[request.ID] {
+			t.Errorf("Duplicate request ID %d", request.ID)
+		}
+		seen[request.ID] = true
+	}
+
+	// The sequence keeps increasing for later requests
+	conn, _ := dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ps.getRecentRequests(clients+1)) <= clients && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	latest := ps.getRecentRequests(1)
+	if len(latest) != 1 || latest[0].ID != clients+1 {
+		t.Errorf("Expected next request ID %d, got %+v", clients+1, latest)
+	}
+
+	// Detailed stats view exposes the IDs
+	recorder := httptest.NewRecorder()
+	ps.handleStats(recorder, httptest.NewRequest("GET", "/stats?detail=requests&limit=5", nil))
+	var stats struct {
+		RecentRequests []RecentRequest `json:"recent_requests"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if len(stats.RecentRequests) != 5 {
+		t.Fatalf("Expected 5 recent requests in detailed stats, got %d", len(stats.RecentRequests))
+	}
+	if last := stats.RecentRequests[4]; last.ID != clients+1 {
+		t.Errorf("Expected newest request ID %d last, got %d", clients+1, last.ID)
+	}
+}
+
+// TestSelectionDuringReload tests concurrent selection while reloads swap the
+// upstream lists and health flips, the path where selection used to drop its
+// read lock to advance the round-robin index
+func TestSelectionDuringReload(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	configFor := func(upstreams ...string) string {
+		entries := make([]string, len(upstreams))
+		for i, upstream := range upstreams {
+			entries[i] = fmt.Sprintf(`{"url": %q, "enabled": true, "weight": %d}`, upstream, i+1)
+		}
+		return `{"server": {"stats_endpoint": "/stats"}, "upstream_proxies": [` + strings.Join(entries, ",") + `]}`
+	}
+	setA := []string{"http://127.0.0.1:9501", "http://127.0.0.1:9502", "http://127.0.0.1:9503"}
+	setB := []string{"http://127.0.0.1:9504"}
+	touchConfig(t, configPath, configFor(setA...), -time.Minute)
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	ps := NewProxyServer(config, configPath)
+
+	valid := make(map[string]bool)
+	for _, upstream := range append(append([]string{}, setA...), setB...) {
+		valid[upstream] = true
+	}
+
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			set := setA
+			if i%2 == 1 {
+				set = setB
+			}
+			touchConfig(t, configPath, configFor(set...), -time.Minute)
+			ps.forceReloadConfig("test")
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			ps.recordUpstreamFailure(setA[0])
+			ps.recordUpstreamSuccess(setA[0])
+		}
+	}()
+
+	var readers sync.WaitGroup
+	invalid := make(chan string, 1)
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for j := 0; j < 500; j++ {
+				if upstream := ps.getNextUpstream(); !valid[upstream] {
+					select {
+					case invalid <- upstream:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(20 * time.Second):
+		t.Fatal("Selection deadlocked while reloading")
+	}
+	close(stop)
+	writers.Wait()
+
+	select {
+	case upstream := <-invalid:
+		t.Errorf("Selection returned unknown upstream %q", upstream)
+	default:
+	}
+}
+
+// TestConnectDuringReload tests that tunnels, stats and health recording stay
+// race-free while reloads rebuild the upstream lists. Run with -race.
+func TestConnectDuringReload(t *testing.T) {
+	upstreamA := "http://" + startMockUpstream(t, echoUpstream)
+	upstreamB := "http://" + startMockUpstream(t, echoUpstream)
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	configFor := func(tag string, upstreams ...string) string {
+		entries := make([]string, len(upstreams))
+		for i, upstream := range upstreams {
+			entries[i] = fmt.Sprintf(`{"url": %q, "enabled": true, "weight": 1, "tag": %q}`, upstream, tag)
+		}
+		return `{"server": {"stats_endpoint": "/stats"}, "upstream_proxies": [` + strings.Join(entries, ",") + `]}`
+	}
+	touchConfig(t, configPath, configFor("a", upstreamA, upstreamB), -time.Minute)
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	ps := NewProxyServer(config, configPath)
+	proxyAddr := startTestProxy(t, ps)
+
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				touchConfig(t, configPath, configFor("b", upstreamB), -time.Minute)
+			} else {
+				touchConfig(t, configPath, configFor("a", upstreamA, upstreamB), -time.Minute)
+			}
+			ps.forceReloadConfig("test")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			ps.recordUpstreamFailure(upstreamA)
+			ps.recordUpstreamSuccess(upstreamA)
+			ps.getTimeWindowStats(15 * time.Minute)
+		}
+	}()
+
+	var clients sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for j := 0; j < 25; j++ {
+				conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+				if err != nil {
+					t.Errorf("Dial failed: %v", err)
+					return
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+				resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				conn.Close()
+				if err != nil {
+					t.Errorf("Failed to read CONNECT response: %v", err)
+					return
+				}
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("Expected 200 during reload, got %d", resp.StatusCode)
+					return
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		clients.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Tunnels stalled while reloading")
+	}
+	close(stop)
+	writers.Wait()
+}
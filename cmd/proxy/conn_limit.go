@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overloadResponse is written to connections turned away at accept time
+const overloadResponse = "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+
+// limitListener caps the client connections open at once on the proxy
+// listener (server.max_client_connections). Connections over the limit get
+// a canned 503 and are closed before any request is read or parsed, so
+// turning them away under overload costs next to nothing. A connection
+// holds its slot until it is closed, which for a tunnel is when the tunnel
+// ends.
+type limitListener struct {
+	net.Listener
+	slots    chan struct{}
+	rejected *int64
+}
+
+// limitClientConnections wraps listener with a limitListener, or returns it
+// as is when limit is 0
+func (ps *ProxyServer) limitClientConnections(listener net.Listener, limit int) net.Listener {
+	if limit <= 0 {
+		return listener
+	}
+	return &limitListener{
+		Listener: listener,
+		slots:    make(chan struct{}, limit),
+		rejected: &ps.stats.RejectedConnections,
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &limitedConn{Conn: conn, release: func() { <-l.slots }}, nil
+		default:
+			atomic.AddInt64(l.rejected, 1)
+			go rejectConn(conn)
+		}
+	}
+}
+
+// rejectConn answers a connection over the limit and closes it. The client
+// has usually sent its CONNECT already; draining it briefly after the
+// half-close keeps the close from turning into a reset that would discard
+// the 503 before the client reads it.
+func rejectConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.WriteString(conn, overloadResponse); err != nil {
+		return
+	}
+	closeWrite(conn)
+	io.Copy(io.Discard, io.LimitReader(conn, 64<<10))
+}
+
+// limitedConn gives its listener slot back on the first Close
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite keeps tunnels able to half-close the client side
+func (c *limitedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMaxClientConnections tests that connections over the limit are
+// answered 503 at accept time, without the request reaching the handler,
+// and that a closed tunnel frees its slot
+func TestMaxClientConnections(t *testing.T) {
+	upstream := "http://" + startMockUpstream(t, echoUpstream)
+	ps := NewProxyServer(&Config{
+		UpstreamProxies: []UpstreamProxyConfig{{URL: upstream, Enabled: true, Weight: 1}},
+	}, "")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: ps}
+	go server.Serve(ps.limitClientConnections(listener, 2))
+	t.Cleanup(func() { server.Close() })
+	proxyAddr := listener.Addr().String()
+
+	var tunnels []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, head := dialConnect(t, proxyAddr, "example.com:443")
+		defer conn.Close()
+		if !strings.Contains(head, "200") {
+			t.Fatalf("Expected tunnel %d to be established, got %q", i+1, head)
+		}
+		tunnels = append(tunnels, conn)
+	}
+
+	// The third connection is turned away and closed promptly
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Expected the rejected connection to be closed, got %v after %v", err, time.Since(start))
+	}
+	if !strings.HasPrefix(string(reply), "HTTP/1.1 503") {
+		t.Errorf("Expected a 503, got %q", reply)
+	}
+	if rejected := atomic.LoadInt64(&ps.stats.RejectedConnections); rejected != 1 {
+		t.Errorf("Expected 1 rejected connection, got %d", rejected)
+	}
+	if total := atomic.LoadInt64(&ps.stats.TotalRequests); total != 2 {
+		t.Errorf("Expected the rejected CONNECT never to reach the handler, got %d requests", total)
+	}
+
+	// Ending a tunnel frees its slot
+	tunnels[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, head := dialConnect(t, proxyAddr, "example.com:443")
+		conn.Close()
+		if strings.Contains(head, "200") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a tunnel after one was closed, got %q", head)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
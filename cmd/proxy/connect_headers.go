@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// connectHeaders expands an upstream's configured CONNECT headers. Values
+// may reference environment variables ($VAR or ${VAR}) so secrets stay out
+// of the config file. Host is always set by the proxy, and Proxy-Authorization
+// only when the upstream URL carries no credentials of its own.
+func connectHeaders(headers map[string]string, hasAuth bool) http.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	expanded := make(http.Header, len(headers))
+	for name, value := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == "Host" || (hasAuth && canonical == "Proxy-Authorization") {
+			continue
+		}
+		value = os.ExpandEnv(value)
+		if strings.ContainsAny(value, "\r\n") {
+			log.Printf("Skipping CONNECT header %s: expanded value contains a line break", canonical)
+			continue
+		}
+		expanded.Set(canonical, value)
+	}
+	return expanded
+}
+
+// HostHeaderConfig normalizes the Host header of the CONNECT sent to an
+// upstream, for upstreams that are strict about its format. The request
+// target always keeps the port.
+type HostHeaderConfig struct {
+	StripPort bool `json:"strip_port,omitempty"`
+	Lowercase bool `json:"lowercase,omitempty"`
+}
+
+// format returns the Host header value for a CONNECT to target
+func (hc HostHeaderConfig) format(target string) string {
+	host := target
+	if hc.StripPort {
+		if hostname, _, err := net.SplitHostPort(target); err == nil {
+			host = hostname
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		}
+	}
+	if hc.Lowercase {
+		host = strings.ToLower(host)
+	}
+	return host
+}
+
+// buildConnectRequest builds the CONNECT request sent upstream for target,
+// with the given Host header, the upstream's credentials (if any) and extra
+// headers in a stable order
+func buildConnectRequest(target, host, auth string, headers http.Header) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, host)
+	if auth != "" {
+		fmt.Fprintf(&b, "Proxy-Authorization: %s\r\n", auth)
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, headers.Get(name))
+	}
+
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// validateConnectHeaders rejects header names that would corrupt the request
+func validateConnectHeaders(upstream UpstreamProxyConfig) error {
+	for name, value := range upstream.ConnectHeaders {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("upstream %s: invalid connect_headers name %q", upstream.URL, name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("upstream %s: connect_headers value for %s contains a line break", upstream.URL, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestUpstreamConnectHeaders tests that configured headers, with environment
+// interpolation, reach the upstream on CONNECT
+func TestUpstreamConnectHeaders(t *testing.T) {
+	t.Setenv("NETDRIFT_TEST_API_KEY", "s3cret")
+
+	received := make(chan string, 1)
+	upstreamAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		head, err := readConnectRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		received <- head
+		// The provider rejects CONNECTs without its API key
+		if !strings.Contains(head, "\r\nX-Api-Key: s3cret\r\n") {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	})
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{
+				URL:     "http://user:pass@" + upstreamAddr,
+				Enabled: true,
+				Weight:  1,
+				ConnectHeaders: map[string]string{
+					"x-api-key":           "${NETDRIFT_TEST_API_KEY}",
+					"X-Session":           "sticky-42",
+					"Host":                "ignored.example",
+					"Proxy-Authorization": "Basic ignored",
+				},
+			},
+		},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected upstream to accept the CONNECT, got %q", head)
+	}
+
+	upstreamHead := <-received
+	for _, want := range []string{
+		"CONNECT example.com:443 HTTP/1.1\r\n",
+		"\r\nHost: example.com:443\r\n",
+		"\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n",
+		"\r\nX-Api-Key: s3cret\r\n",
+		"\r\nX-Session: sticky-42\r\n",
+	} {
+		if !strings.Contains(upstreamHead, want) {
+			t.Errorf("Expected CONNECT to contain %q, got:\n%s", want, upstreamHead)
+		}
+	}
+	if strings.Contains(upstreamHead, "ignored") {
+		t.Errorf("Configured headers must not override Host or URL credentials, got:\n%s", upstreamHead)
+	}
+}
+
+// TestConnectHeadersValidation tests that malformed headers are rejected or dropped
+func TestConnectHeadersValidation(t *testing.T) {
+	for _, headers := range []map[string]string{
+		{"X Bad": "v"},
+		{"X-Colon:": "v"},
+		{"X-Split": "a\r\nInjected: 1"},
+	} {
+		config := &Config{UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9400", Enabled: true, Weight: 1, ConnectHeaders: headers},
+		}}
+		if err := validateConfig(config); err == nil {
+			t.Errorf("Expected %v to be rejected", headers)
+		}
+	}
+
+	// A line break smuggled in through the environment is dropped
+	t.Setenv("NETDRIFT_TEST_SPLIT", "a\r\nInjected: 1")
+	expanded := connectHeaders(map[string]string{"X-Env": "$NETDRIFT_TEST_SPLIT", "X-Ok": "1"}, false)
+	if expanded.Get("X-Env") != "" || expanded.Get("X-Ok") != "1" {
+		t.Errorf("Expected only X-Ok to survive, got %v", expanded)
+	}
+	if request := buildConnectRequest("example.com:443", "example.com:443", "", expanded); strings.Contains(request, "Injected") {
+		t.Errorf("Header injection reached the request:\n%s", request)
+	}
+}
+
+// TestConnectHostHeader tests that the Host header sent upstream follows the
+// upstream's host_header policy while the request target keeps its port
+func TestConnectHostHeader(t *testing.T) {
+	received := make(chan string, 1)
+	upstreamAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		head, err := readConnectRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		received <- head
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	})
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{
+				URL:        "http://" + upstreamAddr,
+				Enabled:    true,
+				Weight:     1,
+				HostHeader: HostHeaderConfig{StripPort: true, Lowercase: true},
+			},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, head := dialConnect(t, proxyAddr, "Example.COM:443")
+	conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected the CONNECT to succeed, got %q", head)
+	}
+	upstreamHead := <-received
+	if !strings.HasPrefix(upstreamHead, "CONNECT Example.COM:443 HTTP/1.1\r\n") {
+		t.Errorf("Expected the request target to be unchanged, got:\n%s", upstreamHead)
+	}
+	if !strings.Contains(upstreamHead, "\r\nHost: example.com\r\n") {
+		t.Errorf("Expected a lowercased Host without port, got:\n%s", upstreamHead)
+	}
+
+	cases := []struct {
+		policy HostHeaderConfig
+		target string
+		want   string
+	}{
+		{HostHeaderConfig{}, "Example.com:443", "Example.com:443"},
+		{HostHeaderConfig{StripPort: true}, "Example.com:443", "Example.com"},
+		{HostHeaderConfig{Lowercase: true}, "Example.com:443", "example.com:443"},
+		{HostHeaderConfig{StripPort: true}, "[2001:db8::1]:443", "[2001:db8::1]"},
+		{HostHeaderConfig{StripPort: true}, "example.com", "example.com"},
+	}
+	for _, tc := range cases {
+		if got := tc.policy.format(tc.target); got != tc.want {
+			t.Errorf("%+v.format(%q) = %q, want %q", tc.policy, tc.target, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "fmt"
+
+// defaultConnectRetryAttempts is how many upstreams a CONNECT may try when
+// connect_retry.retry_statuses is set without max_attempts
+const defaultConnectRetryAttempts = 2
+
+// ConnectRetryConfig classifies the status codes an upstream may answer a
+// CONNECT with. Statuses in RetryStatuses (e.g. 502, 503, 504) move the
+// CONNECT to another upstream; any other non-2xx status, such as 403 or
+// 407, is final and reported to the client.
+type ConnectRetryConfig struct {
+	RetryStatuses []int `json:"retry_statuses,omitempty"`
+	// MaxAttempts bounds the upstreams tried per CONNECT, the first
+	// included (default 2)
+	MaxAttempts int `json:"max_attempts,omitempty"`
+}
+
+// retriableStatus reports whether a CONNECT rejected with status on its
+// attempt-th upstream should move to another one
+func (ps *ProxyServer) retriableStatus(status, attempt int) bool {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	retry := ps.config.ConnectRetry
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultConnectRetryAttempts
+	}
+	if attempt >= maxAttempts {
+		return false
+	}
+	for _, retriable := range retry.RetryStatuses {
+		if retriable == status {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConnectRetry checks the connect_retry settings
+func validateConnectRetry(retry ConnectRetryConfig) error {
+	if retry.MaxAttempts < 0 {
+		return fmt.Errorf("connect_retry.max_attempts must not be negative, got %d", retry.MaxAttempts)
+	}
+	for _, status := range retry.RetryStatuses {
+		if status < 300 || status > 599 {
+			return fmt.Errorf("connect_retry.retry_statuses: %d is not an error status", status)
+		}
+	}
+	return nil
+}
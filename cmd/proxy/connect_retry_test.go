@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// rejectingUpstream answers every CONNECT with status
+func rejectingUpstream(status string) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		if _, err := readConnectRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 " + status + "\r\n\r\n"))
+	}
+}
+
+func TestConnectRetryClassification(t *testing.T) {
+	healthy := "http://" + startMockUpstream(t, echoUpstream)
+
+	tests := []struct {
+		name      string
+		status    string
+		wantRetry bool
+	}{
+		{"retriable 503", "503 Service Unavailable", true},
+		{"fatal 403", "403 Forbidden", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejecting := "http://" + startMockUpstream(t, rejectingUpstream(tt.status))
+			config := &Config{
+				UpstreamProxies: []UpstreamProxyConfig{
+					{URL: rejecting, Enabled: true, Weight: 1},
+					{URL: healthy, Enabled: true, Weight: 1},
+				},
+				ConnectRetry: ConnectRetryConfig{RetryStatuses: []int{502, 503, 504}},
+			}
+			ps := NewProxyServer(config, "")
+			proxyAddr := startTestProxy(t, ps)
+
+			// Round robin puts the rejecting upstream first on every other CONNECT
+			var rejected int
+			for i := 0; i < 4; i++ {
+				conn, head := dialConnect(t, proxyAddr, "example.com:443")
+				conn.Close()
+				if !strings.Contains(head, "200") {
+					rejected++
+				}
+			}
+
+			retries := atomic.LoadInt64(&ps.stats.ConnectRetries)
+			if tt.wantRetry {
+				if rejected != 0 {
+					t.Errorf("Expected every CONNECT to be retried onto %s, %d were rejected", healthy, rejected)
+				}
+				if retries != 2 {
+					t.Errorf("Expected 2 retries, got %d", retries)
+				}
+			} else {
+				if rejected != 2 {
+					t.Errorf("Expected the 2 CONNECTs through the rejecting upstream to fail, got %d", rejected)
+				}
+				if retries != 0 {
+					t.Errorf("Expected no retries for a fatal status, got %d", retries)
+				}
+			}
+		})
+	}
+}
+
+func TestRetriableStatusAttempts(t *testing.T) {
+	ps := NewProxyServer(&Config{
+		ConnectRetry: ConnectRetryConfig{RetryStatuses: []int{502}, MaxAttempts: 3},
+	}, "")
+
+	if !ps.retriableStatus(502, 2) {
+		t.Error("Expected 502 on attempt 2 of 3 to be retried")
+	}
+	if ps.retriableStatus(502, 3) {
+		t.Error("Expected no retry once max_attempts is reached")
+	}
+	if ps.retriableStatus(403, 1) {
+		t.Error("Expected an unlisted status to be fatal")
+	}
+	if err := validateConnectRetry(ConnectRetryConfig{RetryStatuses: []int{200}}); err == nil {
+		t.Error("Expected a 2xx retry status to be rejected")
+	}
+}
+
+// TestConnectRetryExhaustedStaysOffDirect tests that a target every upstream
+// rejected with a retriable status is not tunneled directly with allow_direct
+func TestConnectRetryExhaustedStaysOffDirect(t *testing.T) {
+	var directDials int64
+	targetAddr := startMockUpstream(t, func(conn net.Conn) {
+		atomic.AddInt64(&directDials, 1)
+		conn.Close()
+	})
+
+	config := &Config{
+		Server: ServerConfig{AllowDirect: true},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + startMockUpstream(t, rejectingUpstream("503 Service Unavailable")), Enabled: true, Weight: 1},
+			{URL: "http://" + startMockUpstream(t, rejectingUpstream("503 Service Unavailable")), Enabled: true, Weight: 1},
+		},
+		ConnectRetry: ConnectRetryConfig{RetryStatuses: []int{503}, MaxAttempts: 3},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, head := dialConnect(t, proxyAddr, targetAddr)
+	conn.Close()
+	if !strings.HasPrefix(head, "HTTP/1.1 502") {
+		t.Errorf("Expected 502 once every upstream rejected the target, got %q", head)
+	}
+	if dials := atomic.LoadInt64(&directDials); dials != 0 {
+		t.Errorf("Expected no direct dial to the target, got %d", dials)
+	}
+	if direct := atomic.LoadInt64(&ps.stats.DirectTunnels); direct != 0 {
+		t.Errorf("Expected no direct tunnels, got %d", direct)
+	}
+	if failed := atomic.LoadInt64(&ps.stats.FailedRequests); failed != 1 {
+		t.Errorf("Expected 1 failed request, got %d", failed)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import "strings"
+
+// credentialFreeURL strips the userinfo from an upstream URL, so the same
+// proxy with new credentials has the same key, both across reloads and in
+// the saved health state across restarts
+func credentialFreeURL(upstream string) string {
+	scheme, rest, found := strings.Cut(upstream, "://")
+	if !found {
+		return upstream
+	}
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		rest = rest[at+1:]
+	}
+	return scheme + "://" + rest
+}
+
+// carryOverRotatedCredentials moves the health, stats and latency of an
+// upstream whose credentials changed in a reload to its new URL, so rotating
+// a password keeps its health state instead of looking like one upstream
+// removed and another added. Tunnels already open keep the credentials they
+// were set up with; new CONNECTs use the new URL. It returns the old URL of
+// each rotated upstream keyed by the new one. Caller must hold ps.mutex
+// (write) and call it before buildUpstreamLists.
+func (ps *ProxyServer) carryOverRotatedCredentials(oldUpstreams []string) map[string]string {
+	current := make(map[string]bool)
+	for _, proxy := range ps.config.UpstreamProxies {
+		if proxy.Enabled {
+			current[proxy.URL] = true
+		}
+	}
+
+	// Old upstreams gone from the config, by their credential-free URL
+	gone := make(map[string]string)
+	for _, old := range oldUpstreams {
+		if !current[old] {
+			gone[credentialFreeURL(old)] = old
+		}
+	}
+
+	rotated := make(map[string]string)
+	for _, proxy := range ps.config.UpstreamProxies {
+		if !proxy.Enabled || rotated[proxy.URL] != "" {
+			continue
+		}
+		key := credentialFreeURL(proxy.URL)
+		old, exists := gone[key]
+		if !exists || old == proxy.URL {
+			continue
+		}
+		delete(gone, key)
+		rotated[proxy.URL] = old
+	}
+	if len(rotated) == 0 {
+		return rotated
+	}
+
+	ps.healthMutex.Lock()
+	for upstream, old := range rotated {
+		if health, exists := ps.upstreamHealth[old]; exists {
+			ps.upstreamHealth[upstream] = health
+			delete(ps.upstreamHealth, old)
+		}
+	}
+	ps.healthMutex.Unlock()
+
+	for upstream, old := range rotated {
+		if metric, exists := ps.stats.UpstreamMetrics[old]; exists {
+			metric.URL = upstream
+			ps.stats.UpstreamMetrics[upstream] = metric
+			delete(ps.stats.UpstreamMetrics, old)
+		}
+		ps.latency.rename(old, upstream)
+	}
+	return rotated
+}
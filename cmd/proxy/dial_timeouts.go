@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DialConfig splits the dial to an upstream into DNS resolution and TCP
+// connect, each with its own timeout, so a slow lookup fails fast instead
+// of using up the time the connect needs. Both stay within the request
+// budget; 0 leaves a phase bounded by the budget alone.
+type DialConfig struct {
+	DNSTimeoutMs     int `json:"dns_timeout_ms,omitempty"`
+	ConnectTimeoutMs int `json:"connect_timeout_ms,omitempty"`
+}
+
+func (dc DialConfig) split() bool {
+	return dc.DNSTimeoutMs > 0 || dc.ConnectTimeoutMs > 0
+}
+
+// hostResolver looks up the addresses of a host name, as *net.Resolver does
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dialTCP connects to host ("name:port") for an upstream. With dial
+// timeouts configured, the name is resolved first under dns_timeout_ms and
+// each address is then tried under connect_timeout_ms.
+func (ps *ProxyServer) dialTCP(ctx context.Context, proxyConfig UpstreamProxyConfig, host string) (net.Conn, error) {
+	ps.mutex.RLock()
+	timeouts := ps.config.Dial
+	ps.mutex.RUnlock()
+
+	if !timeouts.split() {
+		return upstreamDialer(proxyConfig, 0).DialContext(ctx, "tcp", host)
+	}
+
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{hostname}
+	if net.ParseIP(hostname) == nil {
+		addrs, err = ps.lookupHost(ctx, hostname, time.Duration(timeouts.DNSTimeoutMs)*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := upstreamDialer(proxyConfig, time.Duration(timeouts.ConnectTimeoutMs)*time.Millisecond)
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// lookupHost resolves hostname, giving up after timeout (0 = no limit of its own)
+func (ps *ProxyServer) lookupHost(ctx context.Context, hostname string, timeout time.Duration) ([]string, error) {
+	resolver := ps.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	lookupCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		lookupCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs, err := resolver.LookupHost(lookupCtx, hostname)
+	if err != nil && ctx.Err() == nil && errors.Is(lookupCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("DNS lookup of %s exceeded dns_timeout_ms (%v)", hostname, timeout)
+	}
+	if err == nil && len(addrs) == 0 {
+		return nil, fmt.Errorf("DNS lookup of %s returned no addresses", hostname)
+	}
+	return addrs, err
+}
+
+// validateDial checks the dial timeouts
+func validateDial(dial DialConfig) error {
+	if dial.DNSTimeoutMs < 0 || dial.ConnectTimeoutMs < 0 {
+		return fmt.Errorf("dial timeouts must not be negative, got dns_timeout_ms %d and connect_timeout_ms %d",
+			dial.DNSTimeoutMs, dial.ConnectTimeoutMs)
+	}
+	return nil
+}
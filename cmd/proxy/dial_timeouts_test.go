@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubResolver answers lookups from a fixed table after delay, or not at
+// all until the context ends
+type stubResolver struct {
+	delay time.Duration
+	hosts map[string][]string
+}
+
+func (sr stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	select {
+	case <-time.After(sr.delay):
+		return sr.hosts[host], nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TestDialDNSTimeout tests that a slow DNS lookup fails within
+// dns_timeout_ms instead of using up the request budget, and that a
+// resolved name is still dialed
+func TestDialDNSTimeout(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startMockUpstream(t, echoUpstream))
+	upstream := "http://upstream.test:" + port
+	config := &Config{
+		UpstreamProxies:      []UpstreamProxyConfig{{URL: upstream, Enabled: true, Weight: 1}},
+		RequestBudgetSeconds: 5,
+		Dial:                 DialConfig{DNSTimeoutMs: 100, ConnectTimeoutMs: 1000},
+	}
+	ps := NewProxyServer(config, "")
+
+	ps.resolver = stubResolver{delay: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), ps.requestBudget(upstream))
+	defer cancel()
+	start := time.Now()
+	_, err := ps.dialUpstream(ctx, upstream, "upstream.test:"+port)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the slow lookup to fail after about 100ms, took %v", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "dns_timeout_ms") {
+		t.Errorf("Expected a DNS timeout error, got %v", err)
+	}
+
+	ps.resolver = stubResolver{delay: 10 * time.Millisecond, hosts: map[string][]string{"upstream.test": {"127.0.0.1"}}}
+	conn, err := ps.dialUpstream(ctx, upstream, "upstream.test:"+port)
+	if err != nil {
+		t.Fatalf("Expected the resolved upstream to be dialed, got %v", err)
+	}
+	conn.Close()
+
+	if err := validateConfig(&Config{Dial: DialConfig{DNSTimeoutMs: -1}}); err == nil {
+		t.Error("Expected a negative dns_timeout_ms to be rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// directUpstream labels tunnels that bypass the upstream pool
+const directUpstream = "direct"
+
+// allowDirect reports whether CONNECTs may fall back to dialing the target
+// directly when no upstream is available (server.allow_direct)
+func (ps *ProxyServer) allowDirect() bool {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	return ps.config.Server.AllowDirect
+}
+
+// handleDirectConnect tunnels the client straight to the target, like the
+// test proxy does. It is only reached with server.allow_direct enabled and
+// no upstream available.
+func (ps *ProxyServer) handleDirectConnect(w http.ResponseWriter, r *http.Request, requestID int64, entry *accessLogEntry) {
+	entry.Upstream = directUpstream
+	budget := ps.requestBudget("")
+	ctx, cancel := context.WithTimeout(r.Context(), budget)
+	defer cancel()
+
+	var dialer net.Dialer
+	targetConn, err := dialer.DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		log.Printf("[req %d] Failed to connect directly to %s: %v", requestID, r.Host, err)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.writeError(w, "Failed to connect to target", http.StatusBadGateway)
+		return
+	}
+	defer targetConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("ResponseWriter doesn't support hijacking")
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Failed to hijack connection: %v", err)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Printf("Failed to send 200 to client: %v", err)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		return
+	}
+
+	log.Printf("[req %d] Established DIRECT tunnel to %s (no upstream available, allow_direct is on)", requestID, r.Host)
+	atomic.AddInt64(&ps.stats.SuccessRequests, 1)
+	atomic.AddInt64(&ps.stats.DirectTunnels, 1)
+
+	// Direct tunnels get the same reaping, lifetime and bandwidth limits
+	toTarget, toClient, closeTunnel := ps.openTunnel(r, directUpstream, clientConn, targetConn)
+	defer closeTunnel()
+	entry.BytesUp, entry.BytesDown, _ = relayTunnel(clientConn, targetConn, toTarget, toClient)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestAllowDirect tests that CONNECTs tunnel straight to the target only when allow_direct is enabled
+func TestAllowDirect(t *testing.T) {
+	// A plain TCP echo server stands in for the target
+	targetAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	// Off by default: no upstreams means 502
+	conn, head := dialConnect(t, proxyAddr, targetAddr)
+	conn.Close()
+	if !strings.HasPrefix(head, "HTTP/1.1 502") {
+		t.Fatalf("Expected 502 without allow_direct, got %q", head)
+	}
+
+	ps.mutex.Lock()
+	config.Server.AllowDirect = true
+	ps.mutex.Unlock()
+
+	conn, head = dialConnect(t, proxyAddr, targetAddr)
+	defer conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected direct tunnel with allow_direct, got %q", head)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write through tunnel failed: %v", err)
+	}
+	buffer := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != "hello" {
+		t.Errorf("Expected echo through direct tunnel, got %q (%v)", buffer, err)
+	}
+
+	if direct := atomic.LoadInt64(&ps.stats.DirectTunnels); direct != 1 {
+		t.Errorf("Expected 1 direct tunnel, got %d", direct)
+	}
+}
+
+// TestDirectTunnelLimits tests that direct tunnels are throttled and expire
+// like tunnels through an upstream
+func TestDirectTunnelLimits(t *testing.T) {
+	targetAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+
+	const limit = 20000
+	config := &Config{
+		Server:    ServerConfig{StatsEndpoint: "/stats", AllowDirect: true},
+		Bandwidth: BandwidthConfig{Default: BandwidthLimit{DownloadBytesPerSecond: limit}},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, head := dialConnect(t, proxyAddr, targetAddr)
+	defer conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected direct tunnel, got %q", head)
+	}
+
+	// One second of burst, so 2.5x the limit takes at least 1.5 seconds
+	payload := bytes.Repeat([]byte("x"), limit*5/2)
+	start := time.Now()
+	go conn.Write(payload)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, len(payload))); err != nil {
+		t.Fatalf("Failed to read echoed payload: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 1400*time.Millisecond {
+		t.Errorf("Direct transfer finished too quickly for the limit: %v", elapsed)
+	}
+
+	ps.mutex.Lock()
+	config.MaxTunnelLifetimeSeconds = 1
+	config.Bandwidth = BandwidthConfig{}
+	ps.mutex.Unlock()
+
+	expiring, head := dialConnect(t, proxyAddr, targetAddr)
+	defer expiring.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected direct tunnel, got %q", head)
+	}
+	expiring.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := expiring.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the direct tunnel to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Direct tunnel was not closed at its max lifetime")
+	}
+	if expired := atomic.LoadInt64(&ps.stats.ExpiredTunnels); expired != 1 {
+		t.Errorf("Expected 1 expired tunnel, got %d", expired)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// ipInExpected reports whether ip is expected, a single IP address or a
+// CIDR subnet
+func ipInExpected(expected, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if strings.Contains(expected, "/") {
+		_, subnet, err := net.ParseCIDR(expected)
+		return err == nil && subnet.Contains(parsed)
+	}
+	return parsed.Equal(net.ParseIP(expected))
+}
+
+// expectedIP returns the expected_ip of upstream, or "" if it has none
+func expectedIP(config *Config, upstream string) string {
+	for _, proxy := range config.UpstreamProxies {
+		if proxy.URL == upstream && proxy.Enabled {
+			return proxy.ExpectedIP
+		}
+	}
+	return ""
+}
+
+// flagUnexpectedIP takes an upstream out of rotation at once when a health
+// check measured an egress IP outside its expected_ip. A static IP that
+// moves suggests the proxy was reassigned or compromised, so this does not
+// wait for failure_threshold; a check from an expected IP clears the flag
+// and normal recovery applies.
+func (ps *ProxyServer) flagUnexpectedIP(upstream, ip string) {
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	health, exists := ps.upstreamHealth[upstream]
+	if !exists {
+		return
+	}
+	health.UnexpectedIP = ip
+	if health.IsHealthy {
+		health.IsHealthy = false
+		log.Printf("Upstream %s marked as unhealthy: egress IP %s is outside expected_ip", upstream, ip)
+	}
+}
+
+// validateExpectedIP checks an upstream's expected_ip
+func validateExpectedIP(upstream UpstreamProxyConfig) error {
+	expected := upstream.ExpectedIP
+	if expected == "" {
+		return nil
+	}
+	if strings.Contains(expected, "/") {
+		if _, _, err := net.ParseCIDR(expected); err != nil {
+			return fmt.Errorf("upstream %s: expected_ip must be an IP address or CIDR subnet, got %q", upstream.URL, expected)
+		}
+		return nil
+	}
+	if net.ParseIP(expected) == nil {
+		return fmt.Errorf("upstream %s: expected_ip must be an IP address or CIDR subnet, got %q", upstream.URL, expected)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUnexpectedEgressIPMarksUnhealthy(t *testing.T) {
+	tests := []struct {
+		name        string
+		measuredIP  string
+		expected    string
+		wantHealthy bool
+	}{
+		{"inside subnet", "203.0.113.25", "203.0.113.0/24", true},
+		{"exact match", "203.0.113.25", "203.0.113.25", true},
+		{"outside subnet", "198.51.100.7", "203.0.113.0/24", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := createMockIPResolverServer(tt.measuredIP, 200, 0)
+			defer resolver.Close()
+			proxy := createMockProxyServer(resolver)
+			defer proxy.server.Close()
+
+			upstream := proxy.server.URL
+			config := &Config{
+				UpstreamProxies: []UpstreamProxyConfig{
+					{URL: upstream, Enabled: true, Weight: 1, ExpectedIP: tt.expected},
+				},
+				HealthCheck: HealthCheckConfig{
+					Endpoints:         []string{resolver.URL},
+					TimeoutSeconds:    5,
+					FailureThreshold:  3,
+					RecoveryThreshold: 1,
+				},
+			}
+			ps := NewProxyServer(config, "")
+			hc := &HealthChecker{proxyServer: ps}
+
+			result := hc.checkUpstreamHealth(upstream, config)
+			hc.processHealthCheckResult(result)
+
+			if result.Success != tt.wantHealthy {
+				t.Errorf("Expected check success %v, got %v (%v)", tt.wantHealthy, result.Success, result.Error)
+			}
+			// One strike is enough: failure_threshold does not apply
+			if ps.isUpstreamHealthy(upstream) != tt.wantHealthy {
+				t.Errorf("Expected healthy %v after one check", tt.wantHealthy)
+			}
+
+			ps.healthMutex.RLock()
+			flagged := ps.upstreamHealth[upstream].UnexpectedIP
+			ps.healthMutex.RUnlock()
+			wantFlag := ""
+			if !tt.wantHealthy {
+				wantFlag = tt.measuredIP
+			}
+			if flagged != wantFlag {
+				t.Errorf("Expected unexpected_ip %q, got %q", wantFlag, flagged)
+			}
+		})
+	}
+}
+
+func TestValidateExpectedIP(t *testing.T) {
+	for _, expected := range []string{"203.0.113.7", "2001:db8::/32", "203.0.113.0/24"} {
+		if err := validateExpectedIP(UpstreamProxyConfig{URL: "http://p:1", ExpectedIP: expected}); err != nil {
+			t.Errorf("Expected %q to be valid: %v", expected, err)
+		}
+	}
+	for _, expected := range []string{"203.0.113", "203.0.113.0/33", "proxy.example.com"} {
+		if err := validateExpectedIP(UpstreamProxyConfig{URL: "http://p:1", ExpectedIP: expected}); err == nil {
+			t.Errorf("Expected %q to be rejected", expected)
+		}
+	}
+}
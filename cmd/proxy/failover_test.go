@@ -11,13 +11,7 @@ import (
 func TestUpstreamFailoverScenarios(t *testing.T) {
 	t.Run("GradualUpstreamFailure", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9070", Enabled: true, Weight: 2},
 				{URL: "http://127.0.0.1:9071", Enabled: true, Weight: 2},
 				{URL: "http://127.0.0.1:9072", Enabled: true, Weight: 1},
@@ -96,13 +90,7 @@ func TestUpstreamFailoverScenarios(t *testing.T) {
 
 	t.Run("CascadingFailureRecovery", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9073", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9074", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9075", Enabled: true, Weight: 1},
@@ -184,13 +172,7 @@ func TestUpstreamFailoverScenarios(t *testing.T) {
 
 	t.Run("PartialFailureLoadRedistribution", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9077", Enabled: true, Weight: 5}, // High capacity
 				{URL: "http://127.0.0.1:9078", Enabled: true, Weight: 3}, // Medium capacity
 				{URL: "http://127.0.0.1:9079", Enabled: true, Weight: 2}, // Low capacity
@@ -246,13 +228,7 @@ func TestUpstreamFailoverScenarios(t *testing.T) {
 // TestFailoverUnderLoad tests failover behavior during high concurrent load
 func TestFailoverUnderLoad(t *testing.T) {
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9080", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9081", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9082", Enabled: true, Weight: 1},
@@ -339,13 +315,7 @@ func TestFailoverUnderLoad(t *testing.T) {
 func TestFailoverThresholds(t *testing.T) {
 	t.Run("LowFailureThreshold", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9083", Enabled: true, Weight: 1},
 			},
 		}
@@ -376,13 +346,7 @@ func TestFailoverThresholds(t *testing.T) {
 
 	t.Run("HighFailureThreshold", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9084", Enabled: true, Weight: 1},
 			},
 		}
@@ -414,13 +378,7 @@ func TestFailoverThresholds(t *testing.T) {
 		t.Skip("Dynamic threshold adjustment not yet implemented - will be added during TDD")
 
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9085", Enabled: true, Weight: 1},
 			},
 		}
@@ -453,13 +411,7 @@ func TestFailoverThresholds(t *testing.T) {
 func TestFailoverRecoveryPatterns(t *testing.T) {
 	t.Run("ImmediateRecovery", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9086", Enabled: true, Weight: 1},
 			},
 		}
@@ -486,13 +438,7 @@ func TestFailoverRecoveryPatterns(t *testing.T) {
 
 	t.Run("GradualRecovery", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9087", Enabled: true, Weight: 1},
 			},
 		}
@@ -529,13 +475,7 @@ func TestFailoverRecoveryPatterns(t *testing.T) {
 		t.Skip("Exponential backoff recovery not yet implemented - will be added during TDD")
 
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9088", Enabled: true, Weight: 1},
 			},
 		}
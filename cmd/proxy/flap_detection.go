@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// FlapDetectionConfig holds down upstreams whose health keeps flipping. An
+// upstream that changes state more than MaxTransitions times within
+// WindowSeconds stays unhealthy for HoldDownSeconds, whatever its checks and
+// requests report meanwhile.
+type FlapDetectionConfig struct {
+	// MaxTransitions is how many state changes the window tolerates (0 = off)
+	MaxTransitions int `json:"max_transitions"`
+	// WindowSeconds is how far back state changes count (default 300)
+	WindowSeconds int `json:"window_seconds,omitempty"`
+	// HoldDownSeconds is how long a flapping upstream is held down (default 600)
+	HoldDownSeconds int `json:"hold_down_seconds,omitempty"`
+}
+
+func (fd FlapDetectionConfig) window() time.Duration {
+	if fd.WindowSeconds > 0 {
+		return time.Duration(fd.WindowSeconds) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+func (fd FlapDetectionConfig) holdDown() time.Duration {
+	if fd.HoldDownSeconds > 0 {
+		return time.Duration(fd.HoldDownSeconds) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// recordTransition adds a state change at now to the upstream's history and
+// holds the upstream down if it is flapping, which it reports. Caller must
+// hold ps.healthMutex (write).
+func (fd FlapDetectionConfig) recordTransition(upstream string, health *UpstreamHealth, now time.Time) bool {
+	if fd.MaxTransitions <= 0 {
+		return false
+	}
+
+	cutoff := now.Add(-fd.window())
+	recent := health.transitions[:0]
+	for _, at := range health.transitions {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	health.transitions = append(recent, now)
+	if len(health.transitions) <= fd.MaxTransitions {
+		return false
+	}
+
+	// The history starts over, so the upstream gets a clean slate once
+	// the hold-down ends
+	log.Printf("Upstream %s is flapping (%d state changes within %v), holding it down for %v",
+		upstream, len(health.transitions), fd.window(), fd.holdDown())
+	health.transitions = nil
+	health.IsHealthy = false
+	health.HeldDownUntil = now.Add(fd.holdDown())
+	return true
+}
+
+// heldDown reports whether a flapping upstream must stay unhealthy at now
+func (health *UpstreamHealth) heldDown(now time.Time) bool {
+	return now.Before(health.HeldDownUntil)
+}
+
+// validateFlapDetection checks the health_check.flap_detection settings
+func validateFlapDetection(fd FlapDetectionConfig) error {
+	if fd.MaxTransitions < 0 || fd.WindowSeconds < 0 || fd.HoldDownSeconds < 0 {
+		return fmt.Errorf("health_check.flap_detection values must not be negative, got %+v", fd)
+	}
+	return nil
+}
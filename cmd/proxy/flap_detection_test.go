@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestFlappingUpstreamHeldDown tests that an upstream changing state more
+// than max_transitions times is held unhealthy until its hold-down ends
+func TestFlappingUpstreamHeldDown(t *testing.T) {
+	flapping := "http://127.0.0.1:9471"
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: flapping, Enabled: true, Weight: 1},
+		},
+		HealthCheck: HealthCheckConfig{
+			FlapDetection: FlapDetectionConfig{MaxTransitions: 3, WindowSeconds: 60, HoldDownSeconds: 300},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	ps.setFailureThreshold(flapping, 1)
+
+	// Three state changes are tolerated
+	ps.recordUpstreamFailure(flapping)
+	ps.recordUpstreamSuccess(flapping)
+	ps.recordUpstreamFailure(flapping)
+	if ps.isUpstreamHealthy(flapping) {
+		t.Fatal("Expected the upstream to be unhealthy after its failure")
+	}
+
+	// The fourth would bring it back, but it is flapping
+	ps.recordUpstreamSuccess(flapping)
+	if ps.isUpstreamHealthy(flapping) {
+		t.Fatal("Expected the flapping upstream to be held down")
+	}
+	for i := 0; i < 5; i++ {
+		ps.recordUpstreamSuccess(flapping)
+	}
+	if ps.isUpstreamHealthy(flapping) {
+		t.Error("Expected successes during the hold-down to leave the upstream down")
+	}
+
+	metrics := ps.getHealthMetrics()["upstreams"].(map[string]interface{})[flapping].(map[string]interface{})
+	if metrics["flapping"] != true {
+		t.Errorf("Expected health metrics to report the upstream as flapping, got %v", metrics)
+	}
+
+	// Once the hold-down is over, the next success restores it
+	ps.healthMutex.Lock()
+	ps.upstreamHealth[flapping].HeldDownUntil = time.Now().Add(-time.Second)
+	ps.healthMutex.Unlock()
+	ps.recordUpstreamSuccess(flapping)
+	if !ps.isUpstreamHealthy(flapping) {
+		t.Error("Expected the upstream to recover after its hold-down")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Selection strategies for server.strategy
+const (
+	strategyRoundRobin     = "round_robin"
+	strategyConsistentHash = "consistent_hash"
+	strategyLeastLatency   = "least_latency"
+	strategySmoothWeighted = "smooth_weighted"
+)
+
+// hashRingReplicas is the number of points per unit of weight on the ring;
+// enough to spread targets evenly across a handful of upstreams
+const hashRingReplicas = 40
+
+// maxCachedRings bounds the ring cache; each distinct candidate set (tag,
+// health state) gets its own ring
+const maxCachedRings = 64
+
+// hashRing maps hashed targets to upstreams. Each upstream owns
+// hashRingReplicas points per unit of weight, so removing one upstream only
+// moves the targets it owned.
+type hashRing struct {
+	points []uint32
+	owners []string
+}
+
+func newHashRing(upstreams []WeightedUpstream) *hashRing {
+	type point struct {
+		hash  uint32
+		owner string
+	}
+	var points []point
+	for _, upstream := range upstreams {
+		for i := 0; i < max(upstream.Weight, 1)*hashRingReplicas; i++ {
+			points = append(points, point{hash: hashKey(upstream.URL + "#" + strconv.Itoa(i)), owner: upstream.URL})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	ring := &hashRing{
+		points: make([]uint32, len(points)),
+		owners: make([]string, len(points)),
+	}
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+	return ring
+}
+
+// lookup returns the upstream owning the first point at or after key's hash
+func (hr *hashRing) lookup(key string) string {
+	if len(hr.points) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= hash })
+	if i == len(hr.points) {
+		i = 0
+	}
+	return hr.owners[i]
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// hashRings caches rings by candidate set, so a ring is only rebuilt when
+// membership or configured weights change. Its mutex is a leaf.
+type hashRings struct {
+	mutex sync.Mutex
+	rings map[string]*hashRing
+}
+
+func (hr *hashRings) get(upstreams []WeightedUpstream) *hashRing {
+	var signature strings.Builder
+	for _, upstream := range upstreams {
+		fmt.Fprintf(&signature, "%s=%d;", upstream.URL, upstream.Weight)
+	}
+	key := signature.String()
+
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	if ring, exists := hr.rings[key]; exists {
+		return ring
+	}
+	if hr.rings == nil || len(hr.rings) >= maxCachedRings {
+		hr.rings = make(map[string]*hashRing)
+	}
+	ring := newHashRing(upstreams)
+	hr.rings[key] = ring
+	return ring
+}
+
+func (hr *hashRings) reset() {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	hr.rings = nil
+}
+
+// hashTarget reduces a CONNECT target to the host it is keyed on, so
+// example.com:443 and example.com:80 share an upstream
+func hashTarget(target string) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	return strings.ToLower(host)
+}
+
+// selectHashedUpstream picks the upstream that owns target on the ring of
+// candidates. The ring uses the configured weights: health scores, capacity
+// hints and slow start adjust weights from one CONNECT to the next, which
+// would rebuild the ring and move targets, so only membership counts.
+// Caller must hold ps.mutex (read).
+func (ps *ProxyServer) selectHashedUpstream(upstreams []WeightedUpstream, target string) string {
+	if len(upstreams) == 1 {
+		return upstreams[0].URL
+	}
+
+	configured := make(map[string]int, len(ps.weightedUpstreams))
+	for _, weighted := range ps.weightedUpstreams {
+		configured[weighted.URL] = weighted.Weight
+	}
+	members := make([]WeightedUpstream, len(upstreams))
+	for i, upstream := range upstreams {
+		members[i] = upstream
+		if weight, exists := configured[upstream.URL]; exists {
+			members[i].Weight = weight
+		}
+	}
+	return ps.rings.get(members).lookup(hashTarget(target))
+}
+
+// strategyName returns strategy, or the default round_robin when unset
+func strategyName(strategy string) string {
+	if strategy == "" {
+		return strategyRoundRobin
+	}
+	return strategy
+}
+
+// validateStrategy rejects unknown selection strategies
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case "", strategyRoundRobin, strategyConsistentHash, strategyLeastLatency, strategySmoothWeighted:
+		return nil
+	}
+	return fmt.Errorf("server.strategy must be %q, %q, %q or %q, got %q",
+		strategyRoundRobin, strategyConsistentHash, strategyLeastLatency, strategySmoothWeighted, strategy)
+}
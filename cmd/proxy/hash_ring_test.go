@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestConsistentHashSelection tests that a target host keeps its upstream
+// while healthy, and that a failing upstream only moves its own targets
+func TestConsistentHashSelection(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{Strategy: strategyConsistentHash},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9701", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9702", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9703", Enabled: true, Weight: 2},
+			{URL: "http://127.0.0.1:9704", Enabled: true, Weight: 1},
+		},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+
+	targets := make([]string, 200)
+	for i := range targets {
+		targets[i] = fmt.Sprintf("host-%d.example.com:443", i)
+	}
+
+	before := make(map[string]string)
+	counts := make(map[string]int)
+	for _, target := range targets {
+		upstream, _ := ps.selectUpstreamFor(target, "")
+		before[target] = upstream
+		counts[upstream]++
+	}
+	if len(counts) != 4 {
+		t.Errorf("Expected targets spread over all 4 upstreams, got %v", counts)
+	}
+
+	// Repeated selections and other ports of the same host stay put
+	for _, target := range targets {
+		for i := 0; i < 3; i++ {
+			if upstream, _ := ps.selectUpstreamFor(target, ""); upstream != before[target] {
+				t.Fatalf("Expected %s to stay on %s, got %s", target, before[target], upstream)
+			}
+		}
+	}
+	if upstream, _ := ps.selectUpstreamFor("host-7.example.com:80", ""); upstream != before["host-7.example.com:443"] {
+		t.Errorf("Expected the port to be ignored, got %s for :80 and %s for :443", upstream, before["host-7.example.com:443"])
+	}
+
+	failed := "http://127.0.0.1:9702"
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure(failed)
+	}
+
+	moved := 0
+	for _, target := range targets {
+		upstream, _ := ps.selectUpstreamFor(target, "")
+		if upstream == failed {
+			t.Fatalf("Expected %s to leave the failed upstream", target)
+		}
+		if before[target] != failed && upstream != before[target] {
+			t.Errorf("Expected %s to stay on healthy %s, moved to %s", target, before[target], upstream)
+		}
+		if upstream != before[target] {
+			moved++
+		}
+	}
+	if moved != counts[failed] {
+		t.Errorf("Expected only the %d targets of the failed upstream to move, %d moved", counts[failed], moved)
+	}
+}
+
+// TestStrategyValidation tests that unknown strategies are rejected
+func TestStrategyValidation(t *testing.T) {
+	if err := validateConfig(&Config{Server: ServerConfig{Strategy: "random"}}); err == nil {
+		t.Error("Expected unknown strategy to be rejected")
+	}
+}
+
+// TestConsistentHashIgnoresAdjustedWeights tests that weights adjusted for a
+// single selection do not move targets to another upstream
+func TestConsistentHashIgnoresAdjustedWeights(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{Strategy: strategyConsistentHash},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9705", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9706", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9707", Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	configured := append([]WeightedUpstream(nil), ps.weightedUpstreams...)
+	// As health scores would scale them
+	adjusted := append([]WeightedUpstream(nil), configured...)
+	adjusted[0].Weight, adjusted[1].Weight, adjusted[2].Weight = 100, 37, 84
+
+	for i := 0; i < 100; i++ {
+		target := fmt.Sprintf("host-%d.example.com:443", i)
+		if want, got := ps.selectHashedUpstream(configured, target), ps.selectHashedUpstream(adjusted, target); got != want {
+			t.Fatalf("Expected %s to stay on %s with adjusted weights, got %s", target, want, got)
+		}
+	}
+	ps.rings.mutex.Lock()
+	rings := len(ps.rings.rings)
+	ps.rings.mutex.Unlock()
+	if rings != 1 {
+		t.Errorf("Expected one ring for one candidate set, got %d", rings)
+	}
+}
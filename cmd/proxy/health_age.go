@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// reverifications tracks the stale upstreams being re-checked, so selection
+// starts at most one check per upstream at a time. Its mutex is a leaf.
+type reverifications struct {
+	mutex    sync.Mutex
+	inFlight map[string]bool
+}
+
+// start reports whether a check of upstream may begin, marking it in flight
+func (rv *reverifications) start(upstream string) bool {
+	rv.mutex.Lock()
+	defer rv.mutex.Unlock()
+
+	if rv.inFlight[upstream] {
+		return false
+	}
+	if rv.inFlight == nil {
+		rv.inFlight = make(map[string]bool)
+	}
+	rv.inFlight[upstream] = true
+	return true
+}
+
+func (rv *reverifications) done(upstream string) {
+	rv.mutex.Lock()
+	defer rv.mutex.Unlock()
+	delete(rv.inFlight, upstream)
+}
+
+// lastVerified returns when upstream last proved to work: its latest
+// successful health check or successful CONNECT. Upstreams never used
+// count from when they were added. Caller must hold ps.mutex (read) and
+// ps.healthMutex (read).
+func (ps *ProxyServer) lastVerified(upstream string, health *UpstreamHealth) time.Time {
+	last := health.LastSuccess
+	if metric, exists := ps.stats.UpstreamMetrics[upstream]; exists && metric.LastRequest.After(last) {
+		last = metric.LastRequest
+	}
+	if last.IsZero() {
+		last = health.AddedAt
+	}
+	return last
+}
+
+// preferVerified drops healthy upstreams that have not proved to work
+// within max_health_age_seconds, unless every candidate is that stale, and
+// starts a re-check of each stale one. Caller must hold ps.mutex (read).
+func (ps *ProxyServer) preferVerified(upstreams []WeightedUpstream) []WeightedUpstream {
+	maxAge := time.Duration(ps.config.HealthCheck.MaxHealthAgeSeconds) * time.Second
+	if maxAge <= 0 || len(upstreams) == 0 {
+		return upstreams
+	}
+
+	now := time.Now()
+	verified := make([]WeightedUpstream, 0, len(upstreams))
+	var stale []string
+	ps.healthMutex.RLock()
+	for _, upstream := range upstreams {
+		health, exists := ps.upstreamHealth[upstream.URL]
+		if exists && now.Sub(ps.lastVerified(upstream.URL, health)) > maxAge {
+			stale = append(stale, upstream.URL)
+			continue
+		}
+		verified = append(verified, upstream)
+	}
+	ps.healthMutex.RUnlock()
+
+	for _, upstream := range stale {
+		ps.reverifyUpstream(upstream)
+	}
+	if len(verified) == 0 {
+		return upstreams
+	}
+	return verified
+}
+
+// reverifyUpstream runs one health check of a stale upstream in the
+// background, when active health checks are enabled. Caller must hold
+// ps.mutex (read).
+func (ps *ProxyServer) reverifyUpstream(upstream string) {
+	hc := ps.healthChecker
+	if hc == nil || !ps.reverifying.start(upstream) {
+		return
+	}
+	config := ps.config
+	go func() {
+		defer ps.reverifying.done(upstream)
+		hc.processHealthCheckResult(hc.checkUpstreamHealth(upstream, config))
+	}()
+}
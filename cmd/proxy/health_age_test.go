@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ageUpstream moves every sign of life of upstream back by age
+func ageUpstream(ps *ProxyServer, upstream string, age time.Duration) {
+	past := time.Now().Add(-age)
+	ps.mutex.Lock()
+	ps.stats.UpstreamMetrics[upstream].LastRequest = past
+	ps.mutex.Unlock()
+	ps.healthMutex.Lock()
+	ps.upstreamHealth[upstream].LastSuccess = past
+	ps.upstreamHealth[upstream].AddedAt = past
+	ps.healthMutex.Unlock()
+}
+
+func TestMaxHealthAgeDeprioritizesStale(t *testing.T) {
+	stale := "http://127.0.0.1:9061"
+	fresh := "http://127.0.0.1:9062"
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: stale, Enabled: true, Weight: 1},
+			{URL: fresh, Enabled: true, Weight: 1},
+		},
+		HealthCheck: HealthCheckConfig{MaxHealthAgeSeconds: 60},
+	}
+	ps := NewProxyServer(config, "")
+	ageUpstream(ps, stale, 2*time.Minute)
+
+	for i := 0; i < 10; i++ {
+		if got := ps.getNextUpstream(); got != fresh {
+			t.Fatalf("Expected only the recently verified upstream, got %s", got)
+		}
+	}
+
+	// Once everything is stale, stale upstreams are better than none
+	ageUpstream(ps, fresh, 2*time.Minute)
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts[stale] == 0 || counts[fresh] == 0 {
+		t.Errorf("Expected both stale upstreams to share traffic, got %v", counts)
+	}
+}
+
+func TestMaxHealthAgeReverifies(t *testing.T) {
+	resolver := createMockIPResolverServer("203.0.113.10", 200, 0)
+	defer resolver.Close()
+	first := createMockProxyServer(resolver)
+	defer first.server.Close()
+	second := createMockProxyServer(resolver)
+	defer second.server.Close()
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: first.server.URL, Enabled: true, Weight: 1},
+			{URL: second.server.URL, Enabled: true, Weight: 1},
+		},
+		HealthCheck: HealthCheckConfig{
+			Enabled:             true,
+			IntervalSeconds:     3600,
+			Endpoints:           []string{resolver.URL},
+			MaxHealthAgeSeconds: 60,
+		},
+	}
+	ps := NewProxyServer(config, "")
+	defer ps.stopHealthChecker()
+
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("the first health check round", func() bool { return atomic.LoadInt64(&ps.healthCycles) > 0 })
+
+	// Selection skips the stale upstream and has it checked again
+	ageUpstream(ps, first.server.URL, 2*time.Minute)
+	if got := ps.getNextUpstream(); got != second.server.URL {
+		t.Fatalf("Expected the stale upstream to be skipped, got %s", got)
+	}
+	waitFor("the stale upstream to be re-verified", func() bool {
+		ps.healthMutex.RLock()
+		defer ps.healthMutex.RUnlock()
+		return time.Since(ps.upstreamHealth[first.server.URL].LastSuccess) < time.Minute
+	})
+
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts[first.server.URL] == 0 {
+		t.Errorf("Expected the re-verified upstream back in rotation, got %v", counts)
+	}
+}
@@ -74,24 +74,10 @@ func TestHealthCheckWithRealProxyServers(t *testing.T) {
 		defer proxyServer.Close()
 
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-				Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: proxyServer.URL, Enabled: true, Weight: 1, Tag: "test"},
 			},
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled:           true,
 				IntervalSeconds:   2, // Fast for testing
 				TimeoutSeconds:    5,
@@ -155,24 +141,10 @@ func TestHealthCheckWithRealProxyServers(t *testing.T) {
 		defer proxyServer.Close()
 
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-				Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: proxyServer.URL, Enabled: true, Weight: 1},
 			},
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled:           true,
 				IntervalSeconds:   1, // Very fast for testing
 				TimeoutSeconds:    3,
@@ -239,24 +211,10 @@ func TestHealthCheckWithRealProxyServers(t *testing.T) {
 		defer proxyServer.Close()
 
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-				Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: proxyServer.URL, Enabled: true, Weight: 1},
 			},
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled:          true,
 				IntervalSeconds:  1,
 				TimeoutSeconds:   3,
@@ -308,24 +266,10 @@ func TestHealthCheckConfigurationIntegration(t *testing.T) {
 
 		// Start with health checks disabled
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-				Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: proxyServer.URL, Enabled: true, Weight: 1},
 			},
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled: false,
 			},
 		}
@@ -398,24 +342,10 @@ func TestHealthCheckStatsIntegration(t *testing.T) {
 		defer proxyServer.Close()
 
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-				Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: proxyServer.URL, Enabled: true, Weight: 1, Tag: "integration-test"},
 			},
-			HealthCheck: struct {
-				Enabled          bool     `json:"enabled"`
-				IntervalSeconds  int      `json:"interval_seconds"`
-				TimeoutSeconds   int      `json:"timeout_seconds"`
-				FailureThreshold int      `json:"failure_threshold"`
-				RecoveryThreshold int     `json:"recovery_threshold"`
-				Endpoints        []string `json:"endpoints"`
-				EndpointRotation bool     `json:"endpoint_rotation"`
-			}{
+			HealthCheck: HealthCheckConfig{
 				Enabled:           true,
 				IntervalSeconds:   1,
 				TimeoutSeconds:    3,
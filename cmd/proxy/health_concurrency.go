@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// endpointSlots caps the health check requests outstanding against each
+// resolver endpoint, so checking many upstreams in parallel cannot send
+// them all to the same endpoint at once
+type endpointSlots struct {
+	mutex sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// acquire blocks until endpoint has fewer than limit requests outstanding
+// and returns the function that gives the slot back. A limit of 0 or less
+// means no cap.
+func (es *endpointSlots) acquire(endpoint string, limit int) func() {
+	if limit <= 0 {
+		return func() {}
+	}
+
+	es.mutex.Lock()
+	if es.slots == nil {
+		es.slots = make(map[string]chan struct{})
+	}
+	slots, exists := es.slots[endpoint]
+	// A reload may change the cap; requests holding old slots drain them
+	if !exists || cap(slots) != limit {
+		slots = make(chan struct{}, limit)
+		es.slots[endpoint] = slots
+	}
+	es.mutex.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// checkAll runs check for every upstream, at most concurrency at a time
+func checkAll(upstreams []string, concurrency int, check func(upstream string)) {
+	if concurrency <= 1 {
+		for _, upstream := range upstreams {
+			check(upstream)
+		}
+		return
+	}
+
+	workers := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, upstream := range upstreams {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(upstream string) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			check(upstream)
+		}(upstream)
+	}
+	wg.Wait()
+}
+
+// validateHealthConcurrency checks the health check concurrency settings
+func validateHealthConcurrency(healthCheck HealthCheckConfig) error {
+	if healthCheck.Concurrency < 0 {
+		return fmt.Errorf("health_check.concurrency must not be negative, got %d", healthCheck.Concurrency)
+	}
+	if healthCheck.MaxPerEndpoint < 0 {
+		return fmt.Errorf("health_check.max_per_endpoint must not be negative, got %d", healthCheck.MaxPerEndpoint)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyTracker records the most requests a handler served at once
+type concurrencyTracker struct {
+	mutex   sync.Mutex
+	current int
+	peak    int
+}
+
+func (ct *concurrencyTracker) enter() {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	ct.current++
+	ct.peak = max(ct.peak, ct.current)
+}
+
+func (ct *concurrencyTracker) leave() {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	ct.current--
+}
+
+func TestHealthCheckPerEndpointCap(t *testing.T) {
+	const (
+		upstreamCount  = 12
+		maxPerEndpoint = 2
+	)
+
+	var endpoints []string
+	var trackers []*concurrencyTracker
+	for i := 0; i < 2; i++ {
+		tracker := &concurrencyTracker{}
+		resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tracker.enter()
+			defer tracker.leave()
+			time.Sleep(50 * time.Millisecond)
+			json.NewEncoder(w).Encode(IPResponse{IP: "203.0.113.10"})
+		}))
+		defer resolver.Close()
+		endpoints = append(endpoints, resolver.URL)
+		trackers = append(trackers, tracker)
+	}
+
+	// Forward proxies that relay the plain HTTP health check GET
+	var upstreams []UpstreamProxyConfig
+	for i := 0; i < upstreamCount; i++ {
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resp, err := http.Get(r.URL.String())
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}))
+		defer proxy.Close()
+		upstreams = append(upstreams, UpstreamProxyConfig{URL: proxy.URL, Enabled: true, Weight: 1})
+	}
+
+	config := &Config{
+		UpstreamProxies: upstreams,
+		HealthCheck: HealthCheckConfig{
+			TimeoutSeconds:    5,
+			FailureThreshold:  1,
+			RecoveryThreshold: 1,
+			Endpoints:         endpoints,
+			EndpointRotation:  true,
+			Concurrency:       upstreamCount,
+			MaxPerEndpoint:    maxPerEndpoint,
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	// Run one round by hand rather than through the background checker
+	config.HealthCheck.Enabled = true
+	hc := &HealthChecker{proxyServer: ps}
+	hc.performHealthChecks()
+
+	for i, tracker := range trackers {
+		if tracker.peak > maxPerEndpoint {
+			t.Errorf("Endpoint %d served %d checks at once, cap is %d", i, tracker.peak, maxPerEndpoint)
+		}
+		if tracker.peak == 0 {
+			t.Errorf("Endpoint %d was never checked against", i)
+		}
+	}
+	for _, upstream := range upstreams {
+		if !ps.isUpstreamHealthy(upstream.URL) {
+			t.Errorf("Expected %s to pass its check", upstream.URL)
+		}
+	}
+}
+
+func TestEndpointSlotsNoCap(t *testing.T) {
+	var es endpointSlots
+	releases := make([]func(), 0, 10)
+	for i := 0; i < 10; i++ {
+		releases = append(releases, es.acquire("http://resolver", 0))
+	}
+	for _, release := range releases {
+		release()
+	}
+}
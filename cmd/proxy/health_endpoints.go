@@ -0,0 +1,47 @@
+package main
+
+// endpointTally counts health check outcomes per resolver endpoint, so a
+// flaky endpoint can be told apart from flaky upstreams
+type endpointTally struct {
+	SuccessCount int64 `json:"success_count"`
+	FailureCount int64 `json:"failure_count"`
+}
+
+// recordCheckEndpoint notes which endpoint checked upstream and tallies the
+// outcome against that endpoint
+func (ps *ProxyServer) recordCheckEndpoint(upstream, endpoint string, success bool) {
+	if endpoint == "" {
+		return
+	}
+
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	if health, exists := ps.upstreamHealth[upstream]; exists {
+		health.LastCheckEndpoint = endpoint
+	}
+
+	if ps.endpointTallies == nil {
+		ps.endpointTallies = make(map[string]*endpointTally)
+	}
+	tally, exists := ps.endpointTallies[endpoint]
+	if !exists {
+		tally = &endpointTally{}
+		ps.endpointTallies[endpoint] = tally
+	}
+	if success {
+		tally.SuccessCount++
+	} else {
+		tally.FailureCount++
+	}
+}
+
+// endpointTallySnapshot copies the per-endpoint tallies. Caller must hold
+// ps.healthMutex.
+func (ps *ProxyServer) endpointTallySnapshot() map[string]endpointTally {
+	snapshot := make(map[string]endpointTally, len(ps.endpointTallies))
+	for endpoint, tally := range ps.endpointTallies {
+		snapshot[endpoint] = *tally
+	}
+	return snapshot
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -10,22 +13,12 @@ import (
 func TestUpstreamHealthTracking(t *testing.T) {
 	t.Run("FailureCountTracking", func(t *testing.T) {
 		config := &Config{
-			Server: struct {
-				Name          string `json:"name"`
-				ListenAddress string `json:"listen_address"`
-				StatsEndpoint string `json:"stats_endpoint"`
-			}{
+			Server: ServerConfig{
 				Name:          "Test Proxy",
 				ListenAddress: "127.0.0.1:3150",
 				StatsEndpoint: "/stats",
 			},
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9020", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9021", Enabled: true, Weight: 1},
 			},
@@ -60,13 +53,7 @@ func TestUpstreamHealthTracking(t *testing.T) {
 
 	t.Run("HealthStatusTracking", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9022", Enabled: true, Weight: 1},
 			},
 		}
@@ -98,13 +85,7 @@ func TestUpstreamHealthTracking(t *testing.T) {
 
 	t.Run("HealthRecovery", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9023", Enabled: true, Weight: 1},
 			},
 		}
@@ -137,13 +118,7 @@ func TestUpstreamHealthTracking(t *testing.T) {
 func TestUpstreamFailover(t *testing.T) {
 	t.Run("SkipUnhealthyUpstreams", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9024", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9025", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9026", Enabled: true, Weight: 1},
@@ -179,13 +154,7 @@ func TestUpstreamFailover(t *testing.T) {
 
 	t.Run("AllUpstreamsUnhealthy", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9027", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9028", Enabled: true, Weight: 1},
 			},
@@ -216,13 +185,7 @@ func TestUpstreamFailover(t *testing.T) {
 
 	t.Run("FailoverWithWeights", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9029", Enabled: true, Weight: 3}, // High weight
 				{URL: "http://127.0.0.1:9030", Enabled: true, Weight: 1}, // Low weight
 				{URL: "http://127.0.0.1:9031", Enabled: true, Weight: 2}, // Medium weight
@@ -270,13 +233,7 @@ func TestHealthCheckInterval(t *testing.T) {
 	t.Skip("Periodic health checks not yet implemented - will be added during TDD")
 
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9032", Enabled: true, Weight: 1},
 		},
 	}
@@ -313,13 +270,7 @@ func TestHealthCheckInterval(t *testing.T) {
 // TestConcurrentHealthManagement tests health tracking under concurrent load
 func TestConcurrentHealthManagement(t *testing.T) {
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9033", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9034", Enabled: true, Weight: 1},
 		},
@@ -390,13 +341,7 @@ func TestCircuitBreakerBehavior(t *testing.T) {
 	t.Skip("Circuit breaker not yet implemented - will be added during TDD")
 
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9035", Enabled: true, Weight: 1},
 		},
 	}
@@ -456,13 +401,7 @@ func TestHealthMetricsExport(t *testing.T) {
 	t.Skip("Health metrics export not yet implemented - will be added during TDD")
 
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9036", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9037", Enabled: true, Weight: 1},
 		},
@@ -510,3 +449,326 @@ func TestHealthMetricsExport(t *testing.T) {
 	t.Logf("Health metrics: %+v", metrics)
 	t.Logf("Expected structure: %+v", expectedMetrics)
 }
+
+// TestSlowStartAfterRecovery tests that a recovered upstream ramps back up to
+// its configured share instead of immediately receiving full traffic
+func TestSlowStartAfterRecovery(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9038", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9039", Enabled: true, Weight: 1},
+		},
+		SlowStartSeconds: 60,
+	}
+
+	ps := NewProxyServer(config, "")
+	recovering := "http://127.0.0.1:9039"
+
+	// Take the upstream down and bring it back
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure(recovering)
+	}
+	if ps.isUpstreamHealthy(recovering) {
+		t.Fatal("Upstream should be unhealthy after failures")
+	}
+	ps.recordUpstreamSuccess(recovering)
+	if !ps.isUpstreamHealthy(recovering) {
+		t.Fatal("Upstream should be healthy after recovery")
+	}
+
+	share := func() float64 {
+		const selections = 4000
+		hits := 0
+		for i := 0; i < selections; i++ {
+			if ps.getNextUpstream() == recovering {
+				hits++
+			}
+		}
+		return float64(hits) / selections
+	}
+
+	// Rewind the recovery timestamp to simulate time passing through the window
+	setElapsed := func(elapsed time.Duration) {
+		ps.healthMutex.Lock()
+		ps.upstreamHealth[recovering].RecoveredAt = time.Now().Add(-elapsed)
+		ps.healthMutex.Unlock()
+	}
+
+	justRecovered := share()
+	setElapsed(30 * time.Second)
+	halfway := share()
+	setElapsed(2 * time.Minute)
+	fullyRamped := share()
+
+	t.Logf("Recovered upstream share - just recovered: %.3f, halfway: %.3f, after window: %.3f", justRecovered, halfway, fullyRamped)
+
+	// Weight 1 vs 100 right after recovery, 50 vs 100 halfway, 100 vs 100 after
+	if justRecovered > 0.02 {
+		t.Errorf("Just-recovered upstream should receive little traffic, got %.3f", justRecovered)
+	}
+	if halfway < 0.30 || halfway > 0.37 {
+		t.Errorf("Halfway through slow start upstream should get ~33%% of traffic, got %.3f", halfway)
+	}
+	if fullyRamped < 0.48 || fullyRamped > 0.52 {
+		t.Errorf("After slow start upstream should get its full ~50%% share, got %.3f", fullyRamped)
+	}
+	if !(justRecovered < halfway && halfway < fullyRamped) {
+		t.Error("Traffic share should increase monotonically over the slow start window")
+	}
+
+	// Scaling must not stretch the round-robin cycle: halfway the recovering
+	// upstream gets one of every three requests, and once ramped up the two
+	// upstreams alternate
+	order := func(n int) []string {
+		picks := make([]string, n)
+		for i := range picks {
+			picks[i] = ps.getNextUpstream()
+		}
+		return picks
+	}
+	setElapsed(30 * time.Second)
+	picks := order(6)
+	for i := 0; i < len(picks); i += 3 {
+		hits := 0
+		for _, pick := range picks[i : i+3] {
+			if pick == recovering {
+				hits++
+			}
+		}
+		if hits != 1 {
+			t.Errorf("Halfway through slow start expected 1 of every 3 requests on the recovering upstream, got order %v", picks)
+			break
+		}
+	}
+	setElapsed(2 * time.Minute)
+	picks = order(6)
+	for i := 1; i < len(picks); i++ {
+		if picks[i] == picks[i-1] {
+			t.Errorf("After slow start equally weighted upstreams should alternate, got order %v", picks)
+			break
+		}
+	}
+}
+
+// TestBackupUpstreamTier tests that backup upstreams only receive traffic
+// while every primary upstream is unhealthy
+func TestBackupUpstreamTier(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9040", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9041", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9042", Enabled: true, Weight: 1, Backup: true},
+		},
+	}
+
+	ps := NewProxyServer(config, "")
+	primary1 := "http://127.0.0.1:9040"
+	primary2 := "http://127.0.0.1:9041"
+	backup := "http://127.0.0.1:9042"
+
+	selectMany := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 100; i++ {
+			counts[ps.getNextUpstream()]++
+		}
+		return counts
+	}
+
+	// Backup stays idle while primaries are healthy
+	counts := selectMany()
+	if counts[backup] != 0 {
+		t.Errorf("Backup should be idle while primaries are healthy, got %d selections", counts[backup])
+	}
+	if counts[primary1] == 0 || counts[primary2] == 0 {
+		t.Errorf("Both primaries should receive traffic, got %v", counts)
+	}
+
+	// Fail both primaries
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure(primary1)
+		ps.recordUpstreamFailure(primary2)
+	}
+
+	counts = selectMany()
+	if counts[backup] != 100 {
+		t.Errorf("Backup should take all traffic when primaries are down, got %v", counts)
+	}
+
+	// Recover one primary: backup goes idle again
+	ps.recordUpstreamSuccess(primary1)
+
+	counts = selectMany()
+	if counts[backup] != 0 {
+		t.Errorf("Backup should go idle once a primary recovers, got %d selections", counts[backup])
+	}
+	if counts[primary1] != 100 {
+		t.Errorf("Recovered primary should take all traffic, got %v", counts)
+	}
+}
+
+// TestDegradedSelectionCounter tests that least-failed fallback selections are counted
+func TestDegradedSelectionCounter(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9043", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9044", Enabled: true, Weight: 1},
+		},
+	}
+
+	ps := NewProxyServer(config, "")
+
+	// Healthy selections do not count as degraded
+	for i := 0; i < 10; i++ {
+		ps.getNextUpstream()
+	}
+	if degraded := atomic.LoadInt64(&ps.stats.DegradedSelections); degraded != 0 {
+		t.Fatalf("Expected no degraded selections while healthy, got %d", degraded)
+	}
+
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure("http://127.0.0.1:9043")
+	}
+	for i := 0; i < 4; i++ {
+		ps.recordUpstreamFailure("http://127.0.0.1:9044")
+	}
+
+	for i := 0; i < 25; i++ {
+		if upstream := ps.getNextUpstream(); upstream != "http://127.0.0.1:9043" {
+			t.Fatalf("Expected fallback to least-failed upstream, got %q", upstream)
+		}
+	}
+	if degraded := atomic.LoadInt64(&ps.stats.DegradedSelections); degraded != 25 {
+		t.Errorf("Expected 25 degraded selections, got %d", degraded)
+	}
+
+	// A tag no upstream carries selects nothing, which is not a degraded pick
+	if upstream, _ := ps.selectUpstream("missing"); upstream != "" {
+		t.Fatalf("Expected no upstream for an unknown tag, got %q", upstream)
+	}
+	if degraded := atomic.LoadInt64(&ps.stats.DegradedSelections); degraded != 25 {
+		t.Errorf("Expected an empty selection not to count as degraded, got %d", degraded)
+	}
+
+	// Counter is exposed in /stats
+	recorder := httptest.NewRecorder()
+	ps.handleStats(recorder, httptest.NewRequest("GET", "/stats", nil))
+	var stats struct {
+		DegradedSelections int64 `json:"degraded_selections_total"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if stats.DegradedSelections != 25 {
+		t.Errorf("Expected degraded_selections_total 25 in /stats, got %d", stats.DegradedSelections)
+	}
+}
+
+// TestFailureCoalescing tests that a burst of failures within
+// failure_coalesce_ms counts as one strike
+func TestFailureCoalescing(t *testing.T) {
+	upstream := "http://127.0.0.1:9801"
+	newServer := func(coalesceMs int) *ProxyServer {
+		return NewProxyServer(&Config{
+			HealthCheck:     HealthCheckConfig{FailureCoalesceMs: coalesceMs},
+			UpstreamProxies: []UpstreamProxyConfig{{URL: upstream, Enabled: true, Weight: 1}},
+		}, "")
+	}
+
+	plain := newServer(0)
+	coalescing := newServer(200)
+	for i := 0; i < 5; i++ {
+		plain.recordUpstreamFailure(upstream)
+		coalescing.recordUpstreamFailure(upstream)
+	}
+
+	if plain.isUpstreamHealthy(upstream) {
+		t.Error("Expected a burst of 5 failures to trip the upstream without coalescing")
+	}
+	if !coalescing.isUpstreamHealthy(upstream) {
+		t.Error("Expected a coalesced burst to leave the upstream healthy")
+	}
+	if failures := coalescing.getUpstreamFailureCount(upstream); failures != 1 {
+		t.Errorf("Expected the burst to count as 1 failure, got %d", failures)
+	}
+	coalescing.healthMutex.RLock()
+	coalesced := coalescing.upstreamHealth[upstream].CoalescedFailures
+	coalescing.healthMutex.RUnlock()
+	if coalesced != 4 {
+		t.Errorf("Expected 4 coalesced failures, got %d", coalesced)
+	}
+
+	// A failure after the window is a new strike; a sustained outage
+	// still trips the upstream one window at a time
+	for i := 0; i < 2; i++ {
+		time.Sleep(250 * time.Millisecond)
+		coalescing.recordUpstreamFailure(upstream)
+	}
+	if coalescing.isUpstreamHealthy(upstream) {
+		t.Errorf("Expected 3 strikes across windows to trip the upstream, got %d failures",
+			coalescing.getUpstreamFailureCount(upstream))
+	}
+}
+
+func TestUpstreamPriorityFallbackOrder(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9043", Enabled: true, Weight: 1, Priority: 3},
+			{URL: "http://127.0.0.1:9044", Enabled: true, Weight: 1, Priority: 1},
+			{URL: "http://127.0.0.1:9045", Enabled: true, Weight: 1, Priority: 2},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	// Priority 1 has failed the most, but priority outranks failure counts
+	for i := 0; i < 5; i++ {
+		ps.recordUpstreamFailure("http://127.0.0.1:9044")
+	}
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure("http://127.0.0.1:9043")
+		ps.recordUpstreamFailure("http://127.0.0.1:9045")
+	}
+
+	// Take each pick out of the running to see the next in line
+	for _, want := range []string{"http://127.0.0.1:9044", "http://127.0.0.1:9045", "http://127.0.0.1:9043"} {
+		if got := ps.getNextUpstream(); got != want {
+			t.Fatalf("Expected the fallback to pick %s, got %s", want, got)
+		}
+		ps.mutex.Lock()
+		for i := range ps.weightedUpstreams {
+			if ps.weightedUpstreams[i].URL == want {
+				ps.weightedUpstreams[i].Weight = 0
+			}
+		}
+		ps.mutex.Unlock()
+	}
+}
+
+func TestBackupTierPriority(t *testing.T) {
+	primary := "http://127.0.0.1:9046"
+	second := "http://127.0.0.1:9047"
+	first := "http://127.0.0.1:9048"
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: primary, Enabled: true, Weight: 1},
+			{URL: second, Enabled: true, Weight: 1, Backup: true, Priority: 2},
+			{URL: first, Enabled: true, Weight: 1, Backup: true, Priority: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure(primary)
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := ps.getNextUpstream(); got != first {
+			t.Fatalf("Expected the priority 1 backup while it is healthy, got %s", got)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure(first)
+	}
+	if got := ps.getNextUpstream(); got != second {
+		t.Errorf("Expected the priority 2 backup once priority 1 is down, got %s", got)
+	}
+}
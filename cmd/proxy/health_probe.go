@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Health probe modes for upstream_proxies[].health_probe.mode
+const (
+	// probeModeTunnel fetches the health_check endpoints (IP resolvers)
+	// through the upstream; the default
+	probeModeTunnel = "tunnel"
+	// probeModeForward sends a plain GET for an http:// URL through the
+	// upstream, without a CONNECT
+	probeModeForward = "forward"
+	// probeModeDirect requests a provider health URL, or a path on the
+	// upstream's own address, without going through the upstream
+	probeModeDirect = "direct"
+)
+
+// HealthProbeConfig replaces the IP resolver check of an upstream with a
+// lighter request that only has to return the expected status. It suits
+// providers that rate-limit CONNECTs or offer a health URL of their own.
+type HealthProbeConfig struct {
+	Mode string `json:"mode,omitempty"`
+	// URL is the address to request. In direct mode a path such as
+	// "/health" is resolved against the upstream's own address.
+	URL string `json:"url,omitempty"`
+	// ExpectStatus is the status that passes the probe (default: any 2xx)
+	ExpectStatus int `json:"expect_status,omitempty"`
+}
+
+// usesHealthProbe reports whether proxy replaces the IP resolver check
+// with a forward or direct probe
+func (proxy UpstreamProxyConfig) usesHealthProbe() bool {
+	return proxy.HealthProbe.Mode != "" && proxy.HealthProbe.Mode != probeModeTunnel
+}
+
+// probeUpstream runs the forward or direct health probe of an upstream
+func (hc *HealthChecker) probeUpstream(proxy UpstreamProxyConfig, config *Config) HealthCheckResult {
+	startTime := time.Now()
+	probe := proxy.HealthProbe
+	result := HealthCheckResult{Upstream: proxy.URL, Timestamp: startTime}
+
+	target, client, err := hc.probeClient(proxy, config)
+	result.Endpoint = target
+	if err != nil {
+		result.Error = fmt.Errorf("failed to create probe client: %v", err)
+		return result
+	}
+
+	resp, err := client.Get(target)
+	result.Latency = time.Since(startTime)
+	if err != nil {
+		result.Error = fmt.Errorf("health probe request failed: %v", err)
+		return result
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if probe.ExpectStatus != 0 && resp.StatusCode != probe.ExpectStatus {
+		result.Error = fmt.Errorf("health probe returned status %d, expected %d", resp.StatusCode, probe.ExpectStatus)
+		return result
+	}
+	if probe.ExpectStatus == 0 && resp.StatusCode/100 != 2 {
+		result.Error = fmt.Errorf("health probe returned status %d", resp.StatusCode)
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// probeClient resolves the probe URL and builds the client to request it:
+// through the upstream in forward mode, straight to it in direct mode
+func (hc *HealthChecker) probeClient(proxy UpstreamProxyConfig, config *Config) (string, *http.Client, error) {
+	target := proxy.HealthProbe.URL
+	if proxy.HealthProbe.Mode == probeModeForward {
+		client, err := hc.createProxyClient(proxy.URL, config)
+		return target, client, err
+	}
+
+	if strings.HasPrefix(target, "/") {
+		host, _, err := parseUpstreamAuth(proxy.URL)
+		if err != nil {
+			return target, nil, err
+		}
+		scheme, _, _ := strings.Cut(proxy.URL, "://")
+		target = scheme + "://" + host + target
+	}
+
+	timeout := 10 * time.Second
+	if config.HealthCheck.TimeoutSeconds > 0 {
+		timeout = time.Duration(config.HealthCheck.TimeoutSeconds) * time.Second
+	}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: proxy.TLSInsecureSkipVerify,
+		},
+	}
+	return target, &http.Client{
+		Transport:     transport,
+		Timeout:       timeout,
+		CheckRedirect: checkRedirectPolicy(config.HealthCheck),
+	}, nil
+}
+
+// validateHealthProbe checks an upstream's health_probe settings
+func validateHealthProbe(upstream UpstreamProxyConfig) error {
+	probe := upstream.HealthProbe
+	switch probe.Mode {
+	case "", probeModeTunnel:
+		return nil
+	case probeModeForward:
+		// An https:// URL would make the client tunnel with CONNECT after all
+		if !strings.HasPrefix(probe.URL, "http://") {
+			return fmt.Errorf("upstream %s: health_probe.url must be an http:// URL in forward mode, got %q", upstream.URL, probe.URL)
+		}
+	case probeModeDirect:
+		if !strings.HasPrefix(probe.URL, "/") && !strings.HasPrefix(probe.URL, "http://") && !strings.HasPrefix(probe.URL, "https://") {
+			return fmt.Errorf("upstream %s: health_probe.url must be a path or an http(s):// URL in direct mode, got %q", upstream.URL, probe.URL)
+		}
+	default:
+		return fmt.Errorf("upstream %s: health_probe.mode must be %q, %q or %q, got %q",
+			upstream.URL, probeModeTunnel, probeModeForward, probeModeDirect, probe.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// TestHealthProbe tests forward probes through an upstream without CONNECT
+// and direct probes of a path on the upstream itself
+func TestHealthProbe(t *testing.T) {
+	var mutex sync.Mutex
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		seen = append(seen, r.Method+" "+r.RequestURI)
+		mutex.Unlock()
+		switch r.RequestURI {
+		case "http://probe.example/ok", "/provider/health":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		probe   HealthProbeConfig
+		success bool
+		request string
+	}{
+		{"Forward", HealthProbeConfig{Mode: probeModeForward, URL: "http://probe.example/ok"}, true, "GET http://probe.example/ok"},
+		{"ForwardFailing", HealthProbeConfig{Mode: probeModeForward, URL: "http://probe.example/down"}, false, "GET http://probe.example/down"},
+		{"DirectPath", HealthProbeConfig{Mode: probeModeDirect, URL: "/provider/health"}, true, "GET /provider/health"},
+		{"ExpectStatus", HealthProbeConfig{Mode: probeModeDirect, URL: "/provider/health", ExpectStatus: http.StatusOK}, false, "GET /provider/health"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				HealthCheck: HealthCheckConfig{TimeoutSeconds: 2},
+				UpstreamProxies: []UpstreamProxyConfig{
+					{URL: upstream.URL, Enabled: true, Weight: 1, HealthProbe: tt.probe},
+				},
+			}
+			if err := validateConfig(config); err != nil {
+				t.Fatalf("Expected valid config, got %v", err)
+			}
+			hc := NewHealthChecker(NewProxyServer(config, ""))
+
+			mutex.Lock()
+			seen = nil
+			mutex.Unlock()
+			result := hc.checkUpstreamHealth(upstream.URL, config)
+			if result.Success != tt.success {
+				t.Errorf("Expected success %v, got %v (%v)", tt.success, result.Success, result.Error)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(seen) != 1 || seen[0] != tt.request {
+				t.Errorf("Expected the upstream to see only %q, got %v", tt.request, seen)
+			}
+		})
+	}
+
+	for _, probe := range []HealthProbeConfig{
+		{Mode: probeModeForward, URL: "https://probe.example/ok"},
+		{Mode: probeModeDirect, URL: "provider/health"},
+		{Mode: "ping"},
+	} {
+		config := &Config{UpstreamProxies: []UpstreamProxyConfig{{URL: upstream.URL, Enabled: true, HealthProbe: probe}}}
+		if err := validateConfig(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", probe)
+		}
+	}
+}
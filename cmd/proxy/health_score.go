@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Default health score weights and recency window
+const (
+	defaultScoreSuccessWeight  = 0.5
+	defaultScoreLatencyWeight  = 0.3
+	defaultScoreRecencyWeight  = 0.2
+	defaultScoreRecencySeconds = 300
+)
+
+// HealthScoreConfig controls the 0-100 health score reported per upstream
+type HealthScoreConfig struct {
+	// SuccessWeight, LatencyWeight and RecencyWeight set the relative
+	// importance of each input; all zero selects 0.5/0.3/0.2
+	SuccessWeight float64 `json:"success_weight,omitempty"`
+	LatencyWeight float64 `json:"latency_weight,omitempty"`
+	RecencyWeight float64 `json:"recency_weight,omitempty"`
+	// RecencySeconds is how long after its last failure an upstream earns
+	// full recency credit (default 300)
+	RecencySeconds int `json:"recency_seconds,omitempty"`
+	// ApplyToSelection scales each upstream's weight by its score
+	ApplyToSelection bool `json:"apply_to_selection,omitempty"`
+}
+
+// weights returns the success, latency and recency weights
+func (c HealthScoreConfig) weights() (float64, float64, float64) {
+	if c.SuccessWeight <= 0 && c.LatencyWeight <= 0 && c.RecencyWeight <= 0 {
+		return defaultScoreSuccessWeight, defaultScoreLatencyWeight, defaultScoreRecencyWeight
+	}
+	return math.Max(c.SuccessWeight, 0), math.Max(c.LatencyWeight, 0), math.Max(c.RecencyWeight, 0)
+}
+
+func (c HealthScoreConfig) recencyWindow() time.Duration {
+	if c.RecencySeconds <= 0 {
+		return defaultScoreRecencySeconds * time.Second
+	}
+	return time.Duration(c.RecencySeconds) * time.Second
+}
+
+// healthScoreInputs are the observations a health score is computed from
+type healthScoreInputs struct {
+	Successes   int64
+	Failures    int64
+	AvgLatency  float64 // this upstream's average latency in ms
+	PeerLatency float64 // mean average latency across upstreams in ms
+	LastFailure time.Time
+}
+
+// score combines success rate, latency relative to peers and time since the
+// last failure into a value between 0 and 100. Inputs without data (no
+// requests, no latency samples, no failures) count as perfect.
+func (c HealthScoreConfig) score(in healthScoreInputs, now time.Time) float64 {
+	successRate := 1.0
+	if total := in.Successes + in.Failures; total > 0 {
+		successRate = float64(in.Successes) / float64(total)
+	}
+
+	latency := 1.0
+	if in.AvgLatency > 0 && in.PeerLatency > 0 {
+		latency = math.Min(in.PeerLatency/in.AvgLatency, 1)
+	}
+
+	recency := 1.0
+	if !in.LastFailure.IsZero() {
+		elapsed := now.Sub(in.LastFailure)
+		recency = math.Min(math.Max(float64(elapsed)/float64(c.recencyWindow()), 0), 1)
+	}
+
+	successWeight, latencyWeight, recencyWeight := c.weights()
+	total := successWeight + latencyWeight + recencyWeight
+	return 100 * (successWeight*successRate + latencyWeight*latency + recencyWeight*recency) / total
+}
+
+// healthScores computes the health score of every known upstream from its
+// request stats and health state. Caller must hold ps.mutex (read).
+func (ps *ProxyServer) healthScores() map[string]float64 {
+	var latencySum float64
+	var latencyCount int
+	for _, metric := range ps.stats.UpstreamMetrics {
+		if metric.AvgLatency > 0 {
+			latencySum += metric.AvgLatency
+			latencyCount++
+		}
+	}
+	var peerLatency float64
+	if latencyCount > 0 {
+		peerLatency = latencySum / float64(latencyCount)
+	}
+
+	ps.healthMutex.RLock()
+	defer ps.healthMutex.RUnlock()
+
+	now := time.Now()
+	scores := make(map[string]float64, len(ps.stats.UpstreamMetrics))
+	for url, metric := range ps.stats.UpstreamMetrics {
+		snapshot := metric.snapshot()
+		in := healthScoreInputs{
+			Successes:   snapshot.SuccessRequests,
+			Failures:    snapshot.FailedRequests,
+			AvgLatency:  snapshot.AvgLatency,
+			PeerLatency: peerLatency,
+		}
+		if health, exists := ps.upstreamHealth[url]; exists {
+			in.LastFailure = health.LastFailure
+		}
+		scores[url] = ps.config.HealthScore.score(in, now)
+	}
+	return scores
+}
+
+// applyHealthScores scales candidate weights by their health score when
+// health_score.apply_to_selection is set. Candidates without a score keep
+// their weight. Caller must hold ps.mutex (read).
+func (ps *ProxyServer) applyHealthScores(upstreams []WeightedUpstream) []WeightedUpstream {
+	if !ps.config.HealthScore.ApplyToSelection || len(upstreams) <= 1 {
+		return upstreams
+	}
+	scores := ps.healthScores()
+
+	scaled := make([]WeightedUpstream, len(upstreams))
+	for i, upstream := range upstreams {
+		scaled[i] = upstream
+		if score, exists := scores[upstream.URL]; exists {
+			scaled[i] = scaleWeight(upstream, score/100)
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestHealthScoreDirection tests that each input moves the score the expected way
+func TestHealthScoreDirection(t *testing.T) {
+	config := HealthScoreConfig{}
+	now := time.Now()
+	baseline := healthScoreInputs{Successes: 100, AvgLatency: 100, PeerLatency: 100}
+
+	if score := config.score(baseline, now); score != 100 {
+		t.Fatalf("Expected perfect score for a clean upstream, got %.1f", score)
+	}
+	if score := config.score(healthScoreInputs{}, now); score != 100 {
+		t.Errorf("Expected upstream without data to score 100, got %.1f", score)
+	}
+
+	failing := baseline
+	failing.Failures = 50
+	if score := config.score(failing, now); score >= config.score(baseline, now) {
+		t.Errorf("Expected failures to lower the score, got %.1f", score)
+	}
+
+	slow := baseline
+	slow.AvgLatency = 400
+	slower := baseline
+	slower.AvgLatency = 800
+	if config.score(slow, now) >= 100 || config.score(slower, now) >= config.score(slow, now) {
+		t.Errorf("Expected higher latency to lower the score: slow=%.1f slower=%.1f",
+			config.score(slow, now), config.score(slower, now))
+	}
+
+	recent := baseline
+	recent.LastFailure = now.Add(-10 * time.Second)
+	older := baseline
+	older.LastFailure = now.Add(-200 * time.Second)
+	if config.score(recent, now) >= config.score(older, now) {
+		t.Errorf("Expected score to recover with time since failure: recent=%.1f older=%.1f",
+			config.score(recent, now), config.score(older, now))
+	}
+	longAgo := baseline
+	longAgo.LastFailure = now.Add(-time.Hour)
+	if score := config.score(longAgo, now); score != 100 {
+		t.Errorf("Expected full recency credit after the window, got %.1f", score)
+	}
+
+	// Weights decide which input dominates
+	latencyOnly := HealthScoreConfig{LatencyWeight: 1}
+	if score := latencyOnly.score(failing, now); score != 100 {
+		t.Errorf("Expected failures to be ignored with zero success weight, got %.1f", score)
+	}
+	if score := latencyOnly.score(slow, now); score != 25 {
+		t.Errorf("Expected latency-only score of 25 at 4x peer latency, got %.1f", score)
+	}
+}
+
+// TestHealthScoreSelection tests that scores feed into selection when enabled
+func TestHealthScoreSelection(t *testing.T) {
+	good := "http://127.0.0.1:9101"
+	bad := "http://127.0.0.1:9102"
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: good, Enabled: true, Weight: 1},
+			{URL: bad, Enabled: true, Weight: 1},
+		},
+		HealthScore: HealthScoreConfig{SuccessWeight: 1, ApplyToSelection: true},
+	}
+	ps := NewProxyServer(config, "")
+
+	ps.mutex.Lock()
+	ps.stats.UpstreamMetrics[good].SuccessRequests = 100
+	ps.stats.UpstreamMetrics[bad].SuccessRequests = 20
+	ps.stats.UpstreamMetrics[bad].FailedRequests = 80
+	ps.mutex.Unlock()
+
+	counts := make(map[string]int)
+	for i := 0; i < 1200; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts[good] < 4*counts[bad] {
+		t.Errorf("Expected healthier upstream to receive ~5x the traffic, got good=%d bad=%d", counts[good], counts[bad])
+	}
+	if counts[bad] == 0 {
+		t.Error("Expected low-scoring upstream to keep some traffic")
+	}
+
+	// Scores of 100 and 20 reduce to weights of 5 and 1, so the low-scoring
+	// upstream gets one of every six requests rather than a long run
+	for round := 0; round < 3; round++ {
+		badPicks := 0
+		for i := 0; i < 6; i++ {
+			if ps.getNextUpstream() == bad {
+				badPicks++
+			}
+		}
+		if badPicks != 1 {
+			t.Errorf("Expected 1 of every 6 requests on the low-scoring upstream, got %d", badPicks)
+			break
+		}
+	}
+
+	upstreams := ps.getHealthMetrics()["upstreams"].(map[string]interface{})
+	goodScore := upstreams[good].(map[string]interface{})["health_score"].(float64)
+	badScore := upstreams[bad].(map[string]interface{})["health_score"].(float64)
+	if goodScore != 100 || badScore != 20 {
+		t.Errorf("Expected health_score 100 and 20 in health metrics, got %.1f and %.1f", goodScore, badScore)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// HealthStateConfig enables persisting upstream health across restarts.
+// State older than TTLSeconds (default 300) is ignored on startup.
+type HealthStateConfig struct {
+	File       string `json:"file"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+func (hsc HealthStateConfig) ttl() time.Duration {
+	if hsc.TTLSeconds > 0 {
+		return time.Duration(hsc.TTLSeconds) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// healthStateFile is the on-disk format, keyed by upstream URL without
+// credentials so passwords never reach the disk
+type healthStateFile struct {
+	SavedAt   time.Time                  `json:"saved_at"`
+	Upstreams map[string]*UpstreamHealth `json:"upstreams"`
+}
+
+// saveHealthState writes the current upstream health to path. The file is
+// replaced atomically so a crash mid-write never leaves a truncated state.
+// Upstreams that differ only in credentials share a key, so their state is
+// ambiguous and not saved.
+func (ps *ProxyServer) saveHealthState(path string) error {
+	state := healthStateFile{
+		SavedAt:   time.Now(),
+		Upstreams: make(map[string]*UpstreamHealth),
+	}
+
+	ambiguous := make(map[string]bool)
+	ps.healthMutex.RLock()
+	for upstream, health := range ps.upstreamHealth {
+		key := credentialFreeURL(upstream)
+		if _, exists := state.Upstreams[key]; exists {
+			ambiguous[key] = true
+		}
+		snapshot := *health
+		snapshot.ProbesInFlight = 0
+		state.Upstreams[key] = &snapshot
+	}
+	ps.healthMutex.RUnlock()
+	for key := range ambiguous {
+		log.Printf("Not saving health state for %s: several upstreams differ only in credentials", key)
+		delete(state.Upstreams, key)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode health state: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".health-state-*")
+	if err != nil {
+		return fmt.Errorf("failed to create health state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write health state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write health state: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace health state file: %v", err)
+	}
+
+	log.Printf("Saved health state for %d upstreams to %s", len(state.Upstreams), path)
+	return nil
+}
+
+// loadHealthState restores upstream health saved within ttl. Only upstreams
+// that are still configured are restored; configured thresholds are kept.
+// Returns the number of upstreams restored.
+func (ps *ProxyServer) loadHealthState(path string, ttl time.Duration) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read health state: %v", err)
+	}
+
+	var state healthStateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("failed to parse health state: %v", err)
+	}
+
+	if age := time.Since(state.SavedAt); age > ttl {
+		log.Printf("Ignoring stale health state from %s (saved %v ago, ttl %v)", path, age.Round(time.Second), ttl)
+		return 0, nil
+	}
+
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	// Match saved keys to configured upstreams without their credentials
+	byKey := make(map[string]*UpstreamHealth, len(ps.upstreamHealth))
+	ambiguous := make(map[string]bool)
+	for upstream, health := range ps.upstreamHealth {
+		key := credentialFreeURL(upstream)
+		if _, exists := byKey[key]; exists {
+			ambiguous[key] = true
+		}
+		byKey[key] = health
+	}
+
+	restored := 0
+	for key, saved := range state.Upstreams {
+		key = credentialFreeURL(key)
+		health, exists := byKey[key]
+		if !exists || ambiguous[key] || saved == nil {
+			continue
+		}
+		health.IsHealthy = saved.IsHealthy
+		health.FailureCount = saved.FailureCount
+		health.SuccessCount = saved.SuccessCount
+		health.LastFailure = saved.LastFailure
+		health.LastSuccess = saved.LastSuccess
+		health.RecoveredAt = saved.RecoveredAt
+		health.LastCheckedIP = saved.LastCheckedIP
+		restored++
+	}
+
+	log.Printf("Restored health state for %d upstreams from %s", restored, path)
+	return restored, nil
+}
+
+// shutdown stops background workers and persists health state if configured
+func (ps *ProxyServer) shutdown() {
+	ps.stopHealthChecker()
+	ps.stopIdleReaper()
+	ps.stopMemoryGuard()
+	ps.stopConnectionWarmer()
+	ps.stopTracing()
+
+	ps.mutex.RLock()
+	stateConfig := ps.config.HealthState
+	ps.mutex.RUnlock()
+
+	if stateConfig.File != "" {
+		if err := ps.saveHealthState(stateConfig.File); err != nil {
+			log.Printf("Failed to save health state: %v", err)
+		}
+	}
+
+	ps.closeLogFiles()
+}
@@ -0,0 +1,68 @@
+package main
+
+import "time"
+
+// recentLatencyWeight is how far each new sample moves an upstream's recent
+// latency, so least_latency follows current conditions rather than the
+// lifetime average
+const recentLatencyWeight = 0.2
+
+// latencyRemeasureInterval is how much older than the freshest sample an
+// upstream's latest sample may get before it is let back into the band to
+// be measured again, so a slow spell does not keep it out for good
+const latencyRemeasureInterval = 30 * time.Second
+
+// observeRecentLatency folds a successful CONNECT's setup latency into the
+// decaying average. Caller must hold ps.mutex (write).
+func (us *UpstreamStats) observeRecentLatency(ms float64) {
+	if !us.recentLatencySet {
+		us.recentLatency, us.recentLatencySet = ms, true
+		return
+	}
+	us.recentLatency += recentLatencyWeight * (ms - us.recentLatency)
+}
+
+// fastestUpstreams keeps the upstreams whose recent CONNECT latency is
+// within latency_tolerance_pct of the fastest one, so similarly fast
+// upstreams share traffic by weight instead of the single minimum taking
+// all of it. Upstreams without a successful request yet, or whose latest
+// one is latencyRemeasureInterval older than the freshest, are kept so they
+// get measured. Caller must hold ps.mutex (read).
+func (ps *ProxyServer) fastestUpstreams(upstreams []WeightedUpstream) []WeightedUpstream {
+	if len(upstreams) <= 1 {
+		return upstreams
+	}
+
+	var freshest time.Time
+	for _, upstream := range upstreams {
+		if metric, exists := ps.stats.UpstreamMetrics[upstream.URL]; exists && metric.LastRequest.After(freshest) {
+			freshest = metric.LastRequest
+		}
+	}
+
+	latencies := make([]float64, len(upstreams))
+	fastest := -1.0
+	for i, upstream := range upstreams {
+		latencies[i] = -1
+		metric, exists := ps.stats.UpstreamMetrics[upstream.URL]
+		if !exists || !metric.recentLatencySet || freshest.Sub(metric.LastRequest) > latencyRemeasureInterval {
+			continue
+		}
+		latencies[i] = metric.recentLatency
+		if fastest < 0 || latencies[i] < fastest {
+			fastest = latencies[i]
+		}
+	}
+	if fastest < 0 {
+		return upstreams
+	}
+
+	limit := fastest * (1 + ps.config.Server.LatencyTolerancePct/100)
+	band := make([]WeightedUpstream, 0, len(upstreams))
+	for i, upstream := range upstreams {
+		if latencies[i] < 0 || latencies[i] <= limit {
+			band = append(band, upstream)
+		}
+	}
+	return band
+}
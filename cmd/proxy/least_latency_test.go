@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLeastLatencyTolerance tests that least_latency spreads traffic across
+// upstreams within the tolerance band and keeps it off slower ones
+func TestLeastLatencyTolerance(t *testing.T) {
+	latencies := map[string]int64{
+		"http://127.0.0.1:9721": 100,
+		"http://127.0.0.1:9722": 105,
+		"http://127.0.0.1:9723": 108,
+		"http://127.0.0.1:9724": 300,
+	}
+	config := &Config{
+		Server: ServerConfig{Strategy: strategyLeastLatency, LatencyTolerancePct: 10},
+	}
+	for upstream := range latencies {
+		config.UpstreamProxies = append(config.UpstreamProxies, UpstreamProxyConfig{URL: upstream, Enabled: true, Weight: 1})
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+
+	// Only the slow upstream lacks samples at first, so it gets measured
+	fresh := "http://127.0.0.1:9724"
+	now := time.Now()
+	setLatency := func(upstream string, latency int64) {
+		ps.mutex.Lock()
+		defer ps.mutex.Unlock()
+		metric := ps.stats.UpstreamMetrics[upstream]
+		metric.LastRequest = now
+		metric.observeRecentLatency(float64(latency))
+	}
+	for upstream, latency := range latencies {
+		if upstream != fresh {
+			setLatency(upstream, latency)
+		}
+	}
+	unmeasured := 0
+	for i := 0; i < 30; i++ {
+		if ps.getNextUpstream() == fresh {
+			unmeasured++
+		}
+	}
+	if unmeasured == 0 {
+		t.Error("Expected an upstream without samples to get traffic")
+	}
+
+	setLatency(fresh, latencies[fresh])
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts[fresh] != 0 {
+		t.Errorf("Expected the slow upstream to get no traffic, got %d", counts[fresh])
+	}
+	for upstream, latency := range latencies {
+		if latency <= 110 && counts[upstream] != 100 {
+			t.Errorf("Expected %s (%dms) to get a third of traffic, got %v", upstream, latency, counts)
+		}
+	}
+
+	// Without a tolerance only the fastest upstream is used
+	ps.mutex.Lock()
+	ps.config.Server.LatencyTolerancePct = 0
+	ps.mutex.Unlock()
+	for i := 0; i < 10; i++ {
+		if upstream := ps.getNextUpstream(); upstream != "http://127.0.0.1:9721" {
+			t.Fatalf("Expected the fastest upstream, got %s", upstream)
+		}
+	}
+
+	if err := validateConfig(&Config{Server: ServerConfig{LatencyTolerancePct: -1}}); err == nil {
+		t.Error("Expected a negative tolerance to be rejected")
+	}
+}
+
+// TestLeastLatencyRecovers tests that an upstream left out for being slow is
+// measured again after a while, and that recent samples outweigh old ones
+func TestLeastLatencyRecovers(t *testing.T) {
+	fast := "http://127.0.0.1:9725"
+	slow := "http://127.0.0.1:9726"
+	config := &Config{
+		Server: ServerConfig{Strategy: strategyLeastLatency, LatencyTolerancePct: 10},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: fast, Enabled: true, Weight: 1},
+			{URL: slow, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	now := time.Now()
+	ps.mutex.Lock()
+	ps.stats.UpstreamMetrics[fast].LastRequest = now
+	ps.stats.UpstreamMetrics[fast].observeRecentLatency(100)
+	ps.stats.UpstreamMetrics[slow].LastRequest = now
+	ps.stats.UpstreamMetrics[slow].observeRecentLatency(300)
+	ps.mutex.Unlock()
+
+	for i := 0; i < 10; i++ {
+		if upstream := ps.getNextUpstream(); upstream != fast {
+			t.Fatalf("Expected only the fast upstream while the slow one is fresh, got %s", upstream)
+		}
+	}
+
+	// The fast upstream keeps being used while the slow one's sample ages
+	ps.mutex.Lock()
+	ps.stats.UpstreamMetrics[fast].LastRequest = now.Add(latencyRemeasureInterval + time.Second)
+	ps.mutex.Unlock()
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts[slow] == 0 {
+		t.Errorf("Expected the slow upstream to be measured again, got %v", counts)
+	}
+
+	// A few fast samples bring it back within the band
+	ps.mutex.Lock()
+	for i := 0; i < 15; i++ {
+		ps.stats.UpstreamMetrics[slow].observeRecentLatency(100)
+	}
+	ps.stats.UpstreamMetrics[slow].LastRequest = ps.stats.UpstreamMetrics[fast].LastRequest
+	recent := ps.stats.UpstreamMetrics[slow].recentLatency
+	ps.mutex.Unlock()
+	if recent > 110 {
+		t.Fatalf("Expected recent samples to dominate the average, got %.1fms", recent)
+	}
+	counts = make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts[slow] != 5 || counts[fast] != 5 {
+		t.Errorf("Expected the recovered upstream to share traffic again, got %v", counts)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixSocketPrefix marks a listen_address as a Unix domain socket path
+const unixSocketPrefix = "unix:"
+
+// listenAddressEnv overrides -listen, as PROXY_CONFIG overrides -config
+const listenAddressEnv = "PROXY_LISTEN"
+
+// applyListenOverride replaces server.listen_address with the address given
+// at startup. Priority: PROXY_LISTEN > -listen > config file.
+func applyListenOverride(config *Config, flagValue string) {
+	override := flagValue
+	if envListen := os.Getenv(listenAddressEnv); envListen != "" {
+		override = envListen
+	}
+	if override != "" {
+		config.Server.ListenAddress = override
+	}
+}
+
+// newHTTPServer builds the HTTP server for the proxy. Addr records the
+// listen address; the listener itself comes from listen.
+func newHTTPServer(handler http.Handler, config ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:           config.ListenAddress,
+		Handler:        handler,
+		MaxHeaderBytes: config.MaxHeaderBytes,
+	}
+}
+
+// startStatsListener serves ps.statsHandler on server.stats_listen_address.
+// The returned server's Addr is the address actually bound.
+func startStatsListener(ps *ProxyServer, config ServerConfig) (*http.Server, error) {
+	listener, err := listen(ServerConfig{ListenAddress: config.StatsListenAddress, SocketMode: config.SocketMode})
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Addr:           config.StatsListenAddress,
+		Handler:        ps.statsHandler(),
+		MaxHeaderBytes: config.MaxHeaderBytes,
+	}
+	if listener.Addr().Network() == "tcp" {
+		server.Addr = listener.Addr().String()
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Stats listener failed: %v", err)
+		}
+	}()
+	return server, nil
+}
+
+// listen opens the listener described by the server config. A listen address
+// of the form "unix:/path/to/socket" creates a Unix domain socket with
+// permissions from socket_mode; the socket file is removed when the listener
+// is closed.
+func listen(config ServerConfig) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(config.ListenAddress, unixSocketPrefix)
+	if !isUnix {
+		return net.Listen("tcp", config.ListenAddress)
+	}
+
+	mode, err := parseSocketMode(config.SocketMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clear a socket left behind by an unclean exit, but never other files
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("refusing to replace non-socket file %s", path)
+		}
+		log.Printf("Removing stale socket %s", path)
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+	return listener, nil
+}
+
+// parseSocketMode parses an octal permission string such as "0660".
+// An empty string selects 0660.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0660, nil
+	}
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("invalid socket_mode %q: expected octal permissions like \"0660\"", mode)
+	}
+	return os.FileMode(parsed), nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUnixSocketListener tests CONNECT over a Unix domain socket listener
+func TestUnixSocketListener(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+
+	config := &Config{
+		Server: ServerConfig{
+			ListenAddress: "unix:" + socketPath,
+			SocketMode:    "0600",
+			StatsEndpoint: "/stats",
+		},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+
+	listener, err := listen(config.Server)
+	if err != nil {
+		t.Fatalf("Failed to listen on Unix socket: %v", err)
+	}
+	server := &http.Server{Handler: NewProxyServer(config, "")}
+	go server.Serve(listener)
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Socket file missing: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected socket permissions 0600, got %o", perm)
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial Unix socket: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	head, err := readConnectRequest(reader)
+	if err != nil || !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200 Connection Established over Unix socket, got %q (%v)", head, err)
+	}
+
+	conn.Write([]byte("ping"))
+	buffer := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buffer); err != nil || string(buffer) != "ping" {
+		t.Errorf("Expected echoed data through tunnel, got %q (%v)", buffer, err)
+	}
+
+	// Shutting down removes the socket file
+	server.Close()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Expected socket file to be removed on shutdown, got %v", err)
+	}
+}
+
+// TestUnixSocketStaleFile tests stale socket cleanup and refusal to clobber regular files
+func TestUnixSocketStaleFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket left behind by a previous run is replaced
+	stalePath := filepath.Join(dir, "stale.sock")
+	stale, err := net.Listen("unix", stalePath)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen(ServerConfig{ListenAddress: "unix:" + stalePath})
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	listener.Close()
+
+	// A regular file is never removed
+	regularPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(regularPath, []byte("{}"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := listen(ServerConfig{ListenAddress: "unix:" + regularPath}); err == nil {
+		t.Error("Expected listen to refuse replacing a regular file")
+	}
+	if _, err := os.Stat(regularPath); err != nil {
+		t.Errorf("Regular file should be left untouched: %v", err)
+	}
+
+	if _, err := listen(ServerConfig{ListenAddress: "unix:" + filepath.Join(dir, "x.sock"), SocketMode: "rw"}); err == nil {
+		t.Error("Expected invalid socket_mode to be rejected")
+	}
+}
+
+// TestListenAddressOverride tests that -listen and PROXY_LISTEN override
+// server.listen_address, with the environment winning
+func TestListenAddressOverride(t *testing.T) {
+	tests := []struct {
+		name string
+		flag string
+		env  string
+		want string
+	}{
+		{name: "ConfigFile", want: "127.0.0.1:3130"},
+		{name: "Flag", flag: ":4000", want: ":4000"},
+		{name: "Env", env: ":5000", want: ":5000"},
+		{name: "EnvOverFlag", flag: ":4000", env: ":5000", want: ":5000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(listenAddressEnv, tt.env)
+			config := &Config{Server: ServerConfig{ListenAddress: "127.0.0.1:3130"}}
+			applyListenOverride(config, tt.flag)
+
+			server := newHTTPServer(NewProxyServer(config, ""), config.Server)
+			if server.Addr != tt.want {
+				t.Errorf("Expected server Addr %q, got %q", tt.want, server.Addr)
+			}
+		})
+	}
+}
+
+// TestStatsListener tests that with stats_listen_address the stats, health
+// and metrics endpoints move to their own port and the proxy port only
+// tunnels
+func TestStatsListener(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+
+	config := &Config{
+		Server: ServerConfig{
+			StatsEndpoint:      "/stats",
+			MetricsEndpoint:    "/metrics",
+			StatsListenAddress: "127.0.0.1:0",
+		},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	statsServer, err := startStatsListener(ps, config.Server)
+	if err != nil {
+		t.Fatalf("Failed to start stats listener: %v", err)
+	}
+	defer statsServer.Close()
+
+	status := func(addr, path string) int {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatalf("GET %s on %s failed: %v", path, addr, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, path := range []string{"/stats", "/metrics", healthEndpointPath, adminUpstreamsPath} {
+		if code := status(statsServer.Addr, path); code != http.StatusOK {
+			t.Errorf("Expected %s on the stats port to return 200, got %d", path, code)
+		}
+		if code := status(proxyAddr, path); code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected %s on the proxy port to return 405, got %d", path, code)
+		}
+	}
+
+	// Tunnels go through the proxy port only
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Errorf("Expected CONNECT on the proxy port to succeed, got %q", head)
+	}
+	conn, head = dialConnect(t, statsServer.Addr, "example.com:443")
+	conn.Close()
+	if !strings.Contains(head, "404") {
+		t.Errorf("Expected CONNECT on the stats port to be refused, got %q", head)
+	}
+}
@@ -1,39 +1,29 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // TestWeightedRoundRobin tests weight-based load balancing
 func TestWeightedRoundRobin(t *testing.T) {
 	t.Run("BasicWeightDistribution", func(t *testing.T) {
 		config := &Config{
-			Server: struct {
-				Name          string `json:"name"`
-				ListenAddress string `json:"listen_address"`
-				StatsEndpoint string `json:"stats_endpoint"`
-			}{
+			Server: ServerConfig{
 				Name:          "Test Proxy",
 				ListenAddress: "127.0.0.1:3140",
 				StatsEndpoint: "/stats",
 			},
-			Authentication: struct {
-				Enabled bool `json:"enabled"`
-				Users   []struct {
-					Username string `json:"username"`
-					Password string `json:"password"`
-				} `json:"users"`
-			}{
+			Authentication: AuthenticationConfig{
 				Enabled: false,
 			},
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9001", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9002", Enabled: true, Weight: 2},
 				{URL: "http://127.0.0.1:9003", Enabled: true, Weight: 3},
@@ -80,31 +70,15 @@ func TestWeightedRoundRobin(t *testing.T) {
 
 	t.Run("SingleWeightUpstream", func(t *testing.T) {
 		config := &Config{
-			Server: struct {
-				Name          string `json:"name"`
-				ListenAddress string `json:"listen_address"`
-				StatsEndpoint string `json:"stats_endpoint"`
-			}{
+			Server: ServerConfig{
 				Name:          "Test Proxy",
 				ListenAddress: "127.0.0.1:3141",
 				StatsEndpoint: "/stats",
 			},
-			Authentication: struct {
-				Enabled bool `json:"enabled"`
-				Users   []struct {
-					Username string `json:"username"`
-					Password string `json:"password"`
-				} `json:"users"`
-			}{
+			Authentication: AuthenticationConfig{
 				Enabled: false,
 			},
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9004", Enabled: true, Weight: 5},
 			},
 		}
@@ -122,13 +96,7 @@ func TestWeightedRoundRobin(t *testing.T) {
 
 	t.Run("ZeroWeightHandling", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9005", Enabled: true, Weight: 0}, // Zero weight
 				{URL: "http://127.0.0.1:9006", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9007", Enabled: true, Weight: 2},
@@ -169,13 +137,7 @@ func TestWeightedRoundRobin(t *testing.T) {
 func TestDisabledUpstreamHandling(t *testing.T) {
 	t.Run("SkipDisabledUpstreams", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9008", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9009", Enabled: false, Weight: 1}, // Disabled
 				{URL: "http://127.0.0.1:9010", Enabled: true, Weight: 1},
@@ -205,13 +167,7 @@ func TestDisabledUpstreamHandling(t *testing.T) {
 
 	t.Run("AllUpstreamsDisabled", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9011", Enabled: false, Weight: 1},
 				{URL: "http://127.0.0.1:9012", Enabled: false, Weight: 1},
 			},
@@ -233,13 +189,7 @@ func TestDisabledUpstreamHandling(t *testing.T) {
 // TestConcurrentWeightedLoadBalancing tests weighted load balancing under concurrent access
 func TestConcurrentWeightedLoadBalancing(t *testing.T) {
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9013", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9014", Enabled: true, Weight: 3},
 			{URL: "http://127.0.0.1:9015", Enabled: true, Weight: 1},
@@ -306,13 +256,7 @@ func TestDynamicWeightChanges(t *testing.T) {
 	
 	// This test will drive implementation of runtime weight updates
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9016", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9017", Enabled: true, Weight: 1},
 		},
@@ -363,4 +307,355 @@ func abs(x int) int {
 		return -x
 	}
 	return x
-}
\ No newline at end of file
+}
+
+// TestDuplicateUpstreamCoalescing tests that duplicate upstream URLs are merged
+// into a single upstream carrying the combined weight
+func TestDuplicateUpstreamCoalescing(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9016", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9017", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9016", Enabled: true, Weight: 2}, // copy-paste duplicate
+			{URL: "http://127.0.0.1:9017", Enabled: false, Weight: 5}, // disabled duplicate is ignored
+		},
+	}
+
+	ps := NewProxyServer(config, "")
+
+	if len(ps.upstreams) != 2 {
+		t.Fatalf("Expected duplicates to be coalesced into 2 upstreams, got %d: %v", len(ps.upstreams), ps.upstreams)
+	}
+	if ps.totalWeight != 4 {
+		t.Errorf("Expected total weight 4, got %d", ps.totalWeight)
+	}
+	if ps.weightedUpstreams[0].URL != "http://127.0.0.1:9016" || ps.weightedUpstreams[0].Weight != 3 {
+		t.Errorf("Expected coalesced upstream with weight 3, got %+v", ps.weightedUpstreams[0])
+	}
+
+	// Distribution should follow the combined 3:1 weights
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts["http://127.0.0.1:9016"] != 300 || counts["http://127.0.0.1:9017"] != 100 {
+		t.Errorf("Expected 300/100 distribution, got %v", counts)
+	}
+}
+
+// TestWeightPercentDistribution tests that weight_percent values are translated
+// into weights whose distribution matches the configured percentages
+func TestWeightPercentDistribution(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9018", Enabled: true, WeightPercent: 50},
+			{URL: "http://127.0.0.1:9019", Enabled: true, WeightPercent: 30},
+			{URL: "http://127.0.0.1:9020", Enabled: true, WeightPercent: 20},
+			{URL: "http://127.0.0.1:9021", Enabled: false, Weight: 10},
+		},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid percentage config, got %v", err)
+	}
+
+	ps := NewProxyServer(config, "")
+	if ps.totalWeight != 10 {
+		t.Errorf("Expected percentages to reduce to total weight 10, got %d", ps.totalWeight)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	expected := map[string]int{
+		"http://127.0.0.1:9018": 500,
+		"http://127.0.0.1:9019": 300,
+		"http://127.0.0.1:9020": 200,
+	}
+	for upstream, want := range expected {
+		if counts[upstream] != want {
+			t.Errorf("Upstream %s: expected %d requests, got %d", upstream, want, counts[upstream])
+		}
+	}
+}
+
+// TestWeightPercentValidation tests validateConfig rules for weight_percent
+func TestWeightPercentValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []UpstreamProxyConfig
+		wantErr   bool
+	}{
+		{
+			name: "RoundedThirds",
+			upstreams: []UpstreamProxyConfig{
+				{URL: "http://127.0.0.1:9022", Enabled: true, WeightPercent: 33.3},
+				{URL: "http://127.0.0.1:9023", Enabled: true, WeightPercent: 33.3},
+				{URL: "http://127.0.0.1:9024", Enabled: true, WeightPercent: 33.4},
+			},
+		},
+		{
+			name: "SumTooLow",
+			upstreams: []UpstreamProxyConfig{
+				{URL: "http://127.0.0.1:9022", Enabled: true, WeightPercent: 50},
+				{URL: "http://127.0.0.1:9023", Enabled: true, WeightPercent: 40},
+			},
+			wantErr: true,
+		},
+		{
+			name: "DisabledExcludedFromSum",
+			upstreams: []UpstreamProxyConfig{
+				{URL: "http://127.0.0.1:9022", Enabled: true, WeightPercent: 60},
+				{URL: "http://127.0.0.1:9023", Enabled: true, WeightPercent: 40},
+				{URL: "http://127.0.0.1:9024", Enabled: false, WeightPercent: 25},
+			},
+		},
+		{
+			name: "MixedWithPlainWeights",
+			upstreams: []UpstreamProxyConfig{
+				{URL: "http://127.0.0.1:9022", Enabled: true, WeightPercent: 100},
+				{URL: "http://127.0.0.1:9023", Enabled: true, Weight: 1},
+			},
+			wantErr: true,
+		},
+		{
+			name: "NegativePercent",
+			upstreams: []UpstreamProxyConfig{
+				{URL: "http://127.0.0.1:9022", Enabled: true, WeightPercent: 120},
+				{URL: "http://127.0.0.1:9023", Enabled: true, WeightPercent: -20},
+			},
+			wantErr: true,
+		},
+		{
+			name: "PlainWeightsOnly",
+			upstreams: []UpstreamProxyConfig{
+				{URL: "http://127.0.0.1:9022", Enabled: true, Weight: 3},
+				{URL: "http://127.0.0.1:9023", Enabled: true, Weight: 7},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&Config{UpstreamProxies: tt.upstreams})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestPreferFreshHealthChecks tests that stale upstreams yield to recently verified peers
+func TestPreferFreshHealthChecks(t *testing.T) {
+	fresh := "http://127.0.0.1:9201"
+	recent := "http://127.0.0.1:9202"
+	stale := "http://127.0.0.1:9203"
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: fresh, Enabled: true, Weight: 1},
+			{URL: recent, Enabled: true, Weight: 1},
+			{URL: stale, Enabled: true, Weight: 1},
+		},
+		HealthCheck: HealthCheckConfig{PreferFreshSeconds: 30},
+	}
+	ps := NewProxyServer(config, "")
+
+	now := time.Now()
+	ps.healthMutex.Lock()
+	ps.upstreamHealth[fresh].LastSuccess = now
+	ps.upstreamHealth[recent].LastSuccess = now.Add(-10 * time.Second)
+	ps.upstreamHealth[stale].LastSuccess = now.Add(-5 * time.Minute)
+	ps.healthMutex.Unlock()
+
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts[stale] != 0 {
+		t.Errorf("Expected stale upstream to be skipped, got %d selections", counts[stale])
+	}
+	// Comparable timestamps fall back to plain weighted round-robin
+	if counts[fresh] != 50 || counts[recent] != 50 {
+		t.Errorf("Expected even split between fresh upstreams, got fresh=%d recent=%d", counts[fresh], counts[recent])
+	}
+
+	// Once the stale upstream passes a check it rejoins the rotation
+	ps.healthMutex.Lock()
+	ps.upstreamHealth[stale].LastSuccess = now
+	ps.healthMutex.Unlock()
+	counts = make(map[string]int)
+	for i := 0; i < 99; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts[stale] != 33 {
+		t.Errorf("Expected refreshed upstream to receive a third of traffic, got %d", counts[stale])
+	}
+}
+
+// TestSelectionFairness tests the Gini coefficient reported across upstream request counts
+func TestSelectionFairness(t *testing.T) {
+	cases := []struct {
+		values []float64
+		want   float64
+	}{
+		{[]float64{5, 5, 5, 5}, 0},
+		{[]float64{0, 0, 0, 10}, 0.75},
+		{[]float64{1, 2, 3, 4}, 0.25},
+		{[]float64{7}, 0},
+		{[]float64{0, 0}, 0},
+	}
+	for _, tc := range cases {
+		if got := giniCoefficient(tc.values); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("giniCoefficient(%v) = %v, want %v", tc.values, got, tc.want)
+		}
+	}
+
+	heavy := "http://127.0.0.1:9301"
+	light := "http://127.0.0.1:9302"
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: heavy, Enabled: true, Weight: 3},
+			{URL: light, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	record := func(upstream string, count int) {
+		ps.mutex.Lock()
+		defer ps.mutex.Unlock()
+		for i := 0; i < count; i++ {
+			ps.stats.RecentRequests = append(ps.stats.RecentRequests, RecentRequest{
+				Timestamp: time.Now(), Upstream: upstream, Latency: 10, Success: true,
+			})
+		}
+	}
+
+	// Traffic matching the configured 3:1 weights is perfectly fair
+	record(heavy, 30)
+	record(light, 10)
+	if gini := ps.getTimeWindowStats(15 * time.Minute).SelectionGini; gini != 0 {
+		t.Errorf("Expected Gini 0 for a weight-proportional split, got %v", gini)
+	}
+
+	// The heavy upstream dominating beyond its weight shows up as skew
+	record(heavy, 90)
+	skewed := ps.getTimeWindowStats(15 * time.Minute).SelectionGini
+	if skewed != 0.3 {
+		t.Errorf("Expected Gini 0.3 for 40 vs 10 requests per unit of weight, got %v", skewed)
+	}
+}
+
+// TestNoImmediateRepeat tests that consecutive selections differ while more
+// than one upstream is healthy, with the heavier upstream still favoured
+func TestNoImmediateRepeat(t *testing.T) {
+	heavy := "http://127.0.0.1:9311"
+	config := &Config{
+		Server: ServerConfig{NoImmediateRepeat: true},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: heavy, Enabled: true, Weight: 4},
+			{URL: "http://127.0.0.1:9312", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9313", Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	counts := make(map[string]int)
+	previous := ""
+	for i := 0; i < 120; i++ {
+		upstream := ps.getNextUpstream()
+		if upstream == previous {
+			t.Fatalf("Selection %d repeated %s", i, upstream)
+		}
+		counts[upstream]++
+		previous = upstream
+	}
+	for upstream, count := range counts {
+		if upstream != heavy && count >= counts[heavy] {
+			t.Errorf("Expected %s to stay the most selected, got %v", heavy, counts)
+		}
+	}
+
+	// With a single healthy upstream left, repeating it is the only option
+	for _, upstream := range []string{"http://127.0.0.1:9312", "http://127.0.0.1:9313"} {
+		for i := 0; i < 3; i++ {
+			ps.recordUpstreamFailure(upstream)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if upstream := ps.getNextUpstream(); upstream != heavy {
+			t.Fatalf("Expected %s as the only healthy upstream, got %s", heavy, upstream)
+		}
+	}
+}
+
+// TestScaledWeightsKeepInterleaving tests that slow start, health scores and
+// capacity hints enabled together leave equally weighted upstreams
+// alternating while none of them scales a weight down
+func TestScaledWeightsKeepInterleaving(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9314", Enabled: true, Weight: 1},
+			{URL: "http://127.0.0.1:9315", Enabled: true, Weight: 1},
+		},
+		SlowStartSeconds: 60,
+		HealthScore:      HealthScoreConfig{SuccessWeight: 1, ApplyToSelection: true},
+		HealthCheck:      HealthCheckConfig{UseCapacityHints: true},
+	}
+	ps := NewProxyServer(config, "")
+
+	previous := ""
+	for i := 0; i < 20; i++ {
+		upstream := ps.getNextUpstream()
+		if upstream == previous {
+			t.Fatalf("Selection %d repeated %s; scaling stretched the round-robin cycle", i, upstream)
+		}
+		previous = upstream
+	}
+}
+
+// TestOmittedWeightDefault tests that an upstream without a weight field
+// gets the default weight while an explicit 0 keeps it staged
+func TestOmittedWeightDefault(t *testing.T) {
+	load := func(server string) *ProxyServer {
+		t.Helper()
+		configPath := filepath.Join(t.TempDir(), "weights.json")
+		content := fmt.Sprintf(`{
+			"server": {"name": "Weight Test", "listen_address": "127.0.0.1:0"%s},
+			"upstream_proxies": [
+				{"url": "http://127.0.0.1:9461", "enabled": true},
+				{"url": "http://127.0.0.1:9462", "enabled": true, "weight": 0},
+				{"url": "http://127.0.0.1:9463", "enabled": true, "weight": 3}
+			]
+		}`, server)
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		config, err := loadConfig(configPath)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		return NewProxyServer(config, configPath)
+	}
+	weights := func(ps *ProxyServer) []int {
+		var weights []int
+		for _, weighted := range ps.weightedUpstreams {
+			weights = append(weights, weighted.Weight)
+		}
+		return weights
+	}
+
+	if got := fmt.Sprint(weights(load(""))); got != "[1 0 3]" {
+		t.Errorf("Expected the omitted weight to default to 1, got %s", got)
+	}
+	if got := fmt.Sprint(weights(load(`, "default_weight": 2`))); got != "[2 0 3]" {
+		t.Errorf("Expected the omitted weight to follow default_weight, got %s", got)
+	}
+
+	config := &Config{
+		Server:          ServerConfig{DefaultWeight: -1},
+		UpstreamProxies: []UpstreamProxyConfig{{URL: "http://127.0.0.1:9461", Enabled: true, Weight: 1}},
+	}
+	if err := validateConfig(config); err == nil || !strings.Contains(err.Error(), "default_weight") {
+		t.Errorf("Expected a negative default_weight to be rejected, got %v", err)
+	}
+}
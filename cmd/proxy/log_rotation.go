@@ -0,0 +1,246 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFileConfig describes a log file and its rotation policy
+type LogFileConfig struct {
+	File string `json:"file"`
+	// MaxSizeMB rotates the file once it would grow past this size (0 = no limit)
+	MaxSizeMB int `json:"max_size_mb,omitempty"`
+	// RotateIntervalSeconds rotates the file after it has been open this long (0 = never)
+	RotateIntervalSeconds int `json:"rotate_interval_seconds,omitempty"`
+	// MaxBackups is how many rotated files to keep (0 = keep all)
+	MaxBackups int `json:"max_backups,omitempty"`
+	// Compress gzips rotated files
+	Compress bool `json:"compress,omitempty"`
+
+	// BufferSize and DropPolicy apply to access_log only: entries are queued
+	// for a background writer and dropped, rather than blocking requests,
+	// once BufferSize entries are waiting (default 1024)
+	BufferSize int `json:"buffer_size,omitempty"`
+	// DropPolicy is "drop_newest" (default) or "drop_oldest"
+	DropPolicy string `json:"drop_policy,omitempty"`
+	// EgressIP adds the upstream's last measured egress IP to access log
+	// entries
+	EgressIP bool `json:"egress_ip,omitempty"`
+}
+
+// rotatedTimeFormat names rotated files so they sort chronologically
+const rotatedTimeFormat = "20060102-150405.000000"
+
+// rotateRetryInterval is how long a writer keeps appending to its current
+// file after a failed rotation before trying again
+const rotateRetryInterval = time.Minute
+
+// rotatingWriter is an append-only file writer that rotates by size or age.
+// Rotated files are renamed to <file>.<timestamp>, optionally gzipped in the
+// background, and pruned to the configured number of backups.
+type rotatingWriter struct {
+	mutex      sync.Mutex
+	path       string
+	maxBytes   int64
+	interval   time.Duration
+	maxBackups int
+	compress   bool
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	retryAt  time.Time
+
+	// backgroundMutex serializes compressing and pruning rotated files,
+	// which run outside mutex so writes never wait on gzip
+	backgroundMutex sync.Mutex
+	background      sync.WaitGroup
+}
+
+func newRotatingWriter(config LogFileConfig) (*rotatingWriter, error) {
+	rw := &rotatingWriter{
+		path:       config.File,
+		maxBytes:   int64(config.MaxSizeMB) << 20,
+		interval:   time.Duration(config.RotateIntervalSeconds) * time.Second,
+		maxBackups: config.MaxBackups,
+		compress:   config.Compress,
+	}
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *rotatingWriter) open() error {
+	file, err := os.OpenFile(rw.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+	rw.file = file
+	rw.size = info.Size()
+	rw.openedAt = time.Now()
+	return nil
+}
+
+func (rw *rotatingWriter) Write(p []byte) (int, error) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	if rw.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rw.size > 0 && rw.shouldRotate(int64(len(p))) {
+		if err := rw.rotate(); err != nil {
+			if rw.file == nil {
+				return 0, err
+			}
+			// Still appending to the old file; this may be the operational
+			// log itself, so report straight to stderr
+			fmt.Fprintf(os.Stderr, "%v; retrying in %v\n", err, rotateRetryInterval)
+			rw.retryAt = time.Now().Add(rotateRetryInterval)
+		}
+	}
+
+	n, err := rw.file.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *rotatingWriter) shouldRotate(incoming int64) bool {
+	if time.Now().Before(rw.retryAt) {
+		return false
+	}
+	if rw.maxBytes > 0 && rw.size+incoming > rw.maxBytes {
+		return true
+	}
+	return rw.interval > 0 && time.Since(rw.openedAt) >= rw.interval
+}
+
+// rotate moves the current file aside and starts a new one. If the file
+// cannot be moved, the current file is reopened so logging carries on. Caller
+// must hold rw.mutex.
+func (rw *rotatingWriter) rotate() error {
+	if err := rw.file.Close(); err != nil {
+		rw.file = nil
+		if openErr := rw.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to close log file: %v", err)
+	}
+	rw.file = nil
+
+	rotated := rw.path + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(rw.path, rotated); err != nil {
+		if openErr := rw.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	if err := rw.open(); err != nil {
+		return err
+	}
+
+	rw.background.Add(1)
+	go func() {
+		defer rw.background.Done()
+		rw.backgroundMutex.Lock()
+		defer rw.backgroundMutex.Unlock()
+
+		// A backlog of rotations may have pruned this file already
+		if _, err := os.Stat(rotated); err != nil {
+			return
+		}
+		if rw.compress {
+			if err := gzipFile(rotated); err != nil {
+				// Keep the uncompressed file rather than lose it. This may be the
+				// operational log itself, so report straight to stderr.
+				fmt.Fprintf(os.Stderr, "Failed to compress rotated log %s: %v\n", rotated, err)
+			}
+		}
+		rw.pruneBackups()
+	}()
+	return nil
+}
+
+// pruneBackups removes the oldest rotated files beyond maxBackups. Caller
+// must hold rw.backgroundMutex.
+func (rw *rotatingWriter) pruneBackups() {
+	if rw.maxBackups <= 0 {
+		return
+	}
+	backups := rotatedFiles(rw.path)
+	for len(backups) > rw.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// rotatedFiles lists the rotated copies of path, oldest first
+func rotatedFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz")
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+// gzipFile compresses path to path.gz and removes the original
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the current file once rotated files are compressed
+func (rw *rotatingWriter) Close() error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	rw.background.Wait()
+	if rw.file == nil {
+		return nil
+	}
+	err := rw.file.Close()
+	rw.file = nil
+	return err
+}
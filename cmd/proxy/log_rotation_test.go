@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLogRotationBySize tests that a full log file is rotated, compressed and pruned
+func TestLogRotationBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rw, err := newRotatingWriter(LogFileConfig{File: path, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer rw.Close()
+	// A few lines per file keeps the test fast
+	rw.maxBytes = 256
+
+	for i := 0; i < 100; i++ {
+		if _, err := fmt.Fprintf(rw, "entry %03d %s\n", i, strings.Repeat("x", 40)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// Compression and pruning run in the background
+	rw.background.Wait()
+	backups := rotatedFiles(path)
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 rotated files after pruning, got %v", backups)
+	}
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".gz") {
+			t.Errorf("Expected rotated file to be compressed: %s", backup)
+		}
+	}
+
+	// The newest backup holds the lines written just before the current file
+	file, err := os.Open(backups[1])
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Backup is not valid gzip: %v", err)
+	}
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Failed to decompress backup: %v", err)
+	}
+	if !strings.HasPrefix(string(content), "entry ") || int64(len(content)) > rw.maxBytes {
+		t.Errorf("Unexpected backup content (%d bytes): %q", len(content), content)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Active log missing: %v", err)
+	}
+	if info.Size() == 0 || info.Size() > rw.maxBytes {
+		t.Errorf("Expected active log within limit, got %d bytes", info.Size())
+	}
+}
+
+// TestLogRotationFailureKeepsLogging tests that a rotation which cannot move
+// the file aside leaves the writer appending rather than closed
+func TestLogRotationFailureKeepsLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	rw, err := newRotatingWriter(LogFileConfig{File: path})
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer rw.Close()
+	rw.maxBytes = 16
+
+	if _, err := rw.Write([]byte("first line\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// With the file gone the rename fails
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Failed to remove log: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := rw.Write([]byte("after failure\n")); err != nil {
+			t.Fatalf("Expected writes to continue after a failed rotation, got %v", err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the log to be reopened: %v", err)
+	}
+	if strings.Count(string(content), "after failure\n") != 3 {
+		t.Errorf("Expected all writes in the reopened log, got %q", content)
+	}
+}
+
+// TestAccessLogEntries tests that CONNECTs are written to the access log and rotated
+func TestAccessLogEntries(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://user:secret@" + upstreamAddr, Enabled: true, Weight: 1, Tag: "echo"},
+		},
+		AccessLog: LogFileConfig{File: path},
+	}
+	ps := NewProxyServer(config, "")
+	defer ps.closeLogFiles()
+	if ps.accessLog == nil {
+		t.Fatal("Expected access log to be open")
+	}
+	ps.accessLog.maxBytes = 200
+	proxyAddr := startTestProxy(t, ps)
+
+	for i := 0; i < 3; i++ {
+		conn, head := dialConnect(t, proxyAddr, "example.com:443")
+		if !strings.Contains(head, "200") {
+			t.Fatalf("Expected 200, got %q", head)
+		}
+		conn.Write([]byte("ping"))
+		buffer := make([]byte, 4)
+		io.ReadFull(conn, buffer)
+		conn.Close()
+	}
+	// Entries are written as each tunnel winds down; with a 200 byte limit
+	// every entry after the first rotates the file
+	deadline := time.Now().Add(2 * time.Second)
+	for len(rotatedFiles(path)) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if backups := rotatedFiles(path); len(backups) != 2 {
+		t.Fatalf("Expected 2 rotated access logs, got %v", backups)
+	}
+	if lines := countAccessLogLines(path); lines != 1 {
+		t.Errorf("Expected 1 entry in the active access log, got %d", lines)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open access log: %v", err)
+	}
+	defer file.Close()
+	var entry accessLogEntry
+	if err := json.NewDecoder(file).Decode(&entry); err != nil {
+		t.Fatalf("Invalid access log entry: %v", err)
+	}
+	if entry.Target != "example.com:443" || entry.Status != 200 || entry.Tag != "echo" ||
+		entry.Upstream != upstreamAddr || entry.BytesUp != 4 || entry.BytesDown != 4 {
+		t.Errorf("Unexpected access log entry: %+v", entry)
+	}
+}
+
+// TestAccessLogEgressIP tests that access_log.egress_ip adds the upstream's
+// last measured egress IP to each entry
+func TestAccessLogEgressIP(t *testing.T) {
+	upstream := "http://" + startMockUpstream(t, echoUpstream)
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{{URL: upstream, Enabled: true, Weight: 1}},
+		AccessLog:       LogFileConfig{File: path, EgressIP: true},
+	}
+	ps := NewProxyServer(config, "")
+	defer ps.closeLogFiles()
+	ps.recordCheckedIP(upstream, "203.0.113.7")
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200, got %q", head)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for countAccessLogLines(path) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read access log: %v", err)
+	}
+	var entry accessLogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Invalid access log entry %q: %v", data, err)
+	}
+	if entry.EgressIP != "203.0.113.7" {
+		t.Errorf("Expected egress_ip 203.0.113.7 in the entry, got %q", data)
+	}
+}
+
+// TestAccessLogBackpressure tests that a stalled access log drops entries
+// instead of holding up tunnels
+func TestAccessLogBackpressure(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+		AccessLog: LogFileConfig{File: path, BufferSize: 2, DropPolicy: dropOldest},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	// Stall the writer as a hung disk would
+	ps.accessLog.mutex.Lock()
+	const tunnels = 10
+	for i := 0; i < tunnels; i++ {
+		conn, head := dialConnect(t, proxyAddr, "example.com:443")
+		if !strings.Contains(head, "200") {
+			t.Fatalf("Tunnel %d: expected 200, got %q", i, head)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("ping"))
+		buffer := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			t.Fatalf("Tunnel %d stalled behind the access log: %v", i, err)
+		}
+		conn.Close()
+	}
+
+	// One entry is stuck in the writer and two are queued
+	var stats struct {
+		DroppedAccessLogs int64 `json:"dropped_access_logs_total"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for stats.DroppedAccessLogs < tunnels-3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		getStats(t, proxyAddr, &stats)
+	}
+	if stats.DroppedAccessLogs < tunnels-3 {
+		t.Errorf("Expected at least %d dropped access log entries, got %d", tunnels-3, stats.DroppedAccessLogs)
+	}
+
+	ps.accessLog.mutex.Unlock()
+	ps.closeLogFiles()
+	dropped := atomic.LoadInt64(&ps.stats.DroppedAccessLogs)
+	if lines := countAccessLogLines(path); int64(lines)+dropped != tunnels {
+		t.Errorf("Expected the %d surviving entries to be flushed on close, got %d", tunnels-dropped, lines)
+	}
+}
+
+func countAccessLogLines(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
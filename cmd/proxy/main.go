@@ -1,57 +1,267 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Config struct {
-	Server struct {
-		Name          string `json:"name"`
-		ListenAddress string `json:"listen_address"`
-		StatsEndpoint string `json:"stats_endpoint"`
-	} `json:"server"`
-	Authentication struct {
-		Enabled bool `json:"enabled"`
-		Users   []struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
-		} `json:"users"`
-	} `json:"authentication"`
-	UpstreamProxies []struct {
-		URL     string `json:"url"`
-		Enabled bool   `json:"enabled"`
-		Weight  int    `json:"weight"`
-		Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-	} `json:"upstream_proxies"`
-	UpstreamTimeout int `json:"upstream_timeout,omitempty"`
-	HealthCheck     struct {
-		Enabled          bool     `json:"enabled"`
-		IntervalSeconds  int      `json:"interval_seconds"`
-		TimeoutSeconds   int      `json:"timeout_seconds"`
-		FailureThreshold int      `json:"failure_threshold"`
-		RecoveryThreshold int     `json:"recovery_threshold"`
-		Endpoints        []string `json:"endpoints"`
-		EndpointRotation bool     `json:"endpoint_rotation"`
-	} `json:"health_check,omitempty"`
+	Server           ServerConfig          `json:"server"`
+	Authentication   AuthenticationConfig  `json:"authentication"`
+	UpstreamProxies  []UpstreamProxyConfig `json:"upstream_proxies"`
+	UpstreamTimeout  int                   `json:"upstream_timeout,omitempty"`
+	SlowStartSeconds int                   `json:"slow_start_seconds,omitempty"`
+	ErrorResponses   ErrorResponseConfig   `json:"error_responses,omitempty"`
+	IdleReaper       IdleReaperConfig      `json:"idle_reaper,omitempty"`
+	MemoryGuard      MemoryGuardConfig     `json:"memory_guard,omitempty"`
+	Bandwidth        BandwidthConfig       `json:"bandwidth,omitempty"`
+	CircuitBreaker   CircuitBreakerConfig  `json:"circuit_breaker,omitempty"`
+	HealthState      HealthStateConfig     `json:"health_state,omitempty"`
+	HealthScore      HealthScoreConfig     `json:"health_score,omitempty"`
+	RoutingRules     []RoutingRule         `json:"routing_rules,omitempty"`
+	ClientRules      []ClientRule          `json:"client_rules,omitempty"`
+	HealthCheck      HealthCheckConfig     `json:"health_check,omitempty"`
+
+	// RequestBudgetSeconds bounds the whole tunnel setup (selection, dial,
+	// TLS handshake and CONNECT exchange); defaults to upstream_timeout
+	RequestBudgetSeconds int `json:"request_budget_seconds,omitempty"`
+	// Dial gives DNS resolution and the TCP connect to upstreams timeouts
+	// of their own within the budget
+	Dial DialConfig `json:"dial,omitempty"`
+
+	// TagWeights splits traffic across tags first (e.g. {"a": 70, "b": 30});
+	// upstream weights then apply within the chosen tag
+	TagWeights map[string]int `json:"tag_weights,omitempty"`
+
+	// AccessLog writes one JSON line per CONNECT; Log redirects the
+	// operational log. Both rotate per LogFileConfig and need a restart
+	// to change.
+	AccessLog LogFileConfig `json:"access_log,omitempty"`
+	Log       LogFileConfig `json:"log,omitempty"`
+
+	// MinHealthyUpstreams marks /health degraded once fewer upstreams are
+	// healthy; RejectWhenDegraded then also answers CONNECTs with 503 so a
+	// load balancer in front routes elsewhere
+	MinHealthyUpstreams int  `json:"min_healthy_upstreams,omitempty"`
+	RejectWhenDegraded  bool `json:"reject_when_degraded,omitempty"`
+
+	// ReadinessDelaySeconds keeps /health at 503 after startup until the
+	// first health check round completes or this many seconds pass
+	ReadinessDelaySeconds int `json:"readiness_delay_seconds,omitempty"`
+
+	// MaxTunnelLifetimeSeconds closes tunnels this long after they were
+	// established, however active, so clients reconnect and may land on
+	// another exit IP (0 = no limit)
+	MaxTunnelLifetimeSeconds int `json:"max_tunnel_lifetime_seconds,omitempty"`
+
+	// EmptyTunnelWindowMs counts a tunnel the upstream closes within this
+	// many milliseconds of establishment, without sending a byte, as a
+	// failure of that upstream (0 = off)
+	EmptyTunnelWindowMs int `json:"empty_tunnel_window_ms,omitempty"`
+
+	// SlowTunnelLog warns about tunnels slow to set up or long-lived
+	SlowTunnelLog SlowTunnelLogConfig `json:"slow_tunnel_log,omitempty"`
+
+	// RecentRequests bounds the recent request history by age and count
+	RecentRequests RecentRequestsConfig `json:"recent_requests,omitempty"`
+
+	// ConnectionWarmer keeps pre-dialed connections to healthy upstreams
+	ConnectionWarmer ConnectionWarmerConfig `json:"connection_warmer,omitempty"`
+
+	// ConnectRetry moves a CONNECT to another upstream when the upstream
+	// answers with a retriable status
+	ConnectRetry ConnectRetryConfig `json:"connect_retry,omitempty"`
+
+	// Tracing exports a span per CONNECT over OTLP
+	Tracing TracingConfig `json:"tracing,omitempty"`
+}
+
+type ServerConfig struct {
+	Name          string `json:"name"`
+	ListenAddress string `json:"listen_address"`
+	StatsEndpoint string `json:"stats_endpoint"`
+	// PrettyStats indents stats JSON by default; ?pretty= overrides it per
+	// request
+	PrettyStats bool `json:"pretty_stats,omitempty"`
+	// SocketMode sets permissions for a "unix:" listen address (octal, default "0660")
+	SocketMode string `json:"socket_mode,omitempty"`
+	// AuthRealm overrides the realm in Proxy-Authenticate and WWW-Authenticate
+	// challenges (defaults: "Proxy" and "Stats")
+	AuthRealm string `json:"auth_realm,omitempty"`
+	// DebugHeaders exposes the selected upstream tag and request ID to clients
+	DebugHeaders bool `json:"debug_headers,omitempty"`
+	// MaxHeaderBytes caps the size of request headers (default 1 MB, Go's
+	// http.Server default); MaxHeaders caps their number for CONNECTs (0 = no limit)
+	MaxHeaderBytes int `json:"max_header_bytes,omitempty"`
+	MaxHeaders     int `json:"max_headers,omitempty"`
+	// MaxClientConnections caps open client connections on listen_address;
+	// the rest are answered 503 at accept time (0 = no limit). Changes need
+	// a restart.
+	MaxClientConnections int `json:"max_client_connections,omitempty"`
+	// AllowDirect tunnels straight to the target when no upstream is
+	// available. Development only: it bypasses the upstream pool entirely.
+	AllowDirect bool `json:"allow_direct,omitempty"`
+	// MetricsEndpoint serves Prometheus metrics with the stats credentials
+	// (empty disables); LatencyBucketsMs sets the latency histogram's upper
+	// bounds in milliseconds
+	MetricsEndpoint  string    `json:"metrics_endpoint,omitempty"`
+	LatencyBucketsMs []float64 `json:"latency_buckets_ms,omitempty"`
+	// Strategy picks among healthy upstreams: "round_robin" (default,
+	// weighted), "consistent_hash" on the CONNECT target host,
+	// "least_latency" or "smooth_weighted" (interleaved, lightly randomized)
+	Strategy string `json:"strategy,omitempty"`
+	// NoImmediateRepeat keeps round-robin from picking the previous
+	// selection again while another candidate is available
+	NoImmediateRepeat bool `json:"no_immediate_repeat,omitempty"`
+	// DefaultWeight is the weight of upstreams that leave weight out of the
+	// config file (0 = 1). An explicit "weight": 0 still stages the upstream.
+	DefaultWeight int `json:"default_weight,omitempty"`
+	// LatencyTolerancePct widens least_latency selection to upstreams within
+	// this many percent of the fastest, rotated by weight (0 = fastest only)
+	LatencyTolerancePct float64 `json:"latency_tolerance_pct,omitempty"`
+	// StatsListenAddress moves stats, metrics, health and admin endpoints
+	// to a listener of their own, leaving listen_address to CONNECTs only.
+	// Like listen_address, changes need a restart.
+	StatsListenAddress string `json:"stats_listen_address,omitempty"`
+	// KeepRotationOnReload continues the round-robin position across config
+	// reloads instead of restarting from the first upstream
+	KeepRotationOnReload bool `json:"keep_rotation_on_reload,omitempty"`
+	// AllowedPorts restricts CONNECT targets to these destination ports,
+	// answering 403 for any other (empty allows all)
+	AllowedPorts []int `json:"allowed_ports,omitempty"`
+}
+
+type AuthenticationConfig struct {
+	Enabled bool         `json:"enabled"`
+	Users   []UserConfig `json:"users"`
+}
+
+type UserConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Roles limits the user to "proxy" (CONNECT) or "stats" (stats,
+	// metrics and admin endpoints); empty grants both
+	Roles []string `json:"roles,omitempty"`
+}
+
+type UpstreamProxyConfig struct {
+	URL     string `json:"url"`
+	Enabled bool   `json:"enabled"`
+	// Weight 0 stages an upstream: it is health checked and reported but
+	// never selected until its weight is raised. Omitted in the config file,
+	// it takes server.default_weight.
+	Weight int    `json:"weight"`
+	Tag    string `json:"tag,omitempty"`
+	Note   string `json:"note,omitempty"`
+	// Backup upstreams only receive traffic when no primary is healthy
+	Backup bool `json:"backup,omitempty"`
+	// LocalAddr is the local IP to dial this upstream from (multi-homed hosts)
+	LocalAddr string `json:"local_addr,omitempty"`
+	// TLSInsecureSkipVerify disables certificate verification for https:// upstreams
+	TLSInsecureSkipVerify bool `json:"tls_insecure_skip_verify,omitempty"`
+	// WeightPercent expresses the share of traffic directly; when used it
+	// takes precedence over Weight and must be set on every enabled upstream
+	WeightPercent float64 `json:"weight_percent,omitempty"`
+	// RequestBudgetSeconds overrides the global setup budget for this upstream
+	RequestBudgetSeconds int `json:"request_budget_seconds,omitempty"`
+	// HealthEndpoints overrides health_check.endpoints for this upstream
+	HealthEndpoints []string `json:"health_endpoints,omitempty"`
+	// Tags puts the upstream in more groups (region, provider, tier...) for
+	// routing and stats; tag, or else the first of these, is its primary tag
+	Tags []string `json:"tags,omitempty"`
+	// ConnectHeaders are added to the CONNECT sent to this upstream (and to
+	// health checks through it); values expand $VAR / ${VAR} from the environment
+	ConnectHeaders map[string]string `json:"connect_headers,omitempty"`
+	// MaxConnections stops selecting this upstream while it has this many
+	// open connections (0 = no limit)
+	MaxConnections int `json:"max_connections,omitempty"`
+	// HostHeader normalizes the Host header of CONNECTs to this upstream
+	HostHeader HostHeaderConfig `json:"host_header,omitempty"`
+	// HealthProbe checks this upstream with a plain request instead of
+	// an IP resolver fetched through it
+	HealthProbe HealthProbeConfig `json:"health_probe,omitempty"`
+	// ExpectedIP is the egress IP (or CIDR subnet) health checks must
+	// measure; any other IP takes the upstream out of rotation
+	ExpectedIP string `json:"expected_ip,omitempty"`
+	// Priority orders the all-unhealthy fallback and the backup tier:
+	// lower numbers are tried first (default 0)
+	Priority int `json:"priority,omitempty"`
+}
+
+type HealthCheckConfig struct {
+	Enabled           bool     `json:"enabled"`
+	IntervalSeconds   int      `json:"interval_seconds"`
+	TimeoutSeconds    int      `json:"timeout_seconds"`
+	FailureThreshold  int      `json:"failure_threshold"`
+	RecoveryThreshold int      `json:"recovery_threshold"`
+	Endpoints         []string `json:"endpoints"`
+	EndpointRotation  bool     `json:"endpoint_rotation"`
+	// WarmupSeconds admits unverified upstreams after this long even without
+	// a successful probe (0 = wait for a probe)
+	WarmupSeconds int `json:"warmup_seconds,omitempty"`
+	// UseCapacityHints scales upstream weights by the "capacity" (0-1)
+	// reported in health check responses
+	UseCapacityHints bool `json:"use_capacity_hints,omitempty"`
+	// PreferFreshSeconds prefers, among equally weighted upstreams, those
+	// whose last successful check is within this many seconds of the
+	// freshest one (0 = disabled)
+	PreferFreshSeconds int `json:"prefer_fresh_seconds,omitempty"`
+	// TagWebhook is notified when a tag's upstreams all fail or recover
+	TagWebhook TagWebhookConfig `json:"tag_webhook,omitempty"`
+	// FailureCoalesceMs counts failures within this many milliseconds of
+	// the last counted one as the same incident (0 = count every failure)
+	FailureCoalesceMs int `json:"failure_coalesce_ms,omitempty"`
+	// FailOnRedirect fails a check whose endpoint answers with a redirect
+	// instead of following it, so a probe never ends up somewhere other
+	// than the configured endpoint
+	FailOnRedirect bool `json:"fail_on_redirect,omitempty"`
+	// FlapDetection holds down upstreams that change state too often
+	FlapDetection FlapDetectionConfig `json:"flap_detection,omitempty"`
+	// Concurrency is how many upstreams are checked at once (default 1)
+	Concurrency int `json:"concurrency,omitempty"`
+	// MaxPerEndpoint caps the checks outstanding against any one endpoint
+	// (0 = no cap)
+	MaxPerEndpoint int `json:"max_per_endpoint,omitempty"`
+	// MaxHealthAgeSeconds deprioritizes healthy upstreams that have not
+	// passed a check or carried a successful CONNECT for this long, and
+	// re-checks them (0 = disabled)
+	MaxHealthAgeSeconds int `json:"max_health_age_seconds,omitempty"`
+}
+
+// ErrorResponseConfig controls how error responses are rendered to clients
+type ErrorResponseConfig struct {
+	// RetryAfterSeconds adds a Retry-After header to 502/503 responses when > 0
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+	// JSONBody renders error bodies as {"error": ..., "status": ...}
+	JSONBody bool `json:"json_body,omitempty"`
 }
 
 type UpstreamStats struct {
 	URL                string    `json:"url"`
 	Tag                string    `json:"tag,omitempty"`
+	Tags               []string  `json:"tags,omitempty"`
 	Index              int       `json:"index"`
 	TotalRequests      int64     `json:"total_reqs"`
 	SuccessRequests    int64     `json:"success_reqs"`
@@ -60,10 +270,63 @@ type UpstreamStats struct {
 	AvgLatency         float64   `json:"avg_latency_ms"`
 	CurrentConnections int64     `json:"current_cons"`
 	LastRequest        time.Time `json:"last_request"`
+	// ErrorRate is FailedRequests / TotalRequests over the window (0 with
+	// no requests)
+	ErrorRate float64 `json:"error_rate"`
+
+	// Failed requests by cause, counted since start (or the last reset) in
+	// every window: the TCP connect or TLS handshake to the upstream,
+	// sending the CONNECT, reading the reply, and a non-200 reply
+	DialFailures         int64 `json:"dial_failures,omitempty"`
+	HandshakeFailures    int64 `json:"tls_handshake_failures,omitempty"`
+	ConnectWriteFailures int64 `json:"connect_write_failures,omitempty"`
+	ConnectReadFailures  int64 `json:"connect_read_failures,omitempty"`
+	Rejections           int64 `json:"rejected_connects,omitempty"`
+
+	// EmptyTunnels counts tunnels the upstream closed right after the
+	// CONNECT without sending anything (see empty_tunnel_window_ms)
+	EmptyTunnels int64 `json:"empty_tunnels,omitempty"`
+
+	// MaxConnections is the upstream's max_connections, and Utilization
+	// CurrentConnections as a fraction of it; both omitted without a limit
+	MaxConnections int64   `json:"max_connections,omitempty"`
+	Utilization    float64 `json:"utilization,omitempty"`
+
+	// recentLatency is the decaying average setup latency least_latency
+	// compares, valid once recentLatencySet
+	recentLatency    float64
+	recentLatencySet bool
+}
+
+// snapshot copies the stats, loading the counters handleConnect updates
+// atomically. Caller must hold ps.mutex.
+func (us *UpstreamStats) snapshot() UpstreamStats {
+	return UpstreamStats{
+		URL:                us.URL,
+		Tag:                us.Tag,
+		Tags:               us.Tags,
+		Index:              us.Index,
+		TotalRequests:      atomic.LoadInt64(&us.TotalRequests),
+		SuccessRequests:    atomic.LoadInt64(&us.SuccessRequests),
+		FailedRequests:     atomic.LoadInt64(&us.FailedRequests),
+		TotalLatency:       atomic.LoadInt64(&us.TotalLatency),
+		AvgLatency:         us.AvgLatency,
+		CurrentConnections: atomic.LoadInt64(&us.CurrentConnections),
+		LastRequest:        us.LastRequest,
+
+		DialFailures:         atomic.LoadInt64(&us.DialFailures),
+		HandshakeFailures:    atomic.LoadInt64(&us.HandshakeFailures),
+		ConnectWriteFailures: atomic.LoadInt64(&us.ConnectWriteFailures),
+		ConnectReadFailures:  atomic.LoadInt64(&us.ConnectReadFailures),
+		Rejections:           atomic.LoadInt64(&us.Rejections),
+
+		EmptyTunnels: atomic.LoadInt64(&us.EmptyTunnels),
+	}
 }
 
 type UpstreamHealth struct {
 	Tag               string    `json:"tag,omitempty"`
+	Tags              []string  `json:"tags,omitempty"`
 	FailureCount      int64     `json:"failure_count"`
 	SuccessCount      int64     `json:"success_count"`
 	LastFailure       time.Time `json:"last_failure"`
@@ -71,12 +334,90 @@ type UpstreamHealth struct {
 	IsHealthy         bool      `json:"is_healthy"`
 	FailureThreshold  int       `json:"failure_threshold"`
 	RecoveryThreshold int       `json:"recovery_threshold"`
+	RecoveredAt       time.Time `json:"recovered_at"`
+	// Verified is false for upstreams added at runtime until an active
+	// health check succeeds; unverified upstreams receive no traffic
+	Verified bool      `json:"verified"`
+	AddedAt  time.Time `json:"added_at"`
+	// ProbesInFlight counts trial requests while the circuit is HALF_OPEN
+	ProbesInFlight int `json:"probes_in_flight"`
+	// LastCheckedIP is the egress IP reported by the last successful health check
+	LastCheckedIP string `json:"last_checked_ip,omitempty"`
+	// CapacityHint is the capacity (0-1] advertised by the last successful
+	// health check, or 0 when none was reported
+	CapacityHint float64 `json:"capacity_hint,omitempty"`
+	// CoalescedFailures counts failures absorbed by failure_coalesce_ms
+	CoalescedFailures int64 `json:"coalesced_failures,omitempty"`
+	// LastCheckEndpoint is the endpoint used by the latest health check
+	LastCheckEndpoint string `json:"last_check_endpoint,omitempty"`
+	// UnexpectedIP is the egress IP outside expected_ip that the latest
+	// health check measured, cleared once a check sees an expected IP
+	UnexpectedIP string `json:"unexpected_ip,omitempty"`
+	// HeldDownUntil keeps a flapping upstream unhealthy until this time
+	HeldDownUntil time.Time `json:"held_down_until,omitempty"`
+
+	// transitions is when the upstream recently changed state, oldest
+	// first, for flap detection
+	transitions []time.Time
+
+	// recentErrors is the latest errors seen through this upstream, newest
+	// last, for /admin/upstreams/{index}
+	recentErrors []upstreamError
 }
 
 type WeightedUpstream struct {
-	URL    string
-	Weight int
-	Tag    string
+	URL      string
+	Weight   int
+	Tag      string
+	Tags     []string
+	Backup   bool
+	Priority int
+
+	// Scale multiplies Weight for the current selection only; 0 means
+	// unscaled. Selection stages adjust it with scaleWeight and
+	// normalizeWeights folds it into Weight before an upstream is picked.
+	Scale float64
+}
+
+// hasTag reports whether the upstream carries tag, as primary or extra tag
+func (w WeightedUpstream) hasTag(tag string) bool {
+	for _, t := range tagList(w.Tag, w.Tags) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// tagList merges a primary tag and extra tags into one list without blanks
+// or duplicates, primary first
+func tagList(tag string, tags []string) []string {
+	var merged []string
+	for _, t := range append([]string{tag}, tags...) {
+		if t == "" {
+			continue
+		}
+		duplicate := false
+		for _, existing := range merged {
+			if existing == t {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			merged = append(merged, t)
+		}
+	}
+	return merged
+}
+
+// RecentRequest is a single completed request kept for windowed statistics
+type RecentRequest struct {
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Upstream  string    `json:"upstream"`
+	Latency   int64     `json:"latency_ms"`
+	Success   bool      `json:"success"`
 }
 
 type TimeWindowStats struct {
@@ -88,6 +429,15 @@ type TimeWindowStats struct {
 	MaxConcurrency  int64                    `json:"max_concurrency"`
 	UpstreamMetrics []UpstreamStats          `json:"upstream_metrics"`
 	TagGroups       map[string]TagGroupStats `json:"tag_groups,omitempty"`
+
+	// SelectionGini measures how unevenly requests are spread relative to
+	// upstream weights: 0 means every upstream got exactly its weighted
+	// share, values near 1 mean one upstream took nearly everything
+	SelectionGini float64 `json:"selection_gini"`
+
+	// SaturationPct is the share of max_connections in use across all
+	// upstreams that have a limit
+	SaturationPct float64 `json:"saturation_pct"`
 }
 
 type TagGroupStats struct {
@@ -95,10 +445,30 @@ type TagGroupStats struct {
 	TotalRequests   int64   `json:"total_reqs"`
 	SuccessRequests int64   `json:"success_reqs"`
 	FailedRequests  int64   `json:"failed_reqs"`
+	ErrorRate       float64 `json:"error_rate"`
 	AvgLatency      float64 `json:"avg_latency_ms"`
 	UpstreamCount   int     `json:"upstream_count"`
 	HealthyCount    int     `json:"healthy_count"`
 	UnhealthyCount  int     `json:"unhealthy_count"`
+
+	// Open connections of the tag's upstreams that have max_connections,
+	// their summed limits and the fraction in use
+	CurrentConnections int64   `json:"current_cons,omitempty"`
+	MaxConnections     int64   `json:"max_connections,omitempty"`
+	Utilization        float64 `json:"utilization,omitempty"`
+}
+
+// ReloadStats tracks the outcome of config file reloads so that rejected
+// configs are visible without digging through logs
+type ReloadStats struct {
+	ReloadsTotal        int64     `json:"reloads_total"`
+	ReloadFailuresTotal int64     `json:"reload_failures_total"`
+	LastReloadTime      time.Time `json:"last_reload_time"`
+	LastFailureTime     time.Time `json:"last_failure_time"`
+	LastReloadError     string    `json:"last_reload_error,omitempty"`
+	// SkippedUpstreams lists the invalid upstream entries the last
+	// successful reload left out, with the reason for each
+	SkippedUpstreams []string `json:"skipped_upstreams,omitempty"`
 }
 
 type HealthCheckResult struct {
@@ -108,6 +478,11 @@ type HealthCheckResult struct {
 	Error     error
 	Endpoint  string
 	Timestamp time.Time
+	IP        string
+	// CapacityHint is the capacity the upstream advertised (0 = none)
+	CapacityHint float64
+	// UnexpectedIP is set when IP falls outside the upstream's expected_ip
+	UnexpectedIP bool
 }
 
 type HealthChecker struct {
@@ -116,13 +491,37 @@ type HealthChecker struct {
 	running       bool
 	mutex         sync.RWMutex
 	currentEndpointIndex int
+	// upstreamEndpointIndex rotates per-upstream health_endpoints overrides
+	upstreamEndpointIndex map[string]int
+	// tagDown records which tags were fully unhealthy after the last round
+	tagDown map[string]bool
+	// tagWebhooks delivers tag events in order, one tag at a time
+	tagWebhooks tagWebhookQueue
+	// endpointSlots enforces health_check.max_per_endpoint
+	endpointSlots endpointSlots
 }
 
 type IPResponse struct {
 	IP     string `json:"ip"`
 	Origin string `json:"origin"`
+	// Capacity is an optional self-reported share of full capacity (0-1)
+	Capacity *float64 `json:"capacity,omitempty"`
 }
 
+// ProxyServer is the CONNECT proxy. Locks are always taken in this order,
+// and none is held while dialing or relaying:
+//
+//   - reloadMutex serializes config reloads
+//   - mutex guards config, the upstream lists and stats (maps, slices and
+//     non-counter fields); a reload holds it for writing while rebuilding
+//   - healthMutex guards upstreamHealth and the entries it points to, and
+//     the per-endpoint health check tallies
+//   - idxMutex guards the round-robin positions
+//
+// latency, rings and the warm connection pool have their own locks, taken
+// last and never held while taking another.
+// Counters (int64 stats fields) are updated with atomics and may be bumped
+// under a read lock; readers must use atomic loads or snapshot().
 type ProxyServer struct {
 	config            *Config
 	configPath        string
@@ -131,11 +530,32 @@ type ProxyServer struct {
 	weightedUpstreams []WeightedUpstream
 	totalWeight       int
 	currentIdx        int
+	tagIdx            int
+	lastSelected      string
+	idxMutex          sync.Mutex // guards currentIdx, tagIdx and lastSelected; taken after mutex, never before
 	mutex             sync.RWMutex
 	reloadMutex       sync.Mutex
 	healthMutex       sync.RWMutex
 	upstreamHealth    map[string]*UpstreamHealth
 	healthChecker     *HealthChecker
+	tunnels           tunnelRegistry
+	idleReaperStop    chan struct{}
+	memoryGuardStop   chan struct{}
+	memoryPressure    int32 // 1 while shedding, accessed atomically
+	accessLog         *rotatingWriter
+	accessLogQueue    *accessLogQueue
+	operationalLog    *rotatingWriter
+	requestSeq        int64
+	latency           latencyHistograms
+	rings             hashRings
+	smooth            smoothWeights
+	reverifying       reverifications
+	warm              warmPool
+	tracer            spanExporter // nil while tracing is off
+	resolver          hostResolver // nil uses net.DefaultResolver
+	startedAt         time.Time
+	healthCycles      int64                     // completed health check rounds, accessed atomically
+	endpointTallies   map[string]*endpointTally // guarded by healthMutex
 	stats             struct {
 		StartTime       time.Time
 		TotalRequests   int64
@@ -144,12 +564,47 @@ type ProxyServer struct {
 		CurrentRequests int64
 		MaxConcurrency  int64
 		UpstreamMetrics map[string]*UpstreamStats
-		RecentRequests  []struct {
-			Timestamp time.Time
-			Upstream  string
-			Latency   int64
-			Success   bool
-		}
+		Reloads         ReloadStats
+		RecentRequests  []RecentRequest
+
+		// DegradedSelections counts picks made by the least-failed fallback
+		DegradedSelections int64
+		lastDegradedLog    int64 // unix nanoseconds, accessed atomically
+
+		// ShedRequests counts CONNECTs rejected under memory pressure
+		ShedRequests int64
+
+		// RejectedConnections counts client connections turned away at
+		// accept time over max_client_connections
+		RejectedConnections int64
+
+		// SetupTimeouts counts CONNECTs that exceeded their setup budget
+		SetupTimeouts int64
+
+		// DirectTunnels counts tunnels made without an upstream (allow_direct)
+		DirectTunnels int64
+
+		// ExpiredTunnels counts tunnels closed at max_tunnel_lifetime_seconds
+		ExpiredTunnels int64
+
+		// DroppedAccessLogs counts access log entries dropped while the
+		// writer could not keep up
+		DroppedAccessLogs int64
+
+		// WarmConnectionHits counts CONNECTs sent over a pre-dialed connection
+		WarmConnectionHits int64
+
+		// ClientAborts counts clients that disconnected before their tunnel
+		// was established
+		ClientAborts int64
+
+		// HijackFailures counts CONNECTs lost because the client connection
+		// could not be hijacked, a server-side error
+		HijackFailures int64
+
+		// ConnectRetries counts CONNECTs moved to another upstream after a
+		// retriable status (connect_retry)
+		ConnectRetries int64
 	}
 }
 
@@ -166,17 +621,24 @@ func NewProxyServer(config *Config, configPath string) *ProxyServer {
 	}
 
 	// Initialize stats
-	ps.stats.StartTime = time.Now()
+	ps.startedAt = time.Now()
+	ps.stats.StartTime = ps.startedAt
 	ps.stats.UpstreamMetrics = make(map[string]*UpstreamStats)
-	ps.stats.RecentRequests = make([]struct {
-		Timestamp time.Time
-		Upstream  string
-		Latency   int64
-		Success   bool
-	}, 0)
+	ps.stats.RecentRequests = make([]RecentRequest, 0)
+	ps.latency.configure(config.Server.LatencyBucketsMs)
+
+	// Open log files first so startup messages land in them
+	ps.openLogFiles()
 
 	// Build list of enabled upstream proxies with weights
-	ps.buildUpstreamLists()
+	ps.buildUpstreamLists(false)
+
+	// Restore health from the previous run, if recent enough
+	if config.HealthState.File != "" {
+		if _, err := ps.loadHealthState(config.HealthState.File, config.HealthState.ttl()); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	}
 
 	log.Printf("Upstream proxy initialization:")
 	log.Printf("  - Total enabled upstreams: %d", len(ps.upstreams))
@@ -190,12 +652,18 @@ func NewProxyServer(config *Config, configPath string) *ProxyServer {
 		if weighted.Tag != "" {
 			tagInfo = fmt.Sprintf(" [tag: %s]", weighted.Tag)
 		}
+		if weighted.Backup {
+			tagInfo += " [backup]"
+		}
 		log.Printf("  - Upstream: %s (weight: %d)%s", weighted.URL, weighted.Weight, tagInfo)
 	}
 	
 	if len(ps.upstreams) == 0 {
 		log.Printf("WARNING: No enabled upstream proxies found in configuration")
 	}
+	if config.Server.AllowDirect {
+		log.Printf("WARNING: server.allow_direct is enabled; CONNECTs will go directly to targets when no upstream is available")
+	}
 	
 	// Initialize health checker if enabled
 	if config.HealthCheck.Enabled {
@@ -207,10 +675,7 @@ func NewProxyServer(config *Config, configPath string) *ProxyServer {
 		
 		// Set default endpoints if none specified
 		if len(config.HealthCheck.Endpoints) == 0 {
-			config.HealthCheck.Endpoints = []string{
-				"https://api.ipify.org?format=json",
-				"https://httpbin.org/ip",
-			}
+			config.HealthCheck.Endpoints = append([]string(nil), defaultHealthEndpoints...)
 		}
 		
 		// Set default thresholds if not specified
@@ -229,52 +694,148 @@ func NewProxyServer(config *Config, configPath string) *ProxyServer {
 	} else {
 		log.Printf("  - Active health checks: disabled")
 	}
+
+	// Start idle tunnel reaper if enabled
+	ps.applyIdleReaper(config.IdleReaper)
+
+	// Start memory guard if a heap limit is configured
+	ps.applyMemoryGuard(config.MemoryGuard)
+
+	// Start the connection warmer if enabled
+	if warmer := config.ConnectionWarmer; warmer.ConnectionsPerUpstream > 0 {
+		interval := 10 * time.Second
+		if warmer.IntervalSeconds > 0 {
+			interval = time.Duration(warmer.IntervalSeconds) * time.Second
+		}
+		maxIdle := 30 * time.Second
+		if warmer.MaxIdleSeconds > 0 {
+			maxIdle = time.Duration(warmer.MaxIdleSeconds) * time.Second
+		}
+		ps.startConnectionWarmer(warmer.ConnectionsPerUpstream, interval, maxIdle)
+	}
+
+	// Export CONNECT spans if tracing is enabled
+	if config.Tracing.Enabled {
+		ps.tracer = newOTLPExporter(config.Tracing)
+		log.Printf("  - Tracing: enabled (OTLP endpoint: %s)", config.Tracing.OTLPEndpoint)
+	}
 	
 	return ps
 }
 
+// reloadConfig reloads the config file if it changed since the last load
 func (ps *ProxyServer) reloadConfig() error {
+	return ps.reload("file watcher", false)
+}
+
+// forceReloadConfig reloads the config file even if its modification time
+// is unchanged, as operators expect from SIGHUP
+func (ps *ProxyServer) forceReloadConfig(trigger string) error {
+	return ps.reload(trigger, true)
+}
+
+func (ps *ProxyServer) reload(trigger string, force bool) error {
 	ps.reloadMutex.Lock()
 	defer ps.reloadMutex.Unlock()
 
 	// Check if config file has been modified
 	stat, err := os.Stat(ps.configPath)
 	if err != nil {
-		return fmt.Errorf("failed to stat config file: %v", err)
+		err = fmt.Errorf("failed to stat config file: %v", err)
+		ps.recordReloadFailure(err)
+		return err
 	}
 
-	if !stat.ModTime().After(ps.configModTime) {
+	if !force && !stat.ModTime().After(ps.configModTime) {
 		// File hasn't been modified
 		return nil
 	}
 
-	log.Printf("Config file modified, reloading configuration from %s", ps.configPath)
+	log.Printf("Reloading configuration from %s (trigger: %s)", ps.configPath, trigger)
 
-	// Load new configuration
-	newConfig, err := loadConfig(ps.configPath)
+	// Load new configuration. Invalid upstream entries are skipped rather
+	// than failing the reload; anything else wrong keeps the old config.
+	newConfig, err := readConfig(ps.configPath)
+	var skipped []string
+	if err == nil {
+		skipped = dropInvalidUpstreams(newConfig)
+		if err = validateConfig(newConfig); err != nil {
+			err = fmt.Errorf("invalid config: %v", err)
+		}
+	}
 	if err != nil {
 		log.Printf("Failed to reload config: %v", err)
-		return fmt.Errorf("failed to reload config: %v", err)
+		err = fmt.Errorf("failed to reload config: %v", err)
+		ps.recordReloadFailure(err)
+		return err
 	}
 
 	// Update configuration with write lock
 	ps.mutex.Lock()
 	defer ps.mutex.Unlock()
 
+	// The listener is only opened at startup, so keep the address in use
+	// (which may come from -listen rather than the file)
+	newConfig.Server.ListenAddress = ps.config.Server.ListenAddress
+	newConfig.Server.StatsListenAddress = ps.config.Server.StatsListenAddress
+	oldStrategy := strategyName(ps.config.Server.Strategy)
+	idleReaperChanged := newConfig.IdleReaper != ps.config.IdleReaper
+	memoryGuardChanged := newConfig.MemoryGuard != ps.config.MemoryGuard
 	ps.config = newConfig
 	ps.configModTime = stat.ModTime()
+	ps.latency.configure(newConfig.Server.LatencyBucketsMs)
+	ps.stats.Reloads.ReloadsTotal++
+	ps.stats.Reloads.LastReloadTime = time.Now()
+	ps.stats.Reloads.SkippedUpstreams = skipped
 
 	// Rebuild upstream list
 	oldUpstreams := ps.upstreams
-	ps.currentIdx = 0
 
-	// Use the new build method
-	ps.buildUpstreamLists()
+	// An upstream whose credentials changed keeps its state
+	rotated := ps.carryOverRotatedCredentials(oldUpstreams)
+
+	// Use the new build method. Upstreams added by the reload stay out of
+	// rotation until the active health checker has verified them.
+	ps.buildUpstreamLists(ps.healthChecker != nil)
+
+	// Restarting the rotation on every reload favors the front of the list
+	// when reloads are frequent; keep_rotation_on_reload carries it over.
+	// Selection reads the strategy from ps.config, so a new one applies to
+	// the next CONNECT; it starts from clean state.
+	strategyChanged := strategyName(newConfig.Server.Strategy) != oldStrategy
+	if strategyChanged {
+		ps.rings.reset()
+	}
+	ps.idxMutex.Lock()
+	if newConfig.Server.KeepRotationOnReload && ps.totalWeight > 0 && !strategyChanged {
+		ps.currentIdx %= ps.totalWeight
+	} else {
+		ps.currentIdx = 0
+		ps.tagIdx = 0
+		ps.smooth.reset()
+	}
+	ps.idxMutex.Unlock()
+
+	if idleReaperChanged {
+		ps.applyIdleReaper(newConfig.IdleReaper)
+	}
+	if memoryGuardChanged {
+		ps.applyMemoryGuard(newConfig.MemoryGuard)
+	}
 
 	log.Printf("Configuration reloaded successfully:")
 	log.Printf("  - Server: %s", newConfig.Server.Name)
 	log.Printf("  - Authentication: %t", newConfig.Authentication.Enabled)
 	log.Printf("  - Upstream proxies: %d enabled (was %d)", len(ps.upstreams), len(oldUpstreams))
+	if strategyChanged {
+		log.Printf("  - Strategy: %s (was %s)", strategyName(newConfig.Server.Strategy), oldStrategy)
+	}
+	for _, reason := range skipped {
+		log.Printf("  ! Skipped invalid upstream: %s", reason)
+	}
+	for upstream := range rotated {
+		log.Printf("  ~ Rotated credentials for upstream: %s", redactUpstreamURL(upstream))
+	}
 
 	// Log upstream changes
 	for _, upstream := range ps.upstreams {
@@ -285,7 +846,7 @@ func (ps *ProxyServer) reloadConfig() error {
 				break
 			}
 		}
-		if !found {
+		if !found && rotated[upstream] == "" {
 			tagInfo := ""
 			for _, weighted := range ps.weightedUpstreams {
 				if weighted.URL == upstream && weighted.Tag != "" {
@@ -300,7 +861,7 @@ func (ps *ProxyServer) reloadConfig() error {
 	for _, oldUpstream := range oldUpstreams {
 		found := false
 		for _, upstream := range ps.upstreams {
-			if upstream == oldUpstream {
+			if upstream == oldUpstream || rotated[upstream] == oldUpstream {
 				found = true
 				break
 			}
@@ -320,12 +881,51 @@ func (ps *ProxyServer) reloadConfig() error {
 	return nil
 }
 
+// recordReloadFailure updates the reload failure counters
+func (ps *ProxyServer) recordReloadFailure(err error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.stats.Reloads.ReloadFailuresTotal++
+	ps.stats.Reloads.LastFailureTime = time.Now()
+	ps.stats.Reloads.LastReloadError = err.Error()
+}
+
+// getReloadStats returns a snapshot of the config reload counters
+func (ps *ProxyServer) getReloadStats() ReloadStats {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	return ps.stats.Reloads
+}
+
+// configMissingRetries and configMissingRetryDelay bound how long the watcher
+// waits for a config file that has disappeared, as it briefly does while a
+// deploy tool replaces it with an atomic rename
+const (
+	configMissingRetries    = 5
+	configMissingRetryDelay = time.Second
+)
+
+// checkConfig runs one pass of the config watcher. A missing config file is
+// re-checked up to retries times, keeping the current config meanwhile;
+// only when it stays missing does the reload fail and get reported.
+func (ps *ProxyServer) checkConfig(retries int, delay time.Duration) error {
+	for attempt := 0; attempt < retries; attempt++ {
+		if _, err := os.Stat(ps.configPath); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		time.Sleep(delay)
+	}
+	return ps.reloadConfig()
+}
+
 func (ps *ProxyServer) startConfigWatcher() {
 	ticker := time.NewTicker(1 * time.Minute)
 	go func() {
 		defer ticker.Stop()
 		for range ticker.C {
-			if err := ps.reloadConfig(); err != nil {
+			if err := ps.checkConfig(configMissingRetries, configMissingRetryDelay); err != nil {
 				log.Printf("Config reload error: %v", err)
 			}
 		}
@@ -333,92 +933,470 @@ func (ps *ProxyServer) startConfigWatcher() {
 	log.Printf("Config file watcher started (checking every 1 minute)")
 }
 
-// buildUpstreamLists builds the upstream lists with weights and health tracking
-func (ps *ProxyServer) buildUpstreamLists() {
+// buildUpstreamLists builds the upstream lists with weights and health tracking.
+// Enabled entries sharing the same URL are coalesced into a single upstream
+// whose weight is the sum of the duplicates, since health and stats are keyed
+// by URL and would otherwise be merged silently while the weight double-counts.
+// New upstreams start unverified when requireVerification is set.
+// Caller must hold ps.mutex (write).
+func (ps *ProxyServer) buildUpstreamLists(requireVerification bool) {
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
 	ps.upstreams = nil
 	ps.weightedUpstreams = nil
 	ps.totalWeight = 0
 
-	for _, upstream := range ps.config.UpstreamProxies {
+	percentWeights := percentToWeights(ps.config.UpstreamProxies)
+
+	seen := make(map[string]int)
+	for i, upstream := range ps.config.UpstreamProxies {
 		if upstream.Enabled {
 			weight := upstream.Weight
-			if weight < 0 {
+			if percentWeights != nil {
+				weight = percentWeights[i]
+			} else if weight < 0 {
 				weight = 1 // Default weight for negative weights
 			}
-			// Allow zero weights (they should be excluded from selection)
+			// Zero-weight upstreams stay in the lists so they are health
+			// checked and reported, but selection skips them
+
+			tags := tagList(upstream.Tag, upstream.Tags)
+			primaryTag := ""
+			if len(tags) > 0 {
+				primaryTag = tags[0]
+			}
+
+			if idx, duplicate := seen[upstream.URL]; duplicate {
+				existing := &ps.weightedUpstreams[idx]
+				existing.Weight += weight
+				ps.totalWeight += weight
+				log.Printf("Duplicate upstream %s in configuration, coalescing (combined weight: %d)", upstream.URL, existing.Weight)
+				if primaryTag != existing.Tag {
+					log.Printf("Duplicate upstream %s has conflicting tag %q, keeping %q", upstream.URL, primaryTag, existing.Tag)
+				}
+				continue
+			}
+			seen[upstream.URL] = len(ps.weightedUpstreams)
 
 			ps.upstreams = append(ps.upstreams, upstream.URL)
 			ps.weightedUpstreams = append(ps.weightedUpstreams, WeightedUpstream{
-				URL:    upstream.URL,
-				Weight: weight,
-				Tag:    upstream.Tag,
+				URL:      upstream.URL,
+				Weight:   weight,
+				Tag:      primaryTag,
+				Tags:     tags,
+				Backup:   upstream.Backup,
+				Priority: upstream.Priority,
 			})
 			ps.totalWeight += weight
 
 			// Initialize upstream health if not exists
 			if _, exists := ps.upstreamHealth[upstream.URL]; !exists {
 				ps.upstreamHealth[upstream.URL] = &UpstreamHealth{
-					Tag:               upstream.Tag,
+					Tag:               primaryTag,
+					Tags:              tags,
 					IsHealthy:         true,
 					FailureThreshold:  3, // Default failure threshold
 					RecoveryThreshold: 1, // Default recovery threshold
+					Verified:          !requireVerification,
+					AddedAt:           time.Now(),
+				}
+				if requireVerification {
+					log.Printf("Upstream %s held out of rotation until verified by a health check", upstream.URL)
 				}
 			} else {
-				// Update tag if it changed
-				ps.upstreamHealth[upstream.URL].Tag = upstream.Tag
+				// Update tags if they changed
+				ps.upstreamHealth[upstream.URL].Tag = primaryTag
+				ps.upstreamHealth[upstream.URL].Tags = tags
 			}
 
 			// Initialize stats if not exists
 			if _, exists := ps.stats.UpstreamMetrics[upstream.URL]; !exists {
 				ps.stats.UpstreamMetrics[upstream.URL] = &UpstreamStats{
 					URL:         upstream.URL,
-					Tag:         upstream.Tag,
+					Tag:         primaryTag,
+					Tags:        tags,
 					LastRequest: time.Now(),
 				}
 			} else {
-				// Update tag if it changed
-				ps.stats.UpstreamMetrics[upstream.URL].Tag = upstream.Tag
+				// Update tags if they changed
+				ps.stats.UpstreamMetrics[upstream.URL].Tag = primaryTag
+				ps.stats.UpstreamMetrics[upstream.URL].Tags = tags
 			}
 		}
 	}
 }
 
+// upstreamMetrics returns the stats entry for upstream. Entries are created
+// by buildUpstreamLists and never removed, so the pointer stays valid across
+// reloads; its counters must be accessed atomically.
+func (ps *ProxyServer) upstreamMetrics(upstream string) *UpstreamStats {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	return ps.stats.UpstreamMetrics[upstream]
+}
+
+// upstreamTagSuffix formats the upstream's tag for log lines, or "" if untagged
+func (ps *ProxyServer) upstreamTagSuffix(upstream string) string {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	for _, weighted := range ps.weightedUpstreams {
+		if weighted.URL == upstream && weighted.Tag != "" {
+			return fmt.Sprintf(" [tag: %s]", weighted.Tag)
+		}
+	}
+	return ""
+}
+
+// upstreamTags returns the tags of upstream, primary first
+func (ps *ProxyServer) upstreamTags(upstream string) []string {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	for _, weighted := range ps.weightedUpstreams {
+		if weighted.URL == upstream {
+			return tagList(weighted.Tag, weighted.Tags)
+		}
+	}
+	return nil
+}
+
+// percentToWeights translates weight_percent values of enabled upstreams into
+// the smallest integer weights with the same ratios (50/30/20 becomes 5/3/2),
+// so the round-robin cycle stays short. Returns nil when percentages are unused.
+func percentToWeights(upstreams []UpstreamProxyConfig) []int {
+	if !usesWeightPercent(upstreams) {
+		return nil
+	}
+
+	// Work in hundredths of a percent
+	weights := make([]int, len(upstreams))
+	divisor := 0
+	for i, upstream := range upstreams {
+		if !upstream.Enabled {
+			continue
+		}
+		weights[i] = int(math.Round(upstream.WeightPercent * 100))
+		divisor = gcd(divisor, weights[i])
+	}
+	if divisor > 1 {
+		for i := range weights {
+			weights[i] /= divisor
+		}
+	}
+	return weights
+}
+
+// usesWeightPercent reports whether any enabled upstream sets weight_percent
+func usesWeightPercent(upstreams []UpstreamProxyConfig) bool {
+	for _, upstream := range upstreams {
+		if upstream.Enabled && upstream.WeightPercent != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// scaleWeight multiplies the selection scale of upstream by factor
+func scaleWeight(upstream WeightedUpstream, factor float64) WeightedUpstream {
+	if upstream.Scale == 0 {
+		upstream.Scale = 1
+	}
+	upstream.Scale *= factor
+	return upstream
+}
+
+// normalizeWeights folds each candidate's Scale into its Weight, in
+// hundredths of the configured weight, then divides by the common divisor so
+// the round-robin cycle stays as short as the ratios allow: unscaled weight-1
+// upstreams still alternate. Every candidate keeps a weight of at least 1.
+// Candidates are returned as is when none was scaled.
+func normalizeWeights(upstreams []WeightedUpstream) []WeightedUpstream {
+	scaled := false
+	for _, upstream := range upstreams {
+		if upstream.Scale != 0 {
+			scaled = true
+			break
+		}
+	}
+	if !scaled {
+		return upstreams
+	}
+
+	normalized := make([]WeightedUpstream, len(upstreams))
+	divisor := 0
+	for i, upstream := range upstreams {
+		scale := upstream.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		normalized[i] = upstream
+		normalized[i].Weight = max(1, int(math.Round(float64(upstream.Weight)*scale*100)))
+		normalized[i].Scale = 0
+		divisor = gcd(divisor, normalized[i].Weight)
+	}
+	for i := range normalized {
+		normalized[i].Weight /= divisor
+	}
+	return normalized
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
 func (ps *ProxyServer) getNextUpstream() string {
+	upstream, _ := ps.selectUpstream("")
+	return upstream
+}
+
+// selectUpstream picks the next upstream, restricted to upstreams carrying
+// tag when it is non-empty, and reports whether the pick is a HALF_OPEN
+// trial, which the caller must resolve with finishProbe
+func (ps *ProxyServer) selectUpstream(tag string) (string, bool) {
+	return ps.selectUpstreamFor("", tag)
+}
+
+// selectUpstreamFor is selectUpstream for a CONNECT to target, which the
+// consistent_hash strategy keys on
+func (ps *ProxyServer) selectUpstreamFor(target, tag string, exclude ...string) (string, bool) {
 	ps.mutex.RLock()
 	defer ps.mutex.RUnlock()
 
 	if len(ps.weightedUpstreams) == 0 {
-		return ""
+		return "", false
 	}
 
-	// Get healthy upstreams only
-	healthyUpstreams := ps.getHealthyUpstreams()
+	// Get healthy upstreams only, minus those a retry has already tried
+	healthyUpstreams := ps.getHealthyUpstreams(tag)
+	for _, url := range exclude {
+		healthyUpstreams = withoutUpstream(healthyUpstreams, url)
+	}
 	if len(healthyUpstreams) == 0 {
+		// With the circuit breaker enabled, open circuits fail fast, and a
+		// retry has nowhere else to go
+		if ps.config.CircuitBreaker.enabled() || len(exclude) > 0 {
+			return "", false
+		}
 		// Fallback: return least failed upstream if all are unhealthy
-		return ps.getLeastFailedUpstream()
+		upstream := ps.getLeastFailedUpstream(tag)
+		if upstream != "" {
+			ps.recordDegradedSelection(upstream)
+		}
+		return upstream, false
+	}
+
+	// Upstreams at max_connections take no more tunnels
+	healthyUpstreams = ps.excludeSaturated(healthyUpstreams)
+	if len(healthyUpstreams) == 0 {
+		return "", false
+	}
+
+	// Healthy long ago is not healthy now: prefer upstreams verified
+	// within max_health_age_seconds
+	healthyUpstreams = ps.preferVerified(healthyUpstreams)
+
+	// Prefer upstreams that passed a health check most recently
+	healthyUpstreams = ps.preferFreshUpstreams(healthyUpstreams)
+
+	// Scale down upstreams that are still ramping up after recovery
+	healthyUpstreams = ps.applySlowStart(healthyUpstreams)
+
+	// Favor upstreams with better health scores when configured
+	healthyUpstreams = ps.applyHealthScores(healthyUpstreams)
+
+	// Honor capacity advertised by the upstreams themselves
+	healthyUpstreams = ps.applyCapacityHints(healthyUpstreams)
+
+	// Turn the scales set above into integer round-robin weights
+	healthyUpstreams = normalizeWeights(healthyUpstreams)
+
+	// least_latency narrows the rotation to the fastest upstreams
+	if ps.config.Server.Strategy == strategyLeastLatency {
+		healthyUpstreams = ps.fastestUpstreams(healthyUpstreams)
+	}
+
+	// Use weighted round-robin selection, skipping HALF_OPEN upstreams whose
+	// trial slots were taken since getHealthyUpstreams looked. Without a
+	// routing tag, tag_weights picks the tag first. Consistent hashing skips
+	// that stage so a target keeps its upstream.
+	hashed := ps.config.Server.Strategy == strategyConsistentHash && target != ""
+	for len(healthyUpstreams) > 0 {
+		var upstream string
+		if hashed {
+			upstream = ps.selectHashedUpstream(healthyUpstreams, target)
+		} else {
+			candidates := healthyUpstreams
+			if tag == "" {
+				candidates = ps.selectTagGroup(healthyUpstreams)
+			}
+			if ps.config.Server.Strategy == strategySmoothWeighted {
+				upstream = ps.smooth.next(candidates)
+			} else {
+				upstream = ps.selectWeightedUpstream(candidates)
+			}
+			if ps.config.Server.NoImmediateRepeat {
+				upstream = ps.avoidRepeat(candidates, upstream)
+			}
+		}
+		if probe, ok := ps.acquireProbe(upstream); ok {
+			if ps.config.Server.NoImmediateRepeat {
+				ps.idxMutex.Lock()
+				ps.lastSelected = upstream
+				ps.idxMutex.Unlock()
+			}
+			return upstream, probe
+		}
+		healthyUpstreams = withoutUpstream(healthyUpstreams, upstream)
+	}
+	return "", false
+}
+
+// applySlowStart scales candidate weights by how far recently recovered
+// upstreams are through the slow start window, so their share of traffic
+// ramps up linearly instead of jumping back to full weight. Caller must hold
+// ps.mutex (read).
+func (ps *ProxyServer) applySlowStart(upstreams []WeightedUpstream) []WeightedUpstream {
+	if ps.config.SlowStartSeconds <= 0 || len(upstreams) <= 1 {
+		return upstreams
+	}
+	window := time.Duration(ps.config.SlowStartSeconds) * time.Second
+	now := time.Now()
+
+	ps.healthMutex.RLock()
+	defer ps.healthMutex.RUnlock()
+
+	scaled := make([]WeightedUpstream, len(upstreams))
+	for i, upstream := range upstreams {
+		scaled[i] = upstream
+		if health, exists := ps.upstreamHealth[upstream.URL]; exists {
+			scaled[i] = scaleWeight(upstream, slowStartFactor(health.RecoveredAt, now, window))
+		}
+	}
+	return scaled
+}
+
+// slowStartFactor returns the fraction (0..1] of full weight an upstream
+// recovered at recoveredAt should receive at time now
+func slowStartFactor(recoveredAt, now time.Time, window time.Duration) float64 {
+	if recoveredAt.IsZero() || window <= 0 {
+		return 1
+	}
+	elapsed := now.Sub(recoveredAt)
+	if elapsed >= window {
+		return 1
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return float64(elapsed) / float64(window)
+}
+
+// preferFreshUpstreams drops candidates whose last successful health check
+// trails the freshest equally weighted candidate by more than
+// prefer_fresh_seconds. Upstreams whose checks are within that window of each
+// other are kept, so selection stays weighted round-robin among them.
+// Caller must hold ps.mutex (read).
+func (ps *ProxyServer) preferFreshUpstreams(upstreams []WeightedUpstream) []WeightedUpstream {
+	if ps.config.HealthCheck.PreferFreshSeconds <= 0 || len(upstreams) <= 1 {
+		return upstreams
+	}
+	tolerance := time.Duration(ps.config.HealthCheck.PreferFreshSeconds) * time.Second
+
+	ps.healthMutex.RLock()
+	defer ps.healthMutex.RUnlock()
+
+	lastSuccess := func(url string) time.Time {
+		if health, exists := ps.upstreamHealth[url]; exists {
+			return health.LastSuccess
+		}
+		return time.Time{}
+	}
+
+	// Freshest successful check per weight
+	freshest := make(map[int]time.Time)
+	for _, upstream := range upstreams {
+		if ts := lastSuccess(upstream.URL); ts.After(freshest[upstream.Weight]) {
+			freshest[upstream.Weight] = ts
+		}
 	}
 
-	// Use weighted round-robin selection
-	return ps.selectWeightedUpstream(healthyUpstreams)
+	filtered := make([]WeightedUpstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if freshest[upstream.Weight].Sub(lastSuccess(upstream.URL)) <= tolerance {
+			filtered = append(filtered, upstream)
+		}
+	}
+	return filtered
 }
 
-func (ps *ProxyServer) getHealthyUpstreams() []WeightedUpstream {
+func (ps *ProxyServer) getHealthyUpstreams(tag string) []WeightedUpstream {
 	ps.healthMutex.RLock()
 	defer ps.healthMutex.RUnlock()
 
-	var healthy []WeightedUpstream
+	warmup := time.Duration(ps.config.HealthCheck.WarmupSeconds) * time.Second
+	circuitBreaker := ps.config.CircuitBreaker
+	now := time.Now()
+
+	var healthy, healthyBackups []WeightedUpstream
 	for _, weighted := range ps.weightedUpstreams {
-		// Skip zero-weight upstreams
-		if weighted.Weight == 0 {
+		// Skip zero-weight upstreams and upstreams outside the requested tag
+		if weighted.Weight == 0 || (tag != "" && !weighted.hasTag(tag)) {
 			continue
 		}
-		if health, exists := ps.upstreamHealth[weighted.URL]; exists && health.IsHealthy {
-			healthy = append(healthy, weighted)
+		health, exists := ps.upstreamHealth[weighted.URL]
+		if !exists || !isWarmedUp(health, now, warmup) {
+			continue
+		}
+		// HALF_OPEN upstreams take part while they have trial slots free
+		if health.IsHealthy || circuitBreaker.acceptsProbe(health, now) {
+			if weighted.Backup {
+				healthyBackups = append(healthyBackups, weighted)
+			} else {
+				healthy = append(healthy, weighted)
+			}
 		}
 	}
+
+	// Backups only take traffic once every primary is unhealthy, and then
+	// only those with the lowest priority number
+	if len(healthy) == 0 {
+		return topPriority(healthyBackups)
+	}
 	return healthy
 }
 
+// topPriority keeps the upstreams sharing the lowest priority number
+func topPriority(upstreams []WeightedUpstream) []WeightedUpstream {
+	if len(upstreams) <= 1 {
+		return upstreams
+	}
+	best := upstreams[0].Priority
+	for _, upstream := range upstreams[1:] {
+		best = min(best, upstream.Priority)
+	}
+	top := make([]WeightedUpstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if upstream.Priority == best {
+			top = append(top, upstream)
+		}
+	}
+	return top
+}
+
+// isWarmedUp reports whether an upstream may receive traffic: it has been
+// verified by a health check, or has been configured longer than the warmup
+func isWarmedUp(health *UpstreamHealth, now time.Time, warmup time.Duration) bool {
+	if health.Verified {
+		return true
+	}
+	return warmup > 0 && now.Sub(health.AddedAt) >= warmup
+}
+
+// selectWeightedUpstream picks the next upstream by weighted round-robin.
+// Caller must hold ps.mutex (read).
 func (ps *ProxyServer) selectWeightedUpstream(upstreams []WeightedUpstream) string {
 	if len(upstreams) == 0 {
 		return ""
@@ -440,13 +1418,12 @@ func (ps *ProxyServer) selectWeightedUpstream(upstreams []WeightedUpstream) stri
 		return upstreams[0].URL
 	}
 
-	// Get current index for weighted selection (thread-safe)
-	ps.mutex.RUnlock()
-	ps.mutex.Lock()
+	// Advance the round-robin position under its own lock; the caller's
+	// read lock on ps.mutex stays held throughout
+	ps.idxMutex.Lock()
 	ps.currentIdx = (ps.currentIdx + 1) % totalWeight
 	targetWeight := ps.currentIdx
-	ps.mutex.Unlock()
-	ps.mutex.RLock()
+	ps.idxMutex.Unlock()
 
 	// Find upstream based on weight distribution
 	currentWeight := 0
@@ -461,24 +1438,63 @@ func (ps *ProxyServer) selectWeightedUpstream(upstreams []WeightedUpstream) stri
 	return upstreams[0].URL
 }
 
-func (ps *ProxyServer) getLeastFailedUpstream() string {
-	ps.healthMutex.RLock()
-	defer ps.healthMutex.RUnlock()
+// avoidRepeat replaces upstream with a weighted pick among the other
+// candidates when it was also the previous selection. Caller must hold
+// ps.mutex (read).
+func (ps *ProxyServer) avoidRepeat(candidates []WeightedUpstream, upstream string) string {
+	ps.idxMutex.Lock()
+	repeated := upstream == ps.lastSelected
+	ps.idxMutex.Unlock()
 
-	if len(ps.upstreams) == 0 {
-		return ""
+	if !repeated || len(candidates) < 2 {
+		return upstream
 	}
+	return ps.selectWeightedUpstream(withoutUpstream(candidates, upstream))
+}
 
-	leastFailed := ps.upstreams[0]
-	minFailures := int64(999999)
+// degradedLogInterval rate-limits the warning logged on degraded selections
+const degradedLogInterval = 30 * time.Second
 
-	for _, upstream := range ps.upstreams {
-		if health, exists := ps.upstreamHealth[upstream]; exists {
-			if health.FailureCount < minFailures {
-				minFailures = health.FailureCount
-				leastFailed = upstream
-			}
-		}
+// recordDegradedSelection counts a fallback selection made while no upstream
+// is healthy and logs a warning at most once per degradedLogInterval
+func (ps *ProxyServer) recordDegradedSelection(upstream string) {
+	total := atomic.AddInt64(&ps.stats.DegradedSelections, 1)
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&ps.stats.lastDegradedLog)
+	if now-last < int64(degradedLogInterval) || !atomic.CompareAndSwapInt64(&ps.stats.lastDegradedLog, last, now) {
+		return
+	}
+	log.Printf("WARNING: No healthy upstreams, falling back to least-failed upstream %s (degraded selections: %d)", upstream, total)
+}
+
+func (ps *ProxyServer) getLeastFailedUpstream(tag string) string {
+	ps.healthMutex.RLock()
+	defer ps.healthMutex.RUnlock()
+
+	// The lowest priority number wins; failure counts break ties
+	leastFailed := ""
+	bestPriority := 0
+	minFailures := int64(999999)
+
+	for _, weighted := range ps.weightedUpstreams {
+		// Zero-weight upstreams are never selected, even as a last resort
+		if weighted.Weight == 0 || (tag != "" && !weighted.hasTag(tag)) {
+			continue
+		}
+		if leastFailed == "" || weighted.Priority < bestPriority {
+			leastFailed = weighted.URL
+			bestPriority = weighted.Priority
+			minFailures = int64(999999)
+		} else if weighted.Priority > bestPriority {
+			continue
+		}
+		if health, exists := ps.upstreamHealth[weighted.URL]; exists {
+			if health.FailureCount < minFailures {
+				minFailures = health.FailureCount
+				leastFailed = weighted.URL
+			}
+		}
 	}
 
 	return leastFailed
@@ -486,6 +1502,11 @@ func (ps *ProxyServer) getLeastFailedUpstream() string {
 
 // Health management methods
 func (ps *ProxyServer) recordUpstreamFailure(upstream string) {
+	ps.mutex.RLock()
+	coalesce := time.Duration(ps.config.HealthCheck.FailureCoalesceMs) * time.Millisecond
+	flap := ps.config.HealthCheck.FlapDetection
+	ps.mutex.RUnlock()
+
 	ps.healthMutex.Lock()
 	defer ps.healthMutex.Unlock()
 
@@ -493,17 +1514,28 @@ func (ps *ProxyServer) recordUpstreamFailure(upstream string) {
 	if !exists {
 		health = &UpstreamHealth{
 			IsHealthy:         true,
+			Verified:          true,
 			FailureThreshold:  3,
 			RecoveryThreshold: 1,
 		}
 		ps.upstreamHealth[upstream] = health
 	}
 
+	// A burst of failures from one blip counts as a single strike.
+	// LastFailure only moves on counted failures, so a sustained outage
+	// still adds a strike per window.
+	now := time.Now()
+	if coalesce > 0 && !health.LastFailure.IsZero() && now.Sub(health.LastFailure) < coalesce {
+		health.CoalescedFailures++
+		return
+	}
+
 	health.FailureCount++
-	health.LastFailure = time.Now()
+	health.LastFailure = now
 
 	// Check if upstream should be marked unhealthy
 	if health.FailureCount >= int64(health.FailureThreshold) {
+		wasHealthy := health.IsHealthy
 		health.IsHealthy = false
 		// Log unhealthy status with tag information
 		tagInfo := ""
@@ -511,10 +1543,17 @@ func (ps *ProxyServer) recordUpstreamFailure(upstream string) {
 			tagInfo = fmt.Sprintf(" [tag: %s]", health.Tag)
 		}
 		log.Printf("Upstream %s%s marked as unhealthy after %d failures", upstream, tagInfo, health.FailureCount)
+		if wasHealthy {
+			flap.recordTransition(upstream, health, now)
+		}
 	}
 }
 
 func (ps *ProxyServer) recordUpstreamSuccess(upstream string) {
+	ps.mutex.RLock()
+	flap := ps.config.HealthCheck.FlapDetection
+	ps.mutex.RUnlock()
+
 	ps.healthMutex.Lock()
 	defer ps.healthMutex.Unlock()
 
@@ -522,20 +1561,27 @@ func (ps *ProxyServer) recordUpstreamSuccess(upstream string) {
 	if !exists {
 		health = &UpstreamHealth{
 			IsHealthy:         true,
+			Verified:          true,
 			FailureThreshold:  30,
 			RecoveryThreshold: 3,
 		}
 		ps.upstreamHealth[upstream] = health
 	}
 
+	now := time.Now()
 	health.SuccessCount++
-	health.LastSuccess = time.Now()
+	health.LastSuccess = now
 
-	// Check if upstream should recover
-	if !health.IsHealthy {
+	// Check if upstream should recover; a flapping one waits out its
+	// hold-down first
+	if !health.IsHealthy && !health.heldDown(now) {
+		if flap.recordTransition(upstream, health, now) {
+			return
+		}
 		// Reset failure count on success to allow recovery
 		health.FailureCount = 0
 		health.IsHealthy = true
+		health.RecoveredAt = now
 		// Log recovery with tag information
 		tagInfo := ""
 		if health.Tag != "" {
@@ -578,6 +1624,7 @@ func (ps *ProxyServer) setFailureThreshold(upstream string, threshold int) {
 	if !exists {
 		health = &UpstreamHealth{
 			IsHealthy:         true,
+			Verified:          true,
 			FailureThreshold:  threshold,
 			RecoveryThreshold: 1,
 		}
@@ -595,6 +1642,7 @@ func (ps *ProxyServer) setRecoveryThreshold(upstream string, threshold int) {
 	if !exists {
 		health = &UpstreamHealth{
 			IsHealthy:         true,
+			Verified:          true,
 			FailureThreshold:  3,
 			RecoveryThreshold: threshold,
 		}
@@ -605,6 +1653,12 @@ func (ps *ProxyServer) setRecoveryThreshold(upstream string, threshold int) {
 }
 
 // Health checker implementation
+// defaultHealthEndpoints are the IP resolvers used when health_check.endpoints is empty
+var defaultHealthEndpoints = []string{
+	"https://api.ipify.org?format=json",
+	"https://httpbin.org/ip",
+}
+
 func NewHealthChecker(proxyServer *ProxyServer) *HealthChecker {
 	return &HealthChecker{
 		proxyServer: proxyServer,
@@ -687,16 +1741,25 @@ func (hc *HealthChecker) performHealthChecks() {
 	}
 	
 	// Check each upstream proxy
-	for _, upstream := range upstreams {
+	checkAll(upstreams, config.HealthCheck.Concurrency, func(upstream string) {
 		result := hc.checkUpstreamHealth(upstream, config)
 		hc.processHealthCheckResult(result)
-	}
+	})
+
+	hc.checkTagTransitions()
+	atomic.AddInt64(&ps.healthCycles, 1)
 }
 
 func (hc *HealthChecker) checkUpstreamHealth(upstream string, config *Config) HealthCheckResult {
+	for _, proxy := range config.UpstreamProxies {
+		if proxy.URL == upstream && proxy.Enabled && proxy.usesHealthProbe() {
+			return hc.probeUpstream(proxy, config)
+		}
+	}
+
 	startTime := time.Now()
 	
-	endpoint := hc.getNextEndpoint(config)
+	endpoint := hc.getUpstreamEndpoint(upstream, config)
 	if endpoint == "" {
 		return HealthCheckResult{
 			Upstream:  upstream,
@@ -719,9 +1782,13 @@ func (hc *HealthChecker) checkUpstreamHealth(upstream string, config *Config) He
 		}
 	}
 	
-	// Make request through proxy
+	// Make request through proxy, waiting for a free slot on the endpoint.
+	// Time spent waiting is not the upstream's latency.
+	release := hc.endpointSlots.acquire(endpoint, config.HealthCheck.MaxPerEndpoint)
+	defer release()
+	requestStart := time.Now()
 	resp, err := client.Get(endpoint)
-	latency := time.Since(startTime)
+	latency := time.Since(requestStart)
 	
 	if err != nil {
 		return HealthCheckResult{
@@ -787,13 +1854,27 @@ func (hc *HealthChecker) checkUpstreamHealth(upstream string, config *Config) He
 			Latency:   latency,
 		}
 	}
+	if expected := expectedIP(config, upstream); expected != "" && !ipInExpected(expected, ip) {
+		return HealthCheckResult{
+			Upstream:     upstream,
+			Success:      false,
+			Error:        fmt.Errorf("egress IP %s is outside expected_ip %s", ip, expected),
+			Endpoint:     endpoint,
+			Timestamp:    startTime,
+			Latency:      latency,
+			IP:           ip,
+			UnexpectedIP: true,
+		}
+	}
 	
 	return HealthCheckResult{
-		Upstream:  upstream,
-		Success:   true,
-		Endpoint:  endpoint,
-		Timestamp: startTime,
-		Latency:   latency,
+		Upstream:     upstream,
+		Success:      true,
+		Endpoint:     endpoint,
+		Timestamp:    startTime,
+		Latency:      latency,
+		IP:           ip,
+		CapacityHint: capacityHint(ipResp.Capacity),
 	}
 }
 
@@ -812,6 +1893,34 @@ func (hc *HealthChecker) getNextEndpoint(config *Config) string {
 	return config.HealthCheck.Endpoints[hc.currentEndpointIndex]
 }
 
+// getUpstreamEndpoint returns the next endpoint to probe upstream with,
+// preferring its health_endpoints override over the global list
+func (hc *HealthChecker) getUpstreamEndpoint(upstream string, config *Config) string {
+	var endpoints []string
+	for _, proxy := range config.UpstreamProxies {
+		if proxy.URL == upstream && len(proxy.HealthEndpoints) > 0 {
+			endpoints = proxy.HealthEndpoints
+			break
+		}
+	}
+	if endpoints == nil {
+		return hc.getNextEndpoint(config)
+	}
+	if !config.HealthCheck.EndpointRotation || len(endpoints) == 1 {
+		return endpoints[0]
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if hc.upstreamEndpointIndex == nil {
+		hc.upstreamEndpointIndex = make(map[string]int)
+	}
+	index := (hc.upstreamEndpointIndex[upstream] + 1) % len(endpoints)
+	hc.upstreamEndpointIndex[upstream] = index
+	return endpoints[index]
+}
+
 func (hc *HealthChecker) createProxyClient(proxyURL string, config *Config) (*http.Client, error) {
 	parsedProxy, err := url.Parse(proxyURL)
 	if err != nil {
@@ -832,38 +1941,145 @@ func (hc *HealthChecker) createProxyClient(proxyURL string, config *Config) (*ht
 		DialContext:           dialer.DialContext,
 		ResponseHeaderTimeout: timeout,
 	}
+
+	// Health checks of https endpoints tunnel with the same CONNECT headers
+	for _, upstream := range config.UpstreamProxies {
+		if upstream.URL == proxyURL && upstream.Enabled {
+			transport.ProxyConnectHeader = connectHeaders(upstream.ConnectHeaders, parsedProxy.User != nil)
+			break
+		}
+	}
 	
 	return &http.Client{
-		Transport: transport,
-		Timeout:   timeout,
+		Transport:     transport,
+		Timeout:       timeout,
+		CheckRedirect: checkRedirectPolicy(config.HealthCheck),
 	}, nil
 }
 
+// checkRedirectPolicy is the redirect policy of health check clients: nil
+// follows redirects like any http.Client, fail_on_redirect fails on the first
+func checkRedirectPolicy(healthCheck HealthCheckConfig) func(*http.Request, []*http.Request) error {
+	if !healthCheck.FailOnRedirect {
+		return nil
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		return fmt.Errorf("redirected to %s with fail_on_redirect set", req.URL.Redacted())
+	}
+}
+
 func (hc *HealthChecker) processHealthCheckResult(result HealthCheckResult) {
 	ps := hc.proxyServer
+	ps.recordCheckEndpoint(result.Upstream, result.Endpoint, result.Success)
 	
 	if result.Success {
 		ps.recordUpstreamSuccess(result.Upstream)
+		ps.markUpstreamVerified(result.Upstream)
+		ps.recordCheckedIP(result.Upstream, result.IP)
+		ps.recordCapacityHint(result.Upstream, result.CapacityHint)
 		log.Printf("Health check passed for %s via %s (latency: %v)", result.Upstream, result.Endpoint, result.Latency)
 	} else {
 		ps.recordUpstreamFailure(result.Upstream)
+		if result.UnexpectedIP {
+			ps.flagUnexpectedIP(result.Upstream, result.IP)
+		}
+		ps.recordUpstreamError(result.Upstream, fmt.Sprintf("health check via %s: %v", result.Endpoint, result.Error))
 		log.Printf("Health check failed for %s via %s: %v (latency: %v)", result.Upstream, result.Endpoint, result.Error, result.Latency)
 	}
 }
 
+// markUpstreamVerified admits an upstream into rotation after a successful probe
+func (ps *ProxyServer) markUpstreamVerified(upstream string) {
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	if health, exists := ps.upstreamHealth[upstream]; exists && !health.Verified {
+		health.Verified = true
+		log.Printf("Upstream %s verified by health check, adding to rotation", upstream)
+	}
+}
+
+// recordCheckedIP stores the egress IP observed by a health check
+func (ps *ProxyServer) recordCheckedIP(upstream, ip string) {
+	if ip == "" {
+		return
+	}
+
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	if health, exists := ps.upstreamHealth[upstream]; exists {
+		health.LastCheckedIP = ip
+		health.UnexpectedIP = ""
+	}
+}
+
+// minCapacityHint keeps upstreams advertising zero capacity at a token weight
+const minCapacityHint = 0.01
+
+// capacityHint clamps an advertised capacity to (0, 1]; nil means no hint
+func capacityHint(capacity *float64) float64 {
+	if capacity == nil {
+		return 0
+	}
+	return math.Min(math.Max(*capacity, minCapacityHint), 1)
+}
+
+// recordCapacityHint stores the capacity advertised by the latest health
+// check, clearing any previous hint when none was reported
+func (ps *ProxyServer) recordCapacityHint(upstream string, hint float64) {
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	if health, exists := ps.upstreamHealth[upstream]; exists {
+		if hint != health.CapacityHint && hint > 0 {
+			log.Printf("Upstream %s advertises %.0f%% capacity", upstream, hint*100)
+		}
+		health.CapacityHint = hint
+	}
+}
+
+// applyCapacityHints scales candidate weights by the capacity upstreams
+// advertise in health check responses when health_check.use_capacity_hints
+// is set. Caller must hold ps.mutex (read).
+func (ps *ProxyServer) applyCapacityHints(upstreams []WeightedUpstream) []WeightedUpstream {
+	if !ps.config.HealthCheck.UseCapacityHints || len(upstreams) <= 1 {
+		return upstreams
+	}
+
+	ps.healthMutex.RLock()
+	defer ps.healthMutex.RUnlock()
+
+	scaled := make([]WeightedUpstream, len(upstreams))
+	for i, upstream := range upstreams {
+		scaled[i] = upstream
+		if health, exists := ps.upstreamHealth[upstream.URL]; exists && health.CapacityHint > 0 {
+			scaled[i] = scaleWeight(upstream, health.CapacityHint)
+		}
+	}
+	return scaled
+}
+
 func (ps *ProxyServer) getCircuitBreakerState(upstream string) string {
-	// TODO: Implement circuit breaker states
+	ps.mutex.RLock()
+	openTimeout := time.Duration(ps.config.CircuitBreaker.OpenTimeoutSeconds) * time.Second
+	ps.mutex.RUnlock()
+
 	ps.healthMutex.RLock()
 	defer ps.healthMutex.RUnlock()
 
 	health, exists := ps.upstreamHealth[upstream]
-	if !exists || health.IsHealthy {
-		return "CLOSED"
+	if !exists {
+		return circuitClosed
 	}
-	return "OPEN"
+	return circuitState(health, time.Now(), openTimeout)
 }
 
 func (ps *ProxyServer) getHealthMetrics() map[string]interface{} {
+	ps.mutex.RLock()
+	scores := ps.healthScores()
+	ps.mutex.RUnlock()
+
 	ps.healthMutex.RLock()
 	defer ps.healthMutex.RUnlock()
 
@@ -873,21 +2089,42 @@ func (ps *ProxyServer) getHealthMetrics() map[string]interface{} {
 
 	// Per-upstream health metrics
 	for url, health := range ps.upstreamHealth {
-		upstreams[url] = map[string]interface{}{
+		entry := map[string]interface{}{
 			"healthy":       health.IsHealthy,
 			"failure_count": health.FailureCount,
 			"success_count": health.SuccessCount,
 			"tag":           health.Tag,
+			"verified":      health.Verified,
+		}
+		if len(health.Tags) > 1 {
+			entry["tags"] = health.Tags
+		}
+		if health.CapacityHint > 0 {
+			entry["capacity_hint"] = health.CapacityHint
+		}
+		if score, exists := scores[url]; exists {
+			entry["health_score"] = math.Round(score*10) / 10
+		}
+		if health.LastCheckEndpoint != "" {
+			entry["last_check_endpoint"] = health.LastCheckEndpoint
+		}
+		if health.UnexpectedIP != "" {
+			entry["unexpected_ip"] = health.UnexpectedIP
+		}
+		if health.heldDown(time.Now()) {
+			entry["flapping"] = true
+			entry["held_down_until"] = health.HeldDownUntil
 		}
+		upstreams[url] = entry
 	}
 
 	// Group health metrics by tag
 	tagHealthStats := make(map[string]map[string]interface{})
 	for _, health := range ps.upstreamHealth {
-		if health.Tag != "" {
-			if _, exists := tagHealthStats[health.Tag]; !exists {
-				tagHealthStats[health.Tag] = map[string]interface{}{
-					"tag":                 health.Tag,
+		for _, tag := range tagList(health.Tag, health.Tags) {
+			if _, exists := tagHealthStats[tag]; !exists {
+				tagHealthStats[tag] = map[string]interface{}{
+					"tag":                 tag,
 					"total_upstreams":     0,
 					"healthy_upstreams":   0,
 					"unhealthy_upstreams": 0,
@@ -896,7 +2133,7 @@ func (ps *ProxyServer) getHealthMetrics() map[string]interface{} {
 				}
 			}
 
-			tagStats := tagHealthStats[health.Tag]
+			tagStats := tagHealthStats[tag]
 			tagStats["total_upstreams"] = tagStats["total_upstreams"].(int) + 1
 			tagStats["total_failures"] = tagStats["total_failures"].(int64) + health.FailureCount
 			tagStats["total_successes"] = tagStats["total_successes"].(int64) + health.SuccessCount
@@ -918,6 +2155,9 @@ func (ps *ProxyServer) getHealthMetrics() map[string]interface{} {
 	if len(tagGroups) > 0 {
 		metrics["tag_groups"] = tagGroups
 	}
+	if len(ps.endpointTallies) > 0 {
+		metrics["endpoints"] = ps.endpointTallySnapshot()
+	}
 	return metrics
 }
 
@@ -1004,6 +2244,10 @@ func (ps *ProxyServer) authenticate(r *http.Request) bool {
 
 	for _, user := range config.Authentication.Users {
 		if user.Username == username && user.Password == password {
+			if !user.hasRole(roleProxy) {
+				log.Printf("Authentication failed for user: %s (no %q role)", username, roleProxy)
+				return false
+			}
 			log.Printf("Authentication successful for user: %s", username)
 			return true
 		}
@@ -1062,6 +2306,10 @@ func (ps *ProxyServer) authenticateHTTP(r *http.Request) bool {
 
 	for _, user := range config.Authentication.Users {
 		if user.Username == username && user.Password == password {
+			if !user.hasRole(roleStats) {
+				log.Printf("HTTP authentication failed for user: %s (no %q role)", username, roleStats)
+				return false
+			}
 			log.Printf("HTTP authentication successful for user: %s", username)
 			return true
 		}
@@ -1071,8 +2319,124 @@ func (ps *ProxyServer) authenticateHTTP(r *http.Request) bool {
 	return false
 }
 
+// connectEstablishedResponse builds the raw 200 response for a CONNECT tunnel.
+// With server.debug_headers enabled it identifies the chosen upstream by tag
+// (or credential-free host) so credentials never reach the client.
+func (ps *ProxyServer) connectEstablishedResponse(upstream string, requestID int64) string {
+	ps.mutex.RLock()
+	debugHeaders := ps.config.Server.DebugHeaders
+	ps.mutex.RUnlock()
+
+	if !debugHeaders {
+		return "HTTP/1.1 200 Connection Established\r\n\r\n"
+	}
+	return fmt.Sprintf("HTTP/1.1 200 Connection Established\r\nX-Netdrift-Upstream: %s\r\nX-Netdrift-Request-Id: %d\r\n\r\n",
+		ps.upstreamLabel(upstream), requestID)
+}
+
+// upstreamLabel returns a client-safe name for an upstream: its tag when set,
+// otherwise its host:port without credentials
+func (ps *ProxyServer) upstreamLabel(upstream string) string {
+	ps.mutex.RLock()
+	for _, weighted := range ps.weightedUpstreams {
+		if weighted.URL == upstream && weighted.Tag != "" {
+			ps.mutex.RUnlock()
+			return weighted.Tag
+		}
+	}
+	ps.mutex.RUnlock()
+
+	host, _, err := parseUpstreamAuth(upstream)
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// checkHeaderLimits returns why r exceeds the configured header limits, or
+// "" if it is within them. The size counts each header line as it appeared
+// on the wire ("Name: value\r\n").
+func (ps *ProxyServer) checkHeaderLimits(r *http.Request) string {
+	ps.mutex.RLock()
+	maxBytes := ps.config.Server.MaxHeaderBytes
+	maxHeaders := ps.config.Server.MaxHeaders
+	ps.mutex.RUnlock()
+
+	if maxBytes <= 0 && maxHeaders <= 0 {
+		return ""
+	}
+
+	count, size := 0, 0
+	for name, values := range r.Header {
+		for _, value := range values {
+			count++
+			size += len(name) + len(value) + 4
+		}
+	}
+	if maxHeaders > 0 && count > maxHeaders {
+		return fmt.Sprintf("%d headers exceed the limit of %d", count, maxHeaders)
+	}
+	if maxBytes > 0 && size > maxBytes {
+		return fmt.Sprintf("%d header bytes exceed the limit of %d", size, maxBytes)
+	}
+	return ""
+}
+
+// authChallenge builds a Basic auth challenge using the configured realm,
+// falling back to defaultRealm
+func (ps *ProxyServer) authChallenge(defaultRealm string) string {
+	ps.mutex.RLock()
+	realm := ps.config.Server.AuthRealm
+	ps.mutex.RUnlock()
+
+	if realm == "" {
+		realm = defaultRealm
+	}
+	return `Basic realm="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(realm) + `"`
+}
+
+// writeError sends an error response using the configured error format.
+// Retry-After is only attached to 502/503, where retrying later can help.
+func (ps *ProxyServer) writeError(w http.ResponseWriter, message string, status int) {
+	ps.mutex.RLock()
+	errorConfig := ps.config.ErrorResponses
+	ps.mutex.RUnlock()
+
+	if errorConfig.RetryAfterSeconds > 0 && (status == http.StatusBadGateway || status == http.StatusServiceUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(errorConfig.RetryAfterSeconds))
+	}
+
+	if !errorConfig.JSONBody {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{
+		Error:  message,
+		Status: status,
+	})
+}
+
 func (ps *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
+	requestID := atomic.AddInt64(&ps.requestSeq, 1)
+
+	// Record the outcome of every CONNECT in the access log
+	entry := newAccessLogEntry(r, requestID, startTime)
+	span := ps.startConnectSpan(r, startTime)
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+	defer func() {
+		entry.Status = recorder.status
+		ps.writeAccessLog(entry)
+		ps.finishConnectSpan(span, recorder.status)
+	}()
 
 	// Increment current requests and update max concurrency
 	currentReqs := atomic.AddInt64(&ps.stats.CurrentRequests, 1)
@@ -1082,84 +2446,200 @@ func (ps *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
-	defer atomic.AddInt64(&ps.stats.CurrentRequests, -1)
+	defer releaseGauge(&ps.stats.CurrentRequests, "current requests")
 
 	atomic.AddInt64(&ps.stats.TotalRequests, 1)
 
+	// Shed new tunnels while the heap is over the configured limit
+	if ps.underMemoryPressure() {
+		log.Printf("[req %d] Shedding CONNECT to %s under memory pressure", requestID, r.Host)
+		atomic.AddInt64(&ps.stats.ShedRequests, 1)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.writeError(w, "Proxy is overloaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	// http.Server enforces MaxHeaderBytes only loosely, so check exactly here
+	if reason := ps.checkHeaderLimits(r); reason != "" {
+		log.Printf("[req %d] Rejected CONNECT to %s: %s", requestID, r.Host, reason)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.writeError(w, "Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
 	if !ps.authenticate(r) {
 		atomic.AddInt64(&ps.stats.FailedRequests, 1)
-		w.Header().Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
-		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		w.Header().Set("Proxy-Authenticate", ps.authChallenge("Proxy"))
+		ps.writeError(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	// Tunneling to the proxy's own listener would loop traffic back on itself
+	if isSelfTarget(r) {
+		log.Printf("[req %d] Rejected CONNECT to %s: target is the proxy itself", requestID, r.Host)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.writeError(w, "Refusing to tunnel to the proxy itself", http.StatusForbidden)
+		return
+	}
+
+	if !ps.portAllowed(r.Host) {
+		log.Printf("[req %d] Rejected CONNECT to %s: port not in allowed_ports", requestID, r.Host)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.writeError(w, "Destination port not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Too few healthy upstreams: send the client to another instance
+	if rd := ps.readiness(); rd.rejectWhenDegraded && rd.degraded() {
+		log.Printf("[req %d] Rejecting CONNECT to %s: %d healthy upstreams, %d required",
+			requestID, r.Host, rd.HealthyUpstreams, rd.MinHealthyUpstreams)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.writeError(w, "Not enough healthy upstream proxies", http.StatusServiceUnavailable)
 		return
 	}
 
-	upstream := ps.getNextUpstream()
+	// Client rules may pin the client, and otherwise routing rules the
+	// target, to upstreams with a specific tag. connect_retry may move the
+	// CONNECT to another upstream after a retriable status.
+	routeTag := ps.clientTag(r)
+	if routeTag == "" {
+		routeTag = ps.routeTag(r.Host)
+	}
+	var tried []string
+	for {
+		upstream, retry := ps.connectThrough(w, r, requestID, startTime, entry, span, routeTag, tried)
+		if !retry {
+			return
+		}
+		tried = append(tried, upstream)
+	}
+}
+
+// connectThrough sets up and relays the tunnel through one upstream, chosen
+// among those not in exclude. It reports retry instead of answering the
+// client when the upstream rejected the CONNECT with a retriable status.
+func (ps *ProxyServer) connectThrough(w http.ResponseWriter, r *http.Request, requestID int64, startTime time.Time, entry *accessLogEntry, span *connectSpan, routeTag string, exclude []string) (upstream string, retry bool) {
+	upstream, probe := ps.selectUpstreamFor(r.Host, routeTag, exclude...)
+	if routeTag != "" {
+		span.setAttribute("netdrift.route_tag", routeTag)
+	}
 	if upstream == "" {
+		if routeTag != "" {
+			log.Printf("No upstream available for %s (routed to tag %q)", r.Host, routeTag)
+		}
+		// Every upstream rejected the target, so answer with the last
+		// rejection rather than leave the pool through a direct tunnel
+		if len(exclude) > 0 {
+			span.setAttribute("netdrift.result", "rejected")
+			atomic.AddInt64(&ps.stats.FailedRequests, 1)
+			ps.writeError(w, "Upstream proxy rejected connection", http.StatusBadGateway)
+			return
+		}
+		if ps.allowDirect() {
+			span.setAttribute("netdrift.upstream", "direct")
+			ps.handleDirectConnect(w, r, requestID, entry)
+			return
+		}
+		span.setAttribute("netdrift.result", "no_upstream")
 		atomic.AddInt64(&ps.stats.FailedRequests, 1)
-		http.Error(w, "No upstream proxies available", http.StatusBadGateway)
+		ps.writeError(w, "No upstream proxies available", http.StatusBadGateway)
 		return
 	}
+	entry.setUpstream(ps, upstream)
+	span.setAttribute("netdrift.upstream", redactUpstreamURL(upstream))
+	if tags := ps.upstreamTags(upstream); len(tags) > 0 {
+		span.setAttribute("netdrift.upstream_tag", strings.Join(tags, ","))
+	}
+	span.event("upstream_selected")
+
+	// A HALF_OPEN trial fails unless the upstream accepts the CONNECT
+	probeResolved := false
+	if probe {
+		defer func() {
+			if !probeResolved {
+				ps.finishProbe(upstream, false)
+			}
+		}()
+	}
 
 	// Update upstream stats
-	upstreamStats := ps.stats.UpstreamMetrics[upstream]
+	upstreamStats := ps.upstreamMetrics(upstream)
 	atomic.AddInt64(&upstreamStats.TotalRequests, 1)
-	atomic.AddInt64(&upstreamStats.CurrentConnections, 1)
-	defer atomic.AddInt64(&upstreamStats.CurrentConnections, -1)
+	defer trackConnection(upstreamStats)()
 
 	// Parse upstream URL for authentication
 	upstreamHost, upstreamAuth, err := parseUpstreamAuth(upstream)
 	if err != nil {
-		upstreamTag := ""
-		for _, weighted := range ps.weightedUpstreams {
-			if weighted.URL == upstream && weighted.Tag != "" {
-				upstreamTag = fmt.Sprintf(" [tag: %s]", weighted.Tag)
-				break
-			}
-		}
+		upstreamTag := ps.upstreamTagSuffix(upstream)
 		log.Printf("Failed to parse upstream URL %s%s: %v", upstream, upstreamTag, err)
 		atomic.AddInt64(&ps.stats.FailedRequests, 1)
 		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
-		http.Error(w, "Invalid upstream proxy configuration", http.StatusBadGateway)
+		ps.writeError(w, "Invalid upstream proxy configuration", http.StatusBadGateway)
 		return
 	}
 
-	// Get configurable timeout with 5s default
-	timeout := 5 * time.Second
-	ps.mutex.RLock()
-	if ps.config.UpstreamTimeout > 0 {
-		timeout = time.Duration(ps.config.UpstreamTimeout) * time.Second
-	}
-	ps.mutex.RUnlock()
+	// The setup budget runs from the start of the request and spans
+	// selection, dial, TLS handshake and the upstream's CONNECT response
+	budget := ps.requestBudget(upstream)
+	ctx, cancel := context.WithDeadline(r.Context(), startTime.Add(budget))
+	defer cancel()
 
-	// Connect to upstream proxy
-	upstreamConn, err := net.DialTimeout("tcp", upstreamHost, timeout)
+	// Connect to upstream proxy, reusing a warmed connection if there is one
+	upstreamConn, err := ps.connectUpstream(ctx, upstream, upstreamHost)
 	if err != nil {
+		if setupExpired(ctx, err) {
+			ps.handleSetupTimeout(w, r, requestID, upstream, budget, probe, &probeResolved)
+			return
+		}
+		log.Printf("Failed to connect to upstream %s: %v", upstreamHost, err)
+		ps.recordUpstreamError(upstream, fmt.Sprintf("dial: %v", err))
 		atomic.AddInt64(&ps.stats.FailedRequests, 1)
 		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
-		http.Error(w, "Failed to connect to upstream proxy", http.StatusBadGateway)
+		if errors.Is(err, errTLSHandshake) {
+			atomic.AddInt64(&upstreamStats.HandshakeFailures, 1)
+		} else {
+			atomic.AddInt64(&upstreamStats.DialFailures, 1)
+		}
+		ps.writeError(w, "Failed to connect to upstream proxy", http.StatusBadGateway)
 		return
 	}
 	defer upstreamConn.Close()
+	span.event("upstream_connected")
 
-	// Send CONNECT request to upstream with authentication if present
-	var connectReq string
-	if upstreamAuth != "" {
-		connectReq = fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\n\r\n", r.Host, r.Host, upstreamAuth)
-	} else {
-		connectReq = fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", r.Host, r.Host)
+	// Bound the CONNECT exchange by the remaining budget, and abort it
+	// promptly if the client goes away
+	if deadline, ok := ctx.Deadline(); ok {
+		upstreamConn.SetDeadline(deadline)
 	}
-	if _, err := upstreamConn.Write([]byte(connectReq)); err != nil {
-		upstreamTag := ""
-		for _, weighted := range ps.weightedUpstreams {
-			if weighted.URL == upstream && weighted.Tag != "" {
-				upstreamTag = fmt.Sprintf(" [tag: %s]", weighted.Tag)
-				break
-			}
+	stopCancelWatch := context.AfterFunc(ctx, func() {
+		upstreamConn.SetDeadline(time.Now())
+	})
+
+	// Send CONNECT request to upstream with authentication and any
+	// configured extra headers
+	proxyConfig := ps.upstreamConfig(upstream)
+	extraHeaders := connectHeaders(proxyConfig.ConnectHeaders, upstreamAuth != "")
+	connectReq := buildConnectRequest(r.Host, proxyConfig.HostHeader.format(r.Host), upstreamAuth, extraHeaders)
+	if err := writeFull(upstreamConn, []byte(connectReq)); err != nil {
+		if setupExpired(ctx, err) {
+			ps.handleSetupTimeout(w, r, requestID, upstream, budget, probe, &probeResolved)
+			return
 		}
+		upstreamTag := ps.upstreamTagSuffix(upstream)
 		log.Printf("Failed to send CONNECT to upstream %s%s: %v", upstream, upstreamTag, err)
-		http.Error(w, "Failed to connect", http.StatusBadGateway)
+		ps.recordUpstreamError(upstream, fmt.Sprintf("send CONNECT: %v", err))
+		ps.writeError(w, "Failed to connect", http.StatusBadGateway)
 		atomic.AddInt64(&ps.stats.FailedRequests, 1)
 		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
+		atomic.AddInt64(&upstreamStats.ConnectWriteFailures, 1)
+
+		// A half-sent CONNECT leaves the upstream connection unusable
+		if probe {
+			probeResolved = true
+			ps.finishProbe(upstream, false)
+		} else {
+			ps.recordUpstreamFailure(upstream)
+		}
 		return
 	}
 
@@ -1167,72 +2647,76 @@ func (ps *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	response := make([]byte, 1024)
 	n, err := upstreamConn.Read(response)
 	if err != nil {
-		upstreamTag := ""
-		for _, weighted := range ps.weightedUpstreams {
-			if weighted.URL == upstream && weighted.Tag != "" {
-				upstreamTag = fmt.Sprintf(" [tag: %s]", weighted.Tag)
-				break
-			}
+		if setupExpired(ctx, err) {
+			ps.handleSetupTimeout(w, r, requestID, upstream, budget, probe, &probeResolved)
+			return
 		}
+		upstreamTag := ps.upstreamTagSuffix(upstream)
 		log.Printf("Failed to read response from upstream %s%s: %v", upstream, upstreamTag, err)
-		http.Error(w, "Failed to connect", http.StatusBadGateway)
+		ps.recordUpstreamError(upstream, fmt.Sprintf("read CONNECT response: %v", err))
+		ps.writeError(w, "Failed to connect", http.StatusBadGateway)
 		atomic.AddInt64(&ps.stats.FailedRequests, 1)
 		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
+		atomic.AddInt64(&upstreamStats.ConnectReadFailures, 1)
 		return
 	}
 
 	responseStr := string(response[:n])
-	if !strings.Contains(responseStr, "200") {
-		upstreamTag := ""
-		for _, weighted := range ps.weightedUpstreams {
-			if weighted.URL == upstream && weighted.Tag != "" {
-				upstreamTag = fmt.Sprintf(" [tag: %s]", weighted.Tag)
-				break
-			}
-		}
+	statusLine, _, _ := strings.Cut(responseStr, "\r\n")
+	if status, ok := parseStatusLine(statusLine); !ok || status/100 != 2 {
+		upstreamTag := ps.upstreamTagSuffix(upstream)
 		log.Printf("Upstream proxy %s%s rejected connection: %s", upstream, upstreamTag, strings.TrimSpace(responseStr))
-		http.Error(w, "Upstream proxy rejected connection", http.StatusBadGateway)
-		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		ps.recordUpstreamError(upstream, fmt.Sprintf("rejected: %s", strings.TrimSpace(statusLine)))
 		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
+		atomic.AddInt64(&upstreamStats.Rejections, 1)
+		if ps.retriableStatus(status, len(exclude)+1) {
+			log.Printf("[req %d] Status %d is retriable, retrying %s on another upstream", requestID, status, r.Host)
+			atomic.AddInt64(&ps.stats.ConnectRetries, 1)
+			span.event("retry")
+			return upstream, true
+		}
+		ps.writeError(w, "Upstream proxy rejected connection", http.StatusBadGateway)
+		atomic.AddInt64(&ps.stats.FailedRequests, 1)
+		return
+	}
+	if probe {
+		probeResolved = true
+		ps.finishProbe(upstream, true)
+	}
+	span.event("upstream_accepted")
+
+	// Setup is done; the tunnel itself is not bound by the budget
+	if !stopCancelWatch() {
+		ps.handleSetupTimeout(w, r, requestID, upstream, budget, false, &probeResolved)
 		return
 	}
+	upstreamConn.SetDeadline(time.Time{})
 
 	// Hijack the connection
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		log.Printf("ResponseWriter doesn't support hijacking")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		atomic.AddInt64(&ps.stats.FailedRequests, 1)
-		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
+		ps.handleHijackFailure(w, requestID, upstreamConn, errors.New("ResponseWriter doesn't support hijacking"))
 		return
 	}
 
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
-		log.Printf("Failed to hijack connection: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		atomic.AddInt64(&ps.stats.FailedRequests, 1)
-		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
+		ps.handleHijackFailure(w, requestID, upstreamConn, err)
 		return
 	}
 	defer clientConn.Close()
 
 	// Send 200 Connection Established to client
-	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+	if _, err := clientConn.Write([]byte(ps.connectEstablishedResponse(upstream, requestID))); err != nil {
 		log.Printf("Failed to send 200 to client: %v", err)
-		atomic.AddInt64(&ps.stats.FailedRequests, 1)
-		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
+		ps.handleClientAbort(requestID, upstream, false, &probeResolved)
+		span.setAttribute("netdrift.result", "client_abort")
 		return
 	}
+	span.event("tunnel_established")
 
-	upstreamTag := ""
-	for _, weighted := range ps.weightedUpstreams {
-		if weighted.URL == upstream && weighted.Tag != "" {
-			upstreamTag = fmt.Sprintf(" [tag: %s]", weighted.Tag)
-			break
-		}
-	}
-	log.Printf("Established tunnel between client and %s via %s%s", r.Host, upstream, upstreamTag)
+	upstreamTag := ps.upstreamTagSuffix(upstream)
+	log.Printf("[req %d] Established tunnel between client and %s via %s%s", requestID, r.Host, upstream, upstreamTag)
 	atomic.AddInt64(&ps.stats.SuccessRequests, 1)
 	atomic.AddInt64(&upstreamStats.SuccessRequests, 1)
 
@@ -1241,41 +2725,72 @@ func (ps *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&upstreamStats.TotalLatency, elapsed)
 	atomic.AddInt64(&upstreamStats.TotalLatency, elapsed)
 
+	ps.latency.observe(upstream, float64(elapsed))
+	slow := ps.slowTunnelThresholds()
+	ps.warnIfSlow(requestID, "setup", r.Host, upstream, time.Since(startTime), slow.SetupMs)
+
 	ps.mutex.Lock()
 	upstreamStats.LastRequest = time.Now()
-	upstreamStats.AvgLatency = float64(upstreamStats.TotalLatency) / float64(upstreamStats.SuccessRequests)
+	upstreamStats.observeRecentLatency(float64(elapsed))
+	upstreamStats.AvgLatency = float64(atomic.LoadInt64(&upstreamStats.TotalLatency)) / float64(atomic.LoadInt64(&upstreamStats.SuccessRequests))
 
 	// Add to recent requests
-	ps.stats.RecentRequests = append(ps.stats.RecentRequests, struct {
-		Timestamp time.Time
-		Upstream  string
-		Latency   int64
-		Success   bool
-	}{
+	ps.recordRecentRequest(RecentRequest{
+		ID:        requestID,
 		Timestamp: time.Now(),
 		Upstream:  upstream,
 		Latency:   elapsed,
 		Success:   true,
 	})
+	ps.mutex.Unlock()
 
-	// Trim old requests (keep last 15 minutes)
-	cutoff := time.Now().Add(-15 * time.Minute)
-	for i, req := range ps.stats.RecentRequests {
-		if req.Timestamp.After(cutoff) {
-			ps.stats.RecentRequests = ps.stats.RecentRequests[i:]
-			break
-		}
+	established := time.Now()
+
+	toUpstream, toClient, closeTunnel := ps.openTunnel(r, upstream, clientConn, upstreamConn)
+	defer closeTunnel()
+
+	// Relay until either side is done
+	var upstreamClosed bool
+	entry.BytesUp, entry.BytesDown, upstreamClosed = relayTunnel(clientConn, upstreamConn, toUpstream, toClient)
+	if upstreamClosed && entry.BytesDown == 0 {
+		ps.checkEmptyTunnel(requestID, r.Host, upstream, upstreamStats, time.Since(established))
 	}
-	ps.mutex.Unlock()
+	span.setAttribute("netdrift.bytes_up", strconv.FormatInt(entry.BytesUp, 10))
+	span.setAttribute("netdrift.bytes_down", strconv.FormatInt(entry.BytesDown, 10))
+	ps.warnIfSlow(requestID, "duration", r.Host, upstream, time.Since(startTime), slow.DurationMs)
+	return upstream, false
+}
 
-	// Start bidirectional copying
-	go func() {
-		defer upstreamConn.Close()
-		defer clientConn.Close()
-		io.Copy(upstreamConn, clientConn)
-	}()
+// errorRate returns failed/total rounded to four decimals, or 0 when there
+// were no requests
+func errorRate(failed, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return math.Round(float64(failed)/float64(total)*10000) / 10000
+}
 
-	io.Copy(clientConn, upstreamConn)
+// giniCoefficient returns the Gini coefficient of values: 0 when all are
+// equal, approaching 1 as a single value dominates. Fewer than two values
+// or an all-zero input count as perfectly even.
+func giniCoefficient(values []float64) float64 {
+	n := len(values)
+	if n < 2 {
+		return 0
+	}
+	sorted := make([]float64, n)
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	var sum, weightedSum float64
+	for i, value := range sorted {
+		sum += value
+		weightedSum += float64(i+1) * value
+	}
+	if sum == 0 {
+		return 0
+	}
+	return 2*weightedSum/(float64(n)*sum) - float64(n+1)/float64(n)
 }
 
 func (ps *ProxyServer) getTimeWindowStats(window time.Duration) TimeWindowStats {
@@ -1300,16 +2815,13 @@ func (ps *ProxyServer) getTimeWindowStats(window time.Duration) TimeWindowStats
 	// Copy upstream metrics (for total stats) and recent requests (for windowed stats)
 	upstreamMetricsCopy := make(map[string]UpstreamStats)
 	for url, metric := range ps.stats.UpstreamMetrics {
-		upstreamMetricsCopy[url] = *metric
+		upstreamMetricsCopy[url] = metric.snapshot()
 	}
 
+	limits := ps.connectionLimits()
+
 	// For recent windows, filter recent requests by timestamp
-	recentRequests := make([]struct {
-		Timestamp time.Time
-		Upstream  string
-		Latency   int64
-		Success   bool
-	}, 0)
+	recentRequests := make([]RecentRequest, 0)
 	if isRecentWindow {
 		for _, req := range ps.stats.RecentRequests {
 			if req.Timestamp.After(cutoff) {
@@ -1327,26 +2839,33 @@ func (ps *ProxyServer) getTimeWindowStats(window time.Duration) TimeWindowStats
 	}
 	ps.healthMutex.RUnlock()
 
-	// Process data without holding any locks
-	upstreamStatsMap := make(map[string]*UpstreamStats)
+	// Process data without holding any locks. Per-upstream stats live in a
+	// slice parallel to upstreamsCopy and are located through a URL -> index
+	// map, keeping aggregation O(requests + upstreams) for large pools.
+	upstreamStatsList := make([]UpstreamStats, len(upstreamsCopy))
+	upstreamIndex := make(map[string]int, len(upstreamsCopy))
 	tagStats := make(map[string]*TagGroupStats)
 	tagLatencyMap := make(map[string]int64)
 
-	// Initialize per-upstream stats with unique keys (URL + index)
 	for i, upstream := range upstreamsCopy {
-		uniqueKey := fmt.Sprintf("%s#%d", upstream, i)
-		upstreamStatsMap[uniqueKey] = &UpstreamStats{
+		upstreamStatsList[i] = UpstreamStats{
 			URL:   upstream,
 			Index: i,
 		}
+		// Requests are attributed to the first upstream with a matching URL
+		if _, exists := upstreamIndex[upstream]; !exists {
+			upstreamIndex[upstream] = i
+		}
 
-		// Initialize tag group stats
-		if upstreamMetric, exists := upstreamMetricsCopy[upstream]; exists && upstreamMetric.Tag != "" {
-			if _, exists := tagStats[upstreamMetric.Tag]; !exists {
-				tagStats[upstreamMetric.Tag] = &TagGroupStats{
-					Tag: upstreamMetric.Tag,
+		// Initialize tag group stats for every tag the upstream carries
+		if upstreamMetric, exists := upstreamMetricsCopy[upstream]; exists {
+			for _, tag := range tagList(upstreamMetric.Tag, upstreamMetric.Tags) {
+				if _, exists := tagStats[tag]; !exists {
+					tagStats[tag] = &TagGroupStats{
+						Tag: tag,
+					}
+					tagLatencyMap[tag] = 0
 				}
-				tagLatencyMap[upstreamMetric.Tag] = 0
 			}
 		}
 	}
@@ -1364,32 +2883,29 @@ func (ps *ProxyServer) getTimeWindowStats(window time.Duration) TimeWindowStats
 				stats.FailedRequests++
 			}
 
-			// Find matching upstream by URL and update stats
-			for i, upstream := range upstreamsCopy {
-				if upstream == req.Upstream {
-					uniqueKey := fmt.Sprintf("%s#%d", upstream, i)
-					if us, exists := upstreamStatsMap[uniqueKey]; exists {
-						us.TotalRequests++
-						if req.Success {
-							us.SuccessRequests++
-							us.TotalLatency += req.Latency
-						} else {
-							us.FailedRequests++
-						}
-						break // Use first matching upstream for this request
-					}
+			// Update stats of the matching upstream
+			if i, exists := upstreamIndex[req.Upstream]; exists {
+				us := &upstreamStatsList[i]
+				us.TotalRequests++
+				if req.Success {
+					us.SuccessRequests++
+					us.TotalLatency += req.Latency
+				} else {
+					us.FailedRequests++
 				}
 			}
 
 			// Update tag group stats
-			if upstreamMetric, exists := upstreamMetricsCopy[req.Upstream]; exists && upstreamMetric.Tag != "" {
-				if tagGroup, exists := tagStats[upstreamMetric.Tag]; exists {
-					tagGroup.TotalRequests++
-					if req.Success {
-						tagGroup.SuccessRequests++
-						tagLatencyMap[upstreamMetric.Tag] += req.Latency
-					} else {
-						tagGroup.FailedRequests++
+			if upstreamMetric, exists := upstreamMetricsCopy[req.Upstream]; exists {
+				for _, tag := range tagList(upstreamMetric.Tag, upstreamMetric.Tags) {
+					if tagGroup, exists := tagStats[tag]; exists {
+						tagGroup.TotalRequests++
+						if req.Success {
+							tagGroup.SuccessRequests++
+							tagLatencyMap[tag] += req.Latency
+						} else {
+							tagGroup.FailedRequests++
+						}
 					}
 				}
 			}
@@ -1397,28 +2913,26 @@ func (ps *ProxyServer) getTimeWindowStats(window time.Duration) TimeWindowStats
 	} else {
 		// For total lifetime stats, use upstream metrics directly
 		for i, upstream := range upstreamsCopy {
-			uniqueKey := fmt.Sprintf("%s#%d", upstream, i)
 			if metric, exists := upstreamMetricsCopy[upstream]; exists {
-				if us, exists := upstreamStatsMap[uniqueKey]; exists {
-					us.TotalRequests = metric.TotalRequests
-					us.SuccessRequests = metric.SuccessRequests
-					us.FailedRequests = metric.FailedRequests
-					us.TotalLatency = metric.TotalLatency
-					
-					// Aggregate total stats
-					stats.TotalRequests += metric.TotalRequests
-					stats.SuccessRequests += metric.SuccessRequests
-					stats.FailedRequests += metric.FailedRequests
-					totalLatency += metric.TotalLatency
-					
-					// Update tag group stats
-					if metric.Tag != "" {
-						if tagGroup, exists := tagStats[metric.Tag]; exists {
-							tagGroup.TotalRequests += metric.TotalRequests
-							tagGroup.SuccessRequests += metric.SuccessRequests
-							tagGroup.FailedRequests += metric.FailedRequests
-							tagLatencyMap[metric.Tag] += metric.TotalLatency
-						}
+				us := &upstreamStatsList[i]
+				us.TotalRequests = metric.TotalRequests
+				us.SuccessRequests = metric.SuccessRequests
+				us.FailedRequests = metric.FailedRequests
+				us.TotalLatency = metric.TotalLatency
+
+				// Aggregate total stats
+				stats.TotalRequests += metric.TotalRequests
+				stats.SuccessRequests += metric.SuccessRequests
+				stats.FailedRequests += metric.FailedRequests
+				totalLatency += metric.TotalLatency
+
+				// Update tag group stats
+				for _, tag := range tagList(metric.Tag, metric.Tags) {
+					if tagGroup, exists := tagStats[tag]; exists {
+						tagGroup.TotalRequests += metric.TotalRequests
+						tagGroup.SuccessRequests += metric.SuccessRequests
+						tagGroup.FailedRequests += metric.FailedRequests
+						tagLatencyMap[tag] += metric.TotalLatency
 					}
 				}
 			}
@@ -1429,23 +2943,73 @@ func (ps *ProxyServer) getTimeWindowStats(window time.Duration) TimeWindowStats
 	if stats.SuccessRequests > 0 {
 		stats.AvgLatency = float64(totalLatency) / float64(stats.SuccessRequests)
 	}
-	
+
 	// Set max concurrency from the global max concurrency tracker
 	stats.MaxConcurrency = atomic.LoadInt64(&ps.stats.MaxConcurrency)
 
+	// Fairness of the distribution: requests per unit of weight
+	perWeight := make([]float64, 0, len(weightedUpstreamsCopy))
+	for _, weighted := range weightedUpstreamsCopy {
+		if i, exists := upstreamIndex[weighted.URL]; exists && weighted.Weight > 0 {
+			perWeight = append(perWeight, float64(upstreamStatsList[i].TotalRequests)/float64(weighted.Weight))
+		}
+	}
+	stats.SelectionGini = math.Round(giniCoefficient(perWeight)*1000) / 1000
+
 	// Finalize upstream stats
+	var poolConnections, poolCapacity int64
+	stats.UpstreamMetrics = make([]UpstreamStats, 0, len(upstreamStatsList))
 	for i, upstream := range upstreamsCopy {
-		uniqueKey := fmt.Sprintf("%s#%d", upstream, i)
-		if us, exists := upstreamStatsMap[uniqueKey]; exists {
-			if us.SuccessRequests > 0 {
-				us.AvgLatency = float64(us.TotalLatency) / float64(us.SuccessRequests)
+		us := &upstreamStatsList[i]
+		if us.SuccessRequests > 0 {
+			us.AvgLatency = float64(us.TotalLatency) / float64(us.SuccessRequests)
+		}
+		us.ErrorRate = errorRate(us.FailedRequests, us.TotalRequests)
+		if metric, exists := upstreamMetricsCopy[upstream]; exists {
+			us.CurrentConnections = metric.CurrentConnections
+			us.DialFailures = metric.DialFailures
+			us.HandshakeFailures = metric.HandshakeFailures
+			us.ConnectWriteFailures = metric.ConnectWriteFailures
+			us.ConnectReadFailures = metric.ConnectReadFailures
+			us.Rejections = metric.Rejections
+			us.EmptyTunnels = metric.EmptyTunnels
+			us.Tag = metric.Tag
+			us.Tags = metric.Tags
+			us.LastRequest = metric.LastRequest
+		}
+		if limit, limited := limits[upstream]; limited {
+			us.MaxConnections = limit
+			us.Utilization = utilization(us.CurrentConnections, limit)
+			poolConnections += us.CurrentConnections
+			poolCapacity += limit
+		}
+		stats.UpstreamMetrics = append(stats.UpstreamMetrics, *us)
+	}
+	if poolCapacity > 0 {
+		stats.SaturationPct = math.Round(float64(poolConnections)/float64(poolCapacity)*1000) / 10
+	}
+
+	// Count healthy/unhealthy upstreams per tag in a single pass
+	for _, weighted := range weightedUpstreamsCopy {
+		for _, tag := range tagList(weighted.Tag, weighted.Tags) {
+			tagGroup, exists := tagStats[tag]
+			if !exists {
+				continue
 			}
-			if metric, exists := upstreamMetricsCopy[upstream]; exists {
-				us.CurrentConnections = metric.CurrentConnections
-				us.Tag = metric.Tag
-				us.LastRequest = metric.LastRequest
+			tagGroup.UpstreamCount++
+			if limit, limited := limits[weighted.URL]; limited {
+				tagGroup.CurrentConnections += upstreamMetricsCopy[weighted.URL].CurrentConnections
+				tagGroup.MaxConnections += limit
+			}
+			if health, exists := upstreamHealthCopy[weighted.URL]; exists {
+				if health.IsHealthy {
+					tagGroup.HealthyCount++
+				} else {
+					tagGroup.UnhealthyCount++
+				}
+			} else {
+				tagGroup.HealthyCount++ // Assume healthy if no health record
 			}
-			stats.UpstreamMetrics = append(stats.UpstreamMetrics, *us)
 		}
 	}
 
@@ -1455,23 +3019,8 @@ func (ps *ProxyServer) getTimeWindowStats(window time.Duration) TimeWindowStats
 		if tagGroup.SuccessRequests > 0 {
 			tagGroup.AvgLatency = float64(tagLatencyMap[tag]) / float64(tagGroup.SuccessRequests)
 		}
-
-		// Count healthy/unhealthy upstreams for this tag
-		for _, weighted := range weightedUpstreamsCopy {
-			if weighted.Tag == tag {
-				tagGroup.UpstreamCount++
-				if health, exists := upstreamHealthCopy[weighted.URL]; exists {
-					if health.IsHealthy {
-						tagGroup.HealthyCount++
-					} else {
-						tagGroup.UnhealthyCount++
-					}
-				} else {
-					tagGroup.HealthyCount++ // Assume healthy if no health record
-				}
-			}
-		}
-
+		tagGroup.ErrorRate = errorRate(tagGroup.FailedRequests, tagGroup.TotalRequests)
+		tagGroup.Utilization = utilization(tagGroup.CurrentConnections, tagGroup.MaxConnections)
 		stats.TagGroups[tag] = *tagGroup
 	}
 
@@ -1480,6 +3029,13 @@ func (ps *ProxyServer) getTimeWindowStats(window time.Duration) TimeWindowStats
 
 func (ps *ProxyServer) handleStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	pretty := ps.prettyStats(r)
+
+	// ?raw=true skips the aggregates and returns only the newest requests
+	if r.URL.Query().Get("raw") == "true" {
+		writeStatsJSON(w, r, ps.getRecentRequests(recentRequestsLimit(r)), pretty)
+		return
+	}
 
 	// Get basic stats without holding mutex
 	ps.mutex.RLock()
@@ -1500,57 +3056,520 @@ func (ps *ProxyServer) handleStats(w http.ResponseWriter, r *http.Request) {
 		TotalStats         TimeWindowStats `json:"total"`
 		RecentStats        TimeWindowStats `json:"recent_15m"`
 		CurrentConcurrency int64           `json:"current_concurrency"`
+		ConfigReloads      ReloadStats     `json:"config_reloads"`
+		DegradedSelections int64           `json:"degraded_selections_total"`
+		ShedRequests       int64           `json:"shed_requests_total"`
+		RejectedConns      int64           `json:"rejected_connections_total"`
+		SetupTimeouts      int64           `json:"setup_timeouts_total"`
+		DirectTunnels      int64           `json:"direct_tunnels_total"`
+		ExpiredTunnels     int64           `json:"expired_tunnels_total"`
+		DroppedAccessLogs  int64           `json:"dropped_access_logs_total"`
+		WarmConnectionHits int64           `json:"warm_connection_hits_total"`
+		ClientAborts       int64           `json:"client_aborts_total"`
+		HijackFailures     int64           `json:"hijack_failures_total"`
+		ConnectRetries     int64           `json:"connect_retries_total"`
+		RecentRequests     []RecentRequest `json:"recent_requests,omitempty"`
 	}{
 		StartTime:          startTime,
 		Uptime:             uptime.String(),
 		TotalStats:         totalStats,
 		RecentStats:        recentStats,
 		CurrentConcurrency: atomic.LoadInt64(&ps.stats.CurrentRequests),
+		ConfigReloads:      ps.getReloadStats(),
+		DegradedSelections: atomic.LoadInt64(&ps.stats.DegradedSelections),
+		ShedRequests:       atomic.LoadInt64(&ps.stats.ShedRequests),
+		RejectedConns:      atomic.LoadInt64(&ps.stats.RejectedConnections),
+		SetupTimeouts:      atomic.LoadInt64(&ps.stats.SetupTimeouts),
+		DirectTunnels:      atomic.LoadInt64(&ps.stats.DirectTunnels),
+		ExpiredTunnels:     atomic.LoadInt64(&ps.stats.ExpiredTunnels),
+		DroppedAccessLogs:  atomic.LoadInt64(&ps.stats.DroppedAccessLogs),
+		WarmConnectionHits: atomic.LoadInt64(&ps.stats.WarmConnectionHits),
+		ClientAborts:       atomic.LoadInt64(&ps.stats.ClientAborts),
+		HijackFailures:     atomic.LoadInt64(&ps.stats.HijackFailures),
+		ConnectRetries:     atomic.LoadInt64(&ps.stats.ConnectRetries),
+	}
+
+	// ?detail=requests adds the most recent requests with their IDs
+	if r.URL.Query().Get("detail") == "requests" {
+		stats.RecentRequests = ps.getRecentRequests(recentRequestsLimit(r))
+	}
+
+	writeStatsJSON(w, r, stats, pretty)
+}
+
+// prettyStats reports whether stats JSON is indented: ?pretty=true or false
+// when given, server.pretty_stats otherwise
+func (ps *ProxyServer) prettyStats(r *http.Request) bool {
+	if pretty, err := strconv.ParseBool(r.URL.Query().Get("pretty")); err == nil {
+		return pretty
+	}
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	return ps.config.Server.PrettyStats
+}
+
+// writeStatsJSON encodes v, indented if pretty and gzipped when the client
+// accepts it
+func writeStatsJSON(w http.ResponseWriter, r *http.Request, v interface{}, pretty bool) {
+	var out io.Writer = w
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
 	}
 
-	json.NewEncoder(w).Encode(stats)
+	encoder := json.NewEncoder(out)
+	if pretty {
+		encoder.SetIndent("", "  ")
+	}
+	encoder.Encode(v)
+}
+
+// recentRequestsLimit reads ?limit=, falling back to the default
+func recentRequestsLimit(r *http.Request) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		return n
+	}
+	return defaultRecentRequestsLimit
+}
+
+// RecentRequestsConfig bounds the recent request history behind the 15 minute
+// stats window and ?detail=requests. Whichever limit is stricter wins.
+type RecentRequestsConfig struct {
+	// MaxAgeSeconds drops requests older than this (default 900)
+	MaxAgeSeconds int `json:"max_age_seconds,omitempty"`
+	// MaxCount keeps at most this many of the newest requests (0 = no cap)
+	MaxCount int `json:"max_count,omitempty"`
+}
+
+// defaultRecentRequestsMaxAge is the history kept without max_age_seconds
+const defaultRecentRequestsMaxAge = 15 * time.Minute
+
+// recordRecentRequest appends req to the recent request history and trims
+// it by age and count. Caller must hold ps.mutex (write).
+func (ps *ProxyServer) recordRecentRequest(req RecentRequest) {
+	ps.stats.RecentRequests = append(ps.stats.RecentRequests, req)
+
+	limits := ps.config.RecentRequests
+	maxAge := defaultRecentRequestsMaxAge
+	if limits.MaxAgeSeconds > 0 {
+		maxAge = time.Duration(limits.MaxAgeSeconds) * time.Second
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for i, recent := range ps.stats.RecentRequests {
+		if recent.Timestamp.After(cutoff) {
+			ps.stats.RecentRequests = ps.stats.RecentRequests[i:]
+			break
+		}
+	}
+
+	if limits.MaxCount > 0 && len(ps.stats.RecentRequests) > limits.MaxCount {
+		ps.stats.RecentRequests = ps.stats.RecentRequests[len(ps.stats.RecentRequests)-limits.MaxCount:]
+	}
+}
+
+// defaultRecentRequestsLimit caps the detailed stats view unless ?limit= is given
+const defaultRecentRequestsLimit = 100
+
+// getRecentRequests returns up to limit of the newest recorded requests
+func (ps *ProxyServer) getRecentRequests(limit int) []RecentRequest {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	start := max(len(ps.stats.RecentRequests)-limit, 0)
+	recent := make([]RecentRequest, len(ps.stats.RecentRequests)-start)
+	copy(recent, ps.stats.RecentRequests[start:])
+	return recent
+}
+
+// acceptsGzip reports whether the client advertised gzip support in Accept-Encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		// An explicit q=0 means the coding is not acceptable
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
 }
 
 func (ps *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.mutex.RLock()
+	separateStats := ps.config.Server.StatsListenAddress != ""
+	ps.mutex.RUnlock()
+
+	// With a stats listener of its own, this port only tunnels
+	if !separateStats && ps.serveAdmin(w, r) {
+		return
+	}
+
+	if r.Method == "CONNECT" {
+		ps.handleConnect(w, r)
+		return
+	}
+
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// statsHandler serves only the stats, metrics, health and admin endpoints,
+// for server.stats_listen_address
+func (ps *ProxyServer) statsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ps.serveAdmin(w, r) {
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// serveAdmin handles r if it is for the stats, metrics, health or admin
+// endpoints, and reports whether it did
+func (ps *ProxyServer) serveAdmin(w http.ResponseWriter, r *http.Request) bool {
 	ps.mutex.RLock()
 	statsEndpoint := ps.config.Server.StatsEndpoint
+	metricsEndpoint := ps.config.Server.MetricsEndpoint
 	authEnabled := ps.config.Authentication.Enabled
 	ps.mutex.RUnlock()
 
-	if r.URL.Path == statsEndpoint {
+	// An empty stats_endpoint disables stats (and the admin endpoints with
+	// them); CONNECT requests have an empty path, so never match on ""
+	statsEnabled := statsEndpoint != ""
+
+	if r.URL.Path == healthEndpointPath && r.Method != "CONNECT" {
+		ps.handleHealth(w, r)
+		return true
+	}
+
+	if statsEnabled && r.URL.Path == statsEndpoint {
 		if authEnabled && !ps.authenticateHTTP(r) {
-			w.Header().Set("WWW-Authenticate", "Basic realm=\"Stats\"")
+			w.Header().Set("WWW-Authenticate", ps.authChallenge("Stats"))
 			http.Error(w, "Authentication Required", http.StatusUnauthorized)
-			return
+			return true
 		}
 		ps.handleStats(w, r)
-		return
+		return true
 	}
 
-	if r.Method == "CONNECT" {
-		ps.handleConnect(w, r)
-		return
+	if metricsEndpoint != "" && r.URL.Path == metricsEndpoint {
+		if authEnabled && !ps.authenticateHTTP(r) {
+			w.Header().Set("WWW-Authenticate", ps.authChallenge("Stats"))
+			http.Error(w, "Authentication Required", http.StatusUnauthorized)
+			return true
+		}
+		ps.handleMetrics(w, r)
+		return true
 	}
 
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if statsEnabled && (r.URL.Path == adminUpstreamsPath || strings.HasPrefix(r.URL.Path, adminUpstreamsPath+"/")) {
+		if authEnabled && !ps.authenticateHTTP(r) {
+			w.Header().Set("WWW-Authenticate", ps.authChallenge("Stats"))
+			http.Error(w, "Authentication Required", http.StatusUnauthorized)
+			return true
+		}
+		ps.handleAdminUpstreams(w, r)
+		return true
+	}
+
+	if statsEnabled && r.URL.Path == adminStatsResetPath {
+		if authEnabled && !ps.authenticateHTTP(r) {
+			w.Header().Set("WWW-Authenticate", ps.authChallenge("Stats"))
+			http.Error(w, "Authentication Required", http.StatusUnauthorized)
+			return true
+		}
+		ps.handleStatsReset(w, r)
+		return true
+	}
+
+	return false
 }
 
+// weightPercentTolerance allows for rounding in configs like 33.3/33.3/33.3
+const weightPercentTolerance = 0.5
+
 func loadConfig(filename string) (*Config, error) {
-	file, err := os.Open(filename)
+	config, err := readConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return config, nil
+}
+
+// readConfig parses a config file without validating it
+func readConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open config file: %v", err)
 	}
-	defer file.Close()
+
+	// Tolerate common editor artifacts: a UTF-8 BOM and trailing commas
+	data = stripTrailingCommas(bytes.TrimPrefix(data, utf8BOM))
 
 	var config Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %v", err)
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %v", describeJSONError(data, err))
 	}
-
+	applyDefaultWeight(data, &config)
 	return &config, nil
 }
 
+// applyDefaultWeight gives upstreams whose entry has no weight field
+// server.default_weight. A plain int cannot tell an omitted weight from an
+// explicit 0, so the entries are decoded a second time for just that field.
+func applyDefaultWeight(data []byte, config *Config) {
+	var weights struct {
+		UpstreamProxies []struct {
+			Weight *int `json:"weight"`
+		} `json:"upstream_proxies"`
+	}
+	if err := json.Unmarshal(data, &weights); err != nil {
+		return
+	}
+
+	defaultWeight := config.Server.DefaultWeight
+	if defaultWeight == 0 {
+		defaultWeight = 1
+	}
+	for i, entry := range weights.UpstreamProxies {
+		if entry.Weight == nil && i < len(config.UpstreamProxies) {
+			config.UpstreamProxies[i].Weight = defaultWeight
+		}
+	}
+}
+
+// utf8BOM is the byte order mark some editors prepend to UTF-8 files
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// stripTrailingCommas blanks out commas that directly precede a closing
+// brace or bracket (ignoring whitespace), leaving string contents alone.
+// Commas are replaced with spaces so error offsets still match the file.
+func stripTrailingCommas(data []byte) []byte {
+	cleaned := make([]byte, len(data))
+	copy(cleaned, data)
+
+	inString, escaped := false, false
+	lastComma := -1
+	for i, c := range cleaned {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+			lastComma = -1
+		case ',':
+			lastComma = i
+		case '}', ']':
+			if lastComma >= 0 {
+				cleaned[lastComma] = ' '
+			}
+			lastComma = -1
+		case ' ', '\t', '\r', '\n':
+		default:
+			lastComma = -1
+		}
+	}
+	return cleaned
+}
+
+// describeJSONError adds the line and column to JSON syntax and type errors
+func describeJSONError(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+
+	// Offset counts the bytes read up to and including the offending one
+	pos := min(max(offset-1, 0), int64(len(data)))
+	before := data[:pos]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(pos) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d, column %d (byte offset %d): %v", line, column, offset, err)
+}
+
+// validateUpstream checks one upstream_proxies entry on its own
+func validateUpstream(upstream UpstreamProxyConfig) error {
+	if upstream.LocalAddr != "" && net.ParseIP(upstream.LocalAddr) == nil {
+		return fmt.Errorf("upstream %s: local_addr must be an IP address, got %q", upstream.URL, upstream.LocalAddr)
+	}
+	if err := validateConnectHeaders(upstream); err != nil {
+		return err
+	}
+	host, _, err := parseUpstreamAuth(upstream.URL)
+	if err != nil {
+		return fmt.Errorf("upstream %s: %v (use scheme://[user:pass@]host:port)", upstream.URL, err)
+	}
+	if _, port, err := net.SplitHostPort(host); err != nil || port == "" {
+		return fmt.Errorf("upstream %s: URL must include a host and port (use scheme://[user:pass@]host:port)", upstream.URL)
+	}
+	if err := validateHealthProbe(upstream); err != nil {
+		return err
+	}
+	if err := validateExpectedIP(upstream); err != nil {
+		return err
+	}
+	if upstream.MaxConnections < 0 {
+		return fmt.Errorf("upstream %s: max_connections must not be negative, got %d", upstream.URL, upstream.MaxConnections)
+	}
+	return nil
+}
+
+// dropInvalidUpstreams removes the upstream_proxies entries that fail
+// validateUpstream, so one bad entry does not fail a whole reload, and
+// returns why each was skipped with credentials masked
+func dropInvalidUpstreams(config *Config) []string {
+	var skipped []string
+	valid := make([]UpstreamProxyConfig, 0, len(config.UpstreamProxies))
+	for _, upstream := range config.UpstreamProxies {
+		if err := validateUpstream(upstream); err != nil {
+			skipped = append(skipped, strings.ReplaceAll(err.Error(), upstream.URL, redactUpstreamURL(upstream.URL)))
+			continue
+		}
+		valid = append(valid, upstream)
+	}
+	config.UpstreamProxies = valid
+	return skipped
+}
+
+// validateConfig checks settings that parse correctly but cannot be used as given
+func validateConfig(config *Config) error {
+	if usesWeightPercent(config.UpstreamProxies) {
+		total := 0.0
+		for _, upstream := range config.UpstreamProxies {
+			if !upstream.Enabled {
+				continue
+			}
+			if upstream.WeightPercent <= 0 || upstream.WeightPercent > 100 {
+				return fmt.Errorf("upstream %s: weight_percent must be set on every enabled upstream and be within (0, 100], got %g",
+					upstream.URL, upstream.WeightPercent)
+			}
+			total += upstream.WeightPercent
+		}
+		if math.Abs(total-100) > weightPercentTolerance {
+			return fmt.Errorf("weight_percent of enabled upstreams must sum to 100, got %g", total)
+		}
+	}
+
+	for _, upstream := range config.UpstreamProxies {
+		if err := validateUpstream(upstream); err != nil {
+			return err
+		}
+	}
+
+	if webhookURL := config.HealthCheck.TagWebhook.URL; webhookURL != "" &&
+		!strings.HasPrefix(webhookURL, "http://") && !strings.HasPrefix(webhookURL, "https://") {
+		return fmt.Errorf("health_check.tag_webhook.url must be an http:// or https:// URL, got %q", webhookURL)
+	}
+
+	if err := validateStrategy(config.Server.Strategy); err != nil {
+		return err
+	}
+	if config.Server.StatsListenAddress != "" && config.Server.StatsListenAddress == config.Server.ListenAddress {
+		return fmt.Errorf("server.stats_listen_address must differ from listen_address, got %q for both", config.Server.ListenAddress)
+	}
+	if config.Server.MaxClientConnections < 0 {
+		return fmt.Errorf("server.max_client_connections must not be negative, got %d", config.Server.MaxClientConnections)
+	}
+	if config.Server.DefaultWeight < 0 {
+		return fmt.Errorf("server.default_weight must not be negative, got %d", config.Server.DefaultWeight)
+	}
+	if config.Server.LatencyTolerancePct < 0 {
+		return fmt.Errorf("server.latency_tolerance_pct must not be negative, got %g", config.Server.LatencyTolerancePct)
+	}
+
+	if err := validateUserRoles(config.Authentication.Users); err != nil {
+		return err
+	}
+	if err := validateFlapDetection(config.HealthCheck.FlapDetection); err != nil {
+		return err
+	}
+	if err := validateHealthConcurrency(config.HealthCheck); err != nil {
+		return err
+	}
+	if err := validateConnectRetry(config.ConnectRetry); err != nil {
+		return err
+	}
+	if err := validateTracing(config.Tracing); err != nil {
+		return err
+	}
+	if err := validateAllowedPorts(config.Server.AllowedPorts); err != nil {
+		return err
+	}
+	if err := validateLatencyBuckets(config.Server.LatencyBucketsMs); err != nil {
+		return err
+	}
+
+	if config.ReadinessDelaySeconds < 0 {
+		return fmt.Errorf("readiness_delay_seconds must not be negative, got %d", config.ReadinessDelaySeconds)
+	}
+	if config.MinHealthyUpstreams < 0 {
+		return fmt.Errorf("min_healthy_upstreams must not be negative, got %d", config.MinHealthyUpstreams)
+	}
+	if config.RecentRequests.MaxAgeSeconds < 0 || config.RecentRequests.MaxCount < 0 {
+		return fmt.Errorf("recent_requests limits must not be negative")
+	}
+	if config.SlowTunnelLog.SetupMs < 0 || config.SlowTunnelLog.DurationMs < 0 {
+		return fmt.Errorf("slow_tunnel_log thresholds must not be negative")
+	}
+	if config.MaxTunnelLifetimeSeconds < 0 {
+		return fmt.Errorf("max_tunnel_lifetime_seconds must not be negative, got %d", config.MaxTunnelLifetimeSeconds)
+	}
+	if warmer := config.ConnectionWarmer; warmer.ConnectionsPerUpstream < 0 || warmer.IntervalSeconds < 0 || warmer.MaxIdleSeconds < 0 {
+		return fmt.Errorf("connection_warmer settings must not be negative")
+	}
+	if config.EmptyTunnelWindowMs < 0 {
+		return fmt.Errorf("empty_tunnel_window_ms must not be negative, got %d", config.EmptyTunnelWindowMs)
+	}
+	if err := validateAccessLogQueue(config.AccessLog); err != nil {
+		return err
+	}
+
+	if err := validateDial(config.Dial); err != nil {
+		return err
+	}
+	if err := validateClientRules(config.ClientRules); err != nil {
+		return err
+	}
+	if err := validateRoutingRules(config.RoutingRules); err != nil {
+		return err
+	}
+
+	if err := validateTagWeights(config.TagWeights); err != nil {
+		return err
+	}
+
+	if _, err := parseSocketMode(config.Server.SocketMode); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func writePidFile() {
 	pidFile := "proxy.pid"
 	file, err := os.Create(pidFile)
@@ -1564,6 +3583,182 @@ func writePidFile() {
 	log.Printf("PID file created: %s", pidFile)
 }
 
+// dialUpstream connects to an upstream proxy. https:// upstreams get a TLS
+// session to the proxy itself before the CONNECT is sent.
+func (ps *ProxyServer) dialUpstream(ctx context.Context, upstream, host string) (net.Conn, error) {
+	proxyConfig := ps.upstreamConfig(upstream)
+
+	conn, err := ps.dialTCP(ctx, proxyConfig, host)
+	if err != nil || !strings.HasPrefix(upstream, "https://") {
+		return conn, err
+	}
+
+	serverName := host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		serverName = hostname
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: proxyConfig.TLSInsecureSkipVerify,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", errTLSHandshake, err)
+	}
+
+	return tlsConn, nil
+}
+
+// errTLSHandshake marks dial errors from the TLS handshake with an
+// https:// upstream, as opposed to the TCP connect
+var errTLSHandshake = errors.New("TLS handshake failed")
+
+// requestBudget returns the setup budget for a CONNECT through upstream:
+// its own request_budget_seconds, else the global one, else
+// upstream_timeout (5s default)
+func (ps *ProxyServer) requestBudget(upstream string) time.Duration {
+	if seconds := ps.upstreamConfig(upstream).RequestBudgetSeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	if ps.config.RequestBudgetSeconds > 0 {
+		return time.Duration(ps.config.RequestBudgetSeconds) * time.Second
+	}
+	if ps.config.UpstreamTimeout > 0 {
+		return time.Duration(ps.config.UpstreamTimeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// setupExpired reports whether a setup step failed because the budget ran
+// out or the client went away. The socket deadline is the budget's own
+// deadline and can fire just before ctx is marked done, so a deadline error
+// or a clock past the deadline counts as well.
+func setupExpired(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// handleSetupTimeout answers a CONNECT whose setup budget ran out (or whose
+// client went away) and records the failure against the upstream
+func (ps *ProxyServer) handleSetupTimeout(w http.ResponseWriter, r *http.Request, requestID int64, upstream string, budget time.Duration, probe bool, probeResolved *bool) {
+	if r.Context().Err() != nil {
+		ps.handleClientAbort(requestID, upstream, probe, probeResolved)
+		return
+	}
+
+	log.Printf("[req %d] Setup via %s canceled: budget of %v exceeded or client gone", requestID, upstream, budget)
+	ps.recordUpstreamError(upstream, fmt.Sprintf("setup canceled: budget of %v exceeded or client gone", budget))
+	atomic.AddInt64(&ps.stats.SetupTimeouts, 1)
+	atomic.AddInt64(&ps.stats.FailedRequests, 1)
+
+	ps.mutex.RLock()
+	if upstreamStats, exists := ps.stats.UpstreamMetrics[upstream]; exists {
+		atomic.AddInt64(&upstreamStats.FailedRequests, 1)
+	}
+	ps.mutex.RUnlock()
+
+	if probe {
+		*probeResolved = true
+		ps.finishProbe(upstream, false)
+	} else {
+		ps.recordUpstreamFailure(upstream)
+	}
+	ps.writeError(w, "Upstream proxy timed out", http.StatusGatewayTimeout)
+}
+
+// handleClientAbort accounts for a client that went away before its tunnel
+// was established. The upstream is not to blame, so its health and failure
+// counts are left alone and a HALF_OPEN trial is released without a verdict.
+func (ps *ProxyServer) handleClientAbort(requestID int64, upstream string, probe bool, probeResolved *bool) {
+	log.Printf("[req %d] Client disconnected during setup via %s", requestID, upstream)
+	atomic.AddInt64(&ps.stats.ClientAborts, 1)
+	atomic.AddInt64(&ps.stats.FailedRequests, 1)
+
+	if probe && !*probeResolved {
+		*probeResolved = true
+		ps.releaseProbe(upstream)
+	}
+}
+
+// handleHijackFailure answers a CONNECT the upstream accepted but whose
+// client connection the server cannot take over. That is a limitation of
+// the server (or of middleware wrapping the ResponseWriter), not an
+// upstream outage, so nothing is recorded against the upstream; its
+// connection is closed right away instead of lingering until return.
+func (ps *ProxyServer) handleHijackFailure(w http.ResponseWriter, requestID int64, upstreamConn net.Conn, err error) {
+	upstreamConn.Close()
+	log.Printf("[req %d] Server error: cannot hijack client connection: %v (not an upstream failure)", requestID, err)
+	atomic.AddInt64(&ps.stats.HijackFailures, 1)
+	atomic.AddInt64(&ps.stats.FailedRequests, 1)
+	ps.writeError(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// upstreamConfig returns the enabled configuration entry for an upstream URL
+func (ps *ProxyServer) upstreamConfig(upstream string) UpstreamProxyConfig {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	for _, proxy := range ps.config.UpstreamProxies {
+		if proxy.URL == upstream && proxy.Enabled {
+			return proxy
+		}
+	}
+	return UpstreamProxyConfig{URL: upstream}
+}
+
+// upstreamDialer builds the dialer for an upstream, binding to its local_addr
+// when configured. local_addr is checked by validateConfig.
+func upstreamDialer(proxyConfig UpstreamProxyConfig, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if ip := net.ParseIP(proxyConfig.LocalAddr); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return dialer
+}
+
+// writeFull writes all of data to w, retrying after short writes. A write
+// that makes no progress without reporting an error fails with io.ErrShortWrite.
+func writeFull(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// parseStatusLine returns the status code of an HTTP response status line
+// such as "HTTP/1.1 200 Connection Established". Anything else, including a
+// bare "200" elsewhere in the response, is not a status line.
+func parseStatusLine(line string) (int, bool) {
+	version, rest, ok := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	if !ok || !strings.HasPrefix(version, "HTTP/") {
+		return 0, false
+	}
+	code, _, _ := strings.Cut(rest, " ")
+	if len(code) != 3 {
+		return 0, false
+	}
+	status, err := strconv.Atoi(code)
+	if err != nil || status < 100 {
+		return 0, false
+	}
+	return status, true
+}
+
 // parseUpstreamAuth parses an upstream proxy URL and extracts host and auth header
 func parseUpstreamAuth(upstreamURL string) (host, auth string, err error) {
 	if !strings.HasPrefix(upstreamURL, "http://") && !strings.HasPrefix(upstreamURL, "https://") {
@@ -1595,14 +3790,48 @@ func parseUpstreamAuth(upstreamURL string) (host, auth string, err error) {
 		host = urlPart
 	}
 
+	// A proxy is addressed by host:port alone; anything after it would end
+	// up in the dial address. A lone trailing slash is harmless.
+	host = strings.TrimSuffix(host, "/")
+	if strings.ContainsAny(host, "/?#") {
+		return "", "", errUpstreamURLPath
+	}
+
 	return host, auth, nil
 }
 
+// errUpstreamURLPath rejects upstream URLs such as http://host:3128/foo
+var errUpstreamURLPath = errors.New("upstream proxy URL must not contain a path, query or fragment")
+
 var (
 	configFile = flag.String("config", "configs/us.json", "Path to configuration file")
 	showHelp   = flag.Bool("help", false, "Show help message")
+	listenAddr = flag.String("listen", "", "Listen address, overriding server.listen_address")
+	selfTest   = flag.Bool("selftest", false, "Check every enabled upstream once, print a report and exit (non-zero if any fail)")
 )
 
+// handleSignals reloads the config on SIGHUP and, on SIGINT or SIGTERM,
+// shuts the proxy down and calls stop before returning
+func (ps *ProxyServer) handleSignals(signals <-chan os.Signal, stop func()) {
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if ps.configPath == "" {
+				log.Printf("Received SIGHUP but no config file is in use, ignoring")
+				continue
+			}
+			if err := ps.forceReloadConfig("SIGHUP"); err != nil {
+				log.Printf("Config reload error: %v", err)
+			}
+			continue
+		}
+
+		log.Printf("Received %v, shutting down", sig)
+		ps.shutdown()
+		stop()
+		return
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -1612,11 +3841,10 @@ func main() {
 		flag.PrintDefaults()
 		fmt.Println("\nEnvironment variables:")
 		fmt.Println("  PROXY_CONFIG - Path to configuration file (overrides -config)")
+		fmt.Println("  PROXY_LISTEN - Listen address (overrides -listen and server.listen_address)")
 		os.Exit(0)
 	}
 
-	writePidFile()
-
 	// Priority: Environment variable > Command line flag > Default
 	configPath := *configFile
 	if envConfig := os.Getenv("PROXY_CONFIG"); envConfig != "" {
@@ -1628,11 +3856,22 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	applyListenOverride(config, *listenAddr)
+
+	if *selfTest {
+		os.Exit(runSelfTest(config, os.Stdout))
+	}
+
+	writePidFile()
 
 	log.Printf("Configuration loaded successfully:")
 	log.Printf("  - Server: %s", config.Server.Name)
 	log.Printf("  - Listen Address: %s", config.Server.ListenAddress)
-	log.Printf("  - Stats Endpoint: %s", config.Server.StatsEndpoint)
+	statsLabel := config.Server.StatsEndpoint
+	if statsLabel == "" {
+		statsLabel = "disabled"
+	}
+	log.Printf("  - Stats Endpoint: %s", statsLabel)
 	log.Printf("  - Authentication: %t", config.Authentication.Enabled)
 	if config.Authentication.Enabled {
 		log.Printf("  - Configured Users: %d", len(config.Authentication.Users))
@@ -1654,20 +3893,49 @@ func main() {
 	// Start config file watcher
 	proxyServer.startConfigWatcher()
 
-	server := &http.Server{
-		Addr:    config.Server.ListenAddress,
-		Handler: proxyServer,
+	listener, err := listen(config.Server)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", config.Server.ListenAddress, err)
+	}
+	listener = proxyServer.limitClientConnections(listener, config.Server.MaxClientConnections)
+
+	server := newHTTPServer(proxyServer, config.Server)
+
+	var statsServer *http.Server
+	if config.Server.StatsListenAddress != "" {
+		statsServer, err = startStatsListener(proxyServer, config.Server)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", config.Server.StatsListenAddress, err)
+		}
 	}
 
 	log.Printf("Proxy server successfully started:")
 	log.Printf("  - Listening on: %s", config.Server.ListenAddress)
-	log.Printf("  - Stats endpoint: %s", config.Server.StatsEndpoint)
+	if statsServer != nil {
+		log.Printf("  - Stats listener: %s", statsServer.Addr)
+	}
+	log.Printf("  - Stats endpoint: %s", statsLabel)
+	if config.Server.MetricsEndpoint != "" {
+		log.Printf("  - Metrics endpoint: %s", config.Server.MetricsEndpoint)
+	}
+	log.Printf("  - Health endpoint: %s (min healthy upstreams: %d)", healthEndpointPath, config.MinHealthyUpstreams)
 	log.Printf("  - Authentication: %s", func() string { if config.Authentication.Enabled { return "enabled" } else { return "disabled" } }())
 	log.Printf("  - Config file watcher: active (checks every 1 minute)")
 	log.Printf("  - Health monitoring: active")
 	log.Printf("Server ready to accept connections")
 
-	if err := server.ListenAndServe(); err != nil {
+	// Reload on SIGHUP; persist state and stop cleanly on SIGINT/SIGTERM
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go proxyServer.handleSignals(sigChan, func() {
+		if statsServer != nil {
+			statsServer.Close()
+		}
+		server.Close()
+	})
+
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed: %v", err)
 	}
+	log.Printf("Server stopped")
 }
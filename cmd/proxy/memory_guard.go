@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryGuardConfig configures load shedding under memory pressure: while
+// the Go heap is above MaxHeapMB, new CONNECTs are rejected with 503
+type MemoryGuardConfig struct {
+	MaxHeapMB       int `json:"max_heap_mb"`
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+}
+
+// checkMemoryPressure samples the heap and updates the shedding flag,
+// logging when the proxy enters or leaves the shedding state
+func (ps *ProxyServer) checkMemoryPressure(maxHeap uint64) bool {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	if memStats.HeapAlloc > maxHeap {
+		if atomic.CompareAndSwapInt32(&ps.memoryPressure, 0, 1) {
+			log.Printf("Memory pressure: heap %d MB exceeds limit of %d MB, shedding new connections",
+				memStats.HeapAlloc>>20, maxHeap>>20)
+		}
+		return true
+	}
+	if atomic.CompareAndSwapInt32(&ps.memoryPressure, 1, 0) {
+		log.Printf("Memory pressure relieved: heap %d MB, accepting new connections", memStats.HeapAlloc>>20)
+	}
+	return false
+}
+
+// underMemoryPressure reports whether new connections should be shed
+func (ps *ProxyServer) underMemoryPressure() bool {
+	return atomic.LoadInt32(&ps.memoryPressure) == 1
+}
+
+// applyMemoryGuard starts, restarts or stops the memory guard to match config
+func (ps *ProxyServer) applyMemoryGuard(config MemoryGuardConfig) {
+	if config.MaxHeapMB <= 0 {
+		ps.stopMemoryGuard()
+		return
+	}
+	interval := 5 * time.Second
+	if config.IntervalSeconds > 0 {
+		interval = time.Duration(config.IntervalSeconds) * time.Second
+	}
+	ps.startMemoryGuard(uint64(config.MaxHeapMB)<<20, interval)
+}
+
+func (ps *ProxyServer) startMemoryGuard(maxHeap uint64, interval time.Duration) {
+	ps.stopMemoryGuard()
+
+	stop := make(chan struct{})
+	ps.memoryGuardStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ps.checkMemoryPressure(maxHeap)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	log.Printf("Memory guard started (max heap: %d MB, interval: %v)", maxHeap>>20, interval)
+}
+
+func (ps *ProxyServer) stopMemoryGuard() {
+	if ps.memoryGuardStop != nil {
+		close(ps.memoryGuardStop)
+		ps.memoryGuardStop = nil
+	}
+	atomic.StoreInt32(&ps.memoryPressure, 0)
+}
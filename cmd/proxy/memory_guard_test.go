@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMemoryPressureShedding tests that CONNECTs are rejected while the heap is over the limit
+func TestMemoryPressureShedding(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	// Any live heap exceeds a one-byte limit
+	ps.startMemoryGuard(1, 20*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for !ps.underMemoryPressure() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ps.underMemoryPressure() {
+		t.Fatal("Expected memory guard to detect pressure")
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, head := dialConnect(t, proxyAddr, "example.com:443")
+		conn.Close()
+		if !strings.HasPrefix(head, "HTTP/1.1 503") {
+			t.Errorf("Expected 503 under memory pressure, got %q", head)
+		}
+	}
+	if shed := atomic.LoadInt64(&ps.stats.ShedRequests); shed != 3 {
+		t.Errorf("Expected 3 shed requests, got %d", shed)
+	}
+
+	// Pressure clears once the heap is back under the limit
+	ps.stopMemoryGuard()
+	if ps.checkMemoryPressure(1 << 40) {
+		t.Error("Expected no pressure under a generous limit")
+	}
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Errorf("Expected CONNECT to succeed after pressure cleared, got %q", head)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultLatencyBucketsMs are the latency histogram's upper bounds when
+// server.latency_buckets_ms is unset
+var defaultLatencyBucketsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// latencyHistogram counts observations per bucket. counts has one entry per
+// bound plus a final +Inf bucket and is not cumulative.
+type latencyHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// latencyHistograms holds one histogram per upstream URL. Its mutex is a
+// leaf: nothing else is locked while holding it.
+type latencyHistograms struct {
+	mutex      sync.Mutex
+	bounds     []float64
+	byUpstream map[string]*latencyHistogram
+}
+
+// configure sets the bucket bounds, discarding observations if they changed
+func (lh *latencyHistograms) configure(bounds []float64) {
+	if len(bounds) == 0 {
+		bounds = defaultLatencyBucketsMs
+	}
+
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+	if lh.byUpstream != nil && equalBounds(lh.bounds, bounds) {
+		return
+	}
+	lh.bounds = append([]float64(nil), bounds...)
+	lh.byUpstream = make(map[string]*latencyHistogram)
+}
+
+func (lh *latencyHistograms) reset() {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+	lh.byUpstream = make(map[string]*latencyHistogram)
+}
+
+// rename moves the histogram of upstream from old to its new URL
+func (lh *latencyHistograms) rename(old, upstream string) {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	if histogram, exists := lh.byUpstream[old]; exists {
+		lh.byUpstream[upstream] = histogram
+		delete(lh.byUpstream, old)
+	}
+}
+
+func (lh *latencyHistograms) observe(upstream string, ms float64) {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	histogram, exists := lh.byUpstream[upstream]
+	if !exists {
+		histogram = &latencyHistogram{counts: make([]int64, len(lh.bounds)+1)}
+		lh.byUpstream[upstream] = histogram
+	}
+	histogram.counts[sort.SearchFloat64s(lh.bounds, ms)]++
+	histogram.count++
+	histogram.sum += ms
+}
+
+// snapshot copies the bounds and histograms for rendering
+func (lh *latencyHistograms) snapshot() ([]float64, map[string]latencyHistogram) {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	histograms := make(map[string]latencyHistogram, len(lh.byUpstream))
+	for upstream, histogram := range lh.byUpstream {
+		copied := *histogram
+		copied.counts = append([]int64(nil), histogram.counts...)
+		histograms[upstream] = copied
+	}
+	return lh.bounds, histograms
+}
+
+func equalBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// validateLatencyBuckets requires positive, strictly increasing bounds
+func validateLatencyBuckets(bounds []float64) error {
+	for i, bound := range bounds {
+		if bound <= 0 {
+			return fmt.Errorf("server.latency_buckets_ms must be positive, got %g", bound)
+		}
+		if i > 0 && bound <= bounds[i-1] {
+			return fmt.Errorf("server.latency_buckets_ms must be strictly increasing, got %g after %g", bound, bounds[i-1])
+		}
+	}
+	return nil
+}
+
+// handleMetrics serves the statistics in the Prometheus text format.
+// Upstreams are labelled by host:port so credentials never reach the scraper.
+func (ps *ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	type upstreamSample struct {
+		label string
+		tag   string
+		stats UpstreamStats
+	}
+
+	ps.mutex.RLock()
+	samples := make(map[string]upstreamSample, len(ps.stats.UpstreamMetrics))
+	for url, metric := range ps.stats.UpstreamMetrics {
+		samples[url] = upstreamSample{tag: metric.Tag, stats: metric.snapshot()}
+	}
+	ps.mutex.RUnlock()
+
+	urls := make([]string, 0, len(samples))
+	for url, sample := range samples {
+		host, _, err := parseUpstreamAuth(url)
+		if err != nil {
+			host = "unknown"
+		}
+		sample.label = fmt.Sprintf(`upstream="%s",tag="%s"`, escapeLabelValue(host), escapeLabelValue(sample.tag))
+		samples[url] = sample
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetricHeader(w, "netdrift_requests_total", "counter", "CONNECT requests handled")
+	fmt.Fprintf(w, "netdrift_requests_total{result=\"success\"} %d\n", atomic.LoadInt64(&ps.stats.SuccessRequests))
+	fmt.Fprintf(w, "netdrift_requests_total{result=\"failed\"} %d\n", atomic.LoadInt64(&ps.stats.FailedRequests))
+	writeMetricHeader(w, "netdrift_current_requests", "gauge", "CONNECT requests in progress")
+	fmt.Fprintf(w, "netdrift_current_requests %d\n", atomic.LoadInt64(&ps.stats.CurrentRequests))
+
+	reloads := ps.getReloadStats()
+	writeMetricHeader(w, "netdrift_reloads_total", "counter", "Config reloads applied")
+	fmt.Fprintf(w, "netdrift_reloads_total %d\n", reloads.ReloadsTotal)
+	writeMetricHeader(w, "netdrift_reload_failures_total", "counter", "Config reloads rejected")
+	fmt.Fprintf(w, "netdrift_reload_failures_total %d\n", reloads.ReloadFailuresTotal)
+	// Zero until the first reload, matching last_reload_time in /stats
+	lastReload := int64(0)
+	if !reloads.LastReloadTime.IsZero() {
+		lastReload = reloads.LastReloadTime.Unix()
+	}
+	writeMetricHeader(w, "netdrift_last_reload_time_seconds", "gauge", "Unix time of the last applied config reload")
+	fmt.Fprintf(w, "netdrift_last_reload_time_seconds %d\n", lastReload)
+	// Zero until the first failed reload, matching last_failure_time
+	lastFailure := int64(0)
+	if !reloads.LastFailureTime.IsZero() {
+		lastFailure = reloads.LastFailureTime.Unix()
+	}
+	writeMetricHeader(w, "netdrift_last_reload_failure_time_seconds", "gauge", "Unix time of the last rejected config reload")
+	fmt.Fprintf(w, "netdrift_last_reload_failure_time_seconds %d\n", lastFailure)
+
+	writeMetricHeader(w, "netdrift_upstream_requests_total", "counter", "CONNECT requests sent to each upstream")
+	for _, url := range urls {
+		sample := samples[url]
+		fmt.Fprintf(w, "netdrift_upstream_requests_total{%s,result=\"success\"} %d\n", sample.label, sample.stats.SuccessRequests)
+		fmt.Fprintf(w, "netdrift_upstream_requests_total{%s,result=\"failed\"} %d\n", sample.label, sample.stats.FailedRequests)
+	}
+	writeMetricHeader(w, "netdrift_upstream_current_connections", "gauge", "Open tunnels through each upstream")
+	for _, url := range urls {
+		sample := samples[url]
+		fmt.Fprintf(w, "netdrift_upstream_current_connections{%s} %d\n", sample.label, sample.stats.CurrentConnections)
+	}
+
+	bounds, histograms := ps.latency.snapshot()
+	writeMetricHeader(w, "netdrift_upstream_latency_ms", "histogram", "Tunnel setup latency of successful CONNECTs in milliseconds")
+	for _, url := range urls {
+		histogram, exists := histograms[url]
+		if !exists {
+			continue
+		}
+		label := samples[url].label
+		cumulative := int64(0)
+		for i, bound := range bounds {
+			cumulative += histogram.counts[i]
+			fmt.Fprintf(w, "netdrift_upstream_latency_ms_bucket{%s,le=\"%s\"} %d\n", label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "netdrift_upstream_latency_ms_bucket{%s,le=\"+Inf\"} %d\n", label, histogram.count)
+		fmt.Fprintf(w, "netdrift_upstream_latency_ms_sum{%s} %s\n", label, strconv.FormatFloat(histogram.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "netdrift_upstream_latency_ms_count{%s} %d\n", label, histogram.count)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// escapeLabelValue escapes a Prometheus label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLatencyHistogramMetrics tests that /metrics exposes a latency histogram
+// with the configured buckets that grows with each successful CONNECT
+func TestLatencyHistogramMetrics(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+
+	config := &Config{
+		Server: ServerConfig{MetricsEndpoint: "/metrics", LatencyBucketsMs: []float64{1, 250, 60000}},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://user:pass@" + upstreamAddr, Enabled: true, Weight: 1, Tag: "primary"},
+		},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	label := `upstream="` + upstreamAddr + `",tag="primary"`
+	scrapeUntil := func(count string) string {
+		t.Helper()
+		want := "netdrift_upstream_latency_ms_count{" + label + "} " + count + "\n"
+		// Stats are recorded just after the 200 reaches the client
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			resp, err := http.Get("http://" + proxyAddr + "/metrics")
+			if err != nil {
+				t.Fatalf("Failed to scrape metrics: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if strings.Contains(string(body), want) {
+				return string(body)
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %q in metrics:\n%s", want, body)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, _ := dialConnect(t, proxyAddr, "example.com:443")
+		conn.Close()
+	}
+	metrics := scrapeUntil("2")
+	for _, want := range []string{
+		"# TYPE netdrift_upstream_latency_ms histogram\n",
+		"netdrift_upstream_latency_ms_bucket{" + label + `,le="1"} `,
+		"netdrift_upstream_latency_ms_bucket{" + label + `,le="250"} `,
+		"netdrift_upstream_latency_ms_bucket{" + label + `,le="60000"} 2` + "\n",
+		"netdrift_upstream_latency_ms_bucket{" + label + `,le="+Inf"} 2` + "\n",
+		"netdrift_upstream_latency_ms_sum{" + label + "} ",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, "user:pass") {
+		t.Errorf("Metrics leak upstream credentials:\n%s", metrics)
+	}
+
+	conn, _ := dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	metrics = scrapeUntil("3")
+	if !strings.Contains(metrics, "netdrift_upstream_latency_ms_bucket{"+label+`,le="+Inf"} 3`+"\n") {
+		t.Errorf("Expected the +Inf bucket to follow the count:\n%s", metrics)
+	}
+}
+
+// TestLatencyBucketsValidation tests that unordered or non-positive buckets are rejected
+func TestLatencyBucketsValidation(t *testing.T) {
+	for _, buckets := range [][]float64{{10, 5}, {0, 5}, {5, 5}} {
+		config := &Config{Server: ServerConfig{LatencyBucketsMs: buckets}}
+		if err := validateConfig(config); err == nil {
+			t.Errorf("Expected buckets %v to be rejected", buckets)
+		}
+	}
+}
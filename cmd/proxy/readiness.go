@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// healthEndpointPath reports readiness for load balancers. It needs no
+// authentication and reveals only upstream counts.
+const healthEndpointPath = "/health"
+
+// readiness is the proxy's health as seen from outside: degraded once fewer
+// than min_healthy_upstreams upstreams can take traffic, and starting while
+// upstreams are still unverified after startup
+type readiness struct {
+	Status              string `json:"status"`
+	HealthyUpstreams    int    `json:"healthy_upstreams"`
+	MinHealthyUpstreams int    `json:"min_healthy_upstreams"`
+	rejectWhenDegraded  bool
+	starting            bool
+}
+
+func (rd readiness) degraded() bool {
+	return rd.HealthyUpstreams < rd.MinHealthyUpstreams
+}
+
+// readiness counts the upstreams selection could use right now (backups
+// count once every primary is down) against the configured minimum
+func (ps *ProxyServer) readiness() readiness {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	rd := readiness{
+		Status:              "ok",
+		HealthyUpstreams:    len(ps.getHealthyUpstreams("")),
+		MinHealthyUpstreams: ps.config.MinHealthyUpstreams,
+		rejectWhenDegraded:  ps.config.RejectWhenDegraded,
+	}
+	if rd.degraded() {
+		rd.Status = "degraded"
+	}
+
+	// Until health checks have run, "healthy" is only the default assumption
+	if delay := time.Duration(ps.config.ReadinessDelaySeconds) * time.Second; delay > 0 {
+		rd.starting = time.Since(ps.startedAt) < delay && atomic.LoadInt64(&ps.healthCycles) == 0
+		if rd.starting {
+			rd.Status = "starting"
+		}
+	}
+	return rd
+}
+
+// handleHealth serves /health: 200 when ready, 503 when degraded or starting
+func (ps *ProxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	rd := ps.readiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if rd.degraded() || rd.starting {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(rd)
+}
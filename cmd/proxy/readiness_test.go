@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMinHealthyUpstreams tests that /health and CONNECT turn 503 once the
+// healthy upstream count drops below min_healthy_upstreams
+func TestMinHealthyUpstreams(t *testing.T) {
+	var upstreams []string
+	config := &Config{MinHealthyUpstreams: 2, RejectWhenDegraded: true}
+	for i := 0; i < 3; i++ {
+		upstream := "http://" + startMockUpstream(t, echoUpstream)
+		upstreams = append(upstreams, upstream)
+		config.UpstreamProxies = append(config.UpstreamProxies, UpstreamProxyConfig{URL: upstream, Enabled: true, Weight: 1})
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	checkHealth := func(wantCode int, wantStatus string, wantHealthy int) {
+		t.Helper()
+		resp, err := http.Get("http://" + proxyAddr + healthEndpointPath)
+		if err != nil {
+			t.Fatalf("Failed to fetch %s: %v", healthEndpointPath, err)
+		}
+		defer resp.Body.Close()
+		var rd readiness
+		if err := json.NewDecoder(resp.Body).Decode(&rd); err != nil {
+			t.Fatalf("Failed to decode readiness: %v", err)
+		}
+		if resp.StatusCode != wantCode || rd.Status != wantStatus || rd.HealthyUpstreams != wantHealthy {
+			t.Errorf("Expected %d %s with %d healthy, got %d %s with %d healthy",
+				wantCode, wantStatus, wantHealthy, resp.StatusCode, rd.Status, rd.HealthyUpstreams)
+		}
+	}
+
+	checkHealth(http.StatusOK, "ok", 3)
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected CONNECT to succeed while ready, got %q", head)
+	}
+
+	// Fail two of three upstreams past the failure threshold
+	for _, upstream := range upstreams[:2] {
+		for i := 0; i < 3; i++ {
+			ps.recordUpstreamFailure(upstream)
+		}
+	}
+	checkHealth(http.StatusServiceUnavailable, "degraded", 1)
+	conn, head = dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	if !strings.Contains(head, "503") {
+		t.Errorf("Expected CONNECT to be rejected while degraded, got %q", head)
+	}
+
+	// Without reject_when_degraded, CONNECTs still use the surviving upstream
+	ps.mutex.Lock()
+	ps.config.RejectWhenDegraded = false
+	ps.mutex.Unlock()
+	conn, head = dialConnect(t, proxyAddr, "example.com:443")
+	conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Errorf("Expected CONNECT to succeed when only reporting degraded, got %q", head)
+	}
+
+	ps.recordUpstreamSuccess(upstreams[0])
+	checkHealth(http.StatusOK, "ok", 2)
+}
+
+// TestReadinessDelay tests that /health reports starting with 503 until the
+// first health check round completes or the readiness delay elapses
+func TestReadinessDelay(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer endpoint.Close()
+
+	checkHealth := func(ps *ProxyServer, wantCode int, wantStatus string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		ps.handleHealth(recorder, httptest.NewRequest(http.MethodGet, healthEndpointPath, nil))
+		var rd readiness
+		if err := json.NewDecoder(recorder.Body).Decode(&rd); err != nil {
+			t.Fatalf("Failed to decode readiness: %v", err)
+		}
+		if recorder.Code != wantCode || rd.Status != wantStatus {
+			t.Errorf("Expected %d %s, got %d %s", wantCode, wantStatus, recorder.Code, rd.Status)
+		}
+	}
+
+	upstream := "http://" + startMockUpstream(t, echoUpstream)
+	config := &Config{
+		ReadinessDelaySeconds: 60,
+		HealthCheck: HealthCheckConfig{
+			Enabled:        true,
+			TimeoutSeconds: 1,
+			Endpoints:      []string{endpoint.URL},
+		},
+		UpstreamProxies: []UpstreamProxyConfig{{URL: upstream, Enabled: true, Weight: 1}},
+	}
+
+	// The first completed health check round makes the proxy ready
+	ps := NewProxyServer(config, "")
+	checkHealth(ps, http.StatusServiceUnavailable, "starting")
+	NewHealthChecker(ps).performHealthChecks()
+	checkHealth(ps, http.StatusOK, "ok")
+
+	// Without health checks, readiness waits out the delay
+	config.HealthCheck.Enabled = false
+	ps = NewProxyServer(config, "")
+	NewHealthChecker(ps).performHealthChecks()
+	checkHealth(ps, http.StatusServiceUnavailable, "starting")
+	ps.startedAt = ps.startedAt.Add(-time.Minute)
+	checkHealth(ps, http.StatusOK, "ok")
+
+	// No delay keeps the previous behavior: ready right away
+	config.ReadinessDelaySeconds = 0
+	checkHealth(NewProxyServer(config, ""), http.StatusOK, "ok")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RoutingRule sends CONNECT targets matching Match through upstreams tagged
+// Tag. Match is an exact host ("api.example.com") or a wildcard suffix
+// ("*.cn" matches any subdomain of cn). Ports are ignored.
+type RoutingRule struct {
+	Match string `json:"match"`
+	Tag   string `json:"tag"`
+}
+
+func (rr RoutingRule) matches(host string) bool {
+	pattern := strings.ToLower(rr.Match)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// routeTag returns the upstream tag required for target by the first
+// matching routing rule, or "" when no rule matches
+func (ps *ProxyServer) routeTag(target string) string {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	for _, rule := range ps.config.RoutingRules {
+		if rule.matches(host) {
+			return rule.Tag
+		}
+	}
+	return ""
+}
+
+// ClientRule pins CONNECTs from a client to upstreams tagged Tag, so each
+// customer goes through its own provider pool. User matches the
+// authenticated username, Source the client address (an IP or a CIDR
+// subnet); with both set, both must match.
+type ClientRule struct {
+	User   string `json:"user,omitempty"`
+	Source string `json:"source,omitempty"`
+	Tag    string `json:"tag"`
+}
+
+func (cr ClientRule) matches(user, client string) bool {
+	if cr.User != "" && cr.User != user {
+		return false
+	}
+	return cr.Source == "" || ipInExpected(cr.Source, client)
+}
+
+// clientTag returns the upstream tag the first matching client rule pins r
+// to, or "" when no rule matches. Usernames only count once authentication
+// has verified them.
+func (ps *ProxyServer) clientTag(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	user := ""
+	if ps.config.Authentication.Enabled {
+		user = proxyAuthUsername(r)
+	}
+	for _, rule := range ps.config.ClientRules {
+		if rule.matches(user, client) {
+			return rule.Tag
+		}
+	}
+	return ""
+}
+
+// validateRoutingRules rejects rules that could never match or route
+func validateRoutingRules(rules []RoutingRule) error {
+	for i, rule := range rules {
+		if rule.Match == "" || rule.Tag == "" {
+			return fmt.Errorf("routing rule %d: match and tag are required", i)
+		}
+		if strings.Contains(strings.TrimPrefix(rule.Match, "*."), "*") {
+			return fmt.Errorf("routing rule %d: only a leading \"*.\" wildcard is supported, got %q", i, rule.Match)
+		}
+	}
+	return nil
+}
+
+// validateClientRules rejects client rules that could never match or route
+func validateClientRules(rules []ClientRule) error {
+	for i, rule := range rules {
+		if rule.Tag == "" || (rule.User == "" && rule.Source == "") {
+			return fmt.Errorf("client rule %d: tag and a user or source are required", i)
+		}
+		if rule.Source == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(rule.Source); err != nil && net.ParseIP(rule.Source) == nil {
+			return fmt.Errorf("client rule %d: source must be an IP address or CIDR subnet, got %q", i, rule.Source)
+		}
+	}
+	return nil
+}
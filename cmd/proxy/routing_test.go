@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestRoutingRuleMatching tests exact and wildcard suffix patterns
+func TestRoutingRuleMatching(t *testing.T) {
+	tests := []struct {
+		match string
+		host  string
+		want  bool
+	}{
+		{"*.cn", "baidu.cn", true},
+		{"*.cn", "www.baidu.cn", true},
+		{"*.cn", "cn", false},
+		{"*.cn", "example.com", false},
+		{"*.cn", "notcn", false},
+		{"api.example.com", "api.example.com", true},
+		{"api.example.com", "www.api.example.com", false},
+		{"API.Example.com", "api.example.com", true},
+	}
+
+	for _, tt := range tests {
+		if got := (RoutingRule{Match: tt.match, Tag: "t"}).matches(tt.host); got != tt.want {
+			t.Errorf("Rule %q matching %q = %v, want %v", tt.match, tt.host, got, tt.want)
+		}
+	}
+}
+
+// TestRoutingRulesSelectTaggedUpstream tests that a matching rule constrains
+// selection to the rule's tag while other targets use default selection
+func TestRoutingRulesSelectTaggedUpstream(t *testing.T) {
+	countingUpstream := func(counter *int64) func(net.Conn) {
+		return func(conn net.Conn) {
+			atomic.AddInt64(counter, 1)
+			defer conn.Close()
+			if _, err := readConnectRequest(bufio.NewReader(conn)); err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		}
+	}
+
+	var chinaHits, defaultHits int64
+	chinaAddr := startMockUpstream(t, countingUpstream(&chinaHits))
+	defaultAddr := startMockUpstream(t, countingUpstream(&defaultHits))
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + chinaAddr, Enabled: true, Weight: 1, Tag: "china"},
+			{URL: "http://" + defaultAddr, Enabled: true, Weight: 100, Tag: "default"},
+		},
+		RoutingRules: []RoutingRule{
+			{Match: "*.cn", Tag: "china"},
+		},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid routing config, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	for i := 0; i < 5; i++ {
+		conn, head := dialConnect(t, proxyAddr, "www.baidu.cn:443")
+		conn.Close()
+		if !strings.Contains(head, "200") {
+			t.Fatalf("Expected routed tunnel to be established, got %q", head)
+		}
+	}
+	if china, other := atomic.LoadInt64(&chinaHits), atomic.LoadInt64(&defaultHits); china != 5 || other != 0 {
+		t.Errorf("Expected all 5 *.cn requests via china upstream, got china=%d default=%d", china, other)
+	}
+
+	// Unmatched targets fall through to weighted selection
+	if tag := ps.routeTag("example.com:443"); tag != "" {
+		t.Errorf("Expected no routing tag for unmatched target, got %q", tag)
+	}
+	if tag := ps.routeTag("WWW.BAIDU.CN:443"); tag != "china" {
+		t.Errorf("Expected case-insensitive match, got %q", tag)
+	}
+}
+
+// TestClientRulesPinUserToTag tests that a client rule keeps a user's
+// CONNECTs on the upstreams of its tag while other users get the whole pool
+func TestClientRulesPinUserToTag(t *testing.T) {
+	countingUpstream := func(counter *int64) func(net.Conn) {
+		return func(conn net.Conn) {
+			atomic.AddInt64(counter, 1)
+			defer conn.Close()
+			if _, err := readConnectRequest(bufio.NewReader(conn)); err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		}
+	}
+
+	var poolAHits, poolBHits int64
+	poolAAddr := startMockUpstream(t, countingUpstream(&poolAHits))
+	poolBAddr := startMockUpstream(t, countingUpstream(&poolBHits))
+
+	config := &Config{
+		Authentication: AuthenticationConfig{
+			Enabled: true,
+			Users:   []UserConfig{{Username: "alice", Password: "a"}, {Username: "bob", Password: "b"}},
+		},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + poolAAddr, Enabled: true, Weight: 1, Tag: "pool-a"},
+			{URL: "http://" + poolBAddr, Enabled: true, Weight: 100, Tag: "pool-b"},
+		},
+		ClientRules: []ClientRule{{User: "alice", Tag: "pool-a"}},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid client rules, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	connect := func(credentials string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %s\r\n\r\n",
+			base64.StdEncoding.EncodeToString([]byte(credentials)))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the tunnel to be established, got %v %v", resp, err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		connect("alice:a")
+	}
+	if a, b := atomic.LoadInt64(&poolAHits), atomic.LoadInt64(&poolBHits); a != 5 || b != 0 {
+		t.Errorf("Expected all 5 of alice's CONNECTs via pool-a, got pool-a=%d pool-b=%d", a, b)
+	}
+
+	// Unpinned users follow the weights, which favor pool-b
+	connect("bob:b")
+	if b := atomic.LoadInt64(&poolBHits); b != 1 {
+		t.Errorf("Expected bob's CONNECT via pool-b, got pool-b=%d", b)
+	}
+}
+
+// TestClientRuleMatching tests user and source matching of client rules
+func TestClientRuleMatching(t *testing.T) {
+	tests := []struct {
+		rule   ClientRule
+		user   string
+		client string
+		want   bool
+	}{
+		{ClientRule{User: "alice"}, "alice", "10.0.0.1", true},
+		{ClientRule{User: "alice"}, "bob", "10.0.0.1", false},
+		{ClientRule{Source: "10.1.0.0/16"}, "", "10.1.2.3", true},
+		{ClientRule{Source: "10.1.0.0/16"}, "", "10.2.0.1", false},
+		{ClientRule{Source: "192.0.2.7"}, "", "192.0.2.7", true},
+		{ClientRule{User: "alice", Source: "10.1.0.0/16"}, "alice", "10.2.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.matches(tt.user, tt.client); got != tt.want {
+			t.Errorf("Rule %+v matching %q from %s = %v, want %v", tt.rule, tt.user, tt.client, got, tt.want)
+		}
+	}
+
+	for _, rule := range []ClientRule{{Tag: "a"}, {User: "alice"}, {Source: "10.1.0.0/33", Tag: "a"}} {
+		if err := validateConfig(&Config{ClientRules: []ClientRule{rule}}); err == nil {
+			t.Errorf("Expected client rule %+v to be rejected", rule)
+		}
+	}
+}
+
+// TestRoutingRuleValidation tests validateConfig rules for routing_rules
+func TestRoutingRuleValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    RoutingRule
+		wantErr bool
+	}{
+		{"Wildcard", RoutingRule{Match: "*.cn", Tag: "china"}, false},
+		{"Exact", RoutingRule{Match: "example.com", Tag: "us"}, false},
+		{"MissingTag", RoutingRule{Match: "*.cn"}, true},
+		{"MissingMatch", RoutingRule{Tag: "china"}, true},
+		{"InnerWildcard", RoutingRule{Match: "api.*.com", Tag: "us"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&Config{RoutingRules: []RoutingRule{tt.rule}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
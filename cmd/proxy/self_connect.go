@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// selfLookupTimeout bounds the DNS lookup used to resolve CONNECT targets
+// that point at the proxy's own port
+const selfLookupTimeout = 2 * time.Second
+
+var (
+	localIPsOnce sync.Once
+	localIPs     []net.IP
+)
+
+// interfaceIPs returns the IP addresses of the host's network interfaces
+func interfaceIPs() []net.IP {
+	localIPsOnce.Do(func() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				localIPs = append(localIPs, ipNet.IP)
+			}
+		}
+	})
+	return localIPs
+}
+
+// isSelfTarget reports whether a CONNECT target points back at the listener
+// that accepted the request, which would make the proxy tunnel to itself.
+// Only targets on the listener's port are resolved, so ordinary traffic
+// never pays for a lookup.
+func isSelfTarget(r *http.Request) bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	host, portStr, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return false
+	}
+	if port, err := strconv.Atoi(portStr); err != nil || port != local.Port {
+		return false
+	}
+
+	var targets []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		targets = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), selfLookupTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			targets = append(targets, addr.IP)
+		}
+	}
+
+	for _, target := range targets {
+		if target.IsLoopback() || target.IsUnspecified() || target.Equal(local.IP) {
+			return true
+		}
+		for _, ip := range interfaceIPs() {
+			if target.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
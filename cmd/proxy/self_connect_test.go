@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestSelfConnectRejected tests that CONNECTs to the proxy's own listener are refused
+func TestSelfConnectRejected(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	proxyAddr := startTestProxy(t, NewProxyServer(config, ""))
+	_, port, _ := net.SplitHostPort(proxyAddr)
+
+	for _, target := range []string{proxyAddr, "localhost:" + port, "0.0.0.0:" + port} {
+		conn, head := dialConnect(t, proxyAddr, target)
+		conn.Close()
+		if !strings.HasPrefix(head, "HTTP/1.1 403") {
+			t.Errorf("Expected 403 for CONNECT to %s, got %q", target, head)
+		}
+	}
+
+	// Other ports on the same host are tunneled as usual
+	conn, head := dialConnect(t, proxyAddr, upstreamAddr)
+	conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Errorf("Expected CONNECT to another local port to succeed, got %q", head)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// runSelfTest checks every enabled upstream once, with the same probe the
+// health checker uses, and writes a pass/fail table to out. It returns the
+// process exit code: 0 when every upstream passed, 1 otherwise.
+func runSelfTest(config *Config, out io.Writer) int {
+	checkConfig := *config
+	if len(checkConfig.HealthCheck.Endpoints) == 0 {
+		checkConfig.HealthCheck.Endpoints = defaultHealthEndpoints
+	}
+	if checkConfig.HealthCheck.TimeoutSeconds == 0 {
+		checkConfig.HealthCheck.TimeoutSeconds = 10
+	}
+
+	var upstreams []UpstreamProxyConfig
+	for _, upstream := range config.UpstreamProxies {
+		if upstream.Enabled {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	if len(upstreams) == 0 {
+		fmt.Fprintln(out, "No enabled upstream proxies to test")
+		return 1
+	}
+
+	hc := NewHealthChecker(nil)
+	results := make([]HealthCheckResult, len(upstreams))
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			results[i] = hc.checkUpstreamHealth(url, &checkConfig)
+		}(i, upstream.URL)
+	}
+	wg.Wait()
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "UPSTREAM\tTAG\tRESULT\tLATENCY\tEGRESS IP\tERROR")
+	passed := 0
+	for i, result := range results {
+		status, ip, errText := "FAIL", result.IP, ""
+		if result.Success {
+			status = "PASS"
+			passed++
+		} else if result.Error != nil {
+			errText = result.Error.Error()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%v\t%s\t%s\n", redactUpstreamURL(upstreams[i].URL), dashIfEmpty(upstreams[i].Tag),
+			status, result.Latency.Round(time.Millisecond), dashIfEmpty(ip), errText)
+	}
+	table.Flush()
+	fmt.Fprintf(out, "\n%d/%d upstreams passed\n", passed, len(upstreams))
+
+	if passed < len(upstreams) {
+		return 1
+	}
+	return 0
+}
+
+// dashIfEmpty keeps empty table cells visible
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
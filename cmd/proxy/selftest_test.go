@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestSelfTest tests the -selftest report and its exit code
+func TestSelfTest(t *testing.T) {
+	resolver := createMockIPResolverServer("203.0.113.7", 200, 0)
+	defer resolver.Close()
+
+	goodProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get(r.URL.String())
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer goodProxy.Close()
+	badProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer badProxy.Close()
+
+	goodURL := strings.Replace(goodProxy.URL, "http://", "http://user:secret@", 1)
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: goodURL, Enabled: true, Weight: 1, Tag: "good"},
+			{URL: badProxy.URL, Enabled: true, Weight: 1, Tag: "bad"},
+			{URL: "http://127.0.0.1:1", Enabled: false, Weight: 1, Tag: "disabled"},
+		},
+		HealthCheck: HealthCheckConfig{
+			TimeoutSeconds: 5,
+			Endpoints:      []string{resolver.URL},
+		},
+	}
+
+	var out bytes.Buffer
+	if code := runSelfTest(config, &out); code != 1 {
+		t.Errorf("Expected exit code 1 with a failing upstream, got %d", code)
+	}
+	report := out.String()
+	lines := strings.Split(report, "\n")
+	var goodLine, badLine string
+	for _, line := range lines {
+		if strings.Contains(line, " good ") {
+			goodLine = line
+		}
+		if strings.Contains(line, " bad ") {
+			badLine = line
+		}
+	}
+	if !strings.Contains(goodLine, "PASS") || !strings.Contains(goodLine, "203.0.113.7") {
+		t.Errorf("Expected a PASS row with the egress IP, got %q", goodLine)
+	}
+	if !strings.Contains(badLine, "FAIL") || !strings.Contains(badLine, "502") {
+		t.Errorf("Expected a FAIL row with the error, got %q", badLine)
+	}
+	if strings.Contains(report, "secret") || strings.Contains(report, "disabled") {
+		t.Errorf("Expected credentials redacted and disabled upstreams skipped:\n%s", report)
+	}
+	if !strings.Contains(report, "1/2 upstreams passed") {
+		t.Errorf("Expected a summary line:\n%s", report)
+	}
+
+	config.UpstreamProxies = config.UpstreamProxies[:1]
+	out.Reset()
+	if code := runSelfTest(config, &out); code != 0 {
+		t.Errorf("Expected exit code 0 when every upstream passes, got %d:\n%s", code, out.String())
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// SlowTunnelLogConfig sets thresholds above which a tunnel is logged as a
+// warning, to spot problematic targets and upstreams. Zero disables a check.
+type SlowTunnelLogConfig struct {
+	// SetupMs flags tunnels whose setup (selection up to the upstream's
+	// CONNECT reply) took longer than this
+	SetupMs int `json:"setup_ms,omitempty"`
+	// DurationMs flags tunnels open longer than this, measured at close
+	DurationMs int `json:"duration_ms,omitempty"`
+}
+
+// slowTunnelThresholds returns the configured slow tunnel thresholds
+func (ps *ProxyServer) slowTunnelThresholds() SlowTunnelLogConfig {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	return ps.config.SlowTunnelLog
+}
+
+// warnIfSlow logs a warning when took exceeds thresholdMs. stage names what
+// was measured ("setup" or "duration").
+func (ps *ProxyServer) warnIfSlow(requestID int64, stage, target, upstream string, took time.Duration, thresholdMs int) {
+	if thresholdMs <= 0 || took <= time.Duration(thresholdMs)*time.Millisecond {
+		return
+	}
+	log.Printf("WARNING: [req %d] Slow tunnel %s of %v (threshold %dms) to %s via %s%s",
+		requestID, stage, took.Round(time.Millisecond), thresholdMs, target, redactUpstreamURL(upstream), ps.upstreamTagSuffix(upstream))
+}
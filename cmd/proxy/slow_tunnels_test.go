@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"netdrift/pkg/faultyproxy"
+)
+
+// logCapture collects log output while still passing it through
+type logCapture struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+	out    io.Writer
+}
+
+func (lc *logCapture) Write(p []byte) (int, error) {
+	lc.mutex.Lock()
+	lc.buffer.Write(p)
+	lc.mutex.Unlock()
+	return lc.out.Write(p)
+}
+
+func (lc *logCapture) String() string {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	return lc.buffer.String()
+}
+
+func (lc *logCapture) contains(s string) bool {
+	return strings.Contains(lc.String(), s)
+}
+
+// TestSlowTunnelLogging tests that tunnels exceeding the setup or duration
+// thresholds are logged with their target, upstream and tag
+func TestSlowTunnelLogging(t *testing.T) {
+	target := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+
+	upstream := faultyproxy.NewFaultyProxy(9160)
+	upstream.Scenario = &faultyproxy.Scenario{
+		Steps:  []faultyproxy.ScenarioStep{{Fault: faultyproxy.NoFault, Delay: 300 * time.Millisecond}},
+		Repeat: true,
+	}
+	if err := upstream.Start(); err != nil {
+		t.Fatalf("Failed to start faulty upstream: %v", err)
+	}
+	defer upstream.Stop()
+
+	capture := &logCapture{out: log.Writer()}
+	log.SetOutput(capture)
+	defer log.SetOutput(capture.out)
+
+	config := &Config{
+		SlowTunnelLog: SlowTunnelLogConfig{SetupMs: 100, DurationMs: 500},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9160", Enabled: true, Weight: 1, Tag: "slow-provider"},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, head := dialConnect(t, proxyAddr, target)
+	if !strings.Contains(head, "200") {
+		conn.Close()
+		t.Fatalf("Expected the tunnel to be established, got %q", head)
+	}
+	setupWarning := "Slow tunnel setup of "
+	if !capture.contains(setupWarning) || !capture.contains("(threshold 100ms) to "+target+" via http://127.0.0.1:9160 [tag: slow-provider]") {
+		t.Errorf("Expected a slow setup warning naming target, upstream and tag, got:\n%s", capture)
+	}
+	if capture.contains("Slow tunnel duration") {
+		t.Error("Expected no duration warning while the tunnel is young")
+	}
+
+	// Keep the tunnel open past the duration threshold
+	time.Sleep(300 * time.Millisecond)
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !capture.contains("Slow tunnel duration") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !capture.contains("Slow tunnel duration") {
+		t.Error("Expected a slow duration warning once the tunnel closed")
+	}
+}
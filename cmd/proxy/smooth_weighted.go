@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// smoothJitter scales the random perturbation of smooth_weighted selection,
+// as a fraction of the candidates' total weight. Larger values look more
+// random; the long-run split follows the weights whatever the value.
+const smoothJitter = 0.25
+
+// smoothWeights holds the running scores of smooth weighted round-robin. Its
+// mutex is a leaf: nothing else is locked while holding it.
+type smoothWeights struct {
+	mutex   sync.Mutex
+	current map[string]float64
+}
+
+// next picks among upstreams with smooth weighted round-robin (as in nginx):
+// every candidate's score grows by its weight, the highest score wins and
+// drops by the total. The winner is chosen on scores perturbed by up to
+// smoothJitter of the total weight, so the order is not fixed, but a
+// candidate passed over keeps gaining until it wins, which bounds both runs
+// on one upstream and the drift from the configured weights.
+func (sw *smoothWeights) next(upstreams []WeightedUpstream) string {
+	if len(upstreams) == 0 {
+		return ""
+	}
+	if len(upstreams) == 1 {
+		return upstreams[0].URL
+	}
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.current == nil {
+		sw.current = make(map[string]float64)
+	}
+
+	total := 0
+	for _, upstream := range upstreams {
+		total += upstream.Weight
+		sw.current[upstream.URL] += float64(upstream.Weight)
+	}
+
+	best := ""
+	bestScore := 0.0
+	for _, upstream := range upstreams {
+		score := sw.current[upstream.URL] + (rand.Float64()*2-1)*smoothJitter*float64(total)
+		if best == "" || score > bestScore {
+			best = upstream.URL
+			bestScore = score
+		}
+	}
+	sw.current[best] -= float64(total)
+	return best
+}
+
+func (sw *smoothWeights) reset() {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	sw.current = nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSmoothWeightedRunsAndDistribution(t *testing.T) {
+	weights := map[string]int{
+		"http://127.0.0.1:9051": 5,
+		"http://127.0.0.1:9052": 3,
+		"http://127.0.0.1:9053": 1,
+		"http://127.0.0.1:9054": 1,
+	}
+	config := &Config{Server: ServerConfig{Strategy: strategySmoothWeighted}}
+	for url, weight := range weights {
+		config.UpstreamProxies = append(config.UpstreamProxies, UpstreamProxyConfig{URL: url, Enabled: true, Weight: weight})
+	}
+	ps := NewProxyServer(config, "")
+
+	const selections = 10000
+	counts := make(map[string]int)
+	previous, run, longestRun := "", 0, 0
+	for i := 0; i < selections; i++ {
+		upstream := ps.getNextUpstream()
+		counts[upstream]++
+		if upstream == previous {
+			run++
+		} else {
+			previous, run = upstream, 1
+		}
+		longestRun = max(longestRun, run)
+	}
+
+	// Plain weighted round-robin gives runs of 5 on the heaviest upstream
+	// and pure weighted random runs of 10 or more; unperturbed smooth
+	// round-robin stays at 2 and the jitter adds at most a little
+	if longestRun > 4 {
+		t.Errorf("Expected no run longer than 4 selections, got %d", longestRun)
+	}
+	for url, weight := range weights {
+		want := float64(selections*weight) / 10
+		if math.Abs(float64(counts[url])-want) > want*0.02 {
+			t.Errorf("%s: expected about %.0f selections for weight %d, got %d", url, want, weight, counts[url])
+		}
+	}
+}
+
+func TestSmoothWeightedIsNotFixed(t *testing.T) {
+	upstreams := []WeightedUpstream{
+		{URL: "http://127.0.0.1:9055", Weight: 1},
+		{URL: "http://127.0.0.1:9056", Weight: 1},
+		{URL: "http://127.0.0.1:9057", Weight: 1},
+	}
+	var sw smoothWeights
+	orders := make(map[string]bool)
+	for round := 0; round < 50; round++ {
+		order := ""
+		for i := 0; i < len(upstreams); i++ {
+			order += sw.next(upstreams)[len("http://127.0.0.1:"):]
+		}
+		orders[order] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("Expected the perturbation to vary the order, got only %v", orders)
+	}
+}
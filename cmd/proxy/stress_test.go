@@ -18,13 +18,7 @@ func TestHighConcurrencyLoadBalancing(t *testing.T) {
 
 	t.Run("HighConcurrencyWeightedDistribution", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9040", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9041", Enabled: true, Weight: 2},
 				{URL: "http://127.0.0.1:9042", Enabled: true, Weight: 3},
@@ -114,13 +108,7 @@ func TestHighConcurrencyLoadBalancing(t *testing.T) {
 
 	t.Run("ConcurrentHealthAndLoadBalancing", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-				Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9044", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9045", Enabled: true, Weight: 1},
 				{URL: "http://127.0.0.1:9046", Enabled: true, Weight: 1},
@@ -194,13 +182,7 @@ func TestMemoryUsageUnderLoad(t *testing.T) {
 	}
 
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9047", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9048", Enabled: true, Weight: 1},
 		},
@@ -339,13 +321,7 @@ func TestLongRunningStressTest(t *testing.T) {
 	}
 
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9049", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9050", Enabled: true, Weight: 2},
 			{URL: "http://127.0.0.1:9051", Enabled: true, Weight: 1},
@@ -470,13 +446,7 @@ func TestRaceConditionDetection(t *testing.T) {
 	}
 
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9052", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9053", Enabled: true, Weight: 1},
 		},
@@ -600,13 +570,7 @@ func abs64(x float64) float64 {
 // TestBenchmarkLoadBalancing provides benchmark tests for performance regression
 func BenchmarkLoadBalancing(b *testing.B) {
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9060", Enabled: true, Weight: 1},
 			{URL: "http://127.0.0.1:9061", Enabled: true, Weight: 2},
 			{URL: "http://127.0.0.1:9062", Enabled: true, Weight: 3},
@@ -625,13 +589,7 @@ func BenchmarkLoadBalancing(b *testing.B) {
 
 func BenchmarkHealthTracking(b *testing.B) {
 	config := &Config{
-		UpstreamProxies: []struct {
-			URL     string `json:"url"`
-			Enabled bool   `json:"enabled"`
-			Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-		}{
+		UpstreamProxies: []UpstreamProxyConfig{
 			{URL: "http://127.0.0.1:9063", Enabled: true, Weight: 1},
 		},
 	}
@@ -653,3 +611,41 @@ func BenchmarkHealthTracking(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkTimeWindowStats measures windowed stats aggregation for a large
+// upstream pool with a busy recent request history
+func BenchmarkTimeWindowStats(b *testing.B) {
+	for _, numUpstreams := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("upstreams=%d", numUpstreams), func(b *testing.B) {
+			config := &Config{}
+			for i := 0; i < numUpstreams; i++ {
+				config.UpstreamProxies = append(config.UpstreamProxies, UpstreamProxyConfig{
+					URL:     fmt.Sprintf("http://10.0.%d.%d:3128", i/250, i%250),
+					Enabled: true,
+					Weight:  1,
+					Tag:     fmt.Sprintf("tag-%d", i%10),
+				})
+			}
+
+			ps := NewProxyServer(config, "")
+
+			const numRequests = 20000
+			now := time.Now()
+			ps.mutex.Lock()
+			for i := 0; i < numRequests; i++ {
+				ps.stats.RecentRequests = append(ps.stats.RecentRequests, RecentRequest{
+					Timestamp: now,
+					Upstream:  ps.upstreams[i%numUpstreams],
+					Latency:   int64(i % 500),
+					Success:   i%10 != 0,
+				})
+			}
+			ps.mutex.Unlock()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = ps.getTimeWindowStats(15 * time.Minute)
+			}
+		})
+	}
+}
@@ -10,22 +10,12 @@ import (
 func TestUpstreamTagging(t *testing.T) {
 	t.Run("BasicTagSupport", func(t *testing.T) {
 		config := &Config{
-			Server: struct {
-				Name          string `json:"name"`
-				ListenAddress string `json:"listen_address"`
-				StatsEndpoint string `json:"stats_endpoint"`
-			}{
+			Server: ServerConfig{
 				Name:          "Test Proxy",
 				ListenAddress: "127.0.0.1:3180",
 				StatsEndpoint: "/stats",
 			},
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9100", Enabled: true, Weight: 1, Tag: "aws-us-east"},
 				{URL: "http://127.0.0.1:9101", Enabled: true, Weight: 1, Tag: "aws-us-east"},
 				{URL: "http://127.0.0.1:9102", Enabled: true, Weight: 1, Tag: "gcp-us-central"},
@@ -92,13 +82,7 @@ func TestUpstreamTagging(t *testing.T) {
 
 	t.Run("TaggedHealthManagement", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9104", Enabled: true, Weight: 1, Tag: "provider-a"},
 				{URL: "http://127.0.0.1:9105", Enabled: true, Weight: 1, Tag: "provider-a"},
 				{URL: "http://127.0.0.1:9106", Enabled: true, Weight: 1, Tag: "provider-b"},
@@ -157,13 +141,7 @@ func TestUpstreamTagging(t *testing.T) {
 
 	t.Run("TaggedStatistics", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9107", Enabled: true, Weight: 1, Tag: "region-east"},
 				{URL: "http://127.0.0.1:9108", Enabled: true, Weight: 1, Tag: "region-west"},
 			},
@@ -173,12 +151,7 @@ func TestUpstreamTagging(t *testing.T) {
 
 		// Simulate some recent requests
 		ps.mutex.Lock()
-		ps.stats.RecentRequests = append(ps.stats.RecentRequests, []struct {
-			Timestamp time.Time
-			Upstream  string
-			Latency   int64
-			Success   bool
-		}{
+		ps.stats.RecentRequests = append(ps.stats.RecentRequests, []RecentRequest{
 			{Timestamp: time.Now(), Upstream: "http://127.0.0.1:9107", Latency: 100, Success: true},
 			{Timestamp: time.Now(), Upstream: "http://127.0.0.1:9107", Latency: 200, Success: true},
 			{Timestamp: time.Now(), Upstream: "http://127.0.0.1:9108", Latency: 150, Success: true},
@@ -226,13 +199,7 @@ func TestUpstreamTagging(t *testing.T) {
 
 	t.Run("TaggedLoadBalancing", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9109", Enabled: true, Weight: 3, Tag: "high-performance"},
 				{URL: "http://127.0.0.1:9110", Enabled: true, Weight: 1, Tag: "backup"},
 				{URL: "http://127.0.0.1:9111", Enabled: true, Weight: 0, Tag: "maintenance"}, // Zero weight
@@ -393,13 +360,7 @@ func TestTaggedLogging(t *testing.T) {
 	// For now, we'll just verify the tag information is available in the structures
 	t.Run("LoggingDataStructures", func(t *testing.T) {
 		config := &Config{
-			UpstreamProxies: []struct {
-				URL     string `json:"url"`
-				Enabled bool   `json:"enabled"`
-				Weight  int    `json:"weight"`
-			Tag     string `json:"tag,omitempty"`
-		Note    string `json:"note,omitempty"`
-			}{
+			UpstreamProxies: []UpstreamProxyConfig{
 				{URL: "http://127.0.0.1:9112", Enabled: true, Weight: 1, Tag: "test-provider"},
 			},
 		}
@@ -430,4 +391,204 @@ func absInt(x int) int {
 		return -x
 	}
 	return x
-}
\ No newline at end of file
+}
+// TestTagWeights tests two-stage selection: tags by tag_weights, then upstreams by weight
+func TestTagWeights(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9301", Enabled: true, Weight: 1, Tag: "provider-a"},
+			{URL: "http://127.0.0.1:9302", Enabled: true, Weight: 1, Tag: "provider-a"},
+			{URL: "http://127.0.0.1:9303", Enabled: true, Weight: 10, Tag: "provider-b"},
+			{URL: "http://127.0.0.1:9304", Enabled: true, Weight: 10},
+		},
+		TagWeights: map[string]int{"provider-a": 70, "provider-b": 30},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Expected valid tag weights, got %v", err)
+	}
+	ps := NewProxyServer(config, "")
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+
+	// Tag shares are exact; untagged and unlisted upstreams get nothing
+	tagA := counts["http://127.0.0.1:9301"] + counts["http://127.0.0.1:9302"]
+	if tagA != 700 || counts["http://127.0.0.1:9303"] != 300 || counts["http://127.0.0.1:9304"] != 0 {
+		t.Errorf("Expected 700/300/0 split across provider-a, provider-b and untagged, got %v", counts)
+	}
+	// Equal weights split provider-a's share evenly
+	for _, upstream := range []string{"http://127.0.0.1:9301", "http://127.0.0.1:9302"} {
+		if counts[upstream] < 300 || counts[upstream] > 400 {
+			t.Errorf("Expected about 350 requests for %s, got %d", upstream, counts[upstream])
+		}
+	}
+
+	// A tag without healthy upstreams drops out and the others absorb its share
+	for i := 0; i < 3; i++ {
+		ps.recordUpstreamFailure("http://127.0.0.1:9303")
+	}
+	counts = make(map[string]int)
+	for i := 0; i < 100; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts["http://127.0.0.1:9301"]+counts["http://127.0.0.1:9302"] != 100 {
+		t.Errorf("Expected provider-a to take all traffic while provider-b is down, got %v", counts)
+	}
+
+	// Routing rules pin a tag and bypass tag weights
+	if upstream, _ := ps.selectUpstream("provider-b"); upstream != "http://127.0.0.1:9303" {
+		t.Errorf("Expected pinned tag to fall back to its least-failed upstream, got %s", upstream)
+	}
+
+	config.TagWeights["provider-b"] = -1
+	if err := validateConfig(config); err == nil {
+		t.Error("Expected negative tag weight to be rejected")
+	}
+}
+
+// TestTagWeightsMatchAnyTag tests that an upstream carrying a weighted tag
+// only in tags still receives that tag's share
+func TestTagWeightsMatchAnyTag(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9305", Enabled: true, Weight: 1, Tag: "eu", Tags: []string{"provider-a"}},
+			{URL: "http://127.0.0.1:9306", Enabled: true, Weight: 1, Tag: "provider-b"},
+			{URL: "http://127.0.0.1:9307", Enabled: true, Weight: 1},
+		},
+		TagWeights: map[string]int{"provider-a": 60, "provider-b": 40},
+	}
+	ps := NewProxyServer(config, "")
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[ps.getNextUpstream()]++
+	}
+	if counts["http://127.0.0.1:9305"] != 600 || counts["http://127.0.0.1:9306"] != 400 || counts["http://127.0.0.1:9307"] != 0 {
+		t.Errorf("Expected 600/400/0 split across provider-a, provider-b and untagged, got %v", counts)
+	}
+}
+
+// TestMultipleTags tests that upstreams with several tags route and aggregate under each of them
+func TestMultipleTags(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9311", Enabled: true, Weight: 1, Tag: "eu", Tags: []string{"provider-x", "premium"}},
+			{URL: "http://127.0.0.1:9312", Enabled: true, Weight: 1, Tags: []string{"us", "provider-x"}},
+			{URL: "http://127.0.0.1:9313", Enabled: true, Weight: 1, Tag: "eu"},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	// The first of tags becomes the primary tag when tag is unset
+	if primary := ps.weightedUpstreams[1].Tag; primary != "us" {
+		t.Errorf("Expected primary tag us, got %q", primary)
+	}
+
+	// Routing by any tag matches
+	for i := 0; i < 10; i++ {
+		if upstream, _ := ps.selectUpstream("provider-x"); upstream == "http://127.0.0.1:9313" {
+			t.Errorf("provider-x selected untagged upstream %s", upstream)
+		}
+		if upstream, _ := ps.selectUpstream("premium"); upstream != "http://127.0.0.1:9311" {
+			t.Errorf("Expected premium to select 9311, got %s", upstream)
+		}
+	}
+
+	// Lifetime stats count each upstream under every one of its tags
+	ps.mutex.Lock()
+	for upstream, requests := range map[string]int64{
+		"http://127.0.0.1:9311": 5,
+		"http://127.0.0.1:9312": 3,
+		"http://127.0.0.1:9313": 2,
+	} {
+		ps.stats.UpstreamMetrics[upstream].TotalRequests = requests
+		ps.stats.UpstreamMetrics[upstream].SuccessRequests = requests
+	}
+	ps.mutex.Unlock()
+
+	stats := ps.getTimeWindowStats(time.Hour)
+	expected := map[string]struct {
+		requests  int64
+		upstreams int
+	}{
+		"eu":         {7, 2},
+		"us":         {3, 1},
+		"provider-x": {8, 2},
+		"premium":    {5, 1},
+	}
+	for tag, want := range expected {
+		group, exists := stats.TagGroups[tag]
+		if !exists {
+			t.Errorf("Missing tag group %s", tag)
+			continue
+		}
+		if group.TotalRequests != want.requests || group.UpstreamCount != want.upstreams {
+			t.Errorf("Tag group %s: expected %d requests over %d upstreams, got %d over %d",
+				tag, want.requests, want.upstreams, group.TotalRequests, group.UpstreamCount)
+		}
+	}
+
+	tagGroups, _ := ps.getHealthMetrics()["tag_groups"].(map[string]interface{})
+	for tag, want := range expected {
+		group, exists := tagGroups[tag].(map[string]interface{})
+		if !exists {
+			t.Errorf("Missing health tag group %s", tag)
+			continue
+		}
+		if total := group["total_upstreams"].(int); total != want.upstreams {
+			t.Errorf("Health tag group %s: expected %d upstreams, got %d", tag, want.upstreams, total)
+		}
+	}
+}
+
+// TestWindowErrorRate tests that error_rate matches the raw counts per
+// upstream and tag group, in recent and lifetime windows
+func TestWindowErrorRate(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9321", Enabled: true, Weight: 1, Tag: "eu"},
+			{URL: "http://127.0.0.1:9322", Enabled: true, Weight: 1, Tag: "eu"},
+			{URL: "http://127.0.0.1:9323", Enabled: true, Weight: 1, Tag: "us"},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	ps.mutex.Lock()
+	for upstream, outcomes := range map[string][2]int{
+		"http://127.0.0.1:9321": {3, 1}, // successes, failures
+		"http://127.0.0.1:9322": {2, 2},
+	} {
+		for i := 0; i < outcomes[0]+outcomes[1]; i++ {
+			ps.recordRecentRequest(RecentRequest{Timestamp: time.Now(), Upstream: upstream, Success: i < outcomes[0]})
+		}
+		metric := ps.stats.UpstreamMetrics[upstream]
+		metric.TotalRequests = int64(10 * (outcomes[0] + outcomes[1]))
+		metric.SuccessRequests = int64(10 * outcomes[0])
+		metric.FailedRequests = int64(10 * outcomes[1])
+	}
+	ps.mutex.Unlock()
+
+	for _, window := range []time.Duration{15 * time.Minute, time.Hour} {
+		stats := ps.getTimeWindowStats(window)
+		for _, us := range stats.UpstreamMetrics {
+			want := 0.0
+			if us.TotalRequests > 0 {
+				want = float64(us.FailedRequests) / float64(us.TotalRequests)
+			}
+			if us.ErrorRate != want {
+				t.Errorf("%v %s: expected error_rate %v from %d/%d, got %v",
+					window, us.URL, want, us.FailedRequests, us.TotalRequests, us.ErrorRate)
+			}
+		}
+
+		eu := stats.TagGroups["eu"]
+		if want := float64(eu.FailedRequests) / float64(eu.TotalRequests); eu.ErrorRate != want || want != 3.0/8 {
+			t.Errorf("%v eu: expected error_rate 0.375 from %d/%d, got %v", window, eu.FailedRequests, eu.TotalRequests, eu.ErrorRate)
+		}
+		if us := stats.TagGroups["us"]; us.ErrorRate != 0 {
+			t.Errorf("%v us: expected error_rate 0 without requests, got %v", window, us.ErrorRate)
+		}
+	}
+}
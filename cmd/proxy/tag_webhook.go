@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TagWebhookConfig announces tag failover: the URL receives a JSON POST
+// whenever every upstream of a tag turns unhealthy, and again on recovery
+type TagWebhookConfig struct {
+	URL string `json:"url,omitempty"`
+	// MaxRetries bounds redelivery after a failed POST (default 3); retries
+	// back off exponentially from RetryBackoffMs (default 1000)
+	MaxRetries     int `json:"max_retries,omitempty"`
+	RetryBackoffMs int `json:"retry_backoff_ms,omitempty"`
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+const (
+	tagEventDown      = "tag_down"
+	tagEventRecovered = "tag_recovered"
+)
+
+// tagEvent is the webhook payload
+type tagEvent struct {
+	Event     string          `json:"event"`
+	Tag       string          `json:"tag"`
+	Server    string          `json:"server,omitempty"`
+	Time      time.Time       `json:"time"`
+	Upstreams []tagEventEntry `json:"upstreams"`
+}
+
+// tagEventEntry describes one upstream of the tag, without credentials
+type tagEventEntry struct {
+	Upstream     string    `json:"upstream"`
+	Healthy      bool      `json:"healthy"`
+	FailureCount int64     `json:"failure_count"`
+	LastFailure  time.Time `json:"last_failure"`
+}
+
+// checkTagTransitions compares every tag's health with the previous health
+// check round and announces tags that went fully unhealthy or recovered.
+// Tags start out as up, matching the initial health of their upstreams.
+func (hc *HealthChecker) checkTagTransitions() {
+	ps := hc.proxyServer
+
+	ps.mutex.RLock()
+	webhook := ps.config.HealthCheck.TagWebhook
+	serverName := ps.config.Server.Name
+	groups := make(map[string][]tagEventEntry)
+	ps.healthMutex.RLock()
+	for _, weighted := range ps.weightedUpstreams {
+		entry := tagEventEntry{Upstream: "unknown", Healthy: true}
+		if host, _, err := parseUpstreamAuth(weighted.URL); err == nil {
+			entry.Upstream = host
+		}
+		if health, exists := ps.upstreamHealth[weighted.URL]; exists {
+			entry.Healthy = health.IsHealthy
+			entry.FailureCount = health.FailureCount
+			entry.LastFailure = health.LastFailure
+		}
+		for _, tag := range tagList(weighted.Tag, weighted.Tags) {
+			groups[tag] = append(groups[tag], entry)
+		}
+	}
+	ps.healthMutex.RUnlock()
+	ps.mutex.RUnlock()
+
+	if hc.tagDown == nil {
+		hc.tagDown = make(map[string]bool)
+	}
+	// Forget tags a reload removed
+	for tag := range hc.tagDown {
+		if _, exists := groups[tag]; !exists {
+			delete(hc.tagDown, tag)
+		}
+	}
+
+	tags := make([]string, 0, len(groups))
+	for tag := range groups {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		down := true
+		for _, entry := range groups[tag] {
+			if entry.Healthy {
+				down = false
+				break
+			}
+		}
+		if down == hc.tagDown[tag] {
+			continue
+		}
+		hc.tagDown[tag] = down
+
+		event := tagEvent{Event: tagEventRecovered, Tag: tag, Server: serverName, Time: time.Now(), Upstreams: groups[tag]}
+		if down {
+			event.Event = tagEventDown
+			log.Printf("WARNING: every upstream tagged %q is unhealthy", tag)
+		} else {
+			log.Printf("Upstreams tagged %q recovered", tag)
+		}
+		if webhook.URL != "" {
+			hc.tagWebhooks.enqueue(webhook, event)
+		}
+	}
+}
+
+// tagWebhookDelivery is an event waiting to be POSTed
+type tagWebhookDelivery struct {
+	webhook TagWebhookConfig
+	event   tagEvent
+}
+
+// tagWebhookQueue delivers each tag's events one at a time in the order they
+// happened, so a retried tag_down never lands after the tag_recovered that
+// followed it. Each tag with pending events has one worker goroutine, which
+// exits once the tag's queue is empty; a slow receiver never delays health
+// checks.
+type tagWebhookQueue struct {
+	mutex   sync.Mutex
+	pending map[string][]tagWebhookDelivery
+}
+
+func (q *tagWebhookQueue) enqueue(webhook TagWebhookConfig, event tagEvent) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.pending == nil {
+		q.pending = make(map[string][]tagWebhookDelivery)
+	}
+	// A tag present in pending already has a worker
+	queued, running := q.pending[event.Tag]
+	q.pending[event.Tag] = append(queued, tagWebhookDelivery{webhook: webhook, event: event})
+	if !running {
+		go q.deliver(event.Tag)
+	}
+}
+
+// deliver sends tag's events until its queue is empty
+func (q *tagWebhookQueue) deliver(tag string) {
+	for {
+		q.mutex.Lock()
+		queued := q.pending[tag]
+		if len(queued) == 0 {
+			delete(q.pending, tag)
+			q.mutex.Unlock()
+			return
+		}
+		next := queued[0]
+		q.pending[tag] = queued[1:]
+		q.mutex.Unlock()
+
+		sendTagWebhook(next.webhook, next.event)
+	}
+}
+
+// sendTagWebhook POSTs event, retrying with exponential backoff on errors
+// and non-2xx responses
+func sendTagWebhook(webhook TagWebhookConfig, event tagEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event for tag %q: %v", event.Event, event.Tag, err)
+		return
+	}
+
+	maxRetries := webhook.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+	backoff := time.Duration(webhook.RetryBackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	timeout := time.Duration(webhook.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	for attempt := 0; ; attempt++ {
+		err = postTagEvent(client, webhook.URL, body)
+		if err == nil {
+			return
+		}
+		if attempt == maxRetries {
+			log.Printf("Giving up on %s webhook for tag %q after %d attempts: %v", event.Event, event.Tag, attempt+1, err)
+			return
+		}
+		log.Printf("Tag webhook delivery failed (attempt %d), retrying in %v: %v", attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postTagEvent(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// selectTagGroup narrows the candidates to a single tag chosen by weighted
+// round-robin over tag_weights, so traffic splits across providers by tag
+// before upstream weights apply within the chosen tag. An upstream belongs
+// to the group of every tag it carries, in tag or tags. Only tags with
+// candidates left take part. Tags missing from tag_weights (including
+// untagged upstreams) get traffic only when no weighted tag has any, in
+// which case the candidates are returned unchanged.
+// Caller must hold ps.mutex (read).
+func (ps *ProxyServer) selectTagGroup(upstreams []WeightedUpstream) []WeightedUpstream {
+	tagWeights := ps.config.TagWeights
+	if len(tagWeights) == 0 {
+		return upstreams
+	}
+
+	groups := make(map[string][]WeightedUpstream)
+	for _, upstream := range upstreams {
+		for _, tag := range tagList(upstream.Tag, upstream.Tags) {
+			if tagWeights[tag] > 0 {
+				groups[tag] = append(groups[tag], upstream)
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return upstreams
+	}
+	if len(groups) == 1 {
+		for _, group := range groups {
+			return group
+		}
+	}
+
+	tags := make([]string, 0, len(groups))
+	totalWeight := 0
+	for tag := range groups {
+		tags = append(tags, tag)
+		totalWeight += tagWeights[tag]
+	}
+	sort.Strings(tags)
+
+	ps.idxMutex.Lock()
+	ps.tagIdx = (ps.tagIdx + 1) % totalWeight
+	targetWeight := ps.tagIdx
+	ps.idxMutex.Unlock()
+
+	currentWeight := 0
+	for _, tag := range tags {
+		currentWeight += tagWeights[tag]
+		if targetWeight < currentWeight {
+			return groups[tag]
+		}
+	}
+	return groups[tags[0]]
+}
+
+// validateTagWeights rejects negative tag weights
+func validateTagWeights(tagWeights map[string]int) error {
+	for tag, weight := range tagWeights {
+		if weight < 0 {
+			return fmt.Errorf("tag_weights: weight for tag %q must not be negative, got %d", tag, weight)
+		}
+	}
+	return nil
+}
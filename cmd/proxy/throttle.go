@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthLimit caps tunnel throughput in bytes per second. BytesPerSecond
+// applies to both directions unless a direction-specific limit is set.
+// Upload is client -> upstream, download is upstream -> client.
+type BandwidthLimit struct {
+	BytesPerSecond         int64 `json:"bytes_per_second,omitempty"`
+	UploadBytesPerSecond   int64 `json:"upload_bytes_per_second,omitempty"`
+	DownloadBytesPerSecond int64 `json:"download_bytes_per_second,omitempty"`
+}
+
+// BandwidthConfig configures per-tunnel throttling. The most specific limit
+// wins: a client entry (keyed by proxy username or client IP), then the
+// selected upstream's tag, then the global default.
+type BandwidthConfig struct {
+	Default BandwidthLimit            `json:"default,omitempty"`
+	Tags    map[string]BandwidthLimit `json:"tags,omitempty"`
+	Clients map[string]BandwidthLimit `json:"clients,omitempty"`
+}
+
+func (bl BandwidthLimit) isSet() bool {
+	return bl.BytesPerSecond > 0 || bl.UploadBytesPerSecond > 0 || bl.DownloadBytesPerSecond > 0
+}
+
+// rates resolves the effective upload and download limits (0 = unlimited)
+func (bl BandwidthLimit) rates() (upload, download int64) {
+	upload, download = bl.BytesPerSecond, bl.BytesPerSecond
+	if bl.UploadBytesPerSecond > 0 {
+		upload = bl.UploadBytesPerSecond
+	}
+	if bl.DownloadBytesPerSecond > 0 {
+		download = bl.DownloadBytesPerSecond
+	}
+	return upload, download
+}
+
+// bandwidthLimit picks the limit for a tunnel from the client identity and
+// the selected upstream's tag
+func (ps *ProxyServer) bandwidthLimit(r *http.Request, upstream string) BandwidthLimit {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	config := ps.config.Bandwidth
+	if len(config.Clients) > 0 {
+		if username := proxyAuthUsername(r); username != "" {
+			if limit, ok := config.Clients[username]; ok {
+				return limit
+			}
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if limit, ok := config.Clients[host]; ok {
+				return limit
+			}
+		}
+	}
+
+	if len(config.Tags) > 0 {
+		for _, weighted := range ps.weightedUpstreams {
+			if weighted.URL != upstream {
+				continue
+			}
+			// The first of the upstream's tags with a limit applies
+			for _, tag := range tagList(weighted.Tag, weighted.Tags) {
+				if limit, ok := config.Tags[tag]; ok {
+					return limit
+				}
+			}
+			break
+		}
+	}
+
+	return config.Default
+}
+
+// proxyAuthUsername extracts the username from a Basic Proxy-Authorization header
+func proxyAuthUsername(r *http.Request) string {
+	encoded, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	username, _, _ := strings.Cut(string(decoded), ":")
+	return username
+}
+
+// tokenBucket is a byte-based token bucket refilled at rate bytes per second
+// with a burst of one second's worth of tokens
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	rate := float64(bytesPerSecond)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// take blocks until n tokens are available and consumes them. n must not
+// exceed the burst size.
+func (tb *tokenBucket) take(n int) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	now := time.Now()
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+
+	tb.tokens -= float64(n)
+	if tb.tokens < 0 {
+		// Sleep off the deficit; the refill on the next call accounts for it
+		time.Sleep(time.Duration(-tb.tokens / tb.rate * float64(time.Second)))
+	}
+}
+
+// throttledWriter limits the rate at which data is written to w
+type throttledWriter struct {
+	w      io.Writer
+	bucket *tokenBucket
+	chunk  int
+}
+
+func newThrottledWriter(w io.Writer, bytesPerSecond int64) *throttledWriter {
+	// Write in chunks of at most a tenth of a second's worth to keep the
+	// transfer smooth rather than bursty
+	chunk := int(max(bytesPerSecond/10, 1))
+	return &throttledWriter{
+		w:      w,
+		bucket: newTokenBucket(bytesPerSecond),
+		chunk:  chunk,
+	}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := min(written+tw.chunk, len(p))
+		tw.bucket.take(end - written)
+		n, err := tw.w.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBandwidthThrottling tests that a tight download limit slows a tunnel transfer
+func TestBandwidthThrottling(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+
+	const limit = 20000
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+		Bandwidth: BandwidthConfig{
+			Default: BandwidthLimit{DownloadBytesPerSecond: limit},
+		},
+	}
+	proxyAddr := startTestProxy(t, NewProxyServer(config, ""))
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	defer conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200 Connection Established, got %q", head)
+	}
+
+	// The bucket starts with one second of burst, so 2.5x the limit needs at
+	// least 1.5 seconds to come back through the echo upstream
+	payload := bytes.Repeat([]byte("x"), limit*5/2)
+	start := time.Now()
+	go conn.Write(payload)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	received := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("Failed to read echoed payload: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(received, payload) {
+		t.Error("Echoed payload does not match")
+	}
+	if elapsed < 1400*time.Millisecond {
+		t.Errorf("Transfer finished too quickly for the limit: %v", elapsed)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("Transfer took much longer than the limit allows: %v", elapsed)
+	}
+}
+
+// TestBandwidthLimitPrecedence tests that client limits override tag limits,
+// which override the global default
+func TestBandwidthLimitPrecedence(t *testing.T) {
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://127.0.0.1:9501", Enabled: true, Weight: 1, Tag: "residential"},
+			{URL: "http://127.0.0.1:9502", Enabled: true, Weight: 1},
+		},
+		Bandwidth: BandwidthConfig{
+			Default: BandwidthLimit{BytesPerSecond: 1000},
+			Tags:    map[string]BandwidthLimit{"residential": {BytesPerSecond: 2000, UploadBytesPerSecond: 500}},
+			Clients: map[string]BandwidthLimit{
+				"alice":     {BytesPerSecond: 3000},
+				"10.0.0.50": {DownloadBytesPerSecond: 4000},
+			},
+		},
+	}
+	ps := NewProxyServer(config, "")
+
+	newRequest := func(remoteAddr, username string) *http.Request {
+		r := &http.Request{Header: make(http.Header), RemoteAddr: remoteAddr}
+		if username != "" {
+			r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":pass")))
+		}
+		return r
+	}
+
+	tests := []struct {
+		name         string
+		request      *http.Request
+		upstream     string
+		wantUpload   int64
+		wantDownload int64
+	}{
+		{"Default", newRequest("10.0.0.1:5000", ""), "http://127.0.0.1:9502", 1000, 1000},
+		{"TagWithUploadOverride", newRequest("10.0.0.1:5000", ""), "http://127.0.0.1:9501", 500, 2000},
+		{"ClientByUsername", newRequest("10.0.0.1:5000", "alice"), "http://127.0.0.1:9501", 3000, 3000},
+		{"ClientByIP", newRequest("10.0.0.50:5000", "bob"), "http://127.0.0.1:9501", 0, 4000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload, download := ps.bandwidthLimit(tt.request, tt.upstream).rates()
+			if upload != tt.wantUpload || download != tt.wantDownload {
+				t.Errorf("Expected upload/download %d/%d, got %d/%d", tt.wantUpload, tt.wantDownload, upload, download)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TracingConfig emits a span per CONNECT to an OpenTelemetry collector over
+// OTLP/HTTP (JSON encoding). Changes need a restart.
+type TracingConfig struct {
+	Enabled bool `json:"enabled"`
+	// OTLPEndpoint is the collector's traces URL, e.g.
+	// "http://localhost:4318/v1/traces"
+	OTLPEndpoint string `json:"otlp_endpoint,omitempty"`
+	// ServiceName is reported as service.name (default "netdrift")
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+// spanExporter receives finished spans
+type spanExporter interface {
+	export(span *connectSpan)
+}
+
+type spanAttribute struct {
+	Key   string
+	Value string
+}
+
+type spanEvent struct {
+	Name string
+	Time time.Time
+}
+
+// connectSpan covers one CONNECT from selection through the end of the
+// tunnel. A nil span is valid and records nothing, which is what every
+// CONNECT gets while tracing is off.
+type connectSpan struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // zero unless the client sent a traceparent header
+	Start      time.Time
+	End        time.Time
+	Attributes []spanAttribute
+	Events     []spanEvent
+	Failed     bool
+}
+
+// startConnectSpan begins the span for a CONNECT, joining the client's
+// trace when the request carries a W3C traceparent header. It returns nil
+// when tracing is off.
+func (ps *ProxyServer) startConnectSpan(r *http.Request, start time.Time) *connectSpan {
+	if ps.tracer == nil {
+		return nil
+	}
+	span := &connectSpan{Start: start}
+	if traceID, parentID, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		span.TraceID, span.ParentID = traceID, parentID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	span.setAttribute("server.address", r.Host)
+	return span
+}
+
+// setAttribute sets key, replacing any earlier value
+func (s *connectSpan) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	for i := range s.Attributes {
+		if s.Attributes[i].Key == key {
+			s.Attributes[i].Value = value
+			return
+		}
+	}
+	s.Attributes = append(s.Attributes, spanAttribute{Key: key, Value: value})
+}
+
+// attribute returns the value of key, or "" if it is not set
+func (s *connectSpan) attribute(key string) string {
+	if s == nil {
+		return ""
+	}
+	for _, attr := range s.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// event marks a step of the CONNECT, such as the dial completing
+func (s *connectSpan) event(name string) {
+	if s == nil {
+		return
+	}
+	s.Events = append(s.Events, spanEvent{Name: name, Time: time.Now()})
+}
+
+// finishConnectSpan records the outcome and hands the span to the exporter
+func (ps *ProxyServer) finishConnectSpan(span *connectSpan, status int) {
+	if span == nil {
+		return
+	}
+	span.End = time.Now()
+	span.setAttribute("http.response.status_code", strconv.Itoa(status))
+	if span.attribute("netdrift.result") == "" {
+		result := "established"
+		if status != http.StatusOK {
+			result = "rejected"
+		}
+		span.setAttribute("netdrift.result", result)
+	}
+	span.Failed = span.attribute("netdrift.result") != "established"
+	ps.tracer.export(span)
+}
+
+// stopTracing flushes spans still queued for export
+func (ps *ProxyServer) stopTracing() {
+	if exporter, ok := ps.tracer.(*otlpExporter); ok {
+		exporter.stop()
+	}
+}
+
+// parseTraceparent extracts the trace and parent span IDs from a version 00
+// W3C traceparent header
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// otlpExporter batches spans and posts them to an OTLP/HTTP collector. Spans
+// that arrive while the queue is full are dropped rather than slowing down
+// CONNECTs.
+type otlpExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	queue       chan *connectSpan
+	stopCh      chan struct{}
+	done        sync.WaitGroup
+}
+
+const (
+	otlpQueueSize     = 1024
+	otlpBatchSize     = 128
+	otlpFlushInterval = 2 * time.Second
+)
+
+func newOTLPExporter(config TracingConfig) *otlpExporter {
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "netdrift"
+	}
+	exporter := &otlpExporter{
+		endpoint:    config.OTLPEndpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		queue:       make(chan *connectSpan, otlpQueueSize),
+		stopCh:      make(chan struct{}),
+	}
+	exporter.done.Add(1)
+	go exporter.run()
+	return exporter
+}
+
+func (e *otlpExporter) export(span *connectSpan) {
+	select {
+	case e.queue <- span:
+	default:
+	}
+}
+
+// stop flushes queued spans and ends the exporter. Tunnels still open
+// afterwards fill the queue and have their spans dropped.
+func (e *otlpExporter) stop() {
+	close(e.stopCh)
+	e.done.Wait()
+}
+
+func (e *otlpExporter) run() {
+	defer e.done.Done()
+
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*connectSpan
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				e.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = nil
+		case <-e.stopCh:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.flush(batch)
+			return
+		}
+	}
+}
+
+func (e *otlpExporter) flush(batch []*connectSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest(e.serviceName, batch))
+	if err != nil {
+		log.Printf("Tracing: failed to encode %d spans: %v", len(batch), err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Tracing: failed to export %d spans: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Tracing: collector rejected %d spans with status %d", len(batch), resp.StatusCode)
+	}
+}
+
+// otlpRequest builds an OTLP ExportTraceServiceRequest in its JSON encoding
+func otlpRequest(serviceName string, spans []*connectSpan) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		attributes := make([]map[string]interface{}, 0, len(span.Attributes))
+		for _, attr := range span.Attributes {
+			attributes = append(attributes, otlpAttribute(attr.Key, attr.Value))
+		}
+		events := make([]map[string]interface{}, 0, len(span.Events))
+		for _, event := range span.Events {
+			events = append(events, map[string]interface{}{
+				"name":         event.Name,
+				"timeUnixNano": unixNano(event.Time),
+			})
+		}
+		// Status codes: 1 = OK, 2 = ERROR
+		statusCode := 1
+		if span.Failed {
+			statusCode = 2
+		}
+		encodedSpan := map[string]interface{}{
+			"traceId":           hex.EncodeToString(span.TraceID[:]),
+			"spanId":            hex.EncodeToString(span.SpanID[:]),
+			"name":              "CONNECT",
+			"kind":              2, // SPAN_KIND_SERVER
+			"startTimeUnixNano": unixNano(span.Start),
+			"endTimeUnixNano":   unixNano(span.End),
+			"attributes":        attributes,
+			"events":            events,
+			"status":            map[string]interface{}{"code": statusCode},
+		}
+		if span.ParentID != [8]byte{} {
+			encodedSpan["parentSpanId"] = hex.EncodeToString(span.ParentID[:])
+		}
+		encoded = append(encoded, encodedSpan)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{otlpAttribute("service.name", serviceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "netdrift"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttribute(key, value string) map[string]interface{} {
+	return map[string]interface{}{"key": key, "value": map[string]interface{}{"stringValue": value}}
+}
+
+// unixNano formats t the way OTLP JSON encodes 64-bit integers
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// validateTracing checks the tracing settings
+func validateTracing(tracing TracingConfig) error {
+	if !tracing.Enabled {
+		return nil
+	}
+	if !strings.HasPrefix(tracing.OTLPEndpoint, "http://") && !strings.HasPrefix(tracing.OTLPEndpoint, "https://") {
+		return fmt.Errorf("tracing.otlp_endpoint must be an http(s):// URL, got %q", tracing.OTLPEndpoint)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// spanRecorder keeps exported spans in memory
+type spanRecorder struct {
+	mutex sync.Mutex
+	spans []*connectSpan
+}
+
+func (sr *spanRecorder) export(span *connectSpan) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.spans = append(sr.spans, span)
+}
+
+func (sr *spanRecorder) waitForSpans(t *testing.T, n int) []*connectSpan {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sr.mutex.Lock()
+		spans := append([]*connectSpan(nil), sr.spans...)
+		sr.mutex.Unlock()
+		if len(spans) >= n || time.Now().After(deadline) {
+			return spans
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectSpan(t *testing.T) {
+	upstream := "http://" + startMockUpstream(t, echoUpstream)
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: upstream, Enabled: true, Weight: 1, Tag: "eu", Tags: []string{"fast"}},
+		},
+		RoutingRules: []RoutingRule{{Match: "*.example.com", Tag: "eu"}},
+	}
+	ps := NewProxyServer(config, "")
+	recorder := &spanRecorder{}
+	ps.tracer = recorder
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	fmt.Fprintf(conn, "CONNECT api.example.com:443 HTTP/1.1\r\nHost: api.example.com:443\r\nTraceparent: 00-%s-00f067aa0ba902b7-01\r\n\r\n", traceID)
+	reader := bufio.NewReader(conn)
+	if head, err := readConnectRequest(reader); err != nil || !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200, got %q (%v)", head, err)
+	}
+	conn.Write([]byte("ping"))
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echoed); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	conn.Close()
+
+	spans := recorder.waitForSpans(t, 1)
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+
+	if got := hex.EncodeToString(span.TraceID[:]); got != traceID {
+		t.Errorf("Expected the span to join trace %s, got %s", traceID, got)
+	}
+	want := map[string]string{
+		"server.address":            "api.example.com:443",
+		"netdrift.upstream":         upstream,
+		"netdrift.route_tag":        "eu",
+		"netdrift.upstream_tag":     "eu,fast",
+		"netdrift.result":           "established",
+		"netdrift.bytes_up":         "4",
+		"http.response.status_code": "200",
+	}
+	for key, value := range want {
+		if got := span.attribute(key); got != value {
+			t.Errorf("Attribute %s: expected %q, got %q", key, value, got)
+		}
+	}
+
+	var events []string
+	for _, event := range span.Events {
+		events = append(events, event.Name)
+	}
+	if got := strings.Join(events, ","); got != "upstream_selected,upstream_connected,upstream_accepted,tunnel_established" {
+		t.Errorf("Unexpected events: %s", got)
+	}
+	if span.Failed || span.End.Before(span.Start) {
+		t.Errorf("Expected a finished, successful span: %+v", span)
+	}
+}
+
+func TestConnectSpanDisabled(t *testing.T) {
+	ps := NewProxyServer(&Config{}, "")
+	if span := ps.startConnectSpan(httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil), time.Now()); span != nil {
+		t.Fatalf("Expected no span while tracing is off, got %+v", span)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer collector.Close()
+
+	exporter := newOTLPExporter(TracingConfig{Enabled: true, OTLPEndpoint: collector.URL})
+	span := &connectSpan{Start: time.Now(), End: time.Now()}
+	span.setAttribute("netdrift.result", "established")
+	exporter.export(span)
+	exporter.stop()
+
+	select {
+	case body := <-received:
+		encoded, _ := json.Marshal(body)
+		for _, want := range []string{`"service.name"`, `"stringValue":"netdrift"`, `"name":"CONNECT"`, `"key":"netdrift.result"`} {
+			if !strings.Contains(string(encoded), want) {
+				t.Errorf("Expected %s in the export request: %s", want, encoded)
+			}
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Collector received no spans")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdleReaperConfig configures the background sweeper that closes tunnels
+// which have not moved any data for longer than IdleTimeoutSeconds
+type IdleReaperConfig struct {
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds"`
+	IntervalSeconds    int `json:"interval_seconds"`
+}
+
+// tunnel is an established client <-> upstream tunnel. It is only tracked in
+// the registry, and so has a non-zero id, while the idle reaper runs.
+type tunnel struct {
+	id           uint64
+	target       string
+	upstream     string
+	clientConn   net.Conn
+	upstreamConn net.Conn
+	established  time.Time
+	lastActivity int64 // unix nanoseconds, accessed atomically
+}
+
+func (t *tunnel) touch() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+}
+
+func (t *tunnel) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&t.lastActivity)))
+}
+
+func (t *tunnel) close() {
+	t.clientConn.Close()
+	t.upstreamConn.Close()
+}
+
+// writers returns the writers to relay t through. Only registered tunnels
+// record activity; the others write to the connections directly so io.Copy
+// keeps its ReadFrom (splice) path and writes skip the timestamp.
+func (t *tunnel) writers() (toUpstream, toClient io.Writer) {
+	if t.id == 0 {
+		return t.upstreamConn, t.clientConn
+	}
+	return &activityWriter{w: t.upstreamConn, tunnel: t}, &activityWriter{w: t.clientConn, tunnel: t}
+}
+
+// activityWriter records tunnel activity on every successful write
+type activityWriter struct {
+	w      io.Writer
+	tunnel *tunnel
+}
+
+func (aw *activityWriter) Write(p []byte) (int, error) {
+	n, err := aw.w.Write(p)
+	if n > 0 {
+		aw.tunnel.touch()
+	}
+	return n, err
+}
+
+// tunnelRegistry keeps track of the active tunnels while the idle reaper runs
+type tunnelRegistry struct {
+	mutex   sync.Mutex
+	nextID  uint64
+	tunnels map[uint64]*tunnel
+	reaping bool
+}
+
+// setReaping turns registration of new tunnels on or off
+func (tr *tunnelRegistry) setReaping(reaping bool) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tr.reaping = reaping
+}
+
+// add creates the record for an established tunnel, registering it only
+// while the idle reaper runs. Tunnels opened with the reaper off are never
+// reaped, even if it is turned on later.
+func (tr *tunnelRegistry) add(target, upstream string, clientConn, upstreamConn net.Conn) *tunnel {
+	now := time.Now()
+	t := &tunnel{
+		target:       target,
+		upstream:     upstream,
+		clientConn:   clientConn,
+		upstreamConn: upstreamConn,
+		established:  now,
+		lastActivity: now.UnixNano(),
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if !tr.reaping {
+		return t
+	}
+	if tr.tunnels == nil {
+		tr.tunnels = make(map[uint64]*tunnel)
+	}
+	tr.nextID++
+	t.id = tr.nextID
+	tr.tunnels[t.id] = t
+	return t
+}
+
+func (tr *tunnelRegistry) remove(t *tunnel) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	delete(tr.tunnels, t.id)
+}
+
+func (tr *tunnelRegistry) count() int {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	return len(tr.tunnels)
+}
+
+// snapshot returns the currently registered tunnels
+func (tr *tunnelRegistry) snapshot() []*tunnel {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tunnels := make([]*tunnel, 0, len(tr.tunnels))
+	for _, t := range tr.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// reapIdleTunnels closes every tunnel idle for longer than idleTimeout and
+// returns how many were closed
+func (ps *ProxyServer) reapIdleTunnels(idleTimeout time.Duration) int {
+	now := time.Now()
+	reaped := 0
+	for _, t := range ps.tunnels.snapshot() {
+		if idle := t.idleFor(now); idle > idleTimeout {
+			log.Printf("Reaping idle tunnel to %s via %s (idle for %v)", t.target, t.upstream, idle.Round(time.Millisecond))
+			t.close()
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// applyIdleReaper starts, restarts or stops the idle reaper to match config
+func (ps *ProxyServer) applyIdleReaper(config IdleReaperConfig) {
+	if config.IdleTimeoutSeconds <= 0 {
+		ps.stopIdleReaper()
+		return
+	}
+	interval := 30 * time.Second
+	if config.IntervalSeconds > 0 {
+		interval = time.Duration(config.IntervalSeconds) * time.Second
+	}
+	ps.startIdleReaper(time.Duration(config.IdleTimeoutSeconds)*time.Second, interval)
+}
+
+func (ps *ProxyServer) startIdleReaper(idleTimeout, interval time.Duration) {
+	ps.stopIdleReaper()
+
+	stop := make(chan struct{})
+	ps.idleReaperStop = stop
+	ps.tunnels.setReaping(true)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ps.reapIdleTunnels(idleTimeout)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	log.Printf("Idle tunnel reaper started (idle timeout: %v, interval: %v)", idleTimeout, interval)
+}
+
+func (ps *ProxyServer) stopIdleReaper() {
+	if ps.idleReaperStop != nil {
+		close(ps.idleReaperStop)
+		ps.idleReaperStop = nil
+	}
+	ps.tunnels.setReaping(false)
+}
+
+// maxTunnelLifetime returns how long a tunnel may stay open regardless of
+// activity (0 = no limit)
+func (ps *ProxyServer) maxTunnelLifetime() time.Duration {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	return time.Duration(ps.config.MaxTunnelLifetimeSeconds) * time.Second
+}
+
+// expireTunnel closes t once it has been open for lifetime. Stop the
+// returned timer when the tunnel ends on its own.
+func (ps *ProxyServer) expireTunnel(t *tunnel, lifetime time.Duration) *time.Timer {
+	return time.AfterFunc(lifetime, func() {
+		log.Printf("Closing tunnel to %s via %s: max lifetime of %v reached", t.target, t.upstream, lifetime)
+		atomic.AddInt64(&ps.stats.ExpiredTunnels, 1)
+		t.close()
+	})
+}
+
+// openTunnel records an established tunnel for r through upstream, arms its
+// max lifetime, and returns the writers to relay it through with any
+// bandwidth limit applied. Call the returned func when the tunnel ends.
+func (ps *ProxyServer) openTunnel(r *http.Request, upstream string, clientConn, upstreamConn net.Conn) (toUpstream, toClient io.Writer, closeTunnel func()) {
+	// Register the tunnel so the idle reaper can see it
+	tun := ps.tunnels.add(r.Host, upstream, clientConn, upstreamConn)
+	var expiry *time.Timer
+	if lifetime := ps.maxTunnelLifetime(); lifetime > 0 {
+		expiry = ps.expireTunnel(tun, lifetime)
+	}
+
+	// Apply bandwidth limits on top of activity tracking
+	toUpstream, toClient = tun.writers()
+	if limit := ps.bandwidthLimit(r, upstream); limit.isSet() {
+		upload, download := limit.rates()
+		if upload > 0 {
+			toUpstream = newThrottledWriter(toUpstream, upload)
+		}
+		if download > 0 {
+			toClient = newThrottledWriter(toClient, download)
+		}
+	}
+
+	return toUpstream, toClient, func() {
+		if expiry != nil {
+			expiry.Stop()
+		}
+		ps.tunnels.remove(tun)
+	}
+}
+
+// halfCloseGrace is how long the other direction of a tunnel may keep
+// flowing after one side has gone away or could not be half-closed
+const halfCloseGrace = 2 * time.Second
+
+// relayDone reports one relay direction finishing
+type relayDone struct {
+	// upstream is set for the upstream-to-client direction
+	upstream bool
+	// clean means the copy reached EOF and the peer was half-closed
+	clean bool
+}
+
+// relayTunnel copies data between client and upstream until both directions
+// end. When one side finishes sending, its peer is half-closed so it sees EOF
+// and can still answer for as long as it needs. Only when a direction ended
+// with an error, or its peer cannot be half-closed, is the other direction
+// interrupted after halfCloseGrace, so neither goroutine is left blocked on a
+// peer that has gone away. It returns the bytes sent upstream and down to the
+// client, and whether the upstream ended the tunnel, and closes both
+// connections.
+func relayTunnel(clientConn, upstreamConn net.Conn, toUpstream, toClient io.Writer) (uploaded, downloaded int64, upstreamClosed bool) {
+	done := make(chan relayDone, 2)
+	go func() {
+		var err error
+		uploaded, err = io.Copy(toUpstream, clientConn)
+		clean := err == nil && closeWrite(upstreamConn) == nil
+		done <- relayDone{upstream: false, clean: clean}
+	}()
+	go func() {
+		var err error
+		downloaded, err = io.Copy(toClient, upstreamConn)
+		clean := err == nil && closeWrite(clientConn) == nil
+		done <- relayDone{upstream: true, clean: clean}
+	}()
+
+	first := <-done
+	upstreamClosed = first.upstream
+	if first.clean {
+		<-done
+	} else {
+		grace := time.NewTimer(halfCloseGrace)
+		defer grace.Stop()
+		select {
+		case <-done:
+		case <-grace.C:
+			now := time.Now()
+			clientConn.SetDeadline(now)
+			upstreamConn.SetDeadline(now)
+			<-done
+		}
+	}
+
+	clientConn.Close()
+	upstreamConn.Close()
+	return uploaded, downloaded, upstreamClosed
+}
+
+// checkEmptyTunnel counts a tunnel the upstream closed after open without
+// sending a byte as an upstream failure, when that happened within
+// empty_tunnel_window_ms. Such upstreams accept the CONNECT but are dead
+// behind it, which the handshake alone cannot tell.
+func (ps *ProxyServer) checkEmptyTunnel(requestID int64, target, upstream string, upstreamStats *UpstreamStats, open time.Duration) {
+	ps.mutex.RLock()
+	window := time.Duration(ps.config.EmptyTunnelWindowMs) * time.Millisecond
+	ps.mutex.RUnlock()
+
+	if window <= 0 || open >= window {
+		return
+	}
+	log.Printf("WARNING: [req %d] Upstream %s%s closed the tunnel to %s after %v without sending data",
+		requestID, upstream, ps.upstreamTagSuffix(upstream), target, open.Round(time.Millisecond))
+	atomic.AddInt64(&upstreamStats.EmptyTunnels, 1)
+	ps.recordUpstreamError(upstream, fmt.Sprintf("empty tunnel: closed after %v without data", open.Round(time.Millisecond)))
+	ps.recordUpstreamFailure(upstream)
+}
+
+// closeWrite half-closes conn, returning errors.ErrUnsupported when the
+// connection type cannot
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
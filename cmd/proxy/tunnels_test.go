@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestProxy serves ps on a random loopback port and returns its address
+func startTestProxy(t *testing.T, ps *ProxyServer) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: ps}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// startMockUpstream starts a TCP listener that hands each accepted connection
+// to handler and returns the listener address
+func startMockUpstream(t *testing.T, handler func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// readConnectRequest reads an HTTP request head (up to the blank line) from conn
+func readConnectRequest(reader *bufio.Reader) (string, error) {
+	var head strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return head.String(), err
+		}
+		head.WriteString(line)
+		if line == "\r\n" {
+			return head.String(), nil
+		}
+	}
+}
+
+// echoUpstream accepts a CONNECT, answers 200 and then echoes tunnel data back
+func echoUpstream(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if _, err := readConnectRequest(reader); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	io.Copy(conn, reader)
+}
+
+// dialConnect opens a CONNECT tunnel through the proxy and returns the
+// connection along with the proxy's response head
+func dialConnect(t *testing.T, proxyAddr, target string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	head, err := readConnectRequest(bufio.NewReader(conn))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && head == "" {
+		conn.Close()
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	return conn, head
+}
+
+// TestIdleTunnelReaper tests that the reaper closes tunnels idle beyond the threshold
+func TestIdleTunnelReaper(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	ps.startIdleReaper(300*time.Millisecond, 50*time.Millisecond)
+	defer ps.stopIdleReaper()
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	defer conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200 Connection Established, got %q", head)
+	}
+
+	// An active tunnel survives past the idle threshold
+	buffer := make([]byte, 4)
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Active tunnel write failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			t.Fatalf("Active tunnel should not be reaped: %v", err)
+		}
+	}
+	if ps.tunnels.count() != 1 {
+		t.Errorf("Expected 1 registered tunnel, got %d", ps.tunnels.count())
+	}
+
+	// Once idle, the tunnel is closed by the reaper
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err := conn.Read(buffer)
+	if err == nil {
+		t.Fatal("Expected idle tunnel to be closed")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Idle tunnel was not reaped before the read deadline")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Idle tunnel reaped too late: %v", elapsed)
+	}
+
+	// Registry is cleaned up once the tunnel handler exits
+	deadline := time.Now().Add(2 * time.Second)
+	for ps.tunnels.count() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ps.tunnels.count() != 0 {
+		t.Errorf("Expected tunnel registry to be empty, got %d", ps.tunnels.count())
+	}
+}
+
+// TestMaxTunnelLifetime tests that a tunnel is closed at its maximum
+// lifetime even while data keeps flowing
+func TestMaxTunnelLifetime(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, echoUpstream)
+
+	config := &Config{
+		MaxTunnelLifetimeSeconds: 1,
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	defer conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200 Connection Established, got %q", head)
+	}
+	established := time.Now()
+
+	// Keep the tunnel busy until it is closed under us
+	buffer := make([]byte, 4)
+	var err error
+	for time.Since(established) < 3*time.Second {
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = io.ReadFull(conn, buffer); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	closedAfter := time.Since(established)
+
+	if err == nil {
+		t.Fatal("Expected the active tunnel to be closed at its lifetime")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("Expected the tunnel to be closed, got a read timeout: %v", err)
+	}
+	if closedAfter < 900*time.Millisecond || closedAfter > 1500*time.Millisecond {
+		t.Errorf("Expected the tunnel to close at about 1s, closed after %v", closedAfter)
+	}
+	if expired := atomic.LoadInt64(&ps.stats.ExpiredTunnels); expired != 1 {
+		t.Errorf("Expected 1 expired tunnel, got %d", expired)
+	}
+}
+
+// TestUpstreamClosesWhileClientSending tests that an upstream closing the
+// tunnel ends both relay directions promptly, even while the client keeps sending
+func TestUpstreamClosesWhileClientSending(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err := readConnectRequest(reader); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		// Once the client sends, answer and hang up while it keeps sending
+		buffer := make([]byte, 16)
+		reader.Read(buffer)
+		conn.Write([]byte("bye"))
+	})
+
+	config := &Config{
+		Server: ServerConfig{StatsEndpoint: "/stats"},
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	proxyAddr := startTestProxy(t, ps)
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	defer conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200, got %q", head)
+	}
+
+	// Keep sending until the proxy stops accepting data
+	stopSending := make(chan struct{})
+	defer close(stopSending)
+	go func() {
+		chunk := []byte(strings.Repeat("x", 1024))
+		for {
+			select {
+			case <-stopSending:
+				return
+			default:
+			}
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The client sees the upstream's last bytes followed by the end of the tunnel
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	received, _ := io.ReadAll(conn)
+	if string(received) != "bye" {
+		t.Errorf("Expected the upstream's reply before the tunnel closed, got %q", received)
+	}
+
+	// Both relay directions have finished once the handler has returned
+	deadline := time.Now().Add(halfCloseGrace + time.Second)
+	for atomic.LoadInt64(&ps.stats.CurrentRequests) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if current := atomic.LoadInt64(&ps.stats.CurrentRequests); current != 0 {
+		t.Errorf("Expected the handler to finish promptly, %d requests still in flight", current)
+	}
+	if count := ps.tunnels.count(); count != 0 {
+		t.Errorf("Expected the tunnel to be unregistered, %d remain", count)
+	}
+}
+
+// TestClientHalfCloseDrainsResponse tests that once the client has finished
+// sending, the upstream's answer still reaches it
+func TestClientHalfCloseDrainsResponse(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err := readConnectRequest(reader); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		// Answer only after the whole request, and take a moment doing so
+		request, _ := io.ReadAll(reader)
+		time.Sleep(200 * time.Millisecond)
+		conn.Write([]byte("got " + string(request)))
+	})
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	proxyAddr := startTestProxy(t, NewProxyServer(config, ""))
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	defer conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200, got %q", head)
+	}
+	conn.Write([]byte("request"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	received, _ := io.ReadAll(conn)
+	if string(received) != "got request" {
+		t.Errorf("Expected the upstream's answer after the half-close, got %q", received)
+	}
+}
+
+// TestClientHalfCloseKeepsLongDownload tests that a client which half-closes
+// after its request still receives a response that streams for longer than
+// halfCloseGrace
+func TestClientHalfCloseKeepsLongDownload(t *testing.T) {
+	const chunks = 6
+	chunkInterval := (halfCloseGrace + time.Second) / chunks
+	upstreamAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err := readConnectRequest(reader); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		io.ReadAll(reader)
+		for i := 0; i < chunks; i++ {
+			time.Sleep(chunkInterval)
+			conn.Write([]byte("chunk\n"))
+		}
+	})
+
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: "http://" + upstreamAddr, Enabled: true, Weight: 1},
+		},
+	}
+	proxyAddr := startTestProxy(t, NewProxyServer(config, ""))
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	defer conn.Close()
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200, got %q", head)
+	}
+	conn.Write([]byte("request"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(halfCloseGrace + 3*time.Second))
+	received, _ := io.ReadAll(conn)
+	if want := strings.Repeat("chunk\n", chunks); string(received) != want {
+		t.Errorf("Expected the whole download after the half-close, got %q", received)
+	}
+}
+
+// TestEmptyTunnelCountsAsFailure tests that an upstream answering the
+// CONNECT and hanging up at once is counted as failing when
+// empty_tunnel_window_ms is set, and not otherwise
+func TestEmptyTunnelCountsAsFailure(t *testing.T) {
+	upstreamAddr := startMockUpstream(t, func(conn net.Conn) {
+		defer conn.Close()
+		if _, err := readConnectRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	})
+	upstream := "http://" + upstreamAddr
+
+	for _, window := range []int{0, 1000} {
+		config := &Config{
+			UpstreamProxies: []UpstreamProxyConfig{
+				{URL: upstream, Enabled: true, Weight: 1},
+			},
+			EmptyTunnelWindowMs: window,
+		}
+		ps := NewProxyServer(config, "")
+		proxyAddr := startTestProxy(t, ps)
+
+		conn, head := dialConnect(t, proxyAddr, "example.com:443")
+		if !strings.Contains(head, "200") {
+			t.Fatalf("Expected 200, got %q", head)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if received, _ := io.ReadAll(conn); len(received) != 0 {
+			t.Fatalf("Expected an empty tunnel, got %q", received)
+		}
+		conn.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt64(&ps.stats.CurrentRequests) != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		want := int64(0)
+		if window > 0 {
+			want = 1
+		}
+		ps.healthMutex.RLock()
+		failures := ps.upstreamHealth[upstream].FailureCount
+		ps.healthMutex.RUnlock()
+		if failures != want {
+			t.Errorf("window %dms: expected %d health failures, got %d", window, want, failures)
+		}
+		ps.mutex.RLock()
+		empty := atomic.LoadInt64(&ps.stats.UpstreamMetrics[upstream].EmptyTunnels)
+		ps.mutex.RUnlock()
+		if empty != want {
+			t.Errorf("window %dms: expected %d empty tunnels, got %d", window, want, empty)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminUpstreamsPath lists upstreams; adminUpstreamsPath + "/{index}" shows
+// everything known about one of them. Indexes match "index" in /stats.
+const adminUpstreamsPath = "/admin/upstreams"
+
+// maxRecentErrors bounds the error history kept per upstream
+const maxRecentErrors = 10
+
+// upstreamError is one entry of an upstream's recent error history
+type upstreamError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// recordUpstreamError appends to the upstream's error history. The slice is
+// replaced rather than modified so copies of the health record stay valid.
+func (ps *ProxyServer) recordUpstreamError(upstream, message string) {
+	ps.healthMutex.Lock()
+	defer ps.healthMutex.Unlock()
+
+	health, exists := ps.upstreamHealth[upstream]
+	if !exists {
+		return
+	}
+	start := max(len(health.recentErrors)+1-maxRecentErrors, 0)
+	history := make([]upstreamError, 0, maxRecentErrors)
+	history = append(history, health.recentErrors[start:]...)
+	health.recentErrors = append(history, upstreamError{Time: time.Now(), Error: message})
+}
+
+// upstreamSummary is one entry of GET /admin/upstreams
+type upstreamSummary struct {
+	Index        int      `json:"index"`
+	URL          string   `json:"url"`
+	Tag          string   `json:"tag,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Weight       int      `json:"weight"`
+	Backup       bool     `json:"backup,omitempty"`
+	Healthy      bool     `json:"healthy"`
+	CircuitState string   `json:"circuit_state"`
+}
+
+// upstreamDetail is the response of GET /admin/upstreams/{index}
+type upstreamDetail struct {
+	upstreamSummary
+	Config       UpstreamProxyConfig `json:"config"`
+	Health       *UpstreamHealth     `json:"health,omitempty"`
+	RecentErrors []upstreamError     `json:"recent_errors"`
+	Stats        struct {
+		Total  UpstreamStats `json:"total"`
+		Recent UpstreamStats `json:"recent_15m"`
+	} `json:"stats"`
+}
+
+// handleAdminUpstreams serves the upstream list and per-upstream views.
+// Authentication matches the stats endpoint and is checked by ServeHTTP.
+func (ps *ProxyServer) handleAdminUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, adminUpstreamsPath), "/")
+	var response interface{}
+	if rest == "" {
+		response = ps.upstreamSummaries()
+	} else {
+		index, err := strconv.Atoi(rest)
+		detail, ok := ps.upstreamDetail(index)
+		if err != nil || !ok {
+			http.Error(w, "Upstream not found", http.StatusNotFound)
+			return
+		}
+		response = detail
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(response)
+}
+
+func (ps *ProxyServer) upstreamSummaries() []upstreamSummary {
+	ps.mutex.RLock()
+	count := len(ps.weightedUpstreams)
+	ps.mutex.RUnlock()
+
+	summaries := make([]upstreamSummary, 0, count)
+	for i := 0; i < count; i++ {
+		// A reload may shrink the list while we iterate
+		if summary, _, ok := ps.upstreamSummary(i); ok {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries
+}
+
+// upstreamSummary describes the upstream at index, also returning its URL
+func (ps *ProxyServer) upstreamSummary(index int) (upstreamSummary, string, bool) {
+	ps.mutex.RLock()
+	if index < 0 || index >= len(ps.weightedUpstreams) {
+		ps.mutex.RUnlock()
+		return upstreamSummary{}, "", false
+	}
+	weighted := ps.weightedUpstreams[index]
+	ps.mutex.RUnlock()
+
+	return upstreamSummary{
+		Index:        index,
+		URL:          redactUpstreamURL(weighted.URL),
+		Tag:          weighted.Tag,
+		Tags:         weighted.Tags,
+		Weight:       weighted.Weight,
+		Backup:       weighted.Backup,
+		Healthy:      ps.isUpstreamHealthy(weighted.URL),
+		CircuitState: ps.getCircuitBreakerState(weighted.URL),
+	}, weighted.URL, true
+}
+
+func (ps *ProxyServer) upstreamDetail(index int) (upstreamDetail, bool) {
+	summary, upstream, ok := ps.upstreamSummary(index)
+	if !ok {
+		return upstreamDetail{}, false
+	}
+
+	detail := upstreamDetail{upstreamSummary: summary}
+	detail.Config = redactUpstreamConfig(ps.upstreamConfig(upstream))
+
+	ps.healthMutex.RLock()
+	if health, exists := ps.upstreamHealth[upstream]; exists {
+		healthCopy := *health
+		detail.Health = &healthCopy
+		detail.RecentErrors = health.recentErrors
+	}
+	ps.healthMutex.RUnlock()
+	if detail.RecentErrors == nil {
+		detail.RecentErrors = []upstreamError{}
+	}
+
+	ps.mutex.RLock()
+	uptime := time.Since(ps.stats.StartTime)
+	ps.mutex.RUnlock()
+	windows := []struct {
+		stats  *UpstreamStats
+		window time.Duration
+	}{
+		{&detail.Stats.Total, uptime},
+		{&detail.Stats.Recent, 15 * time.Minute},
+	}
+	for _, w := range windows {
+		for _, stats := range ps.getTimeWindowStats(w.window).UpstreamMetrics {
+			if stats.Index == index {
+				*w.stats = stats
+				break
+			}
+		}
+		w.stats.URL = summary.URL
+	}
+
+	return detail, true
+}
+
+// redactUpstreamURL masks the password in an upstream URL
+func redactUpstreamURL(upstream string) string {
+	at := strings.LastIndex(upstream, "@")
+	scheme := strings.Index(upstream, "://")
+	if at < 0 || scheme < 0 || at < scheme {
+		return upstream
+	}
+	userinfo := upstream[scheme+3 : at]
+	if user, _, hasPassword := strings.Cut(userinfo, ":"); hasPassword {
+		userinfo = user + ":xxxxx"
+	}
+	return upstream[:scheme+3] + userinfo + upstream[at:]
+}
+
+// redactUpstreamConfig masks credentials in the URL and the values of
+// connect_headers, which typically carry API keys
+func redactUpstreamConfig(config UpstreamProxyConfig) UpstreamProxyConfig {
+	config.URL = redactUpstreamURL(config.URL)
+	if len(config.ConnectHeaders) > 0 {
+		headers := make(map[string]string, len(config.ConnectHeaders))
+		for name := range config.ConnectHeaders {
+			headers[name] = "xxxxx"
+		}
+		config.ConnectHeaders = headers
+	}
+	return config
+}
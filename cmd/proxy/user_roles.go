@@ -0,0 +1,37 @@
+package main
+
+import "fmt"
+
+// User roles for authentication.users[].roles
+const (
+	// roleProxy may open CONNECT tunnels
+	roleProxy = "proxy"
+	// roleStats may read the stats, metrics and admin endpoints
+	roleStats = "stats"
+)
+
+// hasRole reports whether the user may act in role. Users without roles
+// have every role, as before roles existed.
+func (user UserConfig) hasRole(role string) bool {
+	if len(user.Roles) == 0 {
+		return true
+	}
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUserRoles checks authentication.users[].roles
+func validateUserRoles(users []UserConfig) error {
+	for _, user := range users {
+		for _, role := range user.Roles {
+			if role != roleProxy && role != roleStats {
+				return fmt.Errorf("authentication user %q: role must be %q or %q, got %q", user.Username, roleProxy, roleStats, role)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionWarmerConfig keeps a few connections per healthy upstream dialed
+// (and, for https:// upstreams, TLS-handshaked) ahead of time, so a CONNECT
+// can skip straight to sending its request. A CONNECT tunnel cannot be
+// reused once it carried traffic, so only the dial and handshake are saved,
+// never the upstream's CONNECT round trip. Changes need a restart.
+type ConnectionWarmerConfig struct {
+	// ConnectionsPerUpstream is how many idle connections to keep (0 = off)
+	ConnectionsPerUpstream int `json:"connections_per_upstream"`
+	// IntervalSeconds is how often the pool is topped up (default 10)
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+	// MaxIdleSeconds discards warmed connections older than this, before
+	// the upstream's own idle timeout closes them (default 30)
+	MaxIdleSeconds int `json:"max_idle_seconds,omitempty"`
+}
+
+// warmConn is an idle, pre-dialed connection to an upstream
+type warmConn struct {
+	conn     net.Conn
+	dialedAt time.Time
+}
+
+// warmPool holds pre-dialed connections per upstream. It has its own lock,
+// never held while taking another.
+type warmPool struct {
+	mutex sync.Mutex
+	idle  map[string][]warmConn
+	stop  chan struct{}
+}
+
+func (wp *warmPool) put(upstream string, conn net.Conn) {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	if wp.idle == nil {
+		wp.idle = make(map[string][]warmConn)
+	}
+	wp.idle[upstream] = append(wp.idle[upstream], warmConn{conn: conn, dialedAt: time.Now()})
+}
+
+// pop removes the most recently dialed connection to upstream
+func (wp *warmPool) pop(upstream string) net.Conn {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	conns := wp.idle[upstream]
+	if len(conns) == 0 {
+		return nil
+	}
+	last := conns[len(conns)-1]
+	wp.idle[upstream] = conns[:len(conns)-1]
+	return last.conn
+}
+
+func (wp *warmPool) count(upstream string) int {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	return len(wp.idle[upstream])
+}
+
+// expire closes connections older than maxIdle and those to upstreams that
+// are no longer wanted
+func (wp *warmPool) expire(wanted map[string]bool, maxIdle time.Duration) {
+	var stale []net.Conn
+	wp.mutex.Lock()
+	cutoff := time.Now().Add(-maxIdle)
+	for upstream, conns := range wp.idle {
+		kept := conns[:0]
+		for _, wc := range conns {
+			if wanted[upstream] && wc.dialedAt.After(cutoff) {
+				kept = append(kept, wc)
+			} else {
+				stale = append(stale, wc.conn)
+			}
+		}
+		if len(kept) == 0 {
+			delete(wp.idle, upstream)
+		} else {
+			wp.idle[upstream] = kept
+		}
+	}
+	wp.mutex.Unlock()
+
+	for _, conn := range stale {
+		conn.Close()
+	}
+}
+
+// closeAll empties the pool
+func (wp *warmPool) closeAll() {
+	wp.expire(nil, 0)
+}
+
+// connAlive reports whether an idle connection is still open. Upstreams
+// send nothing before a CONNECT, so a short read must time out; EOF or any
+// data means the connection cannot be used.
+func connAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var probe [1]byte
+	n, err := conn.Read(probe[:])
+	conn.SetReadDeadline(time.Time{})
+	return n == 0 && errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// connectUpstream returns a warmed connection to upstream if one is still
+// alive, and dials a new one otherwise
+func (ps *ProxyServer) connectUpstream(ctx context.Context, upstream, host string) (net.Conn, error) {
+	for {
+		conn := ps.warm.pop(upstream)
+		if conn == nil {
+			break
+		}
+		if connAlive(conn) {
+			atomic.AddInt64(&ps.stats.WarmConnectionHits, 1)
+			return conn, nil
+		}
+		conn.Close()
+	}
+	return ps.dialUpstream(ctx, upstream, host)
+}
+
+// refillWarmPool drops expired connections and tops up every healthy
+// upstream to perUpstream idle connections
+func (ps *ProxyServer) refillWarmPool(perUpstream int, maxIdle time.Duration) {
+	ps.mutex.RLock()
+	upstreams := make([]string, len(ps.upstreams))
+	copy(upstreams, ps.upstreams)
+	ps.mutex.RUnlock()
+
+	wanted := make(map[string]bool, len(upstreams))
+	for _, upstream := range upstreams {
+		if ps.isUpstreamHealthy(upstream) {
+			wanted[upstream] = true
+		}
+	}
+	ps.warm.expire(wanted, maxIdle)
+
+	for upstream := range wanted {
+		host, _, err := parseUpstreamAuth(upstream)
+		if err != nil {
+			continue
+		}
+		for i := ps.warm.count(upstream); i < perUpstream; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), ps.requestBudget(upstream))
+			conn, err := ps.dialUpstream(ctx, upstream, host)
+			cancel()
+			if err != nil {
+				log.Printf("Connection warmer: dial to %s failed: %v", host, err)
+				break
+			}
+			ps.warm.put(upstream, conn)
+		}
+	}
+}
+
+func (ps *ProxyServer) startConnectionWarmer(perUpstream int, interval, maxIdle time.Duration) {
+	ps.stopConnectionWarmer()
+
+	stop := make(chan struct{})
+	ps.warm.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ps.refillWarmPool(perUpstream, maxIdle)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				ps.warm.closeAll()
+				return
+			}
+		}
+	}()
+	log.Printf("Connection warmer started (%d per upstream, interval: %v, max idle: %v)", perUpstream, interval, maxIdle)
+}
+
+func (ps *ProxyServer) stopConnectionWarmer() {
+	if ps.warm.stop != nil {
+		close(ps.warm.stop)
+		ps.warm.stop = nil
+	}
+}
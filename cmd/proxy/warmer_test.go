@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConnectionWarmer tests that the warmer keeps connections dialed ahead
+// of time, that a CONNECT uses one instead of dialing, and that each round
+// tops the pool back up
+func TestConnectionWarmer(t *testing.T) {
+	var accepted int64
+	upstreamAddr := startMockUpstream(t, func(conn net.Conn) {
+		atomic.AddInt64(&accepted, 1)
+		echoUpstream(conn)
+	})
+	upstream := "http://" + upstreamAddr
+	config := &Config{
+		UpstreamProxies: []UpstreamProxyConfig{
+			{URL: upstream, Enabled: true, Weight: 1},
+		},
+	}
+	ps := NewProxyServer(config, "")
+	defer ps.warm.closeAll()
+	proxyAddr := startTestProxy(t, ps)
+
+	waitForAccepted := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt64(&accepted) < want && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if got := atomic.LoadInt64(&accepted); got != want {
+			t.Fatalf("Expected %d upstream connections, got %d", want, got)
+		}
+	}
+
+	ps.refillWarmPool(2, time.Minute)
+	waitForAccepted(2)
+	if idle := ps.warm.count(upstream); idle != 2 {
+		t.Fatalf("Expected 2 warmed connections, got %d", idle)
+	}
+
+	conn, head := dialConnect(t, proxyAddr, "example.com:443")
+	if !strings.Contains(head, "200") {
+		t.Fatalf("Expected 200, got %q", head)
+	}
+	conn.Write([]byte("ping"))
+	buffer := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != "ping" {
+		t.Fatalf("Expected the tunnel to echo, got %q (%v)", buffer, err)
+	}
+	conn.Close()
+
+	// The CONNECT went over a warmed connection, not a new dial
+	if hits := atomic.LoadInt64(&ps.stats.WarmConnectionHits); hits != 1 {
+		t.Errorf("Expected 1 warm connection hit, got %d", hits)
+	}
+	if got := atomic.LoadInt64(&accepted); got != 2 {
+		t.Errorf("Expected no extra dial for the CONNECT, got %d upstream connections", got)
+	}
+
+	// The next round replaces the connection that was used
+	ps.refillWarmPool(2, time.Minute)
+	waitForAccepted(3)
+	if idle := ps.warm.count(upstream); idle != 2 {
+		t.Errorf("Expected the pool topped up to 2, got %d", idle)
+	}
+
+	// Expired connections are replaced too
+	ps.refillWarmPool(2, 0)
+	waitForAccepted(5)
+
+	// The background warmer refills as soon as it starts
+	ps.startConnectionWarmer(3, time.Hour, time.Minute)
+	defer ps.stopConnectionWarmer()
+	waitForAccepted(6)
+}
@@ -21,6 +21,9 @@ const (
 	ConnectionTimeout
 	BadGateway
 	InternalError
+
+	// faultTypeCount sizes per-fault counters
+	faultTypeCount
 )
 
 type FaultyProxy struct {
@@ -29,7 +32,13 @@ type FaultyProxy struct {
 	Latency        time.Duration
 	LatencyJitter  time.Duration
 	FaultType      FaultType
+	// Scenario, when set, scripts the behavior of connections by index
+	Scenario       *Scenario
 	connections    int64
+	accepted       int64
+	// faulted counts connections that had a fault injected, by FaultType
+	faulted        [faultTypeCount]int64
+	bytesTunneled  int64
 	server         *http.Server
 	listener       net.Listener
 	shutdownSignal chan struct{}
@@ -50,6 +59,31 @@ func (fp *FaultyProxy) ActiveConnections() int64 {
 	return atomic.LoadInt64(&fp.connections)
 }
 
+// TotalConnections returns the number of connections accepted so far
+func (fp *FaultyProxy) TotalConnections() int64 {
+	return atomic.LoadInt64(&fp.accepted)
+}
+
+// FailedConnections returns the number of connections that had the given
+// fault injected, including resets in the middle of a tunnel
+func (fp *FaultyProxy) FailedConnections(fault FaultType) int64 {
+	if fault <= NoFault || fault >= faultTypeCount {
+		return 0
+	}
+	return atomic.LoadInt64(&fp.faulted[fault])
+}
+
+// BytesTunneled returns the number of bytes relayed in both directions
+func (fp *FaultyProxy) BytesTunneled() int64 {
+	return atomic.LoadInt64(&fp.bytesTunneled)
+}
+
+func (fp *FaultyProxy) recordFault(fault FaultType) {
+	if fault > NoFault && fault < faultTypeCount {
+		atomic.AddInt64(&fp.faulted[fault], 1)
+	}
+}
+
 func (fp *FaultyProxy) simulateLatency() {
 	if fp.Latency > 0 {
 		jitter := time.Duration(0)
@@ -69,21 +103,36 @@ func (fp *FaultyProxy) handleConnection(conn net.Conn) {
 	defer atomic.AddInt64(&fp.connections, -1)
 	defer conn.Close()
 
-	log.Printf("[FaultyProxy-%d] New connection from %s", fp.Port, conn.RemoteAddr())
-
-	// Simulate latency before any processing
-	fp.simulateLatency()
+	index := atomic.AddInt64(&fp.accepted, 1)
+	log.Printf("[FaultyProxy-%d] New connection #%d from %s", fp.Port, index, conn.RemoteAddr())
+
+	// A scripted step replaces the random fault and latency settings
+	step, scripted := fp.Scenario.step(index)
+	faultType, failing := fp.FaultType, false
+	if scripted {
+		log.Printf("[FaultyProxy-%d] Connection #%d follows scenario step (fault %v, delay %v)", fp.Port, index, step.Fault, step.Delay)
+		faultType, failing = step.Fault, true
+	} else {
+		// Simulate latency before any processing
+		fp.simulateLatency()
+		failing = fp.shouldFail()
+	}
 
 	// Check if we should fail this request
-	if fp.shouldFail() {
-		log.Printf("[FaultyProxy-%d] Simulating failure type %v", fp.Port, fp.FaultType)
-		switch fp.FaultType {
+	if failing {
+		log.Printf("[FaultyProxy-%d] Simulating failure type %v", fp.Port, faultType)
+		fp.recordFault(faultType)
+		switch faultType {
 		case ConnectionReset:
 			log.Printf("[FaultyProxy-%d] Simulating connection reset", fp.Port)
 			return
 		case ConnectionTimeout:
-			log.Printf("[FaultyProxy-%d] Simulating timeout (hanging for 31s)", fp.Port)
-			time.Sleep(31 * time.Second) // Most clients timeout at 30s
+			hang := 31 * time.Second // Most clients timeout at 30s
+			if scripted && step.Delay > 0 {
+				hang = step.Delay
+			}
+			log.Printf("[FaultyProxy-%d] Simulating timeout (hanging for %v)", fp.Port, hang)
+			time.Sleep(hang)
 			return
 		case BadGateway:
 			log.Printf("[FaultyProxy-%d] Simulating bad gateway", fp.Port)
@@ -107,7 +156,9 @@ func (fp *FaultyProxy) handleConnection(conn net.Conn) {
 	log.Printf("[FaultyProxy-%d] Received request: %s", fp.Port, string(buffer[:n]))
 
 	// For SlowResponse type, add extra delay before responding
-	if fp.FaultType == SlowResponse {
+	if scripted {
+		time.Sleep(step.Delay)
+	} else if fp.FaultType == SlowResponse {
 		log.Printf("[FaultyProxy-%d] Simulating slow response", fp.Port)
 		jitter := time.Duration(0)
 		if fp.LatencyJitter > 0 {
@@ -146,10 +197,10 @@ func (fp *FaultyProxy) handleConnection(conn net.Conn) {
 	go func() {
 		defer targetConn.Close()
 		defer conn.Close()
-		fp.copyWithFaults(targetConn, conn, "target->client")
+		fp.copyWithFaults(targetConn, conn, "target->client", scripted)
 	}()
 
-	fp.copyWithFaults(conn, targetConn, "client->target")
+	fp.copyWithFaults(conn, targetConn, "client->target", scripted)
 }
 
 func (fp *FaultyProxy) extractTargetFromConnect(request string) string {
@@ -164,7 +215,9 @@ func (fp *FaultyProxy) extractTargetFromConnect(request string) string {
 	return ""
 }
 
-func (fp *FaultyProxy) copyWithFaults(dst, src net.Conn, direction string) {
+// copyWithFaults relays data, injecting random resets and latency unless the
+// connection is scripted by a scenario
+func (fp *FaultyProxy) copyWithFaults(dst, src net.Conn, direction string, scripted bool) {
 	buffer := make([]byte, 32*1024) // 32KB buffer
 	for {
 		select {
@@ -183,19 +236,22 @@ func (fp *FaultyProxy) copyWithFaults(dst, src net.Conn, direction string) {
 			}
 
 			// Simulate random connection drops during data transfer
-			if fp.shouldFail() && fp.FaultType == ConnectionReset {
+			if !scripted && fp.shouldFail() && fp.FaultType == ConnectionReset {
 				log.Printf("[FaultyProxy-%d] Simulating connection reset during %s", fp.Port, direction)
+				fp.recordFault(ConnectionReset)
 				return
 			}
 
 			// Simulate latency for each chunk
-			if fp.FaultType == SlowResponse || fp.Latency > 0 {
+			if !scripted && (fp.FaultType == SlowResponse || fp.Latency > 0) {
 				fp.simulateLatency()
 			}
 
 			// Write data
 			dst.SetWriteDeadline(time.Now().Add(30 * time.Second))
-			if _, err := dst.Write(buffer[:n]); err != nil {
+			written, err := dst.Write(buffer[:n])
+			atomic.AddInt64(&fp.bytesTunneled, int64(written))
+			if err != nil {
 				log.Printf("[FaultyProxy-%d] Failed to write to %s: %v", fp.Port, direction, err)
 				return
 			}
@@ -1,6 +1,9 @@
 package faultyproxy
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 	"testing"
@@ -263,4 +266,78 @@ func TestFaultyProxy_PartialFailure(t *testing.T) {
 	if failureCount == 0 {
 		t.Error("Expected some failed connections, but got none")
 	}
-}
\ No newline at end of file
+}
+func TestFaultyProxy_ConnectionMetrics(t *testing.T) {
+	// Local echo target for the clean tunnel
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start target: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	proxy := NewFaultyProxy(9111)
+	proxy.Scenario = &Scenario{Steps: []ScenarioStep{
+		{Fault: ConnectionReset},
+		{Fault: ConnectionReset},
+		{Fault: BadGateway},
+		{Fault: NoFault},
+	}}
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	addr := "127.0.0.1:9111"
+	connectOnce(t, addr)
+	connectOnce(t, addr)
+	connectOnce(t, addr)
+
+	// The clean connection tunnels a few bytes through to the echo target
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target.Addr(), target.Addr())
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil || !strings.Contains(status, "200") {
+		t.Fatalf("Expected 200 for clean connection, got %q (%v)", status, err)
+	}
+	reader.ReadString('\n') // blank line ending the response
+	conn.Write([]byte("hello"))
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(reader, echo); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+
+	if total := proxy.TotalConnections(); total != 4 {
+		t.Errorf("Expected 4 connections, got %d", total)
+	}
+	if resets := proxy.FailedConnections(ConnectionReset); resets != 2 {
+		t.Errorf("Expected 2 reset connections, got %d", resets)
+	}
+	if badGateways := proxy.FailedConnections(BadGateway); badGateways != 1 {
+		t.Errorf("Expected 1 bad gateway, got %d", badGateways)
+	}
+	if timeouts := proxy.FailedConnections(ConnectionTimeout); timeouts != 0 {
+		t.Errorf("Expected no timeouts, got %d", timeouts)
+	}
+	if bytes := proxy.BytesTunneled(); bytes != 10 {
+		t.Errorf("Expected 10 bytes tunneled (5 each way), got %d", bytes)
+	}
+}
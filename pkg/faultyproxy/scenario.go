@@ -0,0 +1,108 @@
+package faultyproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ParseFaultType converts a fault name as used by the CLI and scenario files
+// (none, slow, reset, timeout, bad-gateway, internal-error) to a FaultType
+func ParseFaultType(name string) (FaultType, error) {
+	switch name {
+	case "none", "ok":
+		return NoFault, nil
+	case "slow":
+		return SlowResponse, nil
+	case "reset":
+		return ConnectionReset, nil
+	case "timeout":
+		return ConnectionTimeout, nil
+	case "bad-gateway":
+		return BadGateway, nil
+	case "internal-error":
+		return InternalError, nil
+	default:
+		return NoFault, fmt.Errorf("unknown fault type: %s", name)
+	}
+}
+
+// ScenarioStep scripts the behavior of a single connection
+type ScenarioStep struct {
+	Fault FaultType
+	// Delay is the wait before responding for none and slow steps, and how
+	// long timeout steps hang (default 31s)
+	Delay time.Duration
+}
+
+// Scenario scripts a fixed sequence of behaviors by connection index, so
+// tests can replay exact fault sequences instead of relying on FailureRate.
+// Connections beyond the script fall back to the proxy's random faults
+// unless Repeat is set, in which case the script starts over.
+type Scenario struct {
+	Steps  []ScenarioStep
+	Repeat bool
+}
+
+// step returns the scripted step for the 1-based connection index
+func (s *Scenario) step(index int64) (ScenarioStep, bool) {
+	if s == nil || len(s.Steps) == 0 || index < 1 {
+		return ScenarioStep{}, false
+	}
+	position := index - 1
+	if position >= int64(len(s.Steps)) {
+		if !s.Repeat {
+			return ScenarioStep{}, false
+		}
+		position %= int64(len(s.Steps))
+	}
+	return s.Steps[position], true
+}
+
+// scenarioFile is the JSON layout of a scenario file:
+//
+//	{
+//	  "repeat": false,
+//	  "connections": [
+//	    {"fault": "reset"},
+//	    {"fault": "slow", "delay": "500ms"},
+//	    {"fault": "none"}
+//	  ]
+//	}
+type scenarioFile struct {
+	Repeat      bool `json:"repeat"`
+	Connections []struct {
+		Fault string `json:"fault"`
+		Delay string `json:"delay,omitempty"`
+	} `json:"connections"`
+}
+
+// LoadScenario reads a scenario file
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %v", err)
+	}
+
+	var file scenarioFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario: %v", err)
+	}
+
+	scenario := &Scenario{Repeat: file.Repeat}
+	for i, conn := range file.Connections {
+		fault, err := ParseFaultType(conn.Fault)
+		if err != nil {
+			return nil, fmt.Errorf("connection %d: %v", i+1, err)
+		}
+		step := ScenarioStep{Fault: fault}
+		if conn.Delay != "" {
+			if step.Delay, err = time.ParseDuration(conn.Delay); err != nil {
+				return nil, fmt.Errorf("connection %d: invalid delay %q: %v", i+1, conn.Delay, err)
+			}
+		}
+		scenario.Steps = append(scenario.Steps, step)
+	}
+	return scenario, nil
+}
@@ -0,0 +1,114 @@
+package faultyproxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectOnce sends a CONNECT and returns the response (empty if the
+// connection was dropped) and how long it took
+func connectOnce(t *testing.T, addr string) (string, time.Duration) {
+	t.Helper()
+	start := time.Now()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	connectReq := "CONNECT httpbin.org:443 HTTP/1.1\r\nHost: httpbin.org:443\r\n\r\n"
+	if _, err := conn.Write([]byte(connectReq)); err != nil {
+		t.Fatalf("Failed to send CONNECT request: %v", err)
+	}
+
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _ := conn.Read(buffer)
+	return string(buffer[:n]), time.Since(start)
+}
+
+func TestFaultyProxy_Scenario(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	content := `{
+		"connections": [
+			{"fault": "reset"},
+			{"fault": "slow", "delay": "300ms"},
+			{"fault": "bad-gateway"},
+			{"fault": "none"}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write scenario: %v", err)
+	}
+
+	scenario, err := LoadScenario(path)
+	if err != nil {
+		t.Fatalf("Failed to load scenario: %v", err)
+	}
+	if len(scenario.Steps) != 4 || scenario.Steps[1].Delay != 300*time.Millisecond {
+		t.Fatalf("Unexpected scenario: %+v", scenario)
+	}
+
+	proxy := NewFaultyProxy(9110)
+	proxy.Scenario = scenario
+	// Connections past the script fall back to the random settings
+	proxy.FailureRate = 1.0
+	proxy.FaultType = InternalError
+
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	addr := "127.0.0.1:9110"
+
+	if response, _ := connectOnce(t, addr); response != "" {
+		t.Errorf("Connection 1: expected reset, got %q", response)
+	}
+
+	response, elapsed := connectOnce(t, addr)
+	if !strings.Contains(response, "200 Connection Established") || elapsed < 300*time.Millisecond {
+		t.Errorf("Connection 2: expected 200 after 300ms, got %q after %v", response, elapsed)
+	}
+
+	if response, _ := connectOnce(t, addr); !strings.Contains(response, "502 Bad Gateway") {
+		t.Errorf("Connection 3: expected 502, got %q", response)
+	}
+
+	response, elapsed = connectOnce(t, addr)
+	if !strings.Contains(response, "200 Connection Established") || elapsed >= 300*time.Millisecond {
+		t.Errorf("Connection 4: expected immediate 200, got %q after %v", response, elapsed)
+	}
+
+	if response, _ := connectOnce(t, addr); !strings.Contains(response, "500 Internal Server Error") {
+		t.Errorf("Connection 5: expected fallback to configured fault, got %q", response)
+	}
+}
+
+func TestLoadScenario_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"unknown-fault.json": `{"connections": [{"fault": "explode"}]}`,
+		"bad-delay.json":     `{"connections": [{"fault": "slow", "delay": "soon"}]}`,
+		"bad-json.json":      `{"connections": [`,
+	}
+	for name, content := range cases {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write scenario: %v", err)
+		}
+		if _, err := LoadScenario(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	repeat := &Scenario{Steps: []ScenarioStep{{Fault: ConnectionReset}, {Fault: NoFault}}, Repeat: true}
+	if step, ok := repeat.step(3); !ok || step.Fault != ConnectionReset {
+		t.Errorf("Expected repeating scenario to start over, got %+v (%v)", step, ok)
+	}
+}